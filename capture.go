@@ -0,0 +1,62 @@
+package migrate
+
+import (
+	"fmt"
+	"sync"
+)
+
+// LogEntry is a log record kept by CaptureLogger.
+type LogEntry struct {
+	Msg    string
+	Fields map[string]interface{}
+}
+
+// CaptureLogger is a Logger which keeps the log records with their fields,
+// e.g. to assert in tests on the file field of the migrated records instead
+// of parsing formatted lines. Keys which are not strings are formatted, and
+// a value without a key is kept under the !BADKEY key, as slog does. It is
+// safe for concurrent use.
+type CaptureLogger struct {
+	mu      sync.Mutex
+	entries []LogEntry
+}
+
+func (l *CaptureLogger) Info(msg string, v ...interface{}) {
+	fields := make(map[string]interface{}, len(v)/2)
+	for i := 0; i < len(v); i += 2 {
+		if i+1 == len(v) {
+			fields["!BADKEY"] = v[i]
+			break
+		}
+		fields[fmt.Sprint(v[i])] = v[i+1]
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, LogEntry{Msg: msg, Fields: fields})
+}
+
+// Entries returns the captured records in the order they were logged.
+func (l *CaptureLogger) Entries() []LogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]LogEntry(nil), l.entries...)
+}
+
+// Find returns the captured records with the message.
+func (l *CaptureLogger) Find(msg string) []LogEntry {
+	var res []LogEntry
+	for _, entry := range l.Entries() {
+		if entry.Msg == msg {
+			res = append(res, entry)
+		}
+	}
+	return res
+}
+
+// Reset drops the captured records.
+func (l *CaptureLogger) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = nil
+}
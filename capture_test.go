@@ -0,0 +1,41 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// Test capturing log records with their fields
+func TestCaptureLogger(t *testing.T) {
+	logger := &CaptureLogger{}
+	dialect := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+	if err := New(&MockSource{migrations: createTestMigrations()}, dialect, logger).Up(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var files []interface{}
+	for _, entry := range logger.Find("migrated") {
+		files = append(files, entry.Fields["file"])
+	}
+	if fmt.Sprint(files) != "[002_add_email 003_add_index 004_add_timestamp]" {
+		t.Errorf("expected the migrated files, got %v", files)
+	}
+	if summary := logger.Find("migration run complete"); len(summary) != 1 || summary[0].Fields["applied"] != 3 || summary[0].Fields["head"] != "004_add_timestamp" {
+		t.Errorf("expected the run summary, got %+v", summary)
+	}
+
+	logger.Reset()
+	logger.Info("odd", "file", "001", "dangling")
+	logger.Info("non-string key", 42, "value")
+	entries := logger.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries after reset, got %+v", entries)
+	}
+	if entries[0].Fields["file"] != "001" || entries[0].Fields["!BADKEY"] != "dangling" {
+		t.Errorf("expected the value without a key under !BADKEY, got %+v", entries[0])
+	}
+	if entries[1].Fields["42"] != "value" {
+		t.Errorf("expected a formatted key, got %+v", entries[1])
+	}
+}
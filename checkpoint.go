@@ -0,0 +1,70 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// Checkpoint persists the progress of a long migration, like a backfill
+// which runs in batches outside of a single transaction. The migration saves
+// a cursor after each batch and reads it on restart to resume where it
+// stopped. The cursor is stored in the checkpoints table of the dialect.
+type Checkpoint struct {
+	store   Checkpointer
+	version string
+}
+
+// Checkpoint returns the checkpoint of the migration version, creating the
+// checkpoints table if needed. The dialect must implement Checkpointer.
+func (m *Migrator) Checkpoint(ctx context.Context, version string) (*Checkpoint, error) {
+	store, ok := m.dialect.(Checkpointer)
+	if !ok {
+		return nil, fmt.Errorf("dialect does not support checkpoints")
+	}
+	if err := store.CreateCheckpointsTable(ctx); err != nil {
+		return nil, fmt.Errorf("failed to create checkpoints table: %w", err)
+	}
+	return &Checkpoint{store: store, version: version}, nil
+}
+
+// Cursor returns the saved cursor, or an empty string when the migration
+// has no progress yet.
+func (c *Checkpoint) Cursor(ctx context.Context) (string, error) {
+	cursor, err := c.store.GetCheckpoint(ctx, c.version)
+	if err != nil {
+		return "", fmt.Errorf("failed to read checkpoint of %s: %w", c.version, err)
+	}
+	return cursor, nil
+}
+
+// Save replaces the saved cursor. It is committed immediately, independent
+// of the transaction of the migration.
+func (c *Checkpoint) Save(ctx context.Context, cursor string) error {
+	if err := c.store.SaveCheckpoint(ctx, c.version, cursor); err != nil {
+		return fmt.Errorf("failed to save checkpoint of %s: %w", c.version, err)
+	}
+	return nil
+}
+
+// Clear deletes the saved cursor, once the migration is complete.
+func (c *Checkpoint) Clear(ctx context.Context) error {
+	if err := c.store.DeleteCheckpoint(ctx, c.version); err != nil {
+		return fmt.Errorf("failed to clear checkpoint of %s: %w", c.version, err)
+	}
+	return nil
+}
+
+// resumeStatements returns the number of statements of the migration which
+// completed in a previous run, as saved by the WithCheckpoints option
+func (c *Checkpoint) resumeStatements(ctx context.Context, total int) (int, error) {
+	cursor, err := c.Cursor(ctx)
+	if err != nil || cursor == "" {
+		return 0, err
+	}
+	done, err := strconv.Atoi(cursor)
+	if err != nil || done < 0 || done > total {
+		return 0, fmt.Errorf("invalid checkpoint of %s: %q", c.version, cursor)
+	}
+	return done, nil
+}
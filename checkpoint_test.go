@@ -0,0 +1,125 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// checkpointDialect keeps the checkpoints in memory and fails a statement
+// executed outside of a transaction
+type checkpointDialect struct {
+	*MockDialect
+	checkpoints map[string]string
+	saved       []string
+	failOn      string
+}
+
+func (d *checkpointDialect) ExecContext(ctx context.Context, query string, args ...interface{}) error {
+	if query == d.failOn {
+		return errors.New("connection lost")
+	}
+	return d.MockDialect.ExecContext(ctx, query, args...)
+}
+
+func (d *checkpointDialect) CreateCheckpointsTable(ctx context.Context) error {
+	if d.checkpoints == nil {
+		d.checkpoints = map[string]string{}
+	}
+	return nil
+}
+
+func (d *checkpointDialect) GetCheckpoint(ctx context.Context, version string) (string, error) {
+	return d.checkpoints[version], nil
+}
+
+func (d *checkpointDialect) SaveCheckpoint(ctx context.Context, version string, cursor string) error {
+	d.checkpoints[version] = cursor
+	d.saved = append(d.saved, cursor)
+	return nil
+}
+
+func (d *checkpointDialect) DeleteCheckpoint(ctx context.Context, version string) error {
+	delete(d.checkpoints, version)
+	return nil
+}
+
+// Test resuming a migration without a transaction from its checkpoint
+func TestMigratorCheckpoints(t *testing.T) {
+	source := &MockSource{migrations: []Migration{{
+		Version:       "001_backfill",
+		Content:       []byte("UPDATE users SET a = 1 WHERE id < 100;\nUPDATE users SET a = 1 WHERE id < 200;\nUPDATE users SET a = 1 WHERE id < 300;"),
+		NoTransaction: true,
+	}}}
+
+	dialect := &checkpointDialect{
+		MockDialect: &MockDialect{appliedMigrations: []string{}},
+		failOn:      "UPDATE users SET a = 1 WHERE id < 200;",
+	}
+	if err := New(source, dialect, &MockLogger{}).Up(context.Background(), WithCheckpoints()); err == nil {
+		t.Fatal("expected error but got none")
+	}
+	if dialect.checkpoints["001_backfill"] != "1" {
+		t.Fatalf("expected the first statement to be checkpointed, got %v", dialect.checkpoints)
+	}
+
+	dialect.failOn = ""
+	dialect.execContextQueries = nil
+	logger := &MockLogger{}
+	if err := New(source, dialect, logger).Up(context.Background(), WithCheckpoints()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"UPDATE users SET a = 1 WHERE id < 200;", "UPDATE users SET a = 1 WHERE id < 300;"}
+	if fmt.Sprintf("%q", dialect.execContextQueries) != fmt.Sprintf("%q", expected) {
+		t.Errorf("expected to resume after the checkpoint, got %q", dialect.execContextQueries)
+	}
+	if fmt.Sprint(dialect.saved) != "[1 2 3]" {
+		t.Errorf("unexpected saved checkpoints %v", dialect.saved)
+	}
+	if len(dialect.checkpoints) != 0 {
+		t.Errorf("expected checkpoint to be cleared, got %v", dialect.checkpoints)
+	}
+	if logs := logger.GetLogs(); logs[0] != "resuming from checkpoint file=001_backfill statement=2" {
+		t.Errorf("unexpected logs %v", logs)
+	}
+}
+
+// Test the checkpoint helper for migrations run by application code
+func TestMigratorCheckpoint(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := New(&MockSource{}, &MockDialect{}, &MockLogger{}).Checkpoint(ctx, "001_backfill"); err == nil {
+		t.Error("expected error for a dialect without checkpoints")
+	}
+
+	dialect := &checkpointDialect{MockDialect: &MockDialect{}}
+	checkpoint, err := New(&MockSource{}, dialect, &MockLogger{}).Checkpoint(ctx, "001_backfill")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cursor, _ := checkpoint.Cursor(ctx); cursor != "" {
+		t.Errorf("expected no cursor, got %q", cursor)
+	}
+	if err := checkpoint.Save(ctx, "id=1000"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cursor, _ := checkpoint.Cursor(ctx); cursor != "id=1000" {
+		t.Errorf("expected saved cursor, got %q", cursor)
+	}
+
+	// a cursor saved by application code is not a statement number
+	_, err = checkpoint.resumeStatements(ctx, 3)
+	if err == nil || !strings.Contains(err.Error(), "invalid checkpoint") {
+		t.Errorf("expected invalid checkpoint error, got %v", err)
+	}
+
+	if err := checkpoint.Clear(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(dialect.checkpoints) != 0 {
+		t.Errorf("expected checkpoint to be cleared, got %v", dialect.checkpoints)
+	}
+}
@@ -0,0 +1,46 @@
+package migrate
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ConfirmRollback asks on w whether n migrations may be rolled back and
+// reads the answer from r, for command-line tools which pass
+// WithConfirmRollback only after the confirmation. With yes, e.g. from a
+// --yes flag, it doesn't ask. Without a terminal, e.g. in CI, it refuses
+// instead of waiting for an answer. Anything but y or yes is a refusal. A
+// refusal is returned as ErrRollbackNotConfirmed.
+func ConfirmRollback(r io.Reader, w io.Writer, n int, yes, isTTY bool) error {
+	if yes || n <= 0 {
+		return nil
+	}
+	if !isTTY {
+		return fmt.Errorf("%w: %d migrations would be rolled back and the input is not a terminal, confirm with yes", ErrRollbackNotConfirmed, n)
+	}
+
+	if _, err := fmt.Fprintf(w, "This will roll back %d migrations. Continue? [y/N] ", n); err != nil {
+		return err
+	}
+	answer, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read the answer: %w", err)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("%w: %d migrations would be rolled back", ErrRollbackNotConfirmed, n)
+}
+
+// IsTerminal reports whether the file is a terminal, e.g. to pass os.Stdin
+// to ConfirmRollback.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,73 @@
+package migrate
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// Test the confirmation prompt of rollbacks
+func TestConfirmRollback(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		yes       bool
+		tty       bool
+		confirmed bool
+		prompt    bool
+	}{
+		{name: "yes answer", input: "y\n", tty: true, confirmed: true, prompt: true},
+		{name: "long yes answer", input: " Yes \n", tty: true, confirmed: true, prompt: true},
+		{name: "no answer", input: "n\n", tty: true, prompt: true},
+		{name: "default answer", input: "\n", tty: true, prompt: true},
+		{name: "closed input", input: "", tty: true, prompt: true},
+		{name: "yes flag", yes: true, confirmed: true},
+		{name: "not a terminal", input: "y\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			err := ConfirmRollback(strings.NewReader(tt.input), &out, 3, tt.yes, tt.tty)
+			if tt.confirmed && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.confirmed && !errors.Is(err, ErrRollbackNotConfirmed) {
+				t.Errorf("expected ErrRollbackNotConfirmed, got %v", err)
+			}
+
+			prompt := "This will roll back 3 migrations. Continue? [y/N] "
+			if tt.prompt && out.String() != prompt {
+				t.Errorf("expected prompt %q, got %q", prompt, out.String())
+			}
+			if !tt.prompt && out.Len() != 0 {
+				t.Errorf("expected no prompt, got %q", out.String())
+			}
+		})
+	}
+
+	var out strings.Builder
+	if err := ConfirmRollback(strings.NewReader(""), &out, 0, false, false); err != nil || out.Len() != 0 {
+		t.Errorf("expected nothing to confirm, got %v %q", err, out.String())
+	}
+	err := ConfirmRollback(iotest.ErrReader(errors.New("read failed")), &out, 1, false, true)
+	if err == nil || errors.Is(err, ErrRollbackNotConfirmed) {
+		t.Errorf("expected read error, got %v", err)
+	}
+}
+
+// Test detection of terminals
+func TestIsTerminal(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "input"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+
+	if IsTerminal(f) {
+		t.Error("expected a regular file not to be a terminal")
+	}
+}
@@ -0,0 +1,95 @@
+package migrate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VersionTimeFormat is the layout of the timestamp prefix of created migrations.
+const VersionTimeFormat = "20060102150405"
+
+var migrationNameRe = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// CreateOptions configures CreateMigration.
+type CreateOptions struct {
+	// Now returns the current time, time.Now is used by default
+	Now func() time.Time
+	// NoDown skips creation of the down migration file
+	NoDown bool
+}
+
+// CreateMigration creates empty up and down migration files in the directory
+// and returns the version of the new migration. The version is the UTC
+// timestamp followed by the name, e.g. 20240102150405_create_users.
+// If the directory already has a migration with the same timestamp, a
+// counter is appended to the timestamp, e.g. 20240102150405~001_add_email,
+// so versions created in a loop stay unique and sorted while the timestamp
+// keeps the wall clock time.
+func CreateMigration(dir, name string, opts CreateOptions) (string, error) {
+	if !migrationNameRe.MatchString(name) {
+		return "", fmt.Errorf("invalid migration name %q, use lowercase letters, digits and underscores", name)
+	}
+
+	now := time.Now
+	if opts.Now != nil {
+		now = opts.Now
+	}
+	stamp := now().UTC().Format(VersionTimeFormat)
+
+	counter, err := nextVersionCounter(dir, stamp)
+	if err != nil {
+		return "", err
+	}
+	if counter > 0 {
+		stamp += fmt.Sprintf("~%03d", counter)
+	}
+
+	version := stamp + "_" + name
+	files := []string{version + ".up.sql"}
+	if !opts.NoDown {
+		files = append(files, version+".down.sql")
+	}
+
+	for _, file := range files {
+		f, err := os.OpenFile(filepath.Join(dir, file), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err != nil {
+			return "", fmt.Errorf("failed to create migration file: %w", err)
+		}
+		f.Close()
+	}
+
+	return version, nil
+}
+
+// nextVersionCounter returns the counter of a new migration with the
+// timestamp, 0 when the directory has no migration with it. The counter
+// follows a ~, which sorts after the _ of a version without a counter.
+func nextVersionCounter(dir, stamp string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read migrations directory: %w", err)
+	}
+
+	next := 0
+	for _, entry := range entries {
+		prefix, _, _ := strings.Cut(entry.Name(), "_")
+		prefix, suffix, found := strings.Cut(prefix, "~")
+		if prefix != stamp {
+			continue
+		}
+		counter := 0
+		if found {
+			if counter, err = strconv.Atoi(suffix); err != nil {
+				continue
+			}
+		}
+		next = max(next, counter+1)
+	}
+
+	return next, nil
+}
@@ -0,0 +1,81 @@
+package migrate
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Test scaffolding of migration files
+func TestCreateMigration(t *testing.T) {
+	dir := t.TempDir()
+	now := func() time.Time {
+		return time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	}
+
+	var versions []string
+	for _, name := range []string{"create_users", "add_email", "add_index"} {
+		version, err := CreateMigration(dir, name, CreateOptions{Now: now})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		versions = append(versions, version)
+	}
+
+	expected := []string{"20240102150405_create_users", "20240102150405~001_add_email", "20240102150405~002_add_index"}
+	for i, version := range expected {
+		if versions[i] != version {
+			t.Errorf("version %d: expected %q, got %q", i, version, versions[i])
+		}
+	}
+	if !sort.StringsAreSorted(versions) {
+		t.Errorf("expected versions to be sorted, got %v", versions)
+	}
+
+	migrations, err := NewFsSource(os.DirFS(dir), ".").GetMigrations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, version := range expected {
+		if migrations[i].Version != version {
+			t.Errorf("migration %d: expected %q, got %q", i, version, migrations[i].Version)
+		}
+	}
+
+	for _, file := range []string{"20240102150405_create_users.up.sql", "20240102150405_create_users.down.sql"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Errorf("expected %s to exist: %v", file, err)
+		}
+	}
+
+	t.Run("next second", func(t *testing.T) {
+		later := func() time.Time {
+			return time.Date(2024, 1, 2, 15, 4, 6, 0, time.UTC)
+		}
+		version, err := CreateMigration(dir, "add_name", CreateOptions{Now: later})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if version != "20240102150406_add_name" {
+			t.Errorf("expected the timestamp without a counter, got %q", version)
+		}
+	})
+
+	t.Run("no down file", func(t *testing.T) {
+		version, err := CreateMigration(dir, "seed", CreateOptions{Now: now, NoDown: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, version+".down.sql")); !os.IsNotExist(err) {
+			t.Error("down file should not be created")
+		}
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		if _, err := CreateMigration(dir, "../escape", CreateOptions{Now: now}); err == nil {
+			t.Error("expected error for invalid name")
+		}
+	})
+}
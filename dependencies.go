@@ -0,0 +1,122 @@
+package migrate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// orderByDependencies orders migrations so that each migration follows the
+// migrations it requires. Otherwise the source order is kept, so migrations
+// without dependencies stay in version order.
+func orderByDependencies(migrations []Migration) ([]Migration, error) {
+	index := make(map[string]int, len(migrations))
+	for i, m := range migrations {
+		index[m.Version] = i
+	}
+
+	dependents := make([][]int, len(migrations))
+	pending := make([]int, len(migrations))
+	hasDependencies := false
+	for i, m := range migrations {
+		directives, err := parseMigrationDirectives(m.Content)
+		if err != nil {
+			return nil, fmt.Errorf("invalid directives in migration %s: %w", m.Version, err)
+		}
+		for _, required := range directives.Requires {
+			j, ok := index[required]
+			if !ok {
+				return nil, fmt.Errorf("migration %s requires unknown migration %s", m.Version, required)
+			}
+			dependents[j] = append(dependents[j], i)
+			pending[i]++
+			hasDependencies = true
+		}
+	}
+
+	if !hasDependencies {
+		return migrations, nil
+	}
+
+	// ready holds indexes of migrations without pending dependencies,
+	// sorted by the source order
+	var ready []int
+	for i := range migrations {
+		if pending[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	ordered := make([]Migration, 0, len(migrations))
+	for len(ready) > 0 {
+		i := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, migrations[i])
+
+		for _, j := range dependents[i] {
+			pending[j]--
+			if pending[j] == 0 {
+				pos := sort.SearchInts(ready, j)
+				ready = append(ready[:pos], append([]int{j}, ready[pos:]...)...)
+			}
+		}
+	}
+
+	if len(ordered) < len(migrations) {
+		return nil, fmt.Errorf("dependency cycle detected: %s", findCycle(migrations, dependents, pending))
+	}
+
+	return ordered, nil
+}
+
+// findCycle returns a cycle among migrations that still have pending
+// dependencies, formatted as "A -> B -> A"
+func findCycle(migrations []Migration, dependents [][]int, pending []int) string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+
+	state := make([]int, len(migrations))
+	var path []int
+	var cycle []int
+
+	var visit func(i int) bool
+	visit = func(i int) bool {
+		state[i] = visiting
+		path = append(path, i)
+		for _, j := range dependents[i] {
+			if pending[j] == 0 {
+				continue
+			}
+			if state[j] == visiting {
+				for k, p := range path {
+					if p == j {
+						cycle = append(append(cycle, path[k:]...), j)
+						break
+					}
+				}
+				return true
+			}
+			if state[j] == unvisited && visit(j) {
+				return true
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = done
+		return false
+	}
+
+	for i := range migrations {
+		if pending[i] > 0 && state[i] == unvisited && visit(i) {
+			break
+		}
+	}
+
+	versions := make([]string, len(cycle))
+	for k, i := range cycle {
+		versions[k] = migrations[i].Version
+	}
+	return strings.Join(versions, " -> ")
+}
@@ -0,0 +1,84 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+)
+
+func requiresMigration(version, requires string) Migration {
+	content := "SELECT 1"
+	if requires != "" {
+		content = "-- migrate:requires " + requires + "\n" + content
+	}
+	return Migration{Version: version, Content: []byte(content)}
+}
+
+// Test ordering of migrations by their dependencies
+func TestOrderByDependencies(t *testing.T) {
+	tests := []struct {
+		name        string
+		migrations  []Migration
+		expected    []string
+		expectError string
+	}{
+		{
+			name: "no dependencies keeps version order",
+			migrations: []Migration{
+				requiresMigration("001", ""),
+				requiresMigration("002", ""),
+				requiresMigration("003", ""),
+			},
+			expected: []string{"001", "002", "003"},
+		},
+		{
+			name: "dependency moves migration after its requirements",
+			migrations: []Migration{
+				requiresMigration("001_a", ""),
+				requiresMigration("002_c", "001_a, 004_b"),
+				requiresMigration("003_d", ""),
+				requiresMigration("004_b", ""),
+			},
+			expected: []string{"001_a", "003_d", "004_b", "002_c"},
+		},
+		{
+			name: "unknown requirement",
+			migrations: []Migration{
+				requiresMigration("001", "000"),
+			},
+			expectError: "requires unknown migration 000",
+		},
+		{
+			name: "cycle",
+			migrations: []Migration{
+				requiresMigration("001", ""),
+				requiresMigration("002", "003"),
+				requiresMigration("003", "002"),
+			},
+			expectError: "002 -> 003 -> 002",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ordered, err := orderByDependencies(tt.migrations)
+			if tt.expectError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectError) {
+					t.Fatalf("expected error containing %q, got %v", tt.expectError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(ordered) != len(tt.expected) {
+				t.Fatalf("expected %d migrations, got %d", len(tt.expected), len(ordered))
+			}
+			for i, expected := range tt.expected {
+				if ordered[i].Version != expected {
+					t.Errorf("migration %d: expected %q, got %q", i, expected, ordered[i].Version)
+				}
+			}
+		})
+	}
+}
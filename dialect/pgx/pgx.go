@@ -0,0 +1,193 @@
+// Package pgx provides a PostgreSQL dialect over the native pgx interface,
+// for applications which use pgxpool instead of database/sql.
+package pgx
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/mkozhukh/migrate"
+)
+
+// Dialect is a PostgreSQL dialect which runs its statements on a pgx pool.
+// It generates the same SQL as migrate.PostgresDialect and accepts the same
+// options.
+type Dialect struct {
+	*migrate.PostgresDialect
+	pool *pgxpool.Pool
+
+	mu sync.Mutex
+	// conn holds the session of the advisory lock
+	conn *pgxpool.Conn
+}
+
+// NewDialect creates a new pgx dialect
+func NewDialect(pool *pgxpool.Pool, table string, opts ...migrate.DialectOption) *Dialect {
+	d := &Dialect{pool: pool}
+
+	exec := func(ctx context.Context, query string, args ...interface{}) error {
+		_, err := pool.Exec(ctx, query, args...)
+		return err
+	}
+	query := func(ctx context.Context, query string, args ...interface{}) ([][]interface{}, error) {
+		return queryRows(ctx, pool, query, args...)
+	}
+	begin := func(ctx context.Context) (migrate.Tx, error) {
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return Tx{tx: tx}, nil
+	}
+
+	opts = append(opts, migrate.WithExecFunc(exec, query, begin))
+	d.PostgresDialect = migrate.NewPostgresDialect(nil, table, opts...)
+	return d
+}
+
+// WithTableSuffix returns a copy of the dialect which uses the
+// <table>_<suffix> table and the same pool.
+func (d *Dialect) WithTableSuffix(suffix string) migrate.Dialect {
+	return &Dialect{
+		PostgresDialect: d.PostgresDialect.WithTableSuffix(suffix).(*migrate.PostgresDialect),
+		pool:            d.pool,
+	}
+}
+
+// queryRows reads the rows of the query as the values of their columns
+func queryRows(ctx context.Context, pool *pgxpool.Pool, query string, args ...interface{}) ([][]interface{}, error) {
+	rows, err := pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res [][]interface{}
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, values)
+	}
+
+	return res, rows.Err()
+}
+
+// Lock acquires the advisory lock. A session-level advisory lock belongs to
+// a connection, so a connection is taken from the pool and held until Unlock.
+func (d *Dialect) Lock(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	conn, err := d.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", d.LockKey); err != nil {
+		conn.Release()
+		return err
+	}
+	d.conn = conn
+	return nil
+}
+
+// TryLock acquires the advisory lock with pg_try_advisory_lock, without
+// waiting when another session holds it. Like Lock, it holds a connection
+// of the pool until Unlock.
+func (d *Dialect) TryLock(ctx context.Context) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	conn, err := d.pool.Acquire(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	var acquired bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", d.LockKey).Scan(&acquired); err != nil || !acquired {
+		conn.Release()
+		return false, err
+	}
+	d.conn = conn
+	return true, nil
+}
+
+// Unlock releases the advisory lock and its connection. It is a no-op when
+// the lock is not held, so calling it more than once is safe.
+func (d *Dialect) Unlock(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn == nil {
+		return nil
+	}
+	conn := d.conn
+	d.conn = nil
+
+	_, err := conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", d.LockKey)
+	if err != nil {
+		// the lock is released with the session
+		conn.Hijack().Close(context.WithoutCancel(ctx))
+		return err
+	}
+	conn.Release()
+	return nil
+}
+
+// Tx is a migration transaction over pgx.Tx.
+type Tx struct {
+	tx pgx.Tx
+}
+
+func (t Tx) Rollback(ctx context.Context) error {
+	err := t.tx.Rollback(ctx)
+	// rolling back a finished transaction is a no-op, like in database/sql
+	if errors.Is(err, pgx.ErrTxClosed) {
+		return nil
+	}
+	return err
+}
+
+func (t Tx) Commit(ctx context.Context) error {
+	return t.tx.Commit(ctx)
+}
+
+func (t Tx) Exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := t.tx.Exec(ctx, query, args...)
+	return err
+}
+
+// ExecResult executes the query and reports the rows it affected.
+func (t Tx) ExecResult(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	tag, err := t.tx.Exec(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return result{tag: tag}, nil
+}
+
+// QueryValue returns the first column of the first row of the query result.
+func (t Tx) QueryValue(ctx context.Context, query string, args ...interface{}) (interface{}, error) {
+	var value interface{}
+	err := t.tx.QueryRow(ctx, query, args...).Scan(&value)
+	return value, err
+}
+
+// result adapts the command tag of pgx to sql.Result
+type result struct {
+	tag pgconn.CommandTag
+}
+
+func (r result) LastInsertId() (int64, error) {
+	return 0, errors.New("LastInsertId is not supported by PostgreSQL")
+}
+
+func (r result) RowsAffected() (int64, error) {
+	return r.tag.RowsAffected(), nil
+}
@@ -0,0 +1,97 @@
+package pgx
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/mkozhukh/migrate"
+)
+
+var (
+	_ migrate.Dialect          = (*Dialect)(nil)
+	_ migrate.DeadlockDetector = (*Dialect)(nil)
+	_ migrate.Executor         = (*Dialect)(nil)
+	_ migrate.Tx               = Tx{}
+	_ migrate.ResultExecer     = Tx{}
+	_ migrate.Querier          = Tx{}
+)
+
+// Test the rows affected reported by the command tag
+func TestResult(t *testing.T) {
+	r := result{tag: pgconn.NewCommandTag("UPDATE 42")}
+	if rows, err := r.RowsAffected(); rows != 42 || err != nil {
+		t.Errorf("expected 42 rows, got %d %v", rows, err)
+	}
+	if _, err := r.LastInsertId(); err == nil {
+		t.Error("expected error for LastInsertId")
+	}
+}
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Info(msg string, v ...interface{}) {
+	l.t.Log(append([]interface{}{msg}, v...)...)
+}
+
+func TestDialectTableSuffix(t *testing.T) {
+	dialect := NewDialect(nil, "")
+	suffixed, ok := dialect.WithTableSuffix("blue").(*Dialect)
+	if !ok {
+		t.Fatal("expected a pgx dialect")
+	}
+	if suffixed.GetAppliedMigrationsSQL != "SELECT version FROM schema_migrations_blue" {
+		t.Errorf("unexpected select %q", suffixed.GetAppliedMigrationsSQL)
+	}
+}
+
+// Test applying and rolling back migrations on a real database, the DSN is
+// read from MIGRATE_PGX_DSN
+func TestDialect(t *testing.T) {
+	dsn := os.Getenv("MIGRATE_PGX_DSN")
+	if dsn == "" {
+		t.Skip("MIGRATE_PGX_DSN is not set")
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	dialect := NewDialect(pool, "pgx_test_migrations")
+	defer pool.Exec(ctx, "DROP TABLE IF EXISTS pgx_test_migrations, pgx_test_users")
+
+	source := &memorySource{migrations: []migrate.Migration{
+		{Version: "001_users", Content: []byte("CREATE TABLE pgx_test_users (id INT)"), DownContent: []byte("DROP TABLE pgx_test_users")},
+		{Version: "002_seed", Content: []byte("INSERT INTO pgx_test_users VALUES (1), (2)"), DownContent: []byte("DELETE FROM pgx_test_users")},
+	}}
+	migrator := migrate.New(source, dialect, testLogger{t})
+
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	applied, err := dialect.GetAppliedMigrations(ctx)
+	if err != nil || len(applied) != 2 {
+		t.Fatalf("expected 2 applied migrations, got %v %v", applied, err)
+	}
+
+	if err := migrator.Down(ctx, -1, migrate.WithConfirmRollback()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	applied, err = dialect.GetAppliedMigrations(ctx)
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("expected no applied migrations, got %v %v", applied, err)
+	}
+}
+
+type memorySource struct {
+	migrations []migrate.Migration
+}
+
+func (s *memorySource) GetMigrations() ([]migrate.Migration, error) {
+	return s.migrations, nil
+}
@@ -3,13 +3,23 @@ package migrate
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Dialect is a dialect interface for different SQL flavors
 type Dialect interface {
 	CreateMigrationsTable(ctx context.Context) error
 	GetAppliedMigrations(ctx context.Context) ([]string, error)
-	StoreAppliedMigration(ctx context.Context, tx Tx, version string) error
+	StoreAppliedMigration(ctx context.Context, tx Tx, record AppliedRecord) error
 	DeleteAppliedMigration(ctx context.Context, tx Tx, version string) error
 
 	BeginTx(ctx context.Context) (Tx, error)
@@ -17,6 +27,159 @@ type Dialect interface {
 	Unlock(ctx context.Context) error
 }
 
+// AppliedRecord describes a migration being recorded as applied.
+type AppliedRecord struct {
+	Version string
+	// Duration is the time it took to apply the migration, zero when the
+	// migration is recorded without being applied
+	Duration time.Duration
+	// Checksum is the SHA-256 of the content of the migration
+	Checksum string
+	// Release identifies the deployment which applied the migration, see
+	// WithRelease
+	Release string
+	// AppliedAt is the time the migration was applied, zero to record the
+	// current time of the database
+	AppliedAt time.Time
+}
+
+// AppliedMigration is a migration recorded as applied.
+type AppliedMigration struct {
+	Version string
+	// AppliedAt is the time the migration was recorded, zero when the
+	// dialect doesn't report it
+	AppliedAt time.Time
+	// Checksum is the recorded checksum, empty when the dialect doesn't
+	// record checksums
+	Checksum string
+	// Release is the recorded release which applied the migration, empty
+	// when the dialect doesn't record releases
+	Release string
+}
+
+// AppliedReader is implemented by dialects which report the details of the
+// applied migrations, not only their versions.
+type AppliedReader interface {
+	GetApplied(ctx context.Context) ([]AppliedMigration, error)
+}
+
+// BatchStorer is implemented by dialects which can record many applied
+// migrations with a single statement.
+type BatchStorer interface {
+	StoreAppliedMigrations(ctx context.Context, tx Tx, records []AppliedRecord) error
+}
+
+// storeAppliedMigrations records the applied migrations in bulk when the
+// dialect supports it, and one by one otherwise
+func storeAppliedMigrations(ctx context.Context, dialect Dialect, tx Tx, records []AppliedRecord) error {
+	if storer, ok := dialect.(BatchStorer); ok {
+		return storer.StoreAppliedMigrations(ctx, tx, records)
+	}
+
+	for _, record := range records {
+		if err := dialect.StoreAppliedMigration(ctx, tx, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TryLocker is implemented by dialects which can try to acquire the
+// migration lock without waiting for it. It is used by Preflight.
+type TryLocker interface {
+	// TryLock acquires the lock when it is free and reports whether it did.
+	// A lock acquired by TryLock is released by Unlock.
+	TryLock(ctx context.Context) (bool, error)
+}
+
+// DeadlockDetector is implemented by dialects which can recognize deadlock
+// errors of their database. It is used by the WithDeadlockRetry option.
+type DeadlockDetector interface {
+	IsDeadlock(err error) bool
+}
+
+// ErrorClass is the kind of a database error, as classified by the dialect.
+type ErrorClass string
+
+// Error classes returned by ErrorClassifier.
+const (
+	ErrorUnknown         ErrorClass = "unknown"
+	ErrorUniqueViolation ErrorClass = "unique violation"
+	ErrorLockTimeout     ErrorClass = "lock timeout"
+	ErrorDeadlock        ErrorClass = "deadlock"
+	ErrorSyntax          ErrorClass = "syntax error"
+)
+
+// ErrorClassifier is implemented by dialects which can classify the errors
+// of their driver, e.g. by SQLSTATE. The migrator uses it to detect
+// deadlocks and to name the kind of a failure in its errors.
+type ErrorClassifier interface {
+	ClassifyError(err error) ErrorClass
+}
+
+// sqlStater is implemented by driver errors that expose the SQLSTATE code,
+// like the errors of lib/pq and pgx
+type sqlStater interface {
+	SQLState() string
+}
+
+// Executor is implemented by dialects which can execute statements outside
+// of a transaction. It is required by migrations without a transaction.
+type Executor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) error
+}
+
+// TransactionalDDL is implemented by dialects whose databases roll back
+// schema changes with the transaction, unlike e.g. MySQL which commits them
+// implicitly. It is required by WithRollbackAfter.
+type TransactionalDDL interface {
+	TransactionalDDL() bool
+}
+
+// RecentLister is implemented by dialects which can read the most recently
+// applied migrations with a limited query. It is used by StatusRecent.
+type RecentLister interface {
+	// GetRecentMigrations returns up to n applied migrations, newest first
+	GetRecentMigrations(ctx context.Context, n int) ([]MigrationStatus, error)
+}
+
+// ChecksumReader is implemented by dialects which record the checksum of
+// AppliedRecord. It is used by WithReapplyOnChange and Validate.
+type ChecksumReader interface {
+	// GetChecksums returns the recorded checksums by version
+	GetChecksums(ctx context.Context) (map[string]string, error)
+}
+
+// TableSuffixer is implemented by dialects which can track migrations in a
+// table with a suffix, see WithTableSuffix.
+type TableSuffixer interface {
+	// WithTableSuffix returns a copy of the dialect which uses the
+	// <table>_<suffix> table
+	WithTableSuffix(suffix string) Dialect
+}
+
+// DirtyMarker is implemented by dialects which track migrations without a
+// transaction that failed partway. While a migration is dirty, runs fail
+// with ErrDirty until it is resolved, see Migrator.Resolve.
+type DirtyMarker interface {
+	MarkDirty(ctx context.Context, version string) error
+	// GetDirty returns the dirty migration, or an empty string if the
+	// database is clean
+	GetDirty(ctx context.Context) (string, error)
+	ClearDirty(ctx context.Context) error
+}
+
+// Checkpointer is implemented by dialects which can persist the progress of
+// long migrations in a checkpoints table, see Migrator.Checkpoint.
+type Checkpointer interface {
+	CreateCheckpointsTable(ctx context.Context) error
+	// GetCheckpoint returns the saved cursor of the migration, or an empty
+	// string if there is none
+	GetCheckpoint(ctx context.Context, version string) (string, error)
+	SaveCheckpoint(ctx context.Context, version string, cursor string) error
+	DeleteCheckpoint(ctx context.Context, version string) error
+}
+
 // Tx is a common transaction interface for SQL
 type Tx interface {
 	Rollback(ctx context.Context) error
@@ -24,8 +187,29 @@ type Tx interface {
 	Exec(ctx context.Context, query string, args ...interface{}) error
 }
 
+// ResultExecer is implemented by transactions that can report the result
+// of a statement. The migrator uses it to log the rows affected by a migration.
+type ResultExecer interface {
+	ExecResult(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Querier is implemented by transactions that can read query results.
+// It is required by migrations that run queries, like the verify directive.
+type Querier interface {
+	// QueryValue returns the first column of the first row of the query result
+	QueryValue(ctx context.Context, query string, args ...interface{}) (interface{}, error)
+}
+
 type CommonTx struct {
-	db *sql.Tx
+	db    *sql.Tx
+	trace func(query string, args []interface{})
+}
+
+// traceSQL reports the statement to the trace hook of the dialect, if any
+func (t CommonTx) traceSQL(query string, args []interface{}) {
+	if t.trace != nil {
+		t.trace(query, args)
+	}
 }
 
 func (t CommonTx) Rollback(ctx context.Context) error {
@@ -37,15 +221,241 @@ func (t CommonTx) Commit(ctx context.Context) error {
 }
 
 func (t CommonTx) Exec(ctx context.Context, query string, args ...interface{}) error {
+	t.traceSQL(query, args)
 	_, err := t.db.ExecContext(ctx, query, args...)
 	return err
 }
 
+func (t CommonTx) ExecResult(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	t.traceSQL(query, args)
+	return t.db.ExecContext(ctx, query, args...)
+}
+
+func (t CommonTx) QueryValue(ctx context.Context, query string, args ...interface{}) (interface{}, error) {
+	t.traceSQL(query, args)
+	var value interface{}
+	err := t.db.QueryRowContext(ctx, query, args...).Scan(&value)
+	return value, err
+}
+
+// ExecFunc executes a statement outside of a transaction.
+type ExecFunc func(ctx context.Context, query string, args ...interface{}) error
+
+// QueryFunc runs a query and returns its rows, each row as the values of
+// its columns.
+type QueryFunc func(ctx context.Context, query string, args ...interface{}) ([][]interface{}, error)
+
+// BeginFunc begins a transaction.
+type BeginFunc func(ctx context.Context) (Tx, error)
+
+// DialectOption configures a dialect at construction time.
+type DialectOption func(*CommonDialect)
+
+// WithVersionColumnLength sets the length of the version column in the
+// migrations table DDL. The default length is 255, which is kept when n is
+// not positive. SQLite stores versions as TEXT and ignores this option.
+func WithVersionColumnLength(n int) DialectOption {
+	return func(d *CommonDialect) {
+		if n > 0 {
+			d.versionColumnLength = n
+		}
+	}
+}
+
+// WithBatchSize sets the maximum number of rows inserted by a single
+// statement when applied migrations are recorded in bulk. The default is 500.
+func WithBatchSize(n int) DialectOption {
+	return func(d *CommonDialect) {
+		d.batchSize = n
+	}
+}
+
+// WithEnvironment scopes the migrations table to an environment, so one
+// table can track the migrations of several logical databases. The table
+// gets an env column, which is set on insert and filtered on select.
+func WithEnvironment(env string) DialectOption {
+	return func(d *CommonDialect) {
+		d.env = env
+	}
+}
+
+// WithVersionColumn sets the name of the version column of the migrations
+// table, e.g. to adopt an existing table. The default is "version".
+func WithVersionColumn(name string) DialectOption {
+	return func(d *CommonDialect) {
+		d.versionColumn = name
+	}
+}
+
+// WithTimestampColumn sets the name of the column with the time a migration
+// was applied. The default is "applied_at".
+func WithTimestampColumn(name string) DialectOption {
+	return func(d *CommonDialect) {
+		d.timestampColumn = name
+	}
+}
+
+// WithTraceSQL sets a hook which receives every statement the dialect
+// issues, including the migrations table statements, the lock queries and
+// the statements of its transactions. It is meant for debugging the SQL
+// generated for a driver.
+func WithTraceSQL(trace func(query string, args []interface{})) DialectOption {
+	return func(d *CommonDialect) {
+		d.trace = trace
+	}
+}
+
+// WithExecFunc routes the statements of the dialect through another database
+// stack instead of database/sql, like an ORM with its own connection pool or
+// the native pgx interface. exec runs the statements outside of transactions,
+// like the migrations table DDL and the lock, query reads the bookkeeping
+// tables, and begin starts the transactions migrations are applied and
+// recorded in. The *sql.DB passed to the constructor is not used and may be
+// nil. Statements of the transactions of begin are not traced.
+func WithExecFunc(exec ExecFunc, query QueryFunc, begin BeginFunc) DialectOption {
+	return func(d *CommonDialect) {
+		d.executor = exec
+		d.query = query
+		d.begin = begin
+	}
+}
+
+// WithChecksums adds a checksum column to the migrations table, which
+// records the SHA-256 of the content of each applied migration.
+func WithChecksums() DialectOption {
+	return func(d *CommonDialect) {
+		d.checksums = true
+	}
+}
+
+// WithDurations adds a duration_ms column to the migrations table, which
+// records how long each migration took to apply, in milliseconds.
+func WithDurations() DialectOption {
+	return func(d *CommonDialect) {
+		d.durations = true
+	}
+}
+
+// WithReleases adds a release_id column to the migrations table, which
+// records the release given to the run with WithRelease, e.g. a CI build
+// number. The column isn't named release, a reserved word of MySQL.
+func WithReleases() DialectOption {
+	return func(d *CommonDialect) {
+		d.releases = true
+	}
+}
+
+// WithDirtyTracking enables tracking of migrations without a transaction
+// which failed partway, see DirtyMarker. The dirty migration is kept in the
+// <table>_dirty table, which is created with the migrations table.
+func WithDirtyTracking() DialectOption {
+	return func(d *CommonDialect) {
+		d.dirtyTracking = true
+	}
+}
+
+// WithLockKey sets the advisory lock key used by PostgresDialect.
+func WithLockKey(key int64) DialectOption {
+	return func(d *CommonDialect) {
+		d.lockKey = &key
+	}
+}
+
+// WithLockNamespace sets the advisory lock key used by PostgresDialect to
+// the key derived from the namespace with LockKeyFromNamespace. Migration
+// histories with different namespaces can run in one database without
+// blocking each other.
+func WithLockNamespace(namespace string) DialectOption {
+	return WithLockKey(LockKeyFromNamespace(namespace))
+}
+
+// WithLockPerNamespace derives the advisory lock key used by PostgresDialect
+// from the migration history the dialect tracks: its table, with the suffix
+// of WithTableSuffix, and the environment of WithEnvironment. Services which
+// own disjoint tables and track them separately don't wait for each other's
+// migrations then, while migrators of the same history still do. Migrations
+// of different namespaces which touch the same objects aren't serialized,
+// so they must use one namespace. WithLockKey and WithLockNamespace take
+// precedence.
+func WithLockPerNamespace() DialectOption {
+	return func(d *CommonDialect) {
+		d.lockPerNamespace = true
+	}
+}
+
+// LockKeyFromNamespace returns the advisory lock key of the namespace,
+// which is the FNV-1a 64-bit hash of the namespace as a signed integer.
+func LockKeyFromNamespace(namespace string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(namespace))
+	return int64(h.Sum64())
+}
+
+// WithRole sets the role migrations are applied under. PostgresDialect
+// switches to this role at the start of each migration transaction and
+// resets it before commit. Other dialects ignore this option.
+func WithRole(role string) DialectOption {
+	return func(d *CommonDialect) {
+		d.role = role
+	}
+}
+
+// WithStatementTimeout limits the duration of each statement of the
+// migration transactions on the database side. PostgresDialect sets
+// `statement_timeout` at the start of each transaction, so the database
+// cancels a runaway statement even when the client lost the connection.
+// The timeout must be a whole number of milliseconds. Statements of
+// migrations without a transaction are not limited. Other dialects ignore
+// this option.
+func WithStatementTimeout(timeout time.Duration) DialectOption {
+	return func(d *CommonDialect) {
+		d.statementTimeout = timeout
+	}
+}
+
+var (
+	identifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*$`)
+	fragmentRe   = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+)
+
+// isIdentifier reports whether s is a plain SQL identifier that is safe
+// to use in a statement without quoting
+func isIdentifier(s string) bool {
+	return identifierRe.MatchString(s)
+}
+
+// isIdentifierFragment reports whether s can be appended to an identifier
+// keeping it safe to use without quoting
+func isIdentifierFragment(s string) bool {
+	return fragmentRe.MatchString(s)
+}
+
 // CommonDialect is a common dialect for SQL
 type CommonDialect struct {
-	db                       *sql.DB
 	tableName                string
+	versionColumnLength      int
+	role                     string
+	statementTimeout         time.Duration
+	batchSize                int
+	lockKey                  *int64
+	lockPerNamespace         bool
+	env                      string
+	versionColumn            string
+	timestampColumn          string
+	versionType              string
+	timestampType            string
+	placeholder              func(n int) string
 	executor                 func(ctx context.Context, query string, args ...interface{}) error
+	query                    QueryFunc
+	begin                    BeginFunc
+	trace                    func(query string, args []interface{})
+	dirtyTracking            bool
+	checksums                bool
+	durations                bool
+	releases                 bool
+	transactionalDDL         bool
+	schemaSQL                string
+	appliedSQL               string
 	CreateMigrationsTableSQL string
 	GetAppliedMigrationsSQL  string
 	ApplyMigrationSQL        string
@@ -53,77 +463,619 @@ type CommonDialect struct {
 }
 
 // NewCommonDialect creates a new common dialect
-func NewCommonDialect(db *sql.DB, table string) *CommonDialect {
+func NewCommonDialect(db *sql.DB, table string, opts ...DialectOption) *CommonDialect {
 	if table == "" {
 		table = "schema_migrations"
 	}
 
-	return &CommonDialect{db: db,
-		tableName: table,
+	res := &CommonDialect{
+		tableName:           table,
+		versionColumnLength: 255,
+		batchSize:           500,
+		versionColumn:       "version",
+		timestampColumn:     "applied_at",
+		placeholder: func(n int) string {
+			return "?"
+		},
 		executor: func(ctx context.Context, query string, args ...interface{}) error {
 			_, err := db.ExecContext(ctx, query, args...)
 			return err
 		},
-		CreateMigrationsTableSQL: `
+		query: func(ctx context.Context, query string, args ...interface{}) ([][]interface{}, error) {
+			return queryRows(ctx, db, query, args...)
+		},
+		begin: func(ctx context.Context) (Tx, error) {
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				return nil, err
+			}
+			return CommonTx{db: tx}, nil
+		},
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+
+	res.versionType = fmt.Sprintf("VARCHAR(%d)", res.versionColumnLength)
+	res.timestampType = "TIMESTAMP"
+	// the schema of the connection, as DATABASE() of MySQL and MariaDB
+	res.schemaSQL = `
+		SELECT table_name, table_schema, column_name, data_type, is_nullable, column_default
+		FROM information_schema.columns
+		WHERE table_schema = DATABASE()
+		ORDER BY table_name, column_name
+	`
+	res.buildSQL()
+
+	return res
+}
+
+// buildSQL generates the statements for the migrations table from the
+// column types, placeholders and options of the dialect
+func (d *CommonDialect) buildSQL() {
+	table := d.tableName
+	version := d.versionColumn
+	columns := version + " " + d.versionType + " PRIMARY KEY"
+	where := ""
+	if d.env != "" {
+		columns = "env VARCHAR(255) NOT NULL,\n\t\t\t" + version + " " + d.versionType + " NOT NULL"
+		where = " WHERE env = " + d.placeholder(1)
+	}
+
+	d.CreateMigrationsTableSQL = `
 		CREATE TABLE IF NOT EXISTS ` + table + ` (
-			version VARCHAR(255) PRIMARY KEY,
-			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			` + columns + `,
+			` + d.timestampColumn + ` ` + d.timestampType + ` DEFAULT CURRENT_TIMESTAMP`
+	if d.checksums {
+		d.CreateMigrationsTableSQL += `,
+			checksum VARCHAR(64)`
+	}
+	if d.durations {
+		d.CreateMigrationsTableSQL += `,
+			duration_ms BIGINT`
+	}
+	if d.releases {
+		d.CreateMigrationsTableSQL += `,
+			release_id VARCHAR(255)`
+	}
+	if d.env != "" {
+		d.CreateMigrationsTableSQL += `,
+			PRIMARY KEY (env, ` + version + `)`
+	}
+	d.CreateMigrationsTableSQL += `
 		)
-	`,
-		GetAppliedMigrationsSQL: `SELECT version FROM ` + table,
-		ApplyMigrationSQL:       `INSERT INTO ` + table + ` (version) VALUES (?)`,
-		DeleteMigrationSQL:      `DELETE FROM ` + table + ` WHERE version = ?`,
+	`
+	d.GetAppliedMigrationsSQL = `SELECT ` + version + ` FROM ` + table + where
+	columns = version + ", " + d.timestampColumn
+	if d.checksums {
+		columns += ", checksum"
+	}
+	if d.releases {
+		columns += ", release_id"
+	}
+	d.appliedSQL = `SELECT ` + columns + ` FROM ` + table + where
+	if d.env != "" {
+		d.DeleteMigrationSQL = `DELETE FROM ` + table + ` WHERE ` + version + ` = ` + d.placeholder(1) + ` AND env = ` + d.placeholder(2)
+	} else {
+		d.DeleteMigrationSQL = `DELETE FROM ` + table + ` WHERE ` + version + ` = ` + d.placeholder(1)
 	}
+	d.ApplyMigrationSQL = d.insertRecordsSQL(false, 1)
+}
+
+// checkColumns validates the configured column names, which are used in
+// the statements without quoting
+func (d *CommonDialect) checkColumns() error {
+	for _, name := range []string{d.versionColumn, d.timestampColumn} {
+		if !isIdentifier(name) {
+			return fmt.Errorf("invalid column name: %q", name)
+		}
+	}
+	return nil
+}
+
+// filterArgs returns the arguments of the environment filter
+func (d *CommonDialect) filterArgs() []interface{} {
+	if d.env == "" {
+		return nil
+	}
+	return []interface{}{d.env}
+}
+
+// recordArgs returns the arguments identifying the migration record
+func (d *CommonDialect) recordArgs(version string) []interface{} {
+	return append([]interface{}{version}, d.filterArgs()...)
+}
+
+// queryRows reads the rows of the query with database/sql
+func queryRows(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([][]interface{}, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var res [][]interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		res = append(res, values)
+	}
+
+	return res, rows.Err()
+}
+
+// queryStrings runs the query and returns the first column of its rows
+func (d *CommonDialect) queryStrings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	d.traceSQL(query, args)
+	rows, err := d.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if len(row) == 0 {
+			return nil, errors.New("query returned no columns")
+		}
+		res = append(res, valueString(row[0]))
+	}
+	return res, nil
+}
+
+// valueString converts a value read by a query to a string
+func valueString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// timestampLayouts are the text formats of timestamps returned by drivers
+// which don't convert them to time.Time
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// valueTime converts a value read by a query to a time, it returns the zero
+// time if the value isn't a timestamp
+func valueTime(v interface{}) time.Time {
+	if t, ok := v.(time.Time); ok {
+		return t
+	}
+	text := valueString(v)
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, text); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
 }
 
 func (d *CommonDialect) SetExecutor(executor func(ctx context.Context, query string, args ...interface{}) error) {
 	d.executor = executor
 }
 
+// TransactionalDDL reports whether schema changes are rolled back with the
+// transaction. It holds for the PostgreSQL, SQLite and libSQL dialects, and
+// not for the generic one, as e.g. MySQL commits DDL implicitly.
+func (d *CommonDialect) TransactionalDDL() bool {
+	return d.transactionalDDL
+}
+
+// ExecContext executes the query outside of a transaction
+func (d *CommonDialect) ExecContext(ctx context.Context, query string, args ...interface{}) error {
+	return d.exec(ctx, query, args...)
+}
+
+// exec traces the statement and runs it with the executor
+func (d *CommonDialect) exec(ctx context.Context, query string, args ...interface{}) error {
+	d.traceSQL(query, args)
+	return d.executor(ctx, query, args...)
+}
+
+// traceSQL reports the statement to the trace hook, if any
+func (d *CommonDialect) traceSQL(query string, args []interface{}) {
+	if d.trace != nil {
+		d.trace(query, args)
+	}
+}
+
+// ClassifyError classifies the error by its message, which works for SQLite
+// and for drivers which don't expose error codes.
+func (d *CommonDialect) ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorUnknown
+	}
+
+	message := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(message, "deadlock"):
+		return ErrorDeadlock
+	case strings.Contains(message, "unique constraint"), strings.Contains(message, "duplicate key"):
+		return ErrorUniqueViolation
+	case strings.Contains(message, "lock timeout"), strings.Contains(message, "database is locked"):
+		return ErrorLockTimeout
+	case strings.Contains(message, "syntax error"):
+		return ErrorSyntax
+	}
+	return ErrorUnknown
+}
+
+// WithTableSuffix returns a copy of the dialect which uses the
+// <table>_<suffix> table. The statements are generated again, so custom
+// statements set on the dialect are not kept.
+func (d *CommonDialect) WithTableSuffix(suffix string) Dialect {
+	return d.withTableSuffix(suffix)
+}
+
+func (d *CommonDialect) withTableSuffix(suffix string) *CommonDialect {
+	res := *d
+	res.tableName = d.tableName + "_" + suffix
+	res.buildSQL()
+	return &res
+}
+
 // CreateMigrationsTable creates the migrations table
 func (d *CommonDialect) CreateMigrationsTable(ctx context.Context) error {
-	return d.executor(ctx, d.CreateMigrationsTableSQL)
+	if err := d.checkColumns(); err != nil {
+		return err
+	}
+	if err := d.exec(ctx, d.CreateMigrationsTableSQL); err != nil {
+		return err
+	}
+	if d.dirtyTracking {
+		return d.exec(ctx, `
+		CREATE TABLE IF NOT EXISTS `+d.dirtyTable()+` (
+			env VARCHAR(255) NOT NULL DEFAULT '' PRIMARY KEY,
+			version `+d.versionType+` NOT NULL,
+			marked_at `+d.timestampType+` DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	}
+	return nil
+}
+
+// dirtyTable returns the name of the table with the dirty migration
+func (d *CommonDialect) dirtyTable() string {
+	return d.tableName + "_dirty"
+}
+
+// MarkDirty records the migration as dirty. It is a no-op unless dirty
+// tracking is enabled.
+func (d *CommonDialect) MarkDirty(ctx context.Context, version string) error {
+	if !d.dirtyTracking {
+		return nil
+	}
+
+	tx, err := d.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := tx.Exec(ctx, `DELETE FROM `+d.dirtyTable()+` WHERE env = `+d.placeholder(1), d.env); err != nil {
+		return err
+	}
+	if err := tx.Exec(ctx, `INSERT INTO `+d.dirtyTable()+` (env, version) VALUES (`+d.placeholder(1)+`, `+d.placeholder(2)+`)`, d.env, version); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// GetDirty returns the dirty migration. It always reports a clean database
+// unless dirty tracking is enabled.
+func (d *CommonDialect) GetDirty(ctx context.Context) (string, error) {
+	if !d.dirtyTracking {
+		return "", nil
+	}
+
+	versions, err := d.queryStrings(ctx, `SELECT version FROM `+d.dirtyTable()+` WHERE env = `+d.placeholder(1), d.env)
+	if err != nil || len(versions) == 0 {
+		return "", err
+	}
+	return versions[0], nil
 }
 
-// GetAppliedMigrations gets the applied migrations from the database
+// ClearDirty clears the dirty migration. It is a no-op unless dirty
+// tracking is enabled.
+func (d *CommonDialect) ClearDirty(ctx context.Context) error {
+	if !d.dirtyTracking {
+		return nil
+	}
+	return d.exec(ctx, `DELETE FROM `+d.dirtyTable()+` WHERE env = `+d.placeholder(1), d.env)
+}
+
+// GetAppliedMigrations gets the versions of the applied migrations from
+// the database
 func (d *CommonDialect) GetAppliedMigrations(ctx context.Context) ([]string, error) {
-	rows, err := d.db.QueryContext(ctx, d.GetAppliedMigrationsSQL)
+	if err := d.checkColumns(); err != nil {
+		return nil, err
+	}
+	return d.queryStrings(ctx, d.GetAppliedMigrationsSQL, d.filterArgs()...)
+}
+
+// GetApplied gets the applied migrations from the database, with the time
+// they were applied, and their checksums and releases when the columns are
+// enabled
+func (d *CommonDialect) GetApplied(ctx context.Context) ([]AppliedMigration, error) {
+	if err := d.checkColumns(); err != nil {
+		return nil, err
+	}
+	d.traceSQL(d.appliedSQL, d.filterArgs())
+	rows, err := d.query(ctx, d.appliedSQL, d.filterArgs()...)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	applied := make([]string, 0)
-	for rows.Next() {
-		var version string
-		if err := rows.Scan(&version); err != nil {
-			return nil, err
+	applied := make([]AppliedMigration, 0, len(rows))
+	for _, row := range rows {
+		if len(row) < 2 {
+			return nil, errors.New("query returned too few columns")
+		}
+		a := AppliedMigration{Version: valueString(row[0]), AppliedAt: valueTime(row[1])}
+		optional := row[2:]
+		if d.checksums && len(optional) > 0 {
+			a.Checksum = valueString(optional[0])
+			optional = optional[1:]
 		}
-		applied = append(applied, version)
+		if d.releases && len(optional) > 0 {
+			a.Release = valueString(optional[0])
+		}
+		applied = append(applied, a)
 	}
+	return applied, nil
+}
 
-	return applied, rows.Err()
+// recentMigrationsSQL returns the query of the n most recently applied
+// migrations
+func (d *CommonDialect) recentMigrationsSQL(n int) string {
+	where := ""
+	if d.env != "" {
+		where = ` WHERE env = ` + d.placeholder(1)
+	}
+	return `SELECT ` + d.versionColumn + `, ` + d.timestampColumn + ` FROM ` + d.tableName + where +
+		` ORDER BY ` + d.timestampColumn + ` DESC, ` + d.versionColumn + ` DESC LIMIT ` + strconv.Itoa(n)
 }
 
-// StoreAppliedMigration stores the applied migration in the database
-func (d *CommonDialect) StoreAppliedMigration(ctx context.Context, tx Tx, version string) error {
-	err := tx.Exec(ctx, d.ApplyMigrationSQL, version)
-	return err
+// GetChecksums gets the recorded checksums of the applied migrations. It
+// returns no checksums unless the checksum column is enabled.
+func (d *CommonDialect) GetChecksums(ctx context.Context) (map[string]string, error) {
+	if !d.checksums {
+		return map[string]string{}, nil
+	}
+	if err := d.checkColumns(); err != nil {
+		return nil, err
+	}
+
+	where := ""
+	if d.env != "" {
+		where = ` WHERE env = ` + d.placeholder(1)
+	}
+	query := `SELECT ` + d.versionColumn + `, checksum FROM ` + d.tableName + where
+	d.traceSQL(query, d.filterArgs())
+	rows, err := d.query(ctx, query, d.filterArgs()...)
+	if err != nil {
+		return nil, err
+	}
+
+	checksums := make(map[string]string, len(rows))
+	for _, row := range rows {
+		if len(row) < 2 {
+			return nil, errors.New("query returned too few columns")
+		}
+		if sum := valueString(row[1]); sum != "" {
+			checksums[valueString(row[0])] = sum
+		}
+	}
+	return checksums, nil
+}
+
+// GetRecentMigrations gets the n most recently applied migrations, ordered
+// by the time they were applied and then by version, newest first
+func (d *CommonDialect) GetRecentMigrations(ctx context.Context, n int) ([]MigrationStatus, error) {
+	if err := d.checkColumns(); err != nil {
+		return nil, err
+	}
+	query := d.recentMigrationsSQL(n)
+	d.traceSQL(query, d.filterArgs())
+	rows, err := d.query(ctx, query, d.filterArgs()...)
+	if err != nil {
+		return nil, err
+	}
+
+	recent := make([]MigrationStatus, 0, len(rows))
+	for _, row := range rows {
+		if len(row) < 2 {
+			return nil, errors.New("query returned too few columns")
+		}
+		recent = append(recent, MigrationStatus{Version: valueString(row[0]), AppliedAt: valueTime(row[1])})
+	}
+	return recent, nil
+}
+
+// StoreAppliedMigration stores the applied migration in the database, with
+// its checksum and duration when the columns are enabled, and its time when
+// it is set
+func (d *CommonDialect) StoreAppliedMigration(ctx context.Context, tx Tx, record AppliedRecord) error {
+	args := d.recordValues(record)
+	if record.AppliedAt.IsZero() {
+		return tx.Exec(ctx, d.ApplyMigrationSQL, args...)
+	}
+	return tx.Exec(ctx, d.insertRecordsSQL(true, 1), args...)
+}
+
+// StoreAppliedMigrations stores many applied migrations in the database,
+// using multi-row inserts of up to batch size rows. Consecutive records
+// with and without a time are inserted by separate statements.
+func (d *CommonDialect) StoreAppliedMigrations(ctx context.Context, tx Tx, records []AppliedRecord) error {
+	size := d.batchSize
+	if size <= 0 {
+		size = len(records)
+	}
+
+	for start := 0; start < len(records); {
+		timed := !records[start].AppliedAt.IsZero()
+		end := start + 1
+		for end < len(records) && end-start < size && !records[end].AppliedAt.IsZero() == timed {
+			end++
+		}
+
+		var args []interface{}
+		for _, record := range records[start:end] {
+			args = append(args, d.recordValues(record)...)
+		}
+		if err := tx.Exec(ctx, d.insertRecordsSQL(timed, end-start), args...); err != nil {
+			return err
+		}
+		start = end
+	}
+
+	return nil
+}
+
+// recordValues returns the values of the columns of ApplyMigrationSQL for
+// the record, followed by its time when it is set
+func (d *CommonDialect) recordValues(record AppliedRecord) []interface{} {
+	args := d.recordArgs(record.Version)
+	if d.checksums {
+		args = append(args, record.Checksum)
+	}
+	if d.durations {
+		args = append(args, record.Duration.Milliseconds())
+	}
+	if d.releases {
+		var release interface{}
+		if record.Release != "" {
+			release = record.Release
+		}
+		args = append(args, release)
+	}
+	if !record.AppliedAt.IsZero() {
+		args = append(args, record.AppliedAt.UTC())
+	}
+	return args
+}
+
+// insertRecordsSQL returns the insert of the rows of applied migrations with
+// the columns of ApplyMigrationSQL, and the timestamp column when timed
+func (d *CommonDialect) insertRecordsSQL(timed bool, rows int) string {
+	columns := []string{d.versionColumn}
+	if d.env != "" {
+		columns = append(columns, "env")
+	}
+	if d.checksums {
+		columns = append(columns, "checksum")
+	}
+	if d.durations {
+		columns = append(columns, "duration_ms")
+	}
+	if d.releases {
+		columns = append(columns, "release_id")
+	}
+	if timed {
+		columns = append(columns, d.timestampColumn)
+	}
+
+	values := make([]string, rows)
+	for i := range values {
+		placeholders := make([]string, len(columns))
+		for j := range placeholders {
+			placeholders[j] = d.placeholder(i*len(columns) + j + 1)
+		}
+		values[i] = "(" + strings.Join(placeholders, ", ") + ")"
+	}
+	return `INSERT INTO ` + d.tableName + ` (` + strings.Join(columns, ", ") + `) VALUES ` + strings.Join(values, ", ")
 }
 
 // DeleteAppliedMigration deletes the applied migration from the database
 func (d *CommonDialect) DeleteAppliedMigration(ctx context.Context, tx Tx, version string) error {
-	err := tx.Exec(ctx, d.DeleteMigrationSQL, version)
+	err := tx.Exec(ctx, d.DeleteMigrationSQL, d.recordArgs(version)...)
 	return err
 }
 
+// checkpointsTable returns the name of the checkpoints table, which is
+// derived from the migrations table
+func (d *CommonDialect) checkpointsTable() string {
+	return d.tableName + "_checkpoints"
+}
+
+// CreateCheckpointsTable creates the checkpoints table. Checkpoints are
+// scoped to the environment of the dialect, the env column is empty when
+// no environment is set.
+func (d *CommonDialect) CreateCheckpointsTable(ctx context.Context) error {
+	return d.exec(ctx, `
+		CREATE TABLE IF NOT EXISTS `+d.checkpointsTable()+` (
+			env VARCHAR(255) NOT NULL DEFAULT '',
+			version `+d.versionType+` NOT NULL,
+			cursor_value TEXT NOT NULL,
+			updated_at `+d.timestampType+` DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (env, version)
+		)
+	`)
+}
+
+// GetCheckpoint returns the saved cursor of the migration
+func (d *CommonDialect) GetCheckpoint(ctx context.Context, version string) (string, error) {
+	query := `SELECT cursor_value FROM ` + d.checkpointsTable() + ` WHERE env = ` + d.placeholder(1) + ` AND version = ` + d.placeholder(2)
+	cursors, err := d.queryStrings(ctx, query, d.env, version)
+	if err != nil || len(cursors) == 0 {
+		return "", err
+	}
+	return cursors[0], nil
+}
+
+// SaveCheckpoint replaces the saved cursor of the migration
+func (d *CommonDialect) SaveCheckpoint(ctx context.Context, version string, cursor string) error {
+	tx, err := d.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	table := d.checkpointsTable()
+	if err := tx.Exec(ctx, `DELETE FROM `+table+` WHERE env = `+d.placeholder(1)+` AND version = `+d.placeholder(2), d.env, version); err != nil {
+		return err
+	}
+	if err := tx.Exec(ctx, `INSERT INTO `+table+` (env, version, cursor_value) VALUES (`+d.placeholder(1)+`, `+d.placeholder(2)+`, `+d.placeholder(3)+`)`, d.env, version, cursor); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// DeleteCheckpoint deletes the saved cursor of the migration
+func (d *CommonDialect) DeleteCheckpoint(ctx context.Context, version string) error {
+	return d.exec(ctx, `DELETE FROM `+d.checkpointsTable()+` WHERE env = `+d.placeholder(1)+` AND version = `+d.placeholder(2), d.env, version)
+}
+
 // BeginTx begins a new transaction
 func (d *CommonDialect) BeginTx(ctx context.Context) (Tx, error) {
-	tx, err := d.db.BeginTx(ctx, nil)
+	tx, err := d.begin(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return CommonTx{db: tx}, nil
+	if common, ok := tx.(CommonTx); ok {
+		common.trace = d.trace
+		return common, nil
+	}
+	return tx, nil
 }
 
 // Lock acquires a database-level lock.
@@ -139,48 +1091,369 @@ func (d *CommonDialect) Unlock(ctx context.Context) error {
 }
 
 // NewSQLiteDialect creates a new SQLite dialect
-func NewSQLiteDialect(db *sql.DB, table string) *CommonDialect {
-	res := NewCommonDialect(db, table)
+func NewSQLiteDialect(db *sql.DB, table string, opts ...DialectOption) *CommonDialect {
+	res := NewCommonDialect(db, table, opts...)
 
-	res.CreateMigrationsTableSQL = `
-		CREATE TABLE IF NOT EXISTS ` + res.tableName + ` (
-			version TEXT PRIMARY KEY,
-			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)
+	res.versionType = "TEXT"
+	res.timestampType = "DATETIME"
+	res.transactionalDDL = true
+	res.schemaSQL = `
+		SELECT tbl_name, name, type, sql
+		FROM sqlite_master
+		WHERE name NOT LIKE 'sqlite_%'
+		ORDER BY tbl_name, type, name
 	`
+	res.buildSQL()
 
 	return res
 }
 
+// LibSQLDialect is a dialect for Turso and libSQL. It uses the SQLite
+// statements and, as remote libSQL has limited locking, an in-process lock.
+// The lock only serializes migrations run by the same dialect instance, so
+// concurrent deployments must be coordinated outside of the migrator.
+type LibSQLDialect struct {
+	*CommonDialect
+	lock chan struct{}
+}
+
+// NewLibSQLDialect creates a new libSQL dialect
+func NewLibSQLDialect(db *sql.DB, table string, opts ...DialectOption) *LibSQLDialect {
+	return &LibSQLDialect{
+		CommonDialect: NewSQLiteDialect(db, table, opts...),
+		lock:          make(chan struct{}, 1),
+	}
+}
+
+// WithTableSuffix returns a copy of the dialect which uses the
+// <table>_<suffix> table and shares the lock of the dialect.
+func (d *LibSQLDialect) WithTableSuffix(suffix string) Dialect {
+	return &LibSQLDialect{CommonDialect: d.withTableSuffix(suffix), lock: d.lock}
+}
+
+// Lock acquires the in-process lock, waiting until it is released or the
+// context is done.
+func (d *LibSQLDialect) Lock(ctx context.Context) error {
+	select {
+	case d.lock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TryLock acquires the in-process lock if it is free.
+func (d *LibSQLDialect) TryLock(ctx context.Context) (bool, error) {
+	select {
+	case d.lock <- struct{}{}:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// Unlock releases the in-process lock. It is a no-op when the lock is not
+// held, so calling it more than once is safe.
+func (d *LibSQLDialect) Unlock(ctx context.Context) error {
+	select {
+	case <-d.lock:
+	default:
+	}
+	return nil
+}
+
 type PostgresDialect struct {
 	*CommonDialect
 	LockKey int
+
+	db     *sql.DB
+	mu     sync.Mutex
+	conn   *sql.Conn
+	locked bool
 }
 
 // NewPostgresDialect creates a new Postgres dialect
-func NewPostgresDialect(db *sql.DB, table string) *PostgresDialect {
+func NewPostgresDialect(db *sql.DB, table string, opts ...DialectOption) *PostgresDialect {
 	res := &PostgresDialect{
-		CommonDialect: NewCommonDialect(db, table),
+		CommonDialect: NewCommonDialect(db, table, opts...),
+		db:            db,
 		// python3 -c "print(abs(hash('github.com/mkozhukh/migrate/v1')))"
 		LockKey: 6492640049987603658,
 	}
 
-	res.CreateMigrationsTableSQL = `
-		CREATE TABLE IF NOT EXISTS ` + res.tableName + ` (
-			version VARCHAR(255) PRIMARY KEY,
-			applied_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-		)
+	if res.lockKey != nil {
+		res.LockKey = int(*res.lockKey)
+	} else if res.lockPerNamespace {
+		res.LockKey = int(LockKeyFromNamespace(res.lockNamespace()))
+	}
+
+	res.timestampType = "TIMESTAMP WITH TIME ZONE"
+	res.transactionalDDL = true
+	res.schemaSQL = `
+		SELECT table_name::text, column_name::text, data_type::text, is_nullable::text, column_default::text
+		FROM information_schema.columns
+		WHERE table_schema = current_schema()
+		UNION ALL
+		SELECT tablename::text, indexname::text, indexdef, '', ''
+		FROM pg_indexes
+		WHERE schemaname = current_schema()
+		ORDER BY 1, 2, 3
 	`
-	res.ApplyMigrationSQL = `INSERT INTO ` + res.tableName + ` (version) VALUES ($1)`
-	res.DeleteMigrationSQL = `DELETE FROM ` + res.tableName + ` WHERE version = $1`
+	res.placeholder = func(n int) string {
+		return fmt.Sprintf("$%d", n)
+	}
+	res.buildSQL()
 
 	return res
 }
 
+// WithTableSuffix returns a copy of the dialect which uses the
+// <table>_<suffix> table, with the same lock key unless the key is derived
+// per namespace.
+func (d *PostgresDialect) WithTableSuffix(suffix string) Dialect {
+	res := &PostgresDialect{CommonDialect: d.withTableSuffix(suffix), LockKey: d.LockKey, db: d.db}
+	if res.lockKey == nil && res.lockPerNamespace {
+		res.LockKey = int(LockKeyFromNamespace(res.lockNamespace()))
+	}
+	return res
+}
+
+// lockNamespace returns the namespace of the lock key of WithLockPerNamespace,
+// the migrations table and the environment
+func (d *CommonDialect) lockNamespace() string {
+	if d.env == "" {
+		return d.tableName
+	}
+	return d.tableName + "/" + d.env
+}
+
+// BeginTx begins a new transaction, setting the statement timeout and
+// switching to the configured role if any
+func (d *PostgresDialect) BeginTx(ctx context.Context) (Tx, error) {
+	if d.role == "" && d.statementTimeout == 0 {
+		return d.CommonDialect.BeginTx(ctx)
+	}
+	if d.role != "" && !isIdentifier(d.role) {
+		return nil, fmt.Errorf("invalid role name: %q", d.role)
+	}
+	// statement_timeout is an integer number of milliseconds, 0 disables it
+	if d.statementTimeout < 0 || d.statementTimeout%time.Millisecond != 0 {
+		return nil, fmt.Errorf("invalid statement timeout %s, use a positive number of milliseconds", d.statementTimeout)
+	}
+
+	tx, err := d.CommonDialect.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if d.statementTimeout != 0 {
+		// SET LOCAL ends with the transaction, the pooled session is not affected
+		query := fmt.Sprintf("SET LOCAL statement_timeout = %d", d.statementTimeout.Milliseconds())
+		if err := tx.Exec(ctx, query); err != nil {
+			tx.Rollback(ctx)
+			return nil, fmt.Errorf("failed to set statement timeout: %w", err)
+		}
+	}
+	if d.role == "" {
+		return tx, nil
+	}
+	if err := tx.Exec(ctx, "SET ROLE "+d.role); err != nil {
+		tx.Rollback(ctx)
+		return nil, fmt.Errorf("failed to set role %s: %w", d.role, err)
+	}
+
+	return roleTx{Tx: tx}, nil
+}
+
+// roleTx resets the session role before the transaction is committed
+type roleTx struct {
+	Tx
+}
+
+func (t roleTx) ExecResult(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	execer, ok := t.Tx.(ResultExecer)
+	if !ok {
+		// the rows affected are reported as unknown
+		return driver.ResultNoRows, t.Tx.Exec(ctx, query, args...)
+	}
+	return execer.ExecResult(ctx, query, args...)
+}
+
+func (t roleTx) QueryValue(ctx context.Context, query string, args ...interface{}) (interface{}, error) {
+	querier, ok := t.Tx.(Querier)
+	if !ok {
+		return nil, errors.New("transaction does not support queries")
+	}
+	return querier.QueryValue(ctx, query, args...)
+}
+
+func (t roleTx) Commit(ctx context.Context) error {
+	if err := t.Exec(ctx, "RESET ROLE"); err != nil {
+		return fmt.Errorf("failed to reset role: %w", err)
+	}
+	return t.Tx.Commit(ctx)
+}
+
+// Lock acquires the advisory lock. A session-level advisory lock belongs to
+// a connection, so a connection is taken from the pool and held until Unlock,
+// otherwise the unlock could run on another session and leave the lock held.
+// Without a database, as with WithExecFunc, the lock statements go through
+// the executor.
 func (d *PostgresDialect) Lock(ctx context.Context) error {
-	return d.executor(ctx, "SELECT pg_advisory_lock($1)", d.LockKey)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.db == nil {
+		if err := d.exec(ctx, "SELECT pg_advisory_lock($1)", d.LockKey); err != nil {
+			return err
+		}
+		d.locked = true
+		return nil
+	}
+
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	d.traceSQL("SELECT pg_advisory_lock($1)", []interface{}{d.LockKey})
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", d.LockKey); err != nil {
+		conn.Close()
+		return err
+	}
+	d.conn = conn
+	d.locked = true
+	return nil
+}
+
+// TryLock acquires the advisory lock with pg_try_advisory_lock, without
+// waiting when another session holds it. Like Lock, it holds the connection
+// of the session until Unlock.
+func (d *PostgresDialect) TryLock(ctx context.Context) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	const query = "SELECT pg_try_advisory_lock($1)"
+	d.traceSQL(query, []interface{}{d.LockKey})
+	if d.db == nil {
+		rows, err := d.query(ctx, query, d.LockKey)
+		if err != nil {
+			return false, err
+		}
+		if len(rows) == 0 || len(rows[0]) == 0 {
+			return false, errors.New("query returned no rows")
+		}
+		d.locked = isTruthy(rows[0][0])
+		return d.locked, nil
+	}
+
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, query, d.LockKey).Scan(&acquired); err != nil || !acquired {
+		conn.Close()
+		return false, err
+	}
+	d.conn = conn
+	d.locked = true
+	return true, nil
 }
 
+// Unlock releases the advisory lock and its connection. It is a no-op when
+// the lock is not held, so calling it more than once is safe.
 func (d *PostgresDialect) Unlock(ctx context.Context) error {
-	return d.executor(ctx, "SELECT pg_advisory_unlock($1)", d.LockKey)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.locked {
+		return nil
+	}
+	d.locked = false
+	if d.conn == nil {
+		if err := d.exec(ctx, "SELECT pg_advisory_unlock($1)", d.LockKey); err != nil {
+			d.locked = true
+			return err
+		}
+		return nil
+	}
+
+	conn := d.conn
+	d.conn = nil
+	d.traceSQL("SELECT pg_advisory_unlock($1)", []interface{}{d.LockKey})
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", d.LockKey)
+	if err != nil {
+		// the lock is released with the session, so the connection is
+		// discarded instead of being returned to the pool
+		conn.Raw(func(driverConn interface{}) error {
+			return driver.ErrBadConn
+		})
+	}
+	conn.Close()
+	return err
+}
+
+// IsDeadlock reports whether the error is a PostgreSQL deadlock, SQLSTATE 40P01.
+func (d *PostgresDialect) IsDeadlock(err error) bool {
+	return d.ClassifyError(err) == ErrorDeadlock
+}
+
+// postgresErrorClasses maps SQLSTATE codes to error classes
+var postgresErrorClasses = map[string]ErrorClass{
+	"23505": ErrorUniqueViolation,
+	"55P03": ErrorLockTimeout,
+	"40P01": ErrorDeadlock,
+	"42601": ErrorSyntax,
+}
+
+// ClassifyError classifies the error by its SQLSTATE code, which lib/pq and
+// pgx expose, falling back to the message for other drivers.
+func (d *PostgresDialect) ClassifyError(err error) ErrorClass {
+	var state sqlStater
+	if errors.As(err, &state) {
+		if class, ok := postgresErrorClasses[state.SQLState()]; ok {
+			return class
+		}
+		return ErrorUnknown
+	}
+	return d.CommonDialect.ClassifyError(err)
+}
+
+// DetectDialect returns the dialect matching the driver of the database.
+// The driver is recognized by its type, supported drivers are lib/pq and the
+// pgx stdlib driver for PostgreSQL, mattn/go-sqlite3, modernc.org/sqlite and
+// ncruces/go-sqlite3 for SQLite, and the libSQL drivers for Turso and libSQL.
+func DetectDialect(db *sql.DB, table string, opts ...DialectOption) (Dialect, error) {
+	switch driverDialect(db) {
+	case "postgres":
+		return NewPostgresDialect(db, table, opts...), nil
+	case "sqlite":
+		return NewSQLiteDialect(db, table, opts...), nil
+	case "libsql":
+		return NewLibSQLDialect(db, table, opts...), nil
+	}
+
+	return nil, fmt.Errorf("unknown database driver: %T", db.Driver())
+}
+
+// driverDialects maps the types of known database drivers, as the package
+// path and the type name, to the dialect of their database
+var driverDialects = map[string]string{
+	"github.com/lib/pq.Driver":                                "postgres",
+	"github.com/jackc/pgx/v4/stdlib.Driver":                   "postgres",
+	"github.com/jackc/pgx/v5/stdlib.Driver":                   "postgres",
+	"github.com/mattn/go-sqlite3.SQLiteDriver":                "sqlite",
+	"modernc.org/sqlite.Driver":                               "sqlite",
+	"github.com/ncruces/go-sqlite3/driver.SQLite":             "sqlite",
+	"github.com/tursodatabase/libsql-client-go/libsql.Driver": "libsql",
+	"github.com/tursodatabase/go-libsql.Driver":               "libsql",
+}
+
+// driverDialect returns the dialect of the driver of the database, or an
+// empty string for unknown drivers
+func driverDialect(db *sql.DB) string {
+	driverType := reflect.TypeOf(db.Driver())
+	if driverType.Kind() == reflect.Pointer {
+		driverType = driverType.Elem()
+	}
+	return driverDialects[driverType.PkgPath()+"."+driverType.Name()]
 }
@@ -0,0 +1,1074 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test the generated DDL of the migrations table
+func TestDialectVersionColumnLength(t *testing.T) {
+	tests := []struct {
+		name     string
+		ddl      string
+		expected string
+	}{
+		{
+			name:     "common default",
+			ddl:      NewCommonDialect(nil, "").CreateMigrationsTableSQL,
+			expected: "version VARCHAR(255) PRIMARY KEY",
+		},
+		{
+			name:     "common custom length",
+			ddl:      NewCommonDialect(nil, "", WithVersionColumnLength(1024)).CreateMigrationsTableSQL,
+			expected: "version VARCHAR(1024) PRIMARY KEY",
+		},
+		{
+			name:     "non-positive length keeps default",
+			ddl:      NewCommonDialect(nil, "", WithVersionColumnLength(0)).CreateMigrationsTableSQL,
+			expected: "version VARCHAR(255) PRIMARY KEY",
+		},
+		{
+			name:     "negative length keeps default",
+			ddl:      NewPostgresDialect(nil, "", WithVersionColumnLength(-1)).CreateMigrationsTableSQL,
+			expected: "version VARCHAR(255) PRIMARY KEY",
+		},
+		{
+			name:     "postgres custom length",
+			ddl:      NewPostgresDialect(nil, "", WithVersionColumnLength(512)).CreateMigrationsTableSQL,
+			expected: "version VARCHAR(512) PRIMARY KEY",
+		},
+		{
+			name:     "sqlite ignores length",
+			ddl:      NewSQLiteDialect(nil, "", WithVersionColumnLength(512)).CreateMigrationsTableSQL,
+			expected: "version TEXT PRIMARY KEY",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(tt.ddl, tt.expected) {
+				t.Errorf("expected DDL to contain %q, got %q", tt.expected, tt.ddl)
+			}
+		})
+	}
+}
+
+// Test that Postgres Unlock is idempotent
+func TestPostgresDialectDoubleUnlock(t *testing.T) {
+	var queries []string
+	dialect := NewPostgresDialect(nil, "")
+	dialect.SetExecutor(func(ctx context.Context, query string, args ...interface{}) error {
+		queries = append(queries, query)
+		return nil
+	})
+
+	ctx := context.Background()
+	if err := dialect.Unlock(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(queries) != 0 {
+		t.Errorf("expected no queries for unlock without lock, got %v", queries)
+	}
+
+	if err := dialect.Lock(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := dialect.Unlock(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := dialect.Unlock(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"SELECT pg_advisory_lock($1)", "SELECT pg_advisory_unlock($1)"}
+	if len(queries) != len(expected) {
+		t.Fatalf("expected %d queries, got %d: %v", len(expected), len(queries), queries)
+	}
+	for i, q := range expected {
+		if queries[i] != q {
+			t.Errorf("query %d: expected %q, got %q", i, q, queries[i])
+		}
+	}
+}
+
+// sessionDriver records the statements executed by each of its connections
+type sessionDriver struct {
+	mu       sync.Mutex
+	sessions int
+	executed []string
+	failOn   string
+	// held makes pg_try_advisory_lock report the lock as taken
+	held bool
+}
+
+func (d *sessionDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sessions++
+	return &sessionConn{driver: d, id: d.sessions}, nil
+}
+
+type sessionConn struct {
+	driver *sessionDriver
+	id     int
+}
+
+func (c *sessionConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *sessionConn) Close() error {
+	return nil
+}
+
+func (c *sessionConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *sessionConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.driver.mu.Lock()
+	defer c.driver.mu.Unlock()
+	c.driver.executed = append(c.driver.executed, fmt.Sprintf("%d: %s", c.id, query))
+	if query == c.driver.failOn {
+		return nil, errors.New("connection reset")
+	}
+	return driver.ResultNoRows, nil
+}
+
+func (c *sessionConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.driver.mu.Lock()
+	defer c.driver.mu.Unlock()
+	c.driver.executed = append(c.driver.executed, fmt.Sprintf("%d: %s", c.id, query))
+	return &boolRows{value: !c.driver.held}, nil
+}
+
+// boolRows is a result of a single boolean
+type boolRows struct {
+	value bool
+	read  bool
+}
+
+func (r *boolRows) Columns() []string {
+	return []string{"value"}
+}
+
+func (r *boolRows) Close() error {
+	return nil
+}
+
+func (r *boolRows) Next(dest []driver.Value) error {
+	if r.read {
+		return io.EOF
+	}
+	r.read = true
+	dest[0] = r.value
+	return nil
+}
+
+// Test that the advisory lock is released on the session which acquired it
+func TestPostgresDialectLockSession(t *testing.T) {
+	sessions := &sessionDriver{}
+	sql.Register("pgsession", sessions)
+	db, err := sql.Open("pgsession", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	dialect := NewPostgresDialect(db, "")
+	if err := dialect.Lock(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the pinned connection is not returned to the pool while the lock is held
+	if err := dialect.ExecContext(ctx, "SELECT 1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := dialect.Unlock(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "[1: SELECT pg_advisory_lock($1) 2: SELECT 1 1: SELECT pg_advisory_unlock($1)]"
+	if got := fmt.Sprint(sessions.executed); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	// a session which failed to unlock is closed, which releases the lock
+	sessions.executed = nil
+	sessions.failOn = "SELECT pg_advisory_unlock($1)"
+	if err := dialect.Lock(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := dialect.Unlock(ctx); err == nil {
+		t.Fatal("expected unlock error")
+	}
+	sessions.failOn = ""
+	if err := dialect.ExecContext(ctx, "SELECT 1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := sessions.executed[len(sessions.executed)-1]; strings.HasPrefix(got, "1:") {
+		t.Errorf("expected the failed session to be discarded, got %v", sessions.executed)
+	}
+}
+
+// Test trying the advisory lock without waiting
+func TestPostgresDialectTryLock(t *testing.T) {
+	sessions := &sessionDriver{}
+	sql.Register("pgtrylock", sessions)
+	db, err := sql.Open("pgtrylock", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	dialect := NewPostgresDialect(db, "")
+	if acquired, err := dialect.TryLock(ctx); err != nil || !acquired {
+		t.Fatalf("expected the free lock to be acquired, got %v %v", acquired, err)
+	}
+	if err := dialect.Unlock(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "[1: SELECT pg_try_advisory_lock($1) 1: SELECT pg_advisory_unlock($1)]"
+	if got := fmt.Sprint(sessions.executed); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	sessions.executed = nil
+	sessions.held = true
+	if acquired, err := dialect.TryLock(ctx); err != nil || acquired {
+		t.Fatalf("expected the held lock not to be acquired, got %v %v", acquired, err)
+	}
+	if err := dialect.Unlock(ctx); err != nil || len(sessions.executed) != 1 {
+		t.Errorf("expected no unlock of a lock which wasn't acquired, got %v %v", err, sessions.executed)
+	}
+
+	query := func(ctx context.Context, query string, args ...interface{}) ([][]interface{}, error) {
+		return [][]interface{}{{true}}, nil
+	}
+	if acquired, err := NewPostgresDialect(nil, "", WithExecFunc(nil, query, nil)).TryLock(ctx); err != nil || !acquired {
+		t.Errorf("expected the lock to be acquired with the query function, got %v %v", acquired, err)
+	}
+}
+
+type recordingTx struct {
+	queries   []string
+	committed bool
+}
+
+func (tx *recordingTx) Exec(ctx context.Context, query string, args ...interface{}) error {
+	tx.queries = append(tx.queries, query)
+	return nil
+}
+
+func (tx *recordingTx) Commit(ctx context.Context) error {
+	tx.committed = true
+	return nil
+}
+
+func (tx *recordingTx) Rollback(ctx context.Context) error {
+	return nil
+}
+
+// Test role switching for Postgres transactions
+func TestPostgresDialectRole(t *testing.T) {
+	t.Run("invalid role name", func(t *testing.T) {
+		dialect := NewPostgresDialect(nil, "", WithRole("owner; DROP TABLE users"))
+		if _, err := dialect.BeginTx(context.Background()); err == nil {
+			t.Error("expected error for invalid role name")
+		}
+	})
+
+	t.Run("reset role before commit", func(t *testing.T) {
+		inner := &recordingTx{}
+		tx := roleTx{Tx: inner}
+
+		if err := tx.Exec(context.Background(), "CREATE TABLE users (id INT)"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := tx.Commit(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if !inner.committed {
+			t.Error("expected transaction to be committed")
+		}
+		if len(inner.queries) != 2 || inner.queries[1] != "RESET ROLE" {
+			t.Errorf("expected RESET ROLE before commit, got %v", inner.queries)
+		}
+	})
+
+	t.Run("pass queries and results through", func(t *testing.T) {
+		ctx := context.Background()
+		tx := roleTx{Tx: &MockTx{dialect: &MockDialect{queryResults: map[string]interface{}{"SELECT 1": int64(1)}}}}
+		if value, err := tx.QueryValue(ctx, "SELECT 1"); err != nil || value != int64(1) {
+			t.Errorf("expected the query result, got %v %v", value, err)
+		}
+
+		// transactions of WithExecFunc may not report results
+		inner := &recordingTx{}
+		res, err := roleTx{Tx: inner}.ExecResult(ctx, "UPDATE users SET active = true")
+		if err != nil || res != driver.ResultNoRows || len(inner.queries) != 1 {
+			t.Errorf("expected the statement to run without results, got %v %v %v", res, err, inner.queries)
+		}
+	})
+}
+
+// Test setting the statement timeout of Postgres transactions
+func TestPostgresDialectStatementTimeout(t *testing.T) {
+	var tx *recordingTx
+	begin := func(ctx context.Context) (Tx, error) {
+		tx = &recordingTx{}
+		return tx, nil
+	}
+
+	dialect := NewPostgresDialect(nil, "", WithExecFunc(nil, nil, begin), WithStatementTimeout(90*time.Second), WithRole("owner"))
+	if _, err := dialect.BeginTx(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(tx.queries) != "[SET LOCAL statement_timeout = 90000 SET ROLE owner]" {
+		t.Errorf("expected the timeout in milliseconds, got %v", tx.queries)
+	}
+
+	for _, timeout := range []time.Duration{-time.Second, 1500 * time.Microsecond} {
+		dialect := NewPostgresDialect(nil, "", WithExecFunc(nil, nil, begin), WithStatementTimeout(timeout))
+		if _, err := dialect.BeginTx(context.Background()); err == nil {
+			t.Errorf("expected error for timeout %s", timeout)
+		}
+	}
+}
+
+type fakePostgresDriver struct{}
+
+func (fakePostgresDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("not implemented")
+}
+
+type fakeSQLiteDriver struct{}
+
+func (fakeSQLiteDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("not implemented")
+}
+
+type fakeLibSQLDriver struct{}
+
+func (fakeLibSQLDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("not implemented")
+}
+
+type fakeUnknownDriver struct{}
+
+func (fakeUnknownDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("not implemented")
+}
+
+func init() {
+	sql.Register("postgres", fakePostgresDriver{})
+	sql.Register("sqlite3", fakeSQLiteDriver{})
+	sql.Register("libsql", fakeLibSQLDriver{})
+	sql.Register("fakedb", fakeUnknownDriver{})
+	sql.Register("pq-alias", fakePostgresDriver{})
+
+	driverDialects["github.com/mkozhukh/migrate.fakePostgresDriver"] = "postgres"
+	driverDialects["github.com/mkozhukh/migrate.fakeSQLiteDriver"] = "sqlite"
+	driverDialects["github.com/mkozhukh/migrate.fakeLibSQLDriver"] = "libsql"
+}
+
+// Test detection of the dialect from the database driver
+func TestDetectDialect(t *testing.T) {
+	tests := []struct {
+		driver      string
+		expected    string
+		expectError bool
+	}{
+		{driver: "postgres", expected: "*migrate.PostgresDialect"},
+		{driver: "sqlite3", expected: "*migrate.CommonDialect"},
+		{driver: "libsql", expected: "*migrate.LibSQLDialect"},
+		{driver: "pq-alias", expected: "*migrate.PostgresDialect"},
+		{driver: "fakedb", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.driver, func(t *testing.T) {
+			db, err := sql.Open(tt.driver, "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer db.Close()
+
+			dialect, err := DetectDialect(db, "")
+			if tt.expectError {
+				if err == nil {
+					t.Error("expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := fmt.Sprintf("%T", dialect); got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+type recordingArgsTx struct {
+	recordingTx
+	args [][]interface{}
+}
+
+func (tx *recordingArgsTx) Exec(ctx context.Context, query string, args ...interface{}) error {
+	tx.args = append(tx.args, args)
+	return tx.recordingTx.Exec(ctx, query, args...)
+}
+
+// Test multi-row inserts of applied migrations
+func TestDialectStoreAppliedMigrations(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialect  Dialect
+		expected []string
+	}{
+		{
+			name:    "common",
+			dialect: NewCommonDialect(nil, "", WithBatchSize(2)),
+			expected: []string{
+				"INSERT INTO schema_migrations (version) VALUES (?), (?)",
+				"INSERT INTO schema_migrations (version) VALUES (?)",
+			},
+		},
+		{
+			name:    "postgres",
+			dialect: NewPostgresDialect(nil, "", WithBatchSize(2)),
+			expected: []string{
+				"INSERT INTO schema_migrations (version) VALUES ($1), ($2)",
+				"INSERT INTO schema_migrations (version) VALUES ($1)",
+			},
+		},
+		{
+			name:    "fallback to single inserts",
+			dialect: &MockDialect{},
+		},
+	}
+
+	versions := []string{"001", "002", "003"}
+	records := []AppliedRecord{{Version: "001"}, {Version: "002"}, {Version: "003"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := &recordingArgsTx{}
+			if err := storeAppliedMigrations(context.Background(), tt.dialect, tx, records); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if mock, ok := tt.dialect.(*MockDialect); ok {
+				if fmt.Sprint(mock.storedMigrations) != fmt.Sprint(versions) {
+					t.Errorf("expected %v to be stored, got %v", versions, mock.storedMigrations)
+				}
+				return
+			}
+
+			if fmt.Sprint(tx.queries) != fmt.Sprint(tt.expected) {
+				t.Errorf("expected queries %q, got %q", tt.expected, tx.queries)
+			}
+			if fmt.Sprint(tx.args) != "[[001 002] [003]]" {
+				t.Errorf("unexpected args %v", tx.args)
+			}
+		})
+	}
+}
+
+// Test recording applied migrations with their time and checksum
+func TestDialectStoreAppliedMigrationsTimed(t *testing.T) {
+	ctx := context.Background()
+	dialect := NewPostgresDialect(nil, "", WithChecksums(), WithBatchSize(3))
+	at := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	records := []AppliedRecord{
+		{Version: "001", Checksum: "a", AppliedAt: at},
+		{Version: "002", Checksum: "b", AppliedAt: at},
+		{Version: "003", Checksum: "c"},
+	}
+
+	tx := &recordingArgsTx{}
+	if err := dialect.StoreAppliedMigrations(ctx, tx, records); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := dialect.StoreAppliedMigration(ctx, tx, records[0]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"INSERT INTO schema_migrations (version, checksum, applied_at) VALUES ($1, $2, $3), ($4, $5, $6)",
+		"INSERT INTO schema_migrations (version, checksum) VALUES ($1, $2)",
+		"INSERT INTO schema_migrations (version, checksum, applied_at) VALUES ($1, $2, $3)",
+	}
+	if fmt.Sprintf("%q", tx.queries) != fmt.Sprintf("%q", expected) {
+		t.Errorf("expected queries %q, got %q", expected, tx.queries)
+	}
+	if tx.args[0][2] != at || tx.args[1][1] != "c" {
+		t.Errorf("unexpected args %v", tx.args)
+	}
+}
+
+// Test configuration of the Postgres lock key
+func TestPostgresDialectLockKey(t *testing.T) {
+	if key := NewPostgresDialect(nil, "").LockKey; key != 6492640049987603658 {
+		t.Errorf("unexpected default lock key %d", key)
+	}
+	if key := NewPostgresDialect(nil, "", WithLockKey(42)).LockKey; key != 42 {
+		t.Errorf("expected lock key 42, got %d", key)
+	}
+
+	billing := NewPostgresDialect(nil, "", WithLockNamespace("billing")).LockKey
+	if billing != int(LockKeyFromNamespace("billing")) {
+		t.Errorf("expected lock key of the namespace, got %d", billing)
+	}
+	if billing == NewPostgresDialect(nil, "", WithLockNamespace("users")).LockKey {
+		t.Error("expected different namespaces to use different keys")
+	}
+	// the hash of an empty namespace is the FNV-1a 64 offset basis
+	if LockKeyFromNamespace("") != -3750763034362895579 {
+		t.Errorf("unexpected hash %d", LockKeyFromNamespace(""))
+	}
+}
+
+// Test lock keys derived from the migration history
+func TestPostgresDialectLockPerNamespace(t *testing.T) {
+	billing := NewPostgresDialect(nil, "billing_migrations", WithLockPerNamespace())
+	if billing.LockKey != int(LockKeyFromNamespace("billing_migrations")) {
+		t.Errorf("expected lock key of the table, got %d", billing.LockKey)
+	}
+	if billing.LockKey == NewPostgresDialect(nil, "users_migrations", WithLockPerNamespace()).LockKey {
+		t.Error("expected different tables to use different keys")
+	}
+	if billing.LockKey != NewPostgresDialect(nil, "billing_migrations", WithLockPerNamespace()).LockKey {
+		t.Error("expected the same table to use the same key")
+	}
+
+	staging := NewPostgresDialect(nil, "billing_migrations", WithLockPerNamespace(), WithEnvironment("staging"))
+	if staging.LockKey != int(LockKeyFromNamespace("billing_migrations/staging")) {
+		t.Errorf("expected lock key of the environment, got %d", staging.LockKey)
+	}
+
+	suffixed := billing.WithTableSuffix("blue").(*PostgresDialect)
+	if suffixed.LockKey != int(LockKeyFromNamespace("billing_migrations_blue")) {
+		t.Errorf("expected lock key of the suffixed table, got %d", suffixed.LockKey)
+	}
+
+	explicit := NewPostgresDialect(nil, "billing_migrations", WithLockPerNamespace(), WithLockKey(42))
+	if explicit.LockKey != 42 || explicit.WithTableSuffix("blue").(*PostgresDialect).LockKey != 42 {
+		t.Errorf("expected the explicit lock key to take precedence, got %d", explicit.LockKey)
+	}
+	if key := NewPostgresDialect(nil, "").WithTableSuffix("blue").(*PostgresDialect).LockKey; key != 6492640049987603658 {
+		t.Errorf("expected the default lock key to be kept, got %d", key)
+	}
+}
+
+// Test scoping of the migrations table to an environment
+func TestDialectEnvironment(t *testing.T) {
+	dialect := NewPostgresDialect(nil, "", WithEnvironment("staging"))
+
+	for _, expected := range []string{"env VARCHAR(255) NOT NULL", "version VARCHAR(255) NOT NULL", "PRIMARY KEY (env, version)"} {
+		if !strings.Contains(dialect.CreateMigrationsTableSQL, expected) {
+			t.Errorf("expected DDL to contain %q, got %q", expected, dialect.CreateMigrationsTableSQL)
+		}
+	}
+	if dialect.GetAppliedMigrationsSQL != "SELECT version FROM schema_migrations WHERE env = $1" {
+		t.Errorf("unexpected select %q", dialect.GetAppliedMigrationsSQL)
+	}
+	if dialect.appliedSQL != "SELECT version, applied_at FROM schema_migrations WHERE env = $1" {
+		t.Errorf("unexpected detailed select %q", dialect.appliedSQL)
+	}
+
+	tx := &recordingArgsTx{}
+	ctx := context.Background()
+	if err := dialect.StoreAppliedMigration(ctx, tx, AppliedRecord{Version: "001"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := dialect.DeleteAppliedMigration(ctx, tx, "001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := dialect.StoreAppliedMigrations(ctx, tx, []AppliedRecord{{Version: "002"}, {Version: "003"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"INSERT INTO schema_migrations (version, env) VALUES ($1, $2)",
+		"DELETE FROM schema_migrations WHERE version = $1 AND env = $2",
+		"INSERT INTO schema_migrations (version, env) VALUES ($1, $2), ($3, $4)",
+	}
+	if fmt.Sprintf("%q", tx.queries) != fmt.Sprintf("%q", expected) {
+		t.Errorf("expected queries %q, got %q", expected, tx.queries)
+	}
+	if fmt.Sprint(tx.args) != "[[001 staging] [001 staging] [002 staging 003 staging]]" {
+		t.Errorf("unexpected args %v", tx.args)
+	}
+}
+
+// Test custom names of the migrations table columns
+func TestDialectColumnNames(t *testing.T) {
+	dialect := NewPostgresDialect(nil, "", WithVersionColumn("migration_name"), WithTimestampColumn("executed_at"), WithEnvironment("prod"))
+
+	for _, expected := range []string{"migration_name VARCHAR(255) NOT NULL", "executed_at TIMESTAMP WITH TIME ZONE", "PRIMARY KEY (env, migration_name)"} {
+		if !strings.Contains(dialect.CreateMigrationsTableSQL, expected) {
+			t.Errorf("expected DDL to contain %q, got %q", expected, dialect.CreateMigrationsTableSQL)
+		}
+	}
+	if strings.Contains(dialect.CreateMigrationsTableSQL, "applied_at") {
+		t.Errorf("default timestamp column should not be used, got %q", dialect.CreateMigrationsTableSQL)
+	}
+
+	queries := []string{dialect.GetAppliedMigrationsSQL, dialect.appliedSQL, dialect.ApplyMigrationSQL, dialect.DeleteMigrationSQL}
+	expected := []string{
+		"SELECT migration_name FROM schema_migrations WHERE env = $1",
+		"SELECT migration_name, executed_at FROM schema_migrations WHERE env = $1",
+		"INSERT INTO schema_migrations (migration_name, env) VALUES ($1, $2)",
+		"DELETE FROM schema_migrations WHERE migration_name = $1 AND env = $2",
+	}
+	if fmt.Sprintf("%q", queries) != fmt.Sprintf("%q", expected) {
+		t.Errorf("expected queries %q, got %q", expected, queries)
+	}
+
+	tx := &recordingArgsTx{}
+	if err := dialect.StoreAppliedMigrations(context.Background(), tx, []AppliedRecord{{Version: "001"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tx.queries[0] != "INSERT INTO schema_migrations (migration_name, env) VALUES ($1, $2)" {
+		t.Errorf("unexpected batch insert %q", tx.queries[0])
+	}
+
+	sqlite := NewSQLiteDialect(nil, "", WithVersionColumn("migration_name"))
+	if !strings.Contains(sqlite.CreateMigrationsTableSQL, "migration_name TEXT PRIMARY KEY") {
+		t.Errorf("unexpected SQLite DDL %q", sqlite.CreateMigrationsTableSQL)
+	}
+
+	invalid := NewSQLiteDialect(nil, "", WithTimestampColumn("applied_at; DROP TABLE users"))
+	if err := invalid.CreateMigrationsTable(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid column name") {
+		t.Errorf("expected invalid column error, got %v", err)
+	}
+	if _, err := invalid.GetAppliedMigrations(context.Background()); err == nil {
+		t.Error("expected invalid column error")
+	}
+}
+
+// Test the in-process lock of the libSQL dialect
+func TestLibSQLDialectLock(t *testing.T) {
+	dialect := NewLibSQLDialect(nil, "")
+	if !strings.Contains(dialect.CreateMigrationsTableSQL, "version TEXT PRIMARY KEY") {
+		t.Errorf("expected SQLite DDL, got %q", dialect.CreateMigrationsTableSQL)
+	}
+
+	if err := dialect.Lock(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := dialect.Lock(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected second lock to wait, got %v", err)
+	}
+
+	if err := dialect.Unlock(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := dialect.Unlock(context.Background()); err != nil {
+		t.Fatalf("second unlock should be a no-op, got %v", err)
+	}
+	if err := dialect.Lock(context.Background()); err != nil {
+		t.Errorf("expected lock to be free after unlock, got %v", err)
+	}
+}
+
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "pq: error " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+// Test detection of PostgreSQL deadlocks
+func TestPostgresIsDeadlock(t *testing.T) {
+	dialect := NewPostgresDialect(nil, "")
+
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{sqlStateError("40P01"), true},
+		{fmt.Errorf("failed to execute migration: %w", sqlStateError("40P01")), true},
+		{sqlStateError("42P01"), false},
+		{errors.New("pq: deadlock detected"), true},
+		{errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := dialect.IsDeadlock(tt.err); got != tt.expected {
+			t.Errorf("IsDeadlock(%v) = %v, expected %v", tt.err, got, tt.expected)
+		}
+	}
+}
+
+// Test classification of driver errors
+func TestDialectClassifyError(t *testing.T) {
+	postgres := NewPostgresDialect(nil, "")
+	sqlite := NewSQLiteDialect(nil, "")
+
+	tests := []struct {
+		dialect  ErrorClassifier
+		err      error
+		expected ErrorClass
+	}{
+		{postgres, sqlStateError("23505"), ErrorUniqueViolation},
+		{postgres, fmt.Errorf("failed to execute migration: %w", sqlStateError("55P03")), ErrorLockTimeout},
+		{postgres, sqlStateError("40P01"), ErrorDeadlock},
+		{postgres, sqlStateError("42601"), ErrorSyntax},
+		{postgres, sqlStateError("42P01"), ErrorUnknown},
+		{postgres, errors.New("pq: duplicate key value violates unique constraint \"users_pkey\""), ErrorUniqueViolation},
+		{sqlite, errors.New("UNIQUE constraint failed: users.email"), ErrorUniqueViolation},
+		{sqlite, errors.New("database is locked"), ErrorLockTimeout},
+		{sqlite, errors.New(`near "CREAT": syntax error`), ErrorSyntax},
+		{sqlite, errors.New("connection refused"), ErrorUnknown},
+		{sqlite, nil, ErrorUnknown},
+	}
+	for _, tt := range tests {
+		if got := tt.dialect.ClassifyError(tt.err); got != tt.expected {
+			t.Errorf("ClassifyError(%v) = %q, expected %q", tt.err, got, tt.expected)
+		}
+	}
+}
+
+// Test the statements of the checkpoints table
+func TestDialectCheckpoints(t *testing.T) {
+	var queries []string
+	var args [][]interface{}
+	dialect := NewPostgresDialect(nil, "migrations", WithEnvironment("staging"))
+	dialect.SetExecutor(func(ctx context.Context, query string, a ...interface{}) error {
+		queries = append(queries, strings.Join(strings.Fields(query), " "))
+		args = append(args, a)
+		return nil
+	})
+
+	if err := dialect.CreateCheckpointsTable(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := dialect.DeleteCheckpoint(context.Background(), "001_backfill"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, expected := range []string{"CREATE TABLE IF NOT EXISTS migrations_checkpoints", "cursor_value TEXT NOT NULL", "PRIMARY KEY (env, version)"} {
+		if !strings.Contains(queries[0], expected) {
+			t.Errorf("expected DDL to contain %q, got %q", expected, queries[0])
+		}
+	}
+	if queries[1] != "DELETE FROM migrations_checkpoints WHERE env = $1 AND version = $2" || fmt.Sprint(args[1]) != "[staging 001_backfill]" {
+		t.Errorf("unexpected delete %q %v", queries[1], args[1])
+	}
+}
+
+// Test tracing the statements issued by the dialect
+func TestDialectTraceSQL(t *testing.T) {
+	var traced []string
+	dialect := NewPostgresDialect(nil, "", WithTraceSQL(func(query string, args []interface{}) {
+		traced = append(traced, fmt.Sprint(strings.Join(strings.Fields(query), " "), " ", args))
+	}))
+	dialect.SetExecutor(func(ctx context.Context, query string, args ...interface{}) error {
+		return nil
+	})
+
+	ctx := context.Background()
+	if err := dialect.CreateMigrationsTable(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := dialect.Lock(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := dialect.ExecContext(ctx, "CREATE INDEX CONCURRENTLY a ON t (a)"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := dialect.Unlock(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"CREATE TABLE IF NOT EXISTS schema_migrations ( version VARCHAR(255) PRIMARY KEY, applied_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP ) []",
+		"SELECT pg_advisory_lock($1) [6492640049987603658]",
+		"CREATE INDEX CONCURRENTLY a ON t (a) []",
+		"SELECT pg_advisory_unlock($1) [6492640049987603658]",
+	}
+	if fmt.Sprintf("%q", traced) != fmt.Sprintf("%q", expected) {
+		t.Errorf("expected traced statements %q, got %q", expected, traced)
+	}
+}
+
+// Test the query of the recently applied migrations
+func TestDialectRecentMigrationsSQL(t *testing.T) {
+	if query := NewCommonDialect(nil, "").recentMigrationsSQL(5); query != "SELECT version, applied_at FROM schema_migrations ORDER BY applied_at DESC, version DESC LIMIT 5" {
+		t.Errorf("unexpected query %q", query)
+	}
+	query := NewPostgresDialect(nil, "", WithEnvironment("staging"), WithTimestampColumn("run_at")).recentMigrationsSQL(3)
+	if query != "SELECT version, run_at FROM schema_migrations WHERE env = $1 ORDER BY run_at DESC, version DESC LIMIT 3" {
+		t.Errorf("unexpected query %q", query)
+	}
+}
+
+// Test which dialects roll back schema changes with the transaction
+func TestDialectTransactionalDDL(t *testing.T) {
+	dialects := map[string]TransactionalDDL{
+		"generic":  NewCommonDialect(nil, ""),
+		"postgres": NewPostgresDialect(nil, ""),
+		"sqlite":   NewSQLiteDialect(nil, ""),
+		"libsql":   NewLibSQLDialect(nil, ""),
+	}
+	for name, dialect := range dialects {
+		if dialect.TransactionalDDL() != (name != "generic") {
+			t.Errorf("unexpected transactional DDL of the %s dialect: %v", name, dialect.TransactionalDDL())
+		}
+	}
+	if !NewPostgresDialect(nil, "").WithTableSuffix("tenant").(TransactionalDDL).TransactionalDDL() {
+		t.Error("expected the suffixed dialect to keep transactional DDL")
+	}
+}
+
+// Test the dirty table, which exists only with dirty tracking
+func TestDialectDirtyTracking(t *testing.T) {
+	var queries []string
+	executor := func(ctx context.Context, query string, args ...interface{}) error {
+		queries = append(queries, strings.Join(strings.Fields(query), " "))
+		return nil
+	}
+	ctx := context.Background()
+
+	dialect := NewPostgresDialect(nil, "migrations")
+	dialect.SetExecutor(executor)
+	if err := dialect.CreateMigrationsTable(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dirty, err := dialect.GetDirty(ctx); dirty != "" || err != nil {
+		t.Errorf("expected clean state without tracking, got %q %v", dirty, err)
+	}
+	if err := dialect.ClearDirty(ctx); err != nil || len(queries) != 1 {
+		t.Errorf("expected only the migrations table, got %q", queries)
+	}
+
+	queries = nil
+	dialect = NewPostgresDialect(nil, "migrations", WithDirtyTracking())
+	dialect.SetExecutor(executor)
+	if err := dialect.CreateMigrationsTable(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := dialect.ClearDirty(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(queries) != 3 || !strings.HasPrefix(queries[1], "CREATE TABLE IF NOT EXISTS migrations_dirty ( env VARCHAR(255) NOT NULL DEFAULT '' PRIMARY KEY") {
+		t.Fatalf("unexpected queries %q", queries)
+	}
+	if queries[2] != "DELETE FROM migrations_dirty WHERE env = $1" {
+		t.Errorf("unexpected clear %q", queries[2])
+	}
+}
+
+// Test reading the details of the applied migrations
+func TestDialectGetApplied(t *testing.T) {
+	var queried []string
+	query := func(ctx context.Context, query string, args ...interface{}) ([][]interface{}, error) {
+		queried = append(queried, query)
+		return [][]interface{}{
+			{"001_create_users", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), []byte("abc")},
+			{[]byte("002_add_email"), "2024-01-03 04:05:06", nil},
+		}, nil
+	}
+	dialect := NewPostgresDialect(nil, "", WithExecFunc(nil, query, nil), WithChecksums())
+
+	applied, err := dialect.GetApplied(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(queried) != "[SELECT version, applied_at, checksum FROM schema_migrations]" {
+		t.Errorf("unexpected queries %q", queried)
+	}
+	expected := []AppliedMigration{
+		{Version: "001_create_users", AppliedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Checksum: "abc"},
+		{Version: "002_add_email", AppliedAt: time.Date(2024, 1, 3, 4, 5, 6, 0, time.UTC)},
+	}
+	if fmt.Sprint(applied) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, applied)
+	}
+
+	versions, err := dialect.GetAppliedMigrations(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(versions) != "[001_create_users 002_add_email]" {
+		t.Errorf("unexpected versions %v", versions)
+	}
+	if queried[1] != "SELECT version FROM schema_migrations" {
+		t.Errorf("expected the versions to be read with the one-column query, got %q", queried[1])
+	}
+
+	// a custom query of the versions keeps returning one column
+	query = func(ctx context.Context, query string, args ...interface{}) ([][]interface{}, error) {
+		return [][]interface{}{{"001_create_users"}}, nil
+	}
+	dialect = NewPostgresDialect(nil, "", WithExecFunc(nil, query, nil))
+	dialect.GetAppliedMigrationsSQL = "SELECT version FROM schema_migrations WHERE version > '000'"
+	if versions, err := dialect.GetAppliedMigrations(context.Background()); err != nil || fmt.Sprint(versions) != "[001_create_users]" {
+		t.Errorf("unexpected versions %v %v", versions, err)
+	}
+}
+
+// Test routing the statements of a dialect through custom functions
+func TestDialectExecFunc(t *testing.T) {
+	var executed, queried []string
+	var transactions []*recordingTx
+	dialect := NewPostgresDialect(nil, "", WithExecFunc(
+		func(ctx context.Context, query string, args ...interface{}) error {
+			executed = append(executed, strings.Join(strings.Fields(query), " "))
+			return nil
+		},
+		func(ctx context.Context, query string, args ...interface{}) ([][]interface{}, error) {
+			queried = append(queried, query)
+			if strings.Contains(query, "ORDER BY") {
+				return [][]interface{}{{"002_add_email", "2024-01-02 03:04:05"}}, nil
+			}
+			return [][]interface{}{{[]byte("001_create_users"), nil}, {"002_add_email", nil}}, nil
+		},
+		func(ctx context.Context) (Tx, error) {
+			tx := &recordingTx{}
+			transactions = append(transactions, tx)
+			return tx, nil
+		},
+	))
+
+	source := &MockSource{migrations: []Migration{
+		{Version: "001_create_users", Content: []byte("CREATE TABLE users (id INT)")},
+		{Version: "002_add_email", Content: []byte("ALTER TABLE users ADD COLUMN email TEXT")},
+		{Version: "003_add_index", Content: []byte("CREATE INDEX idx_users_email ON users(email)")},
+	}}
+	migrator := New(source, dialect, &MockLogger{})
+	if err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(executed) != 3 || !strings.HasPrefix(executed[0], "CREATE TABLE IF NOT EXISTS schema_migrations") || executed[1] != "SELECT pg_advisory_lock($1)" {
+		t.Errorf("unexpected statements %q", executed)
+	}
+	if fmt.Sprint(queried) != "[SELECT version FROM schema_migrations]" {
+		t.Errorf("unexpected queries %q", queried)
+	}
+	if len(transactions) != 1 || !transactions[0].committed {
+		t.Fatalf("expected a committed transaction, got %d", len(transactions))
+	}
+	expected := []string{"CREATE INDEX idx_users_email ON users(email)", "INSERT INTO schema_migrations (version) VALUES ($1)"}
+	if fmt.Sprintf("%q", transactions[0].queries) != fmt.Sprintf("%q", expected) {
+		t.Errorf("expected %q, got %q", expected, transactions[0].queries)
+	}
+
+	recent, err := migrator.StatusRecent(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(recent) != 1 || recent[0].AppliedAt != time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) {
+		t.Errorf("unexpected recent migrations %v", recent)
+	}
+}
+
+// Test the checksum column of the migrations table
+func TestDialectChecksums(t *testing.T) {
+	if strings.Contains(NewCommonDialect(nil, "").CreateMigrationsTableSQL, "checksum") {
+		t.Error("expected no checksum column by default")
+	}
+
+	dialect := NewPostgresDialect(nil, "", WithChecksums(), WithEnvironment("staging"))
+	if !strings.Contains(dialect.CreateMigrationsTableSQL, "checksum VARCHAR(64)") {
+		t.Errorf("expected checksum column, got %q", dialect.CreateMigrationsTableSQL)
+	}
+
+	tx := &recordingArgsTx{}
+	if err := dialect.StoreAppliedMigration(context.Background(), tx, AppliedRecord{Version: "001", Checksum: "abc"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(tx.queries) != "[INSERT INTO schema_migrations (version, env, checksum) VALUES ($1, $2, $3)]" || fmt.Sprint(tx.args) != "[[001 staging abc]]" {
+		t.Errorf("unexpected insert %q %v", tx.queries, tx.args)
+	}
+}
+
+func TestDialectDurations(t *testing.T) {
+	if strings.Contains(NewCommonDialect(nil, "").CreateMigrationsTableSQL, "duration_ms") {
+		t.Error("expected no duration column by default")
+	}
+
+	dialect := NewPostgresDialect(nil, "", WithDurations(), WithChecksums())
+	if !strings.Contains(dialect.CreateMigrationsTableSQL, "duration_ms BIGINT") {
+		t.Errorf("expected duration column, got %q", dialect.CreateMigrationsTableSQL)
+	}
+
+	tx := &recordingArgsTx{}
+	record := AppliedRecord{Version: "001", Duration: 1500 * time.Millisecond, Checksum: "abc"}
+	if err := dialect.StoreAppliedMigration(context.Background(), tx, record); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(tx.queries) != "[INSERT INTO schema_migrations (version, checksum, duration_ms) VALUES ($1, $2, $3)]" || fmt.Sprint(tx.args) != "[[001 abc 1500]]" {
+		t.Errorf("unexpected insert %q %v", tx.queries, tx.args)
+	}
+}
+
+func TestDialectReleases(t *testing.T) {
+	if strings.Contains(NewCommonDialect(nil, "").CreateMigrationsTableSQL, "release_id") {
+		t.Error("expected no release column by default")
+	}
+
+	query := func(ctx context.Context, query string, args ...interface{}) ([][]interface{}, error) {
+		return [][]interface{}{{"001", nil, "abc", "build-1234"}, {"002", nil, nil, nil}}, nil
+	}
+	dialect := NewPostgresDialect(nil, "", WithReleases(), WithChecksums(), WithExecFunc(nil, query, nil))
+	if !strings.Contains(dialect.CreateMigrationsTableSQL, "release_id VARCHAR(255)") {
+		t.Errorf("expected release column, got %q", dialect.CreateMigrationsTableSQL)
+	}
+
+	tx := &recordingArgsTx{}
+	for _, record := range []AppliedRecord{{Version: "001", Checksum: "abc", Release: "build-1234"}, {Version: "002", Checksum: "def"}} {
+		if err := dialect.StoreAppliedMigration(context.Background(), tx, record); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if tx.queries[0] != "INSERT INTO schema_migrations (version, checksum, release_id) VALUES ($1, $2, $3)" || fmt.Sprint(tx.args) != "[[001 abc build-1234] [002 def <nil>]]" {
+		t.Errorf("unexpected insert %q %v", tx.queries, tx.args)
+	}
+
+	applied, err := dialect.GetApplied(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dialect.appliedSQL != "SELECT version, applied_at, checksum, release_id FROM schema_migrations" {
+		t.Errorf("unexpected select %q", dialect.appliedSQL)
+	}
+	if len(applied) != 2 || applied[0].Release != "build-1234" || applied[0].Checksum != "abc" || applied[1].Release != "" {
+		t.Errorf("unexpected applied migrations %+v", applied)
+	}
+}
+
+func TestDialectTableSuffix(t *testing.T) {
+	dialect := NewPostgresDialect(nil, "", WithEnvironment("prod"), WithDirtyTracking())
+	suffixed, ok := dialect.WithTableSuffix("blue").(*PostgresDialect)
+	if !ok {
+		t.Fatal("expected a PostgresDialect")
+	}
+	if suffixed.GetAppliedMigrationsSQL != "SELECT version FROM schema_migrations_blue WHERE env = $1" {
+		t.Errorf("unexpected select %q", suffixed.GetAppliedMigrationsSQL)
+	}
+	if suffixed.dirtyTable() != "schema_migrations_blue_dirty" || suffixed.LockKey != dialect.LockKey {
+		t.Errorf("unexpected suffixed dialect %q %d", suffixed.dirtyTable(), suffixed.LockKey)
+	}
+	if dialect.GetAppliedMigrationsSQL != "SELECT version FROM schema_migrations WHERE env = $1" {
+		t.Errorf("expected the original dialect to be unchanged, got %q", dialect.GetAppliedMigrationsSQL)
+	}
+
+	libsql := NewLibSQLDialect(nil, "migrations")
+	if suffixed := libsql.WithTableSuffix("green").(*LibSQLDialect); suffixed.tableName != "migrations_green" || suffixed.lock != libsql.lock {
+		t.Errorf("expected a suffixed table sharing the lock, got %q", suffixed.tableName)
+	}
+}
@@ -0,0 +1,184 @@
+package migrate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationDirectives holds the directives declared in the migration content
+type migrationDirectives struct {
+	// Verify holds queries that must return a truthy value after the migration
+	Verify []string
+	// Requires holds versions of migrations that must be applied before
+	Requires []string
+	// Session holds statements executed in the transaction before the migration
+	Session []string
+	// Refresh holds statements executed once after all migrations of a run
+	Refresh []string
+	// SkipIf holds a query, the migration body is skipped when it returns a
+	// truthy value
+	SkipIf string
+	// NoTrack executes the migration without recording it as applied
+	NoTrack bool
+	// Label is a name the migration can be targeted by, like a release
+	Label string
+	// NoTransaction holds the directions which run without a transaction,
+	// an empty direction is the direction of the file
+	NoTransaction []string
+}
+
+// parseMigrationDirectives collects the known directives of the migration
+// content, unknown directives are ignored
+func parseMigrationDirectives(content []byte) (migrationDirectives, error) {
+	var res migrationDirectives
+	for _, d := range parseDirectives(string(content)) {
+		switch d.Name {
+		case "verify":
+			if d.Args == "" {
+				return res, errors.New("verify directive requires a query")
+			}
+			res.Verify = append(res.Verify, d.Args)
+		case "session":
+			if d.Args == "" {
+				return res, errors.New("session directive requires a statement")
+			}
+			res.Session = append(res.Session, d.Args)
+		case "skip-if":
+			if d.Args == "" {
+				return res, errors.New("skip-if directive requires a query")
+			}
+			if res.SkipIf != "" {
+				return res, errors.New("only one skip-if directive is allowed")
+			}
+			res.SkipIf = d.Args
+		case "refresh-after":
+			if d.Args == "" {
+				return res, errors.New("refresh-after directive requires a statement")
+			}
+			res.Refresh = append(res.Refresh, d.Args)
+		case "label":
+			if d.Args == "" {
+				return res, errors.New("label directive requires a name")
+			}
+			if res.Label != "" {
+				return res, errors.New("only one label directive is allowed")
+			}
+			res.Label = d.Args
+		case "no-track":
+			res.NoTrack = true
+		case "no-transaction":
+			if d.Args != "" && d.Args != DirectionUp && d.Args != DirectionDown {
+				return res, fmt.Errorf("no-transaction directive accepts %s or %s, got %q", DirectionUp, DirectionDown, d.Args)
+			}
+			res.NoTransaction = append(res.NoTransaction, d.Args)
+		case "requires":
+			for _, version := range strings.Split(d.Args, ",") {
+				if version = strings.TrimSpace(version); version != "" {
+					res.Requires = append(res.Requires, version)
+				}
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// noTransaction reports whether the directives of the file of the direction
+// exclude the direction from a transaction
+func (d migrationDirectives) noTransaction(file, direction string) bool {
+	for _, scope := range d.NoTransaction {
+		if scope == direction || scope == "" && file == direction {
+			return true
+		}
+	}
+	return false
+}
+
+// noTransaction reports whether the migration runs without a transaction in
+// the direction, by its metadata header or the no-transaction directives of
+// either file. Invalid directives are reported when the content is applied.
+func noTransaction(migration Migration, direction string) bool {
+	if migration.NoTransaction {
+		return true
+	}
+	up, _ := parseMigrationDirectives(migration.Content)
+	down, _ := parseMigrationDirectives(migration.DownContent)
+	return up.noTransaction(DirectionUp, direction) || down.noTransaction(DirectionDown, direction)
+}
+
+// migrationMetadata is the JSON metadata header of a migration, a directive
+// like `-- migrate: {"transaction": false, "tags": ["schema"], "timeout": "5m"}`
+type migrationMetadata struct {
+	Transaction *bool    `json:"transaction"`
+	Tags        []string `json:"tags"`
+	Timeout     string   `json:"timeout"`
+}
+
+// parseMetadata reads the metadata header of the migration content into the
+// migration fields. Content without a header leaves the migration unchanged.
+func parseMetadata(migration *Migration, content []byte) error {
+	var header string
+	for _, d := range parseDirectives(string(content)) {
+		text := strings.TrimSpace(d.Name + " " + d.Args)
+		if !strings.HasPrefix(text, "{") {
+			continue
+		}
+		if header != "" {
+			return errors.New("more than one metadata header")
+		}
+		header = text
+	}
+	if header == "" {
+		return nil
+	}
+
+	var meta migrationMetadata
+	decoder := json.NewDecoder(bytes.NewReader([]byte(header)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&meta); err != nil {
+		return fmt.Errorf("malformed metadata header: %w", err)
+	}
+
+	if meta.Timeout != "" {
+		timeout, err := time.ParseDuration(meta.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q in metadata header", meta.Timeout)
+		}
+		migration.Timeout = timeout
+	}
+	migration.NoTransaction = meta.Transaction != nil && !*meta.Transaction
+	migration.Tags = meta.Tags
+
+	return nil
+}
+
+// isTruthy reports whether a value returned by a query counts as true
+func isTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	case []byte:
+		return isTruthy(string(v))
+	case string:
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f != 0
+		}
+		return false
+	}
+
+	return true
+}
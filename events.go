@@ -0,0 +1,56 @@
+package migrate
+
+import "time"
+
+// EventType is the kind of an Event.
+type EventType string
+
+// Event types sent to the event channel.
+const (
+	// EventStart is sent when a run starts
+	EventStart EventType = "start"
+	// EventMigrationStart is sent before a migration is applied or rolled back
+	EventMigrationStart EventType = "migration_start"
+	// EventMigrationDone is sent after a migration was applied or rolled back
+	EventMigrationDone EventType = "migration_done"
+	// EventDone is sent when a run completes
+	EventDone EventType = "done"
+	// EventError is sent when a run fails, with the error
+	EventError EventType = "error"
+)
+
+// Event is a progress event of a run, see WithEventChannel.
+type Event struct {
+	Type EventType
+	// Version and Direction are set for migration events
+	Version   string
+	Direction string
+	// Err is set for EventError
+	Err       error
+	Timestamp time.Time
+}
+
+// WithEventChannel is an option that sends the progress events of the run
+// to the channel, e.g. to stream them to a deploy UI. Events are sent
+// without blocking: when the channel is full the event is dropped, so size
+// its buffer for the expected number of events. The caller owns the
+// channel, the migrator never closes it. Migration events are not sent
+// for dry runs.
+func WithEventChannel(events chan<- Event) Option {
+	return func(opts *RunOptions) {
+		opts.Events = events
+	}
+}
+
+// emit sends the event to the event channel, if any, dropping it when the
+// channel is full
+func (o *RunOptions) emit(event Event) {
+	if o.Events == nil {
+		return
+	}
+	event.Timestamp = time.Now()
+	select {
+	case o.Events <- event:
+	default:
+	}
+}
@@ -0,0 +1,94 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// eventSummary formats the events without timestamps
+func eventSummary(events <-chan Event) []string {
+	var res []string
+	for len(events) > 0 {
+		e := <-events
+		if e.Timestamp.IsZero() {
+			res = append(res, "missing timestamp")
+		}
+		s := string(e.Type)
+		if e.Version != "" {
+			s += " " + e.Direction + " " + e.Version
+		}
+		if e.Err != nil {
+			s += " err"
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// Test the progress events of runs
+func TestMigratorEventChannel(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("up and down", func(t *testing.T) {
+		events := make(chan Event, 100)
+		dialect := &trackingDialect{MockDialect: &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email"}}}
+		migrator := New(&MockSource{migrations: createTestMigrations()[:3]}, dialect, &MockLogger{})
+
+		if err := migrator.Up(ctx, WithEventChannel(events)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := migrator.DownOne(ctx, WithEventChannel(events), WithConfirmRollback()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		expected := []string{
+			"start",
+			"migration_start up 003_add_index",
+			"migration_done up 003_add_index",
+			"done",
+			"start",
+			"migration_start down 003_add_index",
+			"migration_done down 003_add_index",
+			"done",
+		}
+		if got := eventSummary(events); fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("expected events\n%v\ngot\n%v", expected, got)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		events := make(chan Event, 100)
+		dialect := &MockDialect{appliedMigrations: []string{}, execErrors: map[string]error{"ALTER TABLE users ADD COLUMN email VARCHAR(255)": errors.New("boom")}}
+		err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Up(ctx, WithEventChannel(events))
+		if err == nil {
+			t.Fatal("expected error but got none")
+		}
+
+		expected := []string{
+			"start",
+			"migration_start up 001_create_users",
+			"migration_done up 001_create_users",
+			"migration_start up 002_add_email",
+			"error err",
+		}
+		if got := eventSummary(events); fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("expected events\n%v\ngot\n%v", expected, got)
+		}
+	})
+
+	t.Run("full channel", func(t *testing.T) {
+		events := make(chan Event, 2)
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		if err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Up(ctx, WithEventChannel(events)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := eventSummary(events); fmt.Sprint(got) != "[start migration_start up 001_create_users]" {
+			t.Errorf("expected the first events only, got %v", got)
+		}
+		if len(dialect.storedMigrations) != 4 {
+			t.Errorf("expected the run not to block, got %v", dialect.storedMigrations)
+		}
+	})
+}
@@ -0,0 +1,37 @@
+//go:build failpoints
+
+package migrate
+
+import "sync"
+
+var (
+	failpointsMu sync.Mutex
+	failpoints   = map[string]map[int]error{}
+)
+
+// injectFailure makes the run fail with err before it applies or rolls back
+// the migration at the index, counted from 0 among the migrations the run
+// applies or rolls back. It is compiled only with the failpoints build tag
+// and meant for tests of partially applied runs. The returned function
+// removes the failure.
+func injectFailure(direction string, index int, err error) func() {
+	failpointsMu.Lock()
+	defer failpointsMu.Unlock()
+
+	if failpoints[direction] == nil {
+		failpoints[direction] = map[int]error{}
+	}
+	failpoints[direction][index] = err
+	return func() {
+		failpointsMu.Lock()
+		defer failpointsMu.Unlock()
+		delete(failpoints[direction], index)
+	}
+}
+
+// injectedFailure returns the failure injected at the index, if any
+func injectedFailure(direction string, index int) error {
+	failpointsMu.Lock()
+	defer failpointsMu.Unlock()
+	return failpoints[direction][index]
+}
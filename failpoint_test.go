@@ -0,0 +1,54 @@
+//go:build failpoints
+
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Test the applied state after a failure in the middle of a run
+func TestMigratorInjectedFailure(t *testing.T) {
+	ctx := context.Background()
+	errInjected := errors.New("injected")
+
+	t.Run("up", func(t *testing.T) {
+		remove := injectFailure(DirectionUp, 2, errInjected)
+		defer remove()
+
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Up(ctx)
+		if !errors.Is(err, errInjected) {
+			t.Fatalf("expected injected error, got %v", err)
+		}
+		if fmt.Sprint(dialect.storedMigrations) != "[001_create_users 002_add_email]" {
+			t.Fatalf("expected the migrations before the failure to be applied, got %v", dialect.storedMigrations)
+		}
+
+		// the next run resumes with the failed migration
+		remove()
+		dialect.appliedMigrations = dialect.storedMigrations
+		dialect.storedMigrations = nil
+		if err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Up(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fmt.Sprint(dialect.storedMigrations) != "[003_add_index 004_add_timestamp]" {
+			t.Errorf("expected the remaining migrations to be applied, got %v", dialect.storedMigrations)
+		}
+	})
+
+	t.Run("down", func(t *testing.T) {
+		defer injectFailure(DirectionDown, 1, errInjected)()
+
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email", "003_add_index"}}
+		err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Down(ctx, -1, WithConfirmRollback())
+		if !errors.Is(err, errInjected) {
+			t.Fatalf("expected injected error, got %v", err)
+		}
+		if fmt.Sprint(dialect.deletedMigrations) != "[003_add_index]" {
+			t.Errorf("expected only the last migration to be rolled back, got %v", dialect.deletedMigrations)
+		}
+	})
+}
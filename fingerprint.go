@@ -0,0 +1,149 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SchemaFingerprinter is implemented by dialects which can hash the schema
+// of the database and keep the hash of the last run, see
+// WithSchemaFingerprint.
+type SchemaFingerprinter interface {
+	CreateFingerprintTable(ctx context.Context) error
+	// SchemaFingerprint returns the hash of the current schema
+	SchemaFingerprint(ctx context.Context) (string, error)
+	// GetSchemaFingerprint returns the hash stored by the last run, or an
+	// empty string if there is none
+	GetSchemaFingerprint(ctx context.Context) (string, error)
+	StoreSchemaFingerprint(ctx context.Context, fingerprint string) error
+}
+
+// WithSchemaFingerprint is an option that detects changes to the schema made
+// outside of the migrations. The dialect hashes the schema after the run and
+// stores the hash, the next run compares it with the schema before applying
+// anything and logs a warning when someone altered the schema manually. With
+// WithStrict, the run fails with ErrSchemaDrift instead. The dialect must
+// implement SchemaFingerprinter.
+func WithSchemaFingerprint() Option {
+	return func(opts *RunOptions) {
+		opts.SchemaFingerprint = true
+	}
+}
+
+// checkFingerprint compares the schema with the fingerprint of the last run
+func (m *Migrator) checkFingerprint(ctx context.Context, options *RunOptions) (SchemaFingerprinter, error) {
+	store, ok := m.dialect.(SchemaFingerprinter)
+	if !ok {
+		return nil, errors.New("dialect does not support schema fingerprints")
+	}
+	if err := store.CreateFingerprintTable(ctx); err != nil {
+		return nil, fmt.Errorf("failed to create fingerprint table: %w", err)
+	}
+
+	stored, err := store.GetSchemaFingerprint(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schema fingerprint: %w", err)
+	}
+	if stored == "" {
+		return store, nil
+	}
+	current, err := store.SchemaFingerprint(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fingerprint schema: %w", err)
+	}
+	if current != stored {
+		if options.Strict {
+			return nil, fmt.Errorf("%w: fingerprint %s, expected %s", ErrSchemaDrift, current, stored)
+		}
+		m.logger.Info("warning: schema changed outside of migrations since the last run", "fingerprint", current, "expected", stored)
+	}
+	return store, nil
+}
+
+// storeFingerprint stores the fingerprint of the schema after the run
+func storeFingerprint(ctx context.Context, store SchemaFingerprinter) error {
+	fingerprint, err := store.SchemaFingerprint(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fingerprint schema: %w", err)
+	}
+	if err := store.StoreSchemaFingerprint(ctx, fingerprint); err != nil {
+		return fmt.Errorf("failed to store schema fingerprint: %w", err)
+	}
+	return nil
+}
+
+// fingerprintTable returns the name of the table with the fingerprint of
+// the schema, which is derived from the migrations table
+func (d *CommonDialect) fingerprintTable() string {
+	return d.tableName + "_fingerprint"
+}
+
+// CreateFingerprintTable creates the fingerprint table. Fingerprints are
+// scoped to the environment of the dialect.
+func (d *CommonDialect) CreateFingerprintTable(ctx context.Context) error {
+	return d.exec(ctx, `
+		CREATE TABLE IF NOT EXISTS `+d.fingerprintTable()+` (
+			env VARCHAR(255) NOT NULL DEFAULT '' PRIMARY KEY,
+			fingerprint VARCHAR(64) NOT NULL,
+			recorded_at `+d.timestampType+` DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+}
+
+// SchemaFingerprint returns the SHA-256 of the rows of the schema query of
+// the dialect, the columns of the tables and, where the database reports
+// them, the indexes. The tables of the migrator, which are named after the
+// migrations table, are left out.
+func (d *CommonDialect) SchemaFingerprint(ctx context.Context) (string, error) {
+	d.traceSQL(d.schemaSQL, nil)
+	rows, err := d.query(ctx, d.schemaSQL)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, row := range rows {
+		if len(row) == 0 {
+			return "", errors.New("query returned no columns")
+		}
+		if table := valueString(row[0]); table == d.tableName || strings.HasPrefix(table, d.tableName+"_") {
+			continue
+		}
+		values := make([]string, len(row))
+		for i, value := range row {
+			values[i] = valueString(value)
+		}
+		fmt.Fprintln(h, strings.Join(values, "\t"))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// GetSchemaFingerprint returns the fingerprint stored by the last run
+func (d *CommonDialect) GetSchemaFingerprint(ctx context.Context) (string, error) {
+	fingerprints, err := d.queryStrings(ctx, `SELECT fingerprint FROM `+d.fingerprintTable()+` WHERE env = `+d.placeholder(1), d.env)
+	if err != nil || len(fingerprints) == 0 {
+		return "", err
+	}
+	return fingerprints[0], nil
+}
+
+// StoreSchemaFingerprint replaces the stored fingerprint
+func (d *CommonDialect) StoreSchemaFingerprint(ctx context.Context, fingerprint string) error {
+	tx, err := d.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := tx.Exec(ctx, `DELETE FROM `+d.fingerprintTable()+` WHERE env = `+d.placeholder(1), d.env); err != nil {
+		return err
+	}
+	if err := tx.Exec(ctx, `INSERT INTO `+d.fingerprintTable()+` (env, fingerprint) VALUES (`+d.placeholder(1)+`, `+d.placeholder(2)+`)`, d.env, fingerprint); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,175 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fingerprintDialect is a MockDialect with a schema and a stored fingerprint
+type fingerprintDialect struct {
+	*MockDialect
+	schema string
+	stored string
+}
+
+func (d *fingerprintDialect) CreateFingerprintTable(ctx context.Context) error {
+	return nil
+}
+
+func (d *fingerprintDialect) SchemaFingerprint(ctx context.Context) (string, error) {
+	return checksum([]byte(d.schema)), nil
+}
+
+func (d *fingerprintDialect) GetSchemaFingerprint(ctx context.Context) (string, error) {
+	return d.stored, nil
+}
+
+func (d *fingerprintDialect) StoreSchemaFingerprint(ctx context.Context, fingerprint string) error {
+	d.stored = fingerprint
+	return nil
+}
+
+// Test the fingerprint of the schema of a dialect
+func TestDialectSchemaFingerprint(t *testing.T) {
+	schema := [][]interface{}{
+		{"schema_migrations", "version", "text", "NO", nil},
+		{"schema_migrations_dirty", "version", "text", "NO", nil},
+		{"users", "email", "text", "YES", nil},
+		{"users", "id", "integer", "NO", "nextval('users_id_seq')"},
+	}
+	var executed []string
+	exec := func(ctx context.Context, query string, args ...interface{}) error {
+		executed = append(executed, query)
+		return nil
+	}
+	query := func(ctx context.Context, query string, args ...interface{}) ([][]interface{}, error) {
+		if strings.Contains(query, "information_schema.columns") {
+			return schema, nil
+		}
+		return [][]interface{}{{"abc"}}, nil
+	}
+	tx := &recordingArgsTx{}
+	begin := func(ctx context.Context) (Tx, error) {
+		return tx, nil
+	}
+	dialect := NewPostgresDialect(nil, "", WithExecFunc(exec, query, begin), WithEnvironment("staging"))
+	ctx := context.Background()
+
+	fingerprint, err := dialect.SchemaFingerprint(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fingerprint) != 64 {
+		t.Errorf("expected a SHA-256 hex digest, got %q", fingerprint)
+	}
+
+	// the tables of the migrator don't change the fingerprint
+	schema = schema[2:]
+	if same, _ := dialect.SchemaFingerprint(ctx); same != fingerprint {
+		t.Errorf("expected the migrator tables to be ignored, got %s and %s", same, fingerprint)
+	}
+	schema = append(schema, []interface{}{"users", "name", "text", "YES", nil})
+	if changed, _ := dialect.SchemaFingerprint(ctx); changed == fingerprint {
+		t.Error("expected a new column to change the fingerprint")
+	}
+
+	if err := dialect.CreateFingerprintTable(ctx); err != nil || !strings.Contains(executed[0], "CREATE TABLE IF NOT EXISTS schema_migrations_fingerprint") {
+		t.Errorf("expected the fingerprint table to be created, got %v %v", err, executed)
+	}
+	if stored, err := dialect.GetSchemaFingerprint(ctx); err != nil || stored != "abc" {
+		t.Errorf("expected the stored fingerprint, got %q %v", stored, err)
+	}
+	if err := dialect.StoreSchemaFingerprint(ctx, fingerprint); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !tx.committed || len(tx.queries) != 2 || !strings.HasPrefix(tx.queries[1], "INSERT INTO schema_migrations_fingerprint") {
+		t.Errorf("expected the fingerprint to be replaced, got %v", tx.queries)
+	}
+	if tx.args[1][0] != "staging" || tx.args[1][1] != fingerprint {
+		t.Errorf("expected the fingerprint of the environment, got %v", tx.args[1])
+	}
+}
+
+// Test the schema query of the generic dialect
+func TestCommonDialectSchemaFingerprint(t *testing.T) {
+	var queried []string
+	schema := [][]interface{}{
+		{"schema_migrations", "app", "version", "varchar", "NO", nil},
+		{"users", "app", "id", "int", "NO", nil},
+	}
+	query := func(ctx context.Context, query string, args ...interface{}) ([][]interface{}, error) {
+		queried = append(queried, query)
+		return schema, nil
+	}
+	dialect := NewCommonDialect(nil, "", WithExecFunc(nil, query, nil))
+
+	fingerprint, err := dialect.SchemaFingerprint(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(queried[0], "WHERE table_schema = DATABASE()") || !strings.Contains(queried[0], "table_name, table_schema, column_name") {
+		t.Errorf("expected the columns of the current schema, got %q", queried[0])
+	}
+
+	schema = schema[1:]
+	if same, _ := dialect.SchemaFingerprint(context.Background()); same != fingerprint {
+		t.Errorf("expected the migrations table to be ignored, got %s and %s", same, fingerprint)
+	}
+	schema = [][]interface{}{{"users", "other", "id", "int", "NO", nil}}
+	if changed, _ := dialect.SchemaFingerprint(context.Background()); changed == fingerprint {
+		t.Error("expected the schema to change the fingerprint")
+	}
+}
+
+// Test detecting schema changes made outside of the migrations
+func TestMigratorSchemaFingerprint(t *testing.T) {
+	ctx := context.Background()
+	dialect := &fingerprintDialect{MockDialect: &MockDialect{appliedMigrations: []string{}}, schema: "users"}
+	migrator := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{})
+
+	if err := migrator.Up(ctx, WithSchemaFingerprint()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dialect.stored != checksum([]byte("users")) {
+		t.Fatalf("expected the fingerprint to be stored, got %q", dialect.stored)
+	}
+
+	logger := &MockLogger{}
+	if err := New(&MockSource{migrations: createTestMigrations()}, dialect, logger).Up(ctx, WithSchemaFingerprint()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, log := range logger.GetLogs() {
+		if strings.Contains(log, "schema changed") {
+			t.Errorf("expected no warning for an unchanged schema, got %v", log)
+		}
+	}
+
+	dialect.schema = "users, audit"
+	logger = &MockLogger{}
+	if err := New(&MockSource{migrations: createTestMigrations()}, dialect, logger).Up(ctx, WithSchemaFingerprint()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if logs := logger.GetLogs(); len(logs) == 0 || !strings.HasPrefix(logs[0], "warning: schema changed outside of migrations since the last run") {
+		t.Errorf("expected drift warning, got %v", logs)
+	}
+	if dialect.stored != checksum([]byte("users, audit")) {
+		t.Errorf("expected the new fingerprint to be stored, got %q", dialect.stored)
+	}
+
+	dialect.schema = "users"
+	dialect.storedMigrations = nil
+	err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Up(ctx, WithSchemaFingerprint(), WithStrict())
+	if !errors.Is(err, ErrSchemaDrift) {
+		t.Fatalf("expected ErrSchemaDrift, got %v", err)
+	}
+	if len(dialect.storedMigrations) != 0 || dialect.stored != checksum([]byte("users, audit")) {
+		t.Error("expected nothing to run or be stored on drift in strict mode")
+	}
+
+	err = New(&MockSource{migrations: createTestMigrations()}, &MockDialect{appliedMigrations: []string{}}, &MockLogger{}).Up(ctx, WithSchemaFingerprint())
+	if err == nil || !strings.Contains(err.Error(), "does not support schema fingerprints") {
+		t.Errorf("expected unsupported dialect error, got %v", err)
+	}
+}
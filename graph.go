@@ -0,0 +1,56 @@
+package migrate
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// GraphDOT renders the dependency graph of the migrations of the source in
+// the Graphviz DOT format, with an edge from each required migration to the
+// migration which requires it. Without any dependencies, the migrations are
+// rendered as a chain in version order.
+func GraphDOT(source Source) (string, error) {
+	migrations, err := source.GetMigrations()
+	if err != nil {
+		return "", fmt.Errorf("failed to get migration files: %w", err)
+	}
+
+	versions := make([]string, len(migrations))
+	for i, m := range migrations {
+		versions[i] = m.Version
+	}
+	slices.Sort(versions)
+
+	var edges [][2]string
+	for _, m := range migrations {
+		directives, err := parseMigrationDirectives(m.Content)
+		if err != nil {
+			return "", fmt.Errorf("invalid directives in migration %s: %w", m.Version, err)
+		}
+		for _, required := range directives.Requires {
+			if _, ok := slices.BinarySearch(versions, required); !ok {
+				return "", fmt.Errorf("migration %s requires unknown migration %s", m.Version, required)
+			}
+			edges = append(edges, [2]string{required, m.Version})
+		}
+	}
+	if len(edges) == 0 {
+		for i := 1; i < len(versions); i++ {
+			edges = append(edges, [2]string{versions[i-1], versions[i]})
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("digraph migrations {\n")
+	for _, version := range versions {
+		fmt.Fprintf(&b, "\t%s;\n", strconv.Quote(version))
+	}
+	for _, edge := range edges {
+		fmt.Fprintf(&b, "\t%s -> %s;\n", strconv.Quote(edge[0]), strconv.Quote(edge[1]))
+	}
+	b.WriteString("}\n")
+
+	return b.String(), nil
+}
@@ -0,0 +1,63 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test rendering the dependency graph in the DOT format
+func TestGraphDOT(t *testing.T) {
+	tests := []struct {
+		name        string
+		migrations  []Migration
+		expected    string
+		expectError string
+	}{
+		{
+			name: "chain without dependencies",
+			migrations: []Migration{
+				requiresMigration("002", ""),
+				requiresMigration("001", ""),
+				requiresMigration("003", ""),
+			},
+			expected: "digraph migrations {\n\t\"001\";\n\t\"002\";\n\t\"003\";\n\t\"001\" -> \"002\";\n\t\"002\" -> \"003\";\n}\n",
+		},
+		{
+			name: "dependencies",
+			migrations: []Migration{
+				requiresMigration("001", ""),
+				requiresMigration("002", "001"),
+				requiresMigration("003", "001,002"),
+				requiresMigration("004", ""),
+			},
+			expected: "digraph migrations {\n\t\"001\";\n\t\"002\";\n\t\"003\";\n\t\"004\";\n\t\"001\" -> \"002\";\n\t\"001\" -> \"003\";\n\t\"002\" -> \"003\";\n}\n",
+		},
+		{
+			name:     "empty source",
+			expected: "digraph migrations {\n}\n",
+		},
+		{
+			name:        "unknown dependency",
+			migrations:  []Migration{requiresMigration("001", "000")},
+			expectError: "requires unknown migration 000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dot, err := GraphDOT(&MockSource{migrations: tt.migrations})
+			if tt.expectError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectError) {
+					t.Fatalf("expected error containing %q, got %v", tt.expectError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if dot != tt.expected {
+				t.Errorf("expected\n%s\ngot\n%s", tt.expected, dot)
+			}
+		})
+	}
+}
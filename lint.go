@@ -0,0 +1,155 @@
+package migrate
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// LintWarning is a suspicious pattern found in a migration.
+type LintWarning struct {
+	Version string
+	Message string
+}
+
+func (w LintWarning) String() string {
+	return w.Version + ": " + w.Message
+}
+
+var (
+	destructiveRe = regexp.MustCompile(`(?i)^(DROP|DELETE|TRUNCATE)\b`)
+	createRe      = regexp.MustCompile(`(?i)\bCREATE\b`)
+	createdRe     = regexp.MustCompile(`(?i)\bCREATE\s+(?:UNIQUE\s+)?(TABLE|INDEX|VIEW|SEQUENCE)\s+(?:CONCURRENTLY\s+)?(?:IF\s+NOT\s+EXISTS\s+)?([\w."]+)`)
+	droppedRe     = regexp.MustCompile(`(?i)\bDROP\s+(TABLE|INDEX|VIEW|SEQUENCE)\s+(?:CONCURRENTLY\s+)?(?:IF\s+EXISTS\s+)?([\w."]+)`)
+)
+
+// Lint statically checks the migrations of the source for common mistakes,
+// like up and down migrations that look swapped. The warnings are hints for
+// code review, they don't affect how migrations are applied.
+func Lint(source Source) ([]LintWarning, error) {
+	migrations, err := source.GetMigrations()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get migration files: %w", err)
+	}
+
+	var warnings []LintWarning
+	for _, m := range migrations {
+		for _, message := range lintMigration(m) {
+			warnings = append(warnings, LintWarning{Version: m.Version, Message: message})
+		}
+	}
+	for _, gap := range versionGaps(migrations) {
+		warnings = append(warnings, LintWarning{Version: gap.next, Message: "missing versions " + gap.missing + " before this migration"})
+	}
+
+	return warnings, nil
+}
+
+// lintMigration returns the warnings of a single migration
+func lintMigration(m Migration) []string {
+	up := splitStatements(stripComments(string(m.Content)))
+	down := stripComments(string(m.DownContent))
+
+	var messages []string
+	if identicalUpDown(m) {
+		messages = append(messages, "down migration is identical to up migration, a rollback would apply it again")
+	}
+	if len(up) > 0 && strings.TrimSpace(down) != "" {
+		onlyDestructive := true
+		for _, statement := range up {
+			if !destructiveRe.MatchString(statement) {
+				onlyDestructive = false
+				break
+			}
+		}
+		if onlyDestructive && createRe.MatchString(down) {
+			messages = append(messages, "up migration only drops or deletes while down migration creates, up and down may be swapped")
+		}
+	}
+
+	created := objectNames(createdRe, string(m.Content))
+	dropped := objectNames(droppedRe, down)
+	if len(created) > 0 && len(dropped) > 0 {
+		matched := false
+		for _, name := range dropped {
+			if slices.Contains(created, name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			messages = append(messages, fmt.Sprintf("down migration drops %s, but up migration creates %s",
+				strings.Join(dropped, ", "), strings.Join(created, ", ")))
+		}
+	}
+
+	return messages
+}
+
+// identicalUpDown reports whether the down migration is a copy of the up
+// migration, ignoring surrounding whitespace
+func identicalUpDown(m Migration) bool {
+	up := bytes.TrimSpace(m.Content)
+	return len(up) > 0 && bytes.Equal(up, bytes.TrimSpace(m.DownContent))
+}
+
+// objectNames returns the lower-cased object names matched by the expression
+func objectNames(re *regexp.Regexp, content string) []string {
+	var names []string
+	for _, match := range re.FindAllStringSubmatch(stripComments(content), -1) {
+		names = append(names, strings.ToLower(strings.Trim(match[2], `"`)))
+	}
+	return names
+}
+
+// versionGap is a range of missing sequential version numbers
+type versionGap struct {
+	// missing is the number or the range of numbers, like 003 or 005-009
+	missing string
+	// next is the version which follows the gap
+	next string
+}
+
+// maxSequentialDigits is the longest version number treated as sequential,
+// longer numbers are timestamps like 20230101 where gaps are expected
+const maxSequentialDigits = 7
+
+// versionGaps returns the gaps between sequential version numbers, like the
+// missing 003 between 002 and 004. It returns nil if any version doesn't
+// start with a number or the numbers look like timestamps.
+func versionGaps(migrations []Migration) []versionGap {
+	type numbered struct {
+		number  int
+		version string
+	}
+
+	var versions []numbered
+	width := 0
+	for _, m := range migrations {
+		digits := len(m.Version) - len(strings.TrimLeft(m.Version, "0123456789"))
+		if digits == 0 || digits > maxSequentialDigits {
+			return nil
+		}
+		n, _ := strconv.Atoi(m.Version[:digits])
+		versions = append(versions, numbered{number: n, version: m.Version})
+		width = max(width, digits)
+	}
+	slices.SortStableFunc(versions, func(a, b numbered) int { return a.number - b.number })
+
+	var gaps []versionGap
+	for i := 1; i < len(versions); i++ {
+		from, to := versions[i-1].number+1, versions[i].number-1
+		if from > to {
+			continue
+		}
+		missing := fmt.Sprintf("%0*d", width, from)
+		if to > from {
+			missing += fmt.Sprintf("-%0*d", width, to)
+		}
+		gaps = append(gaps, versionGap{missing: missing, next: versions[i].version})
+	}
+	return gaps
+}
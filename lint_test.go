@@ -0,0 +1,184 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Test detection of suspicious migrations
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name      string
+		migration Migration
+		expected  string
+	}{
+		{
+			name: "valid migration",
+			migration: Migration{
+				Content:     []byte("CREATE TABLE users (id INT);\nCREATE INDEX idx_users ON users(id);"),
+				DownContent: []byte("DROP TABLE users;"),
+			},
+		},
+		{
+			name: "swapped up and down",
+			migration: Migration{
+				Content:     []byte("-- oops\nDROP TABLE users;"),
+				DownContent: []byte("CREATE TABLE users (id INT);"),
+			},
+			expected: "may be swapped",
+		},
+		{
+			name: "destructive up migration without down",
+			migration: Migration{
+				Content: []byte("DELETE FROM sessions;"),
+			},
+		},
+		{
+			name: "mismatched object names",
+			migration: Migration{
+				Content:     []byte(`CREATE TABLE IF NOT EXISTS "Orders" (id INT);`),
+				DownContent: []byte("DROP TABLE IF EXISTS users;"),
+			},
+			expected: "down migration drops users, but up migration creates orders",
+		},
+		{
+			name: "identical up and down",
+			migration: Migration{
+				Content:     []byte("CREATE TABLE users (id INT);\n"),
+				DownContent: []byte("CREATE TABLE users (id INT);"),
+			},
+			expected: "identical to up migration",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.migration.Version = "001"
+			warnings, err := Lint(&MockSource{migrations: []Migration{tt.migration}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.expected == "" {
+				if len(warnings) != 0 {
+					t.Errorf("expected no warnings, got %v", warnings)
+				}
+				return
+			}
+			if len(warnings) != 1 || !strings.Contains(warnings[0].Message, tt.expected) {
+				t.Errorf("expected a warning containing %q, got %v", tt.expected, warnings)
+			}
+		})
+	}
+}
+
+// Test detection of gaps in sequential versions
+func TestLintVersionGaps(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []string
+		expected string
+	}{
+		{name: "contiguous", versions: []string{"001_users", "002_email", "003_orders"}},
+		{name: "single gap", versions: []string{"001_users", "002_email", "004_orders"}, expected: "[004_orders: missing versions 003 before this migration]"},
+		{name: "range", versions: []string{"1_users", "5_email", "6_orders"}, expected: "[5_email: missing versions 2-4 before this migration]"},
+		{name: "padding of the longest version", versions: []string{"9_users", "0011_email"}, expected: "[0011_email: missing versions 0010 before this migration]"},
+		{name: "timestamps", versions: []string{"20230101_users", "20230105_email"}},
+		{name: "unnumbered", versions: []string{"001_users", "init", "004_orders"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var migrations []Migration
+			for _, v := range tt.versions {
+				migrations = append(migrations, Migration{Version: v, Content: []byte("SELECT 1")})
+			}
+			warnings, err := Lint(&MockSource{migrations: migrations})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.expected == "" {
+				if len(warnings) != 0 {
+					t.Errorf("expected no warnings, got %v", warnings)
+				}
+				return
+			}
+			if fmt.Sprint(warnings) != tt.expected {
+				t.Errorf("expected %s, got %v", tt.expected, warnings)
+			}
+		})
+	}
+}
+
+// Test logging the gaps in versions at the start of a run
+func TestMigratorWarnOnGaps(t *testing.T) {
+	migrations := []Migration{
+		{Version: "001_users", Content: []byte("CREATE TABLE users (id INT)")},
+		{Version: "003_email", Content: []byte("ALTER TABLE users ADD COLUMN email TEXT")},
+		{Version: "007_orders", Content: []byte("CREATE TABLE orders (id INT)")},
+	}
+
+	logger := &MockLogger{}
+	dialect := &MockDialect{appliedMigrations: []string{}}
+	if err := New(&MockSource{migrations: migrations}, dialect, logger).Up(context.Background(), WithWarnOnGaps()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if logs := logger.GetLogs(); len(logs) == 0 || logs[0] != "warning: gaps in migration versions missing=002, 004-006" {
+		t.Errorf("expected gap warning, got %v", logs)
+	}
+
+	logger = &MockLogger{}
+	if err := New(&MockSource{migrations: migrations}, &MockDialect{appliedMigrations: []string{}}, logger).Up(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, log := range logger.GetLogs() {
+		if strings.Contains(log, "gaps") {
+			t.Errorf("expected no gap warning without the option, got %v", log)
+		}
+	}
+}
+
+// Test detection of down migrations copied from their up migrations at the
+// start of a run
+func TestMigratorIdenticalUpDown(t *testing.T) {
+	migrations := func() []Migration {
+		migrations := createTestMigrations()
+		migrations[1].DownContent = migrations[1].Content
+		return migrations
+	}
+
+	logger := &MockLogger{}
+	dialect := &MockDialect{appliedMigrations: []string{}}
+	if err := New(&MockSource{migrations: migrations()}, dialect, logger).Up(context.Background(), WithWarnIdenticalUpDown()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if logs := logger.GetLogs(); len(logs) == 0 || logs[0] != "warning: down migration is identical to up migration version=002_add_email" {
+		t.Errorf("expected identical migration warning, got %v", logs)
+	}
+	if len(dialect.storedMigrations) != 4 {
+		t.Errorf("expected the warning not to stop the run, got %v", dialect.storedMigrations)
+	}
+
+	dialect = &MockDialect{appliedMigrations: []string{}}
+	err := New(&MockSource{migrations: migrations()}, dialect, &MockLogger{}).Up(context.Background(), WithWarnIdenticalUpDown(), WithStrict())
+	if !errors.Is(err, ErrIdenticalUpDown) || !strings.Contains(err.Error(), "002_add_email") {
+		t.Fatalf("expected ErrIdenticalUpDown in strict mode, got %v", err)
+	}
+	if len(dialect.storedMigrations) != 0 {
+		t.Errorf("expected nothing to be applied, got %v", dialect.storedMigrations)
+	}
+
+	logger = &MockLogger{}
+	if err := New(&MockSource{migrations: migrations()}, &MockDialect{appliedMigrations: []string{}}, logger).Up(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, log := range logger.GetLogs() {
+		if strings.Contains(log, "identical") {
+			t.Errorf("expected no warning without the option, got %v", log)
+		}
+	}
+}
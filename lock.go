@@ -0,0 +1,117 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Locker is a strategy to keep concurrent runs apart. Every Dialect is a
+// Locker, WithLocker replaces the lock of the dialect for a run.
+type Locker interface {
+	Lock(ctx context.Context) error
+	Unlock(ctx context.Context) error
+}
+
+// WithLocker is an option that locks the run with the locker instead of the
+// dialect, e.g. with a TableLock on databases without advisory locks.
+func WithLocker(locker Locker) Option {
+	return func(opts *RunOptions) {
+		opts.Locker = locker
+	}
+}
+
+// defaultLockPoll is the interval a TableLock checks a held lock at
+const defaultLockPoll = time.Second
+
+// TableLock is a Locker which holds the lock as a row of the
+// <table>_lock table, for databases without advisory locks like SQLite.
+// The row is inserted with a random token, so only one migrator succeeds,
+// and deleted on Unlock. The others wait until the row is deleted or is
+// older than the stale timeout, which recovers the lock of a crashed
+// migrator.
+type TableLock struct {
+	dialect    *CommonDialect
+	staleAfter time.Duration
+	poll       time.Duration
+
+	mu    sync.Mutex
+	token string
+}
+
+// TableLock returns a TableLock in the migrations database of the dialect,
+// scoped to its environment. A lock older than staleAfter is taken over,
+// so it must be longer than the longest run; 0 never takes a lock over.
+func (d *CommonDialect) TableLock(staleAfter time.Duration) *TableLock {
+	return &TableLock{dialect: d, staleAfter: staleAfter, poll: defaultLockPoll}
+}
+
+// table returns the name of the lock table
+func (l *TableLock) table() string {
+	return l.dialect.tableName + "_lock"
+}
+
+// Lock creates the lock table if needed and inserts the lock row, waiting
+// until the lock is released, becomes stale or the context is done.
+func (l *TableLock) Lock(ctx context.Context) error {
+	d := l.dialect
+	if err := d.exec(ctx, `
+		CREATE TABLE IF NOT EXISTS `+l.table()+` (
+			env VARCHAR(255) NOT NULL DEFAULT '' PRIMARY KEY,
+			token VARCHAR(64) NOT NULL,
+			locked_at_ms BIGINT NOT NULL
+		)
+	`); err != nil {
+		return fmt.Errorf("failed to create lock table: %w", err)
+	}
+
+	token := newRunID()
+	for {
+		now := time.Now()
+		if l.staleAfter > 0 {
+			stale := now.Add(-l.staleAfter).UnixMilli()
+			if err := d.exec(ctx, `DELETE FROM `+l.table()+` WHERE env = `+d.placeholder(1)+` AND locked_at_ms < `+d.placeholder(2), d.env, stale); err != nil {
+				return fmt.Errorf("failed to clear stale lock: %w", err)
+			}
+		}
+
+		// the primary key lets only one insert succeed, the error of the
+		// others is expected while the lock is held
+		insertErr := d.exec(ctx, `INSERT INTO `+l.table()+` (env, token, locked_at_ms) VALUES (`+d.placeholder(1)+`, `+d.placeholder(2)+`, `+d.placeholder(3)+`)`, d.env, token, now.UnixMilli())
+		holders, err := d.queryStrings(ctx, `SELECT token FROM `+l.table()+` WHERE env = `+d.placeholder(1), d.env)
+		if err != nil {
+			return fmt.Errorf("failed to read lock: %w", err)
+		}
+		if len(holders) > 0 && holders[0] == token {
+			l.mu.Lock()
+			l.token = token
+			l.mu.Unlock()
+			return nil
+		}
+		if len(holders) == 0 && insertErr != nil {
+			return fmt.Errorf("failed to insert lock: %w", insertErr)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("lock is held by another migrator: %w", ctx.Err())
+		case <-time.After(l.poll):
+		}
+	}
+}
+
+// Unlock deletes the lock row of this lock. It is a no-op when the lock is
+// not held, so calling it more than once is safe.
+func (l *TableLock) Unlock(ctx context.Context) error {
+	l.mu.Lock()
+	token := l.token
+	l.token = ""
+	l.mu.Unlock()
+	if token == "" {
+		return nil
+	}
+
+	d := l.dialect
+	return d.exec(ctx, `DELETE FROM `+l.table()+` WHERE env = `+d.placeholder(1)+` AND token = `+d.placeholder(2), d.env, token)
+}
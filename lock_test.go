@@ -0,0 +1,122 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lockTable emulates the lock table for the statements of a TableLock
+type lockTable struct {
+	rows map[string]lockRow
+}
+
+type lockRow struct {
+	token string
+	ms    int64
+}
+
+func (t *lockTable) dialect() *CommonDialect {
+	exec := func(ctx context.Context, query string, args ...interface{}) error {
+		switch {
+		case strings.Contains(query, "CREATE TABLE"):
+		case strings.HasPrefix(query, "INSERT"):
+			env := args[0].(string)
+			if _, ok := t.rows[env]; ok {
+				return errors.New("UNIQUE constraint failed")
+			}
+			t.rows[env] = lockRow{token: args[1].(string), ms: args[2].(int64)}
+		case strings.Contains(query, "locked_at_ms <"):
+			if row, ok := t.rows[args[0].(string)]; ok && row.ms < args[1].(int64) {
+				delete(t.rows, args[0].(string))
+			}
+		case strings.Contains(query, "token ="):
+			if row, ok := t.rows[args[0].(string)]; ok && row.token == args[1].(string) {
+				delete(t.rows, args[0].(string))
+			}
+		default:
+			return errors.New("unexpected statement " + query)
+		}
+		return nil
+	}
+	query := func(ctx context.Context, query string, args ...interface{}) ([][]interface{}, error) {
+		if row, ok := t.rows[args[0].(string)]; ok {
+			return [][]interface{}{{row.token}}, nil
+		}
+		return nil, nil
+	}
+	return NewSQLiteDialect(nil, "", WithExecFunc(exec, query, nil))
+}
+
+// Test mutual exclusion with the lock table
+func TestTableLock(t *testing.T) {
+	table := &lockTable{rows: map[string]lockRow{}}
+	first := table.dialect().TableLock(time.Minute)
+	second := table.dialect().TableLock(time.Minute)
+	second.poll = time.Millisecond
+
+	if err := first.Lock(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := second.Lock(ctx); !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "held by another migrator") {
+		t.Fatalf("expected the held lock to time out, got %v", err)
+	}
+	if err := second.Unlock(context.Background()); err != nil || len(table.rows) != 1 {
+		t.Fatalf("expected unlock without the lock to keep the row, got %v %v", err, table.rows)
+	}
+
+	if err := first.Unlock(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := second.Lock(context.Background()); err != nil {
+		t.Fatalf("expected the released lock to be acquired, got %v", err)
+	}
+	second.Unlock(context.Background())
+	if len(table.rows) != 0 {
+		t.Errorf("expected the lock row to be deleted, got %v", table.rows)
+	}
+}
+
+// Test taking over the lock of a crashed migrator
+func TestTableLockStale(t *testing.T) {
+	table := &lockTable{rows: map[string]lockRow{"": {token: "crashed", ms: time.Now().Add(-time.Hour).UnixMilli()}}}
+
+	lock := table.dialect().TableLock(10 * time.Minute)
+	if err := lock.Lock(context.Background()); err != nil {
+		t.Fatalf("expected the stale lock to be taken over, got %v", err)
+	}
+	if table.rows[""].token == "crashed" {
+		t.Error("expected a new lock row")
+	}
+}
+
+// Test running with a locker instead of the lock of the dialect
+func TestMigratorWithLocker(t *testing.T) {
+	table := &lockTable{rows: map[string]lockRow{}}
+	lock := table.dialect().TableLock(time.Minute)
+	dialect := &MockDialect{appliedMigrations: []string{}}
+
+	held := false
+	observer := func(event string, d time.Duration) {
+		if event == LockAcquired {
+			held = len(table.rows) == 1
+		}
+	}
+	if err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Up(context.Background(), WithLocker(lock), WithLockObserver(observer)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !held {
+		t.Error("expected the table lock to be held during the run")
+	}
+	if dialect.lockCalled || dialect.unlockCalled {
+		t.Error("expected the dialect lock not to be used")
+	}
+	if lock.token != "" || len(table.rows) != 0 {
+		t.Errorf("expected the table lock to be released, got %v", table.rows)
+	}
+}
@@ -0,0 +1,60 @@
+package migrate
+
+import (
+	"context"
+	"time"
+)
+
+// StatementMetric is the timing of a single statement of a migration, see
+// WithStatementMetrics.
+type StatementMetric struct {
+	Version string
+	// Index is the position of the statement in the migration, from 0
+	Index int
+	// Statement is the SQL of the statement, with the secret placeholders
+	// of WithSecretResolver unresolved
+	Statement string
+	Duration  time.Duration
+	// Err is the error of the statement, if it failed
+	Err error
+}
+
+// WithStatementMetrics is an option that passes the timing of every statement
+// of the applied and rolled back migrations to fn, e.g. to find the one slow
+// ALTER TABLE of a long migration. Migrations in a transaction are split into
+// statements, which run one by one in the transaction instead of as a single
+// query, so the timing has a small overhead and is off by default.
+func WithStatementMetrics(fn func(StatementMetric)) Option {
+	return func(opts *RunOptions) {
+		opts.StatementMetrics = fn
+	}
+}
+
+// measure passes the timing of the statement to the metrics callback, if any
+func (o *RunOptions) measure(version string, index int, statement string, start time.Time, err error) {
+	if o.StatementMetrics != nil {
+		o.StatementMetrics(StatementMetric{Version: version, Index: index, Statement: statement, Duration: time.Since(start), Err: err})
+	}
+}
+
+// execTimed executes the statements of the query one by one in the
+// transaction, measuring each. It returns the sum of the affected rows, or
+// unknownRows when a statement doesn't report them.
+func execTimed(ctx context.Context, tx Tx, query string, version string, options *RunOptions) (int64, error) {
+	total := int64(0)
+	for i, statement := range splitStatements(query) {
+		resolved, err := options.resolveSecrets(statement)
+		if err != nil {
+			return unknownRows, err
+		}
+
+		start := time.Now()
+		rows, err := execStatementRows(ctx, tx, resolved)
+		options.measure(version, i, statement, start, err)
+		if err != nil {
+			return unknownRows, err
+		}
+		total = addRows(total, rows)
+	}
+	return total, nil
+}
@@ -0,0 +1,101 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Test timing the statements of migrations
+func TestMigratorStatementMetrics(t *testing.T) {
+	ctx := context.Background()
+	record := func(metrics *[]StatementMetric) Option {
+		return WithStatementMetrics(func(metric StatementMetric) {
+			*metrics = append(*metrics, metric)
+		})
+	}
+	summary := func(metrics []StatementMetric) string {
+		var res []string
+		for _, metric := range metrics {
+			if metric.Duration < 0 {
+				t.Errorf("unexpected duration %s", metric.Duration)
+			}
+			res = append(res, fmt.Sprintf("%s#%d %s", metric.Version, metric.Index, metric.Statement))
+		}
+		return strings.Join(res, ", ")
+	}
+
+	t.Run("transaction", func(t *testing.T) {
+		migrations := []Migration{{
+			Version: "001_users",
+			Content: []byte("CREATE TABLE users (id INT);\nALTER TABLE users ADD COLUMN name TEXT;\nCREATE ROLE app PASSWORD '${secret:app}';"),
+		}}
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		var metrics []StatementMetric
+		resolve := func(key string) (string, error) { return "hunter2", nil }
+		if err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(ctx, record(&metrics), WithSecretResolver(resolve)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		expected := "001_users#0 CREATE TABLE users (id INT);, 001_users#1 ALTER TABLE users ADD COLUMN name TEXT;, 001_users#2 CREATE ROLE app PASSWORD '${secret:app}';"
+		if summary(metrics) != expected {
+			t.Errorf("expected %s, got %s", expected, summary(metrics))
+		}
+		if len(dialect.executedQueries) != 3 || dialect.executedQueries[2] != "CREATE ROLE app PASSWORD 'hunter2';" {
+			t.Errorf("expected the statements to run one by one with the secrets, got %v", dialect.executedQueries)
+		}
+		if len(dialect.storedMigrations) != 1 {
+			t.Errorf("expected the migration to be recorded, got %v", dialect.storedMigrations)
+		}
+	})
+
+	t.Run("failed statement", func(t *testing.T) {
+		migrations := []Migration{{Version: "001_users", Content: []byte("CREATE TABLE users (id INT);\nALTER TABLE users ADD COLUMN oops;\nSELECT 1;")}}
+		failure := errors.New("syntax error")
+		dialect := &MockDialect{appliedMigrations: []string{}, execErrors: map[string]error{"ALTER TABLE users ADD COLUMN oops;": failure}}
+		var metrics []StatementMetric
+		err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(ctx, record(&metrics))
+		if !errors.Is(err, failure) {
+			t.Fatalf("expected the statement error, got %v", err)
+		}
+		if len(metrics) != 2 || metrics[0].Err != nil || !errors.Is(metrics[1].Err, failure) {
+			t.Errorf("expected the failed statement to be reported last, got %+v", metrics)
+		}
+	})
+
+	t.Run("without a transaction", func(t *testing.T) {
+		migrations := []Migration{{
+			Version:     "001_index",
+			Content:     []byte("-- migrate:no-transaction\nCREATE INDEX CONCURRENTLY a ON t (a);\nCREATE INDEX CONCURRENTLY b ON t (b);"),
+			DownContent: []byte("-- migrate:no-transaction\nDROP INDEX CONCURRENTLY b;\nDROP INDEX CONCURRENTLY a;"),
+		}}
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		var metrics []StatementMetric
+		migrator := New(&MockSource{migrations: migrations}, dialect, &MockLogger{})
+		if err := migrator.Up(ctx, record(&metrics)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		dialect.appliedMigrations = []string{"001_index"}
+		if err := migrator.Down(ctx, 1, record(&metrics), WithConfirmRollback()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		expected := "001_index#0 CREATE INDEX CONCURRENTLY a ON t (a);, 001_index#1 CREATE INDEX CONCURRENTLY b ON t (b);, 001_index#0 DROP INDEX CONCURRENTLY b;, 001_index#1 DROP INDEX CONCURRENTLY a;"
+		if summary(metrics) != expected {
+			t.Errorf("expected %s, got %s", expected, summary(metrics))
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		migrations := []Migration{{Version: "001_users", Content: []byte("CREATE TABLE users (id INT);\nCREATE TABLE roles (id INT);")}}
+		if err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(dialect.executedQueries) != 1 {
+			t.Errorf("expected the migration to run as one query, got %v", dialect.executedQueries)
+		}
+	})
+}
@@ -2,8 +2,74 @@ package migrate
 
 import (
 	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"runtime/debug"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrEmptyMigration is returned when a migration has no content to apply.
+	ErrEmptyMigration = errors.New("no content to apply for migration")
+	// ErrNoDownMigration is returned when a migration to roll back has no
+	// down content, i.e. it is irreversible.
+	ErrNoDownMigration = errors.New("no down migration")
+	// ErrSchemaAhead is returned when the database has migrations applied
+	// that are newer than any migration known to the source.
+	ErrSchemaAhead = errors.New("database schema is ahead of known migrations")
+	// ErrRunTimeout is returned when a run exceeds the WithRunTimeout budget.
+	ErrRunTimeout = errors.New("migration run timed out")
+	// ErrBookkeepingTimeout is returned when a query on the migrations table
+	// exceeds the WithBookkeepingTimeout budget.
+	ErrBookkeepingTimeout = errors.New("bookkeeping query timed out")
+	// ErrMigrationNotFound is returned when an applied migration has no
+	// matching file in the source, e.g. when rolling it back.
+	ErrMigrationNotFound = errors.New("migration file not found")
+	// ErrTargetNotFound is returned by To when the target version is neither
+	// applied nor among the pending migrations.
+	ErrTargetNotFound = errors.New("target version not found")
+	// ErrOrderMismatch is returned by To when the target version is pending
+	// but comes before the newest applied migration in the source.
+	ErrOrderMismatch = errors.New("applied migrations and the source are not in the same order")
+	// ErrPanic is returned when a migration panics and WithRecover is set.
+	ErrPanic = errors.New("panic during migration")
+	// ErrAlreadyApplied is returned by ApplyAdHoc when the version is
+	// already recorded as applied.
+	ErrAlreadyApplied = errors.New("migration is already applied")
+	// ErrRollbackNotConfirmed is returned by operations which would roll
+	// back migrations when WithConfirmRollback is required but not set.
+	ErrRollbackNotConfirmed = errors.New("rollback not confirmed")
+	// ErrReapplyNotAllowed is returned when WithReapplyOnChange is used
+	// outside of a development environment.
+	ErrReapplyNotAllowed = errors.New("reapplying changed migrations is not allowed")
+	// ErrDirty is returned when a migration without a transaction failed
+	// partway and the database needs a manual fix, see Resolve.
+	ErrDirty = errors.New("database is dirty")
+	// ErrVersionMismatch is returned by AssertVersion and Migrate when the
+	// database is not at the expected version.
+	ErrVersionMismatch = errors.New("unexpected database version")
+	// ErrPreflight is returned by Preflight when the database is not ready
+	// for migrations, with the problems found.
+	ErrPreflight = errors.New("preflight check failed")
+	// ErrIdenticalUpDown is returned when WithWarnIdenticalUpDown is used
+	// with WithStrict and a down migration is a copy of its up migration.
+	ErrIdenticalUpDown = errors.New("down migration is identical to up migration")
+	// ErrTooManyMigrations is returned when WithMaxMigrationsPerRun is used
+	// with WithStrict and more migrations are pending than the cap.
+	ErrTooManyMigrations = errors.New("too many pending migrations")
+	// ErrSchemaDrift is returned when WithSchemaFingerprint is used with
+	// WithStrict and the schema was changed outside of the migrations.
+	ErrSchemaDrift = errors.New("schema changed outside of migrations")
+	// ErrPhaseBlocked is returned by UpPhase when a pending migration of the
+	// phase follows a pending migration of the other phase.
+	ErrPhaseBlocked = errors.New("deploy phase is blocked by a migration of the other phase")
 )
 
 // Logger is a logger interface, slog compatible
@@ -16,6 +82,14 @@ type Migrator struct {
 	source  Source
 	dialect Dialect
 	logger  Logger
+
+	// migrations applied with ApplyAdHoc, which are not in the source
+	adHoc *adHocMigrations
+	// txFactory replaces the transactions of the dialect during a run
+	txFactory func(ctx context.Context) (Tx, error)
+	// sharedTx is the transaction of WithRollbackAfter, which all migrations
+	// of the run use
+	sharedTx Tx
 }
 
 // New creates a new Migrator.
@@ -24,13 +98,135 @@ func New(source Source, dialect Dialect, logger Logger) *Migrator {
 		source:  source,
 		dialect: dialect,
 		logger:  logger,
+		adHoc:   &adHocMigrations{},
+	}
+}
+
+// adHocMigrations holds the migrations applied with ApplyAdHoc. The copies of
+// a migrator made for a run share it, and concurrent runs read and add to it.
+type adHocMigrations struct {
+	mu         sync.Mutex
+	migrations []Migration
+}
+
+func (a *adHocMigrations) add(migration Migration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.migrations = append(a.migrations, migration)
+}
+
+// find returns the ad-hoc migration of the version, a nil set has none
+func (a *adHocMigrations) find(version string) (Migration, bool) {
+	if a == nil {
+		return Migration{}, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, f := range a.migrations {
+		if f.Version == version {
+			return f, true
+		}
 	}
+	return Migration{}, false
 }
 
 // RunOptions holds configuration for a single migration run.
 type RunOptions struct {
 	DryRun bool
-	// Future options like 'Force' could be added here.
+	// RollbackAfter runs the migrations in one transaction which is rolled
+	// back at the end
+	RollbackAfter bool
+	NoCreateTable bool
+	LockObserver  func(event string, d time.Duration)
+	// Locker replaces the lock of the dialect
+	Locker        Locker
+	StripComments bool
+	RunTimeout    time.Duration
+	// BookkeepingTimeout limits each query on the migrations table
+	BookkeepingTimeout time.Duration
+	// Shadow is a database the operation is validated on before the real one
+	Shadow          Dialect
+	ShadowRoundTrip bool
+
+	NoRunSummary bool
+
+	DeadlockRetries int
+	DeadlockBackoff time.Duration
+
+	Recover bool
+
+	RunID string
+
+	// SetupSQL are idempotent statements run before the migrations table
+	// is created, e.g. CREATE EXTENSION IF NOT EXISTS
+	SetupSQL []string
+
+	// TxFactory creates the transactions instead of the dialect
+	TxFactory func(ctx context.Context) (Tx, error)
+
+	WarnOnGaps bool
+
+	// WarnIdenticalUpDown logs down migrations which are copies of their up
+	// migrations
+	WarnIdenticalUpDown bool
+
+	// MaxMigrations caps the number of migrations a run applies
+	MaxMigrations int
+	// Strict turns the warnings of safety checks into errors
+	Strict bool
+
+	// StatementMetrics receives the timing of each statement
+	StatementMetrics func(StatementMetric)
+
+	// SchemaFingerprint compares the schema with the fingerprint of the
+	// last run and stores it after the run
+	SchemaFingerprint bool
+
+	// Checkpoints enables resuming migrations without a transaction
+	Checkpoints bool
+
+	ConfirmRollback bool
+
+	// Force proceeds despite a dirty migration
+	Force bool
+
+	// ReapplyEnvironment enables re-applying changed migrations
+	ReapplyEnvironment string
+
+	// TableSuffix selects the <table>_<suffix> migrations table
+	TableSuffix string
+
+	// AutoDownOnFailure runs the down migration of a failed migration
+	// without a transaction
+	AutoDownOnFailure bool
+
+	// Release identifies the deployment of the run in the migrations table
+	Release string
+
+	// SecretResolver resolves the secret placeholders of the migrations
+	SecretResolver SecretResolver
+
+	// Events receives the progress events of the run
+	Events chan<- Event
+
+	// OnConflict is the behavior when a pending migration is recorded as
+	// applied during the run
+	OnConflict ConflictStrategy
+
+	// rollbackOnly is set by operations which only need the migrations
+	// being rolled back
+	rollbackOnly bool
+	// applyOnly is set by operations which only apply migrations
+	applyOnly bool
+	// ignoreDirty is set by operations which resolve the dirty state
+	ignoreDirty bool
+	// dirty is the dirty migration the run proceeds despite of
+	dirty string
+	// migrations applied and rolled back during the run
+	runApplied    []string
+	runRolledBack []string
+	// report collects the details of the run, if requested
+	report *RunReport
 }
 
 // Option is a function that configures a RunOptions.
@@ -45,226 +241,1930 @@ func WithDryRun() Option {
 	}
 }
 
-// Up applies all pending "up" migrations.
-func (m *Migrator) Up(ctx context.Context, opts ...Option) error {
-	if err := m.prepareData(ctx, 0, m.doUp, opts...); err != nil {
-		return err
+// WithRollbackAfter is an option that really executes the migrations of the
+// run, all in one transaction which is rolled back at the end, so SQL and
+// constraint errors a dry run can't see are reported with the version of the
+// failed migration, and nothing persists. The dialect must implement
+// TransactionalDDL, and migrations without a transaction fail the run, as
+// their statements would be committed.
+func WithRollbackAfter() Option {
+	return func(opts *RunOptions) {
+		opts.RollbackAfter = true
 	}
+}
 
-	return nil
+// WithNoCreateTable is an option that disables automatic creation of the
+// migrations table. The migrator assumes the table already exists, which
+// allows running under a database user without DDL privileges.
+func WithNoCreateTable() Option {
+	return func(opts *RunOptions) {
+		opts.NoCreateTable = true
+	}
 }
 
-func (m *Migrator) doUp(ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error {
-	if steps <= 0 || steps > len(migrations) {
-		steps = len(migrations)
+// WithStripComments is an option that removes SQL line comments from the
+// migration content before it is executed. Comment markers inside string
+// literals and dollar-quoted bodies are preserved.
+func WithStripComments() Option {
+	return func(opts *RunOptions) {
+		opts.StripComments = true
 	}
+}
 
-	logMessage := "migrated"
-	if options.DryRun {
-		logMessage = "would migrate"
+// WithRunTimeout is an option that limits the duration of the whole run.
+// When the limit is exceeded the run is cancelled and ErrRunTimeout is returned.
+func WithRunTimeout(d time.Duration) Option {
+	return func(opts *RunOptions) {
+		opts.RunTimeout = d
 	}
+}
 
-	// Apply pending migrations
-	for _, file := range migrations {
-		if steps == 0 {
-			break
-		}
-		if slices.Contains(applied, file.Version) {
-			continue
-		}
+// WithBookkeepingTimeout is an option that limits each query the run makes
+// on the tables of the migrator: creating the migrations table, reading the
+// applied and the dirty migrations, the checksums and the checkpoints.
+// These queries are fast, so a long wait means a problem like a contended
+// catalog, and the run fails with ErrBookkeepingTimeout instead of hanging.
+// Migrations, their records and the lock are not limited.
+func WithBookkeepingTimeout(d time.Duration) Option {
+	return func(opts *RunOptions) {
+		opts.BookkeepingTimeout = d
+	}
+}
 
-		if !options.DryRun {
-			if err := m.commitMigration(ctx, file); err != nil {
-				return fmt.Errorf("failed to apply migration %s: %w", file.Version, err)
-			}
-		}
+// bookkeeping runs the query on the migrations table with the timeout of
+// WithBookkeepingTimeout
+func (o *RunOptions) bookkeeping(ctx context.Context, name string, query func(ctx context.Context) error) error {
+	if o.BookkeepingTimeout <= 0 {
+		return query(ctx)
+	}
 
-		m.logger.Info(logMessage, "file", file.Version)
+	queryCtx, cancel := context.WithTimeout(ctx, o.BookkeepingTimeout)
+	defer cancel()
 
-		steps--
+	err := query(queryCtx)
+	if err != nil && errors.Is(queryCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return fmt.Errorf("%w: %s took longer than %s: %w", ErrBookkeepingTimeout, name, o.BookkeepingTimeout, err)
 	}
+	return err
+}
 
-	return nil
+// WithShadowDatabase is an option that performs the operation against a
+// shadow database first, e.g. a fresh copy of the production schema.
+// The real database is not touched if the shadow run fails.
+func WithShadowDatabase(shadow Dialect) Option {
+	return func(opts *RunOptions) {
+		opts.Shadow = shadow
+	}
 }
 
-// Down applies a specific number of "down" migrations.
-func (m *Migrator) Down(ctx context.Context, steps int, opts ...Option) error {
-	if err := m.prepareData(ctx, steps, m.doDown, opts...); err != nil {
-		return err
+// WithShadowRoundTrip is an option that additionally checks the migrations
+// applied on the shadow database are reversible, by rolling them back and
+// applying them again before the real run.
+func WithShadowRoundTrip() Option {
+	return func(opts *RunOptions) {
+		opts.ShadowRoundTrip = true
 	}
+}
 
-	return nil
+// WithoutRunSummary is an option that disables the summary log record
+// written at the end of Up and To.
+func WithoutRunSummary() Option {
+	return func(opts *RunOptions) {
+		opts.NoRunSummary = true
+	}
 }
 
-func (m *Migrator) doDown(ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error {
-	if steps < 0 || steps > len(applied) {
-		steps = len(applied)
+// WithDeadlockRetry is an option that runs the transaction of a migration
+// again when it fails with a deadlock, up to retries times. The delay before
+// a retry starts at backoff and doubles with each attempt. Deadlocks are
+// detected by the dialect, see DeadlockDetector, other errors are not retried.
+// Migrations run with WithRollbackAfter are not retried either.
+func WithDeadlockRetry(retries int, backoff time.Duration) Option {
+	return func(opts *RunOptions) {
+		opts.DeadlockRetries = retries
+		opts.DeadlockBackoff = backoff
 	}
+}
 
-	// Determine the last N migrations to be rolled back.
-	if steps == 0 {
-		m.logger.Info("no migrations to rollback")
-		return nil
+// WithRecover is an option that converts a panic during a migration, e.g.
+// in a custom dialect or transaction, into an ErrPanic error with the stack
+// trace. The transaction of the migration is rolled back. By default panics
+// propagate, so bugs are not hidden.
+func WithRecover() Option {
+	return func(opts *RunOptions) {
+		opts.Recover = true
 	}
+}
 
-	toRollback := applied[len(applied)-steps:]
+// WithRunID is an option that adds the run_id field with the id to every
+// log record of the run, so the records of concurrent migrators can be told
+// apart. An empty id is replaced with a random UUID.
+func WithRunID(id string) Option {
+	return func(opts *RunOptions) {
+		opts.RunID = id
+		if id == "" {
+			opts.RunID = newRunID()
+		}
+	}
+}
 
-	logMessage := "rolled back"
-	if options.DryRun {
-		logMessage = "would rollback"
+// WithSetupSQL is an option that runs the statements at the start of every
+// run, before the migrations table is created, e.g. to create extensions the
+// table or the migrations rely on. The statements run outside of a
+// transaction when the dialect is an Executor and must be idempotent.
+func WithSetupSQL(statements ...string) Option {
+	return func(opts *RunOptions) {
+		opts.SetupSQL = append(opts.SetupSQL, statements...)
 	}
+}
 
-	// Rollback migrations in reverse order.
-	for i := len(toRollback) - 1; i >= 0; i-- {
-		version := toRollback[i]
-		var migration *Migration
-		for _, f := range migrations {
-			if f.Version == version {
-				migration = &f
-				break
-			}
-		}
+// WithTxFactory is an option that makes the migrator begin transactions
+// with the factory instead of the dialect, e.g. to join a transaction of an
+// external coordinator. The dialect still manages the migrations table and
+// the lock. Shadow runs use the transactions of the shadow dialect.
+func WithTxFactory(factory func(ctx context.Context) (Tx, error)) Option {
+	return func(opts *RunOptions) {
+		opts.TxFactory = factory
+	}
+}
 
-		if migration == nil {
-			return fmt.Errorf("migration file not found for version: %s", version)
-		}
+// WithCheckpoints is an option that saves the progress of migrations without
+// a transaction after each statement, see Checkpoint. When such a migration
+// fails, the next run skips the statements which already completed. The
+// dialect must implement Checkpointer.
+func WithCheckpoints() Option {
+	return func(opts *RunOptions) {
+		opts.Checkpoints = true
+	}
+}
 
-		if !options.DryRun {
-			if err := m.rollbackMigration(ctx, *migration); err != nil {
-				return fmt.Errorf("failed to rollback migration %s: %w", version, err)
-			}
-		}
+// WithConfirmRollback is an option that confirms the operation may roll back
+// migrations. Without it Down, DownOne, Revert and To with an older target
+// return ErrRollbackNotConfirmed instead of running down migrations, so a
+// mistyped command can't drop tables. Dry runs don't need the confirmation.
+func WithConfirmRollback() Option {
+	return func(opts *RunOptions) {
+		opts.ConfirmRollback = true
+	}
+}
 
-		m.logger.Info(logMessage, "file", version)
+// WithForce is an option that proceeds despite a dirty migration, instead
+// of returning ErrDirty. The dirty migration is run again by Up, so the
+// database must be fixed by hand first; Resolve is usually the better way.
+func WithForce() Option {
+	return func(opts *RunOptions) {
+		opts.Force = true
 	}
+}
 
-	return nil
+// reapplyEnvironments are the environments WithReapplyOnChange may be used in
+var reapplyEnvironments = []string{"development", "dev", "local", "test"}
 
+// WithReapplyOnChange is an option for development databases which makes Up
+// roll back and apply again the migrations whose content changed since they
+// were applied, so migrations can be edited freely. The migrations applied
+// after a changed one are rolled back and applied again with it. The
+// dialect must record checksums, see WithChecksums. As a guard against
+// production use, the run fails with ErrReapplyNotAllowed unless env is
+// development, dev, local or test, e.g. pass the environment of the
+// application.
+func WithReapplyOnChange(env string) Option {
+	return func(opts *RunOptions) {
+		opts.ReapplyEnvironment = env
+	}
 }
 
-// To migrates the database up or down to a specific version.
-func (m *Migrator) To(ctx context.Context, version string, opts ...Option) error {
-	if err := m.prepareData(ctx, 0, func(ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error {
+// WithWarnOnGaps is an option that logs a warning when sequential version
+// numbers have gaps, like 001, 002, 004, which often means a migration was
+// lost in a merge. Timestamp versions are not checked, gaps are expected there.
+func WithWarnOnGaps() Option {
+	return func(opts *RunOptions) {
+		opts.WarnOnGaps = true
+	}
+}
 
-		currentVersion := ""
-		apply := true
-		if len(applied) > 0 {
-			currentVersion = applied[len(applied)-1]
-			apply = false
-		}
-		if currentVersion == version {
-			return nil
-		}
+// WithWarnIdenticalUpDown is an option that logs a warning for each down
+// migration identical to its up migration, a copy-paste mistake which makes
+// a rollback apply the migration again instead of reverting it.
+func WithWarnIdenticalUpDown() Option {
+	return func(opts *RunOptions) {
+		opts.WarnIdenticalUpDown = true
+	}
+}
 
-		appliedIndex := slices.Index(applied, version)
-		if appliedIndex != -1 {
-			// we need to rollback
-			return m.doDown(ctx, len(applied)-appliedIndex-1, applied, migrations, options)
-		} else {
-			upSteps := 0
-			found := false
-			for _, f := range migrations {
-				if f.Version == currentVersion {
-					apply = true
-				} else if apply {
-					upSteps++
-				} else {
-					if f.Version == version {
-						return fmt.Errorf("applied migration and migrations are not in the same order for version: %s", version)
-					}
-				}
+// WithMaxMigrationsPerRun is an option that caps the number of migrations
+// applied by one run, limiting the blast radius of a deploy which brings
+// many migrations at once, e.g. accidentally merged ones. The run applies n
+// migrations and logs how many remain, another run continues. With
+// WithStrict, the run fails with ErrTooManyMigrations before anything is
+// applied instead.
+func WithMaxMigrationsPerRun(n int) Option {
+	return func(opts *RunOptions) {
+		opts.MaxMigrations = n
+	}
+}
 
-				if f.Version == version {
-					found = true
-					break
-				}
-			}
+// WithStrict is an option that turns the warnings of safety checks into
+// errors, see WithMaxMigrationsPerRun, WithWarnIdenticalUpDown and
+// WithSchemaFingerprint.
+func WithStrict() Option {
+	return func(opts *RunOptions) {
+		opts.Strict = true
+	}
+}
 
-			if !found {
-				return fmt.Errorf("migration file not found for version: %s", version)
-			}
+// WithTableSuffix is an option that runs the operation against the
+// <table>_<suffix> migrations table, e.g. schema_migrations_blue for
+// blue-green deployments, without creating another dialect. The suffix may
+// contain only letters, digits and underscores, and the dialect must
+// implement TableSuffixer.
+func WithTableSuffix(suffix string) Option {
+	return func(opts *RunOptions) {
+		opts.TableSuffix = suffix
+	}
+}
 
-			if upSteps > 0 {
-				return m.doUp(ctx, upSteps, applied, migrations, options)
-			}
-			return nil
-		}
+// WithRelease is an option that records the release, like a CI build number,
+// with each migration applied by the run, to correlate schema changes with
+// deployments. The dialect must record releases, see WithReleases.
+func WithRelease(release string) Option {
+	return func(opts *RunOptions) {
+		opts.Release = release
+	}
+}
 
-	}, opts...); err != nil {
+// WithAutoDownOnFailure is an option that cleans up after a migration
+// without a transaction which failed partway: its down statements are run
+// one by one right away, before the error is returned. Statements which
+// fail, e.g. because the up migration didn't get to create their objects,
+// are logged and skipped. The cleanup is best-effort, a dirty migration
+// stays dirty until it is resolved. Migrations in a transaction are rolled
+// back by the database and are not affected.
+func WithAutoDownOnFailure() Option {
+	return func(opts *RunOptions) {
+		opts.AutoDownOnFailure = true
+	}
+}
+
+// ConflictStrategy is the behavior of Up when a pending migration is found
+// recorded as applied during the run, e.g. by another instance under weak
+// locking.
+type ConflictStrategy int
+
+const (
+	// OnConflictSkip skips the migrations that were applied when the run
+	// started and doesn't check for migrations applied during the run
+	OnConflictSkip ConflictStrategy = iota
+	// OnConflictError fails the run with ErrAlreadyApplied
+	OnConflictError
+	// OnConflictReapply applies the migration again and replaces its record
+	OnConflictReapply
+)
+
+// WithConflictStrategy is an option that sets how Up handles a pending
+// migration recorded as applied during the run. With a strategy other than
+// OnConflictSkip, the applied migrations are read again before each
+// migration, which surfaces inconsistent state hidden by the silent skip.
+func WithConflictStrategy(strategy ConflictStrategy) Option {
+	return func(opts *RunOptions) {
+		opts.OnConflict = strategy
+	}
+}
+
+// newRunID returns a random version 4 UUID
+func newRunID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Lock events reported to the lock observer.
+const (
+	LockAcquired = "acquired"
+	LockReleased = "released"
+)
+
+// WithLockObserver is an option that reports lock activity.
+// The observer is called with LockAcquired and the time spent waiting for
+// the lock, and with LockReleased and the time the lock was held.
+func WithLockObserver(observer func(event string, d time.Duration)) Option {
+	return func(opts *RunOptions) {
+		opts.LockObserver = observer
+	}
+}
+
+// Up applies all pending "up" migrations.
+// Each migration is applied and recorded in its own transaction, so when a
+// run fails, the migrations before the failed one stay applied and calling
+// Up again continues with the failed migration.
+func (m *Migrator) Up(ctx context.Context, opts ...Option) error {
+	opts = append(opts, func(opts *RunOptions) {
+		opts.applyOnly = true
+	})
+	if err := m.prepareData(ctx, 0, withRunSummary((*Migrator).doUp), opts...); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (m *Migrator) prepareData(ctx context.Context, steps int, after func(ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error, opts ...Option) error {
-	options := &RunOptions{}
-	for _, opt := range opts {
-		opt(options)
+func (m *Migrator) doUp(ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error {
+	if options.ReapplyEnvironment != "" {
+		if err := m.reapplyChanged(ctx, applied, migrations, options); err != nil {
+			return err
+		}
 	}
 
-	// Create migrations table if it doesn't exist
-	if err := m.dialect.CreateMigrationsTable(ctx); err != nil {
-		return fmt.Errorf("failed to create migrations table: %w", err)
+	if steps <= 0 || steps > len(migrations) {
+		steps = len(migrations)
 	}
 
-	if !options.DryRun {
-		if err := m.dialect.Lock(ctx); err != nil {
-			return fmt.Errorf("failed to lock database: %w", err)
+	done := appliedSet(applied)
+	remaining := 0
+	if options.MaxMigrations > 0 {
+		pending := 0
+		for _, file := range migrations {
+			if _, ok := done[file.Version]; !ok {
+				pending++
+			}
+		}
+		if pending = min(pending, steps); pending > options.MaxMigrations {
+			if options.Strict {
+				return fmt.Errorf("%w: %d pending, at most %d per run", ErrTooManyMigrations, pending, options.MaxMigrations)
+			}
+			steps = options.MaxMigrations
+			remaining = pending - options.MaxMigrations
 		}
-		defer m.dialect.Unlock(ctx)
 	}
 
-	// Get all migration files from the source.
-	migrations, err := m.source.GetMigrations()
-	if err != nil {
-		return fmt.Errorf("failed to get migration files: %w", err)
+	logMessage := "migrated"
+	if options.DryRun {
+		logMessage = "would migrate"
 	}
 
-	// Get all applied migrations from the dialect.
-	applied, err := m.dialect.GetAppliedMigrations(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to get applied migrations: %w", err)
+	// Apply pending migrations
+	var refreshes []string
+	index := 0
+	for _, file := range migrations {
+		if steps == 0 {
+			break
+		}
+		if _, ok := done[file.Version]; ok {
+			continue
+		}
+
+		rows := unknownRows
+		start := time.Now()
+		if !options.DryRun {
+			options.emit(Event{Type: EventMigrationStart, Version: file.Version, Direction: DirectionUp})
+			replace, err := m.appliedDuringRun(ctx, file.Version, options)
+			if err == nil {
+				err = injectedFailure(DirectionUp, index)
+			}
+			if err == nil {
+				rows, err = m.commitMigration(ctx, file, options, replace)
+			}
+			if err != nil {
+				err = fmt.Errorf("failed to apply migration %s%s: %w", file.Version, m.errorClass(err), err)
+				// the migrations committed before still need their refreshes
+				return errors.Join(err, m.runRefreshes(ctx, refreshes, options))
+			}
+			options.emit(Event{Type: EventMigrationDone, Version: file.Version, Direction: DirectionUp})
+		}
+
+		m.logger.Info(logMessage, migrationFields(file.Version, rows)...)
+		options.runApplied = append(options.runApplied, file.Version)
+		options.report.applied(file, start, rows)
+
+		directives, _ := parseMigrationDirectives(file.Content)
+		for _, statement := range directives.Refresh {
+			if !slices.Contains(refreshes, statement) {
+				refreshes = append(refreshes, statement)
+			}
+		}
+
+		index++
+		steps--
 	}
 
-	return after(ctx, steps, applied, migrations, options)
+	if remaining > 0 {
+		m.logger.Info("migration cap reached, run again to apply the rest", "cap", options.MaxMigrations, "remaining", remaining)
+	}
+	return m.runRefreshes(ctx, refreshes, options)
 }
 
-func (m *Migrator) applyMigrations(ctx context.Context, content []byte, name string, after func(tx Tx) error) error {
-	if len(content) == 0 {
-		return fmt.Errorf("no content to apply for migration: %s", name)
+// reapplyChanged rolls back and applies again the applied migrations whose
+// content differs from the recorded checksum. The migrations applied after
+// the oldest changed one may depend on it, so they are rolled back before it
+// and applied again after it.
+func (m *Migrator) reapplyChanged(ctx context.Context, applied []string, migrations []Migration, options *RunOptions) error {
+	if !slices.Contains(reapplyEnvironments, options.ReapplyEnvironment) {
+		return fmt.Errorf("%w in environment %q", ErrReapplyNotAllowed, options.ReapplyEnvironment)
+	}
+	store, ok := m.dialect.(ChecksumReader)
+	if !ok {
+		return errors.New("dialect does not record checksums")
 	}
 
-	// Begin transaction
-	tx, err := m.dialect.BeginTx(ctx)
+	var checksums map[string]string
+	err := options.bookkeeping(ctx, "reading the checksums", func(ctx context.Context) (err error) {
+		checksums, err = store.GetChecksums(ctx)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return fmt.Errorf("failed to get checksums: %w", err)
 	}
-	defer tx.Rollback(ctx)
 
-	// Execute migration
-	if err = tx.Exec(ctx, string(content)); err != nil {
-		return fmt.Errorf("failed to execute migration: %w", err)
+	byVersion := versionIndex(migrations)
+	first := -1
+	for i, version := range applied {
+		j, ok := byVersion[version]
+		if !ok || checksums[version] == "" || checksums[version] == checksum(migrations[j].Content) {
+			continue
+		}
+
+		m.logger.Info("WARNING: migration changed since it was applied, re-applying it (development only)", "file", version, "env", options.ReapplyEnvironment)
+		if first == -1 {
+			first = i
+		}
+	}
+	if first == -1 {
+		return nil
 	}
 
-	// Record changes
-	err = after(tx)
-	if err != nil {
-		return fmt.Errorf("failed to record migration: %w", err)
+	reapplied := applied[first:]
+	for _, version := range reapplied {
+		if _, ok := byVersion[version]; !ok {
+			return fmt.Errorf("%w for version %s, which is applied after the changed migration %s", ErrMigrationNotFound, version, applied[first])
+		}
+	}
+	if options.DryRun {
+		for _, version := range reapplied {
+			m.logger.Info("would reapply", "file", version)
+		}
+		return nil
 	}
 
-	// Commit transaction
-	return tx.Commit(ctx)
-}
+	for i := len(reapplied) - 1; i >= 0; i-- {
+		version := reapplied[i]
+		if _, err := m.rollbackMigration(ctx, migrations[byVersion[version]], options); err != nil {
+			return fmt.Errorf("failed to roll back migration %s to reapply %s: %w", version, applied[first], err)
+		}
+	}
+	for _, version := range reapplied {
+		if _, err := m.commitMigration(ctx, migrations[byVersion[version]], options, false); err != nil {
+			return fmt.Errorf("failed to reapply migration %s: %w", version, err)
+		}
+		m.logger.Info("reapplied", "file", version)
+	}
 
-func (m *Migrator) commitMigration(ctx context.Context, migration Migration) error {
-	return m.applyMigrations(ctx, migration.Content, migration.Version, func(tx Tx) error {
-		return m.dialect.StoreAppliedMigration(ctx, tx, migration.Version)
-	})
+	return nil
 }
 
-func (m *Migrator) rollbackMigration(ctx context.Context, migration Migration) error {
-	return m.applyMigrations(ctx, migration.DownContent, migration.Version, func(tx Tx) error {
+// appliedDuringRun checks whether the pending migration was recorded as
+// applied since the run started, according to the conflict strategy. It
+// reports whether the record of the migration should be replaced.
+func (m *Migrator) appliedDuringRun(ctx context.Context, version string, options *RunOptions) (bool, error) {
+	if options.OnConflict == OnConflictSkip {
+		return false, nil
+	}
+
+	var applied []string
+	err := options.bookkeeping(ctx, "reading the applied migrations", func(ctx context.Context) (err error) {
+		applied, err = m.dialect.GetAppliedMigrations(ctx)
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	if !slices.Contains(applied, version) {
+		return false, nil
+	}
+
+	if options.OnConflict == OnConflictError {
+		return false, fmt.Errorf("%w during the run", ErrAlreadyApplied)
+	}
+	m.logger.Info("WARNING: migration was applied during the run, applying it again", "file", version)
+	return true, nil
+}
+
+// runRefreshes executes the refresh-after statements of the applied
+// migrations once, in the order the migrations were applied. They run
+// outside of a transaction when the dialect supports it.
+func (m *Migrator) runRefreshes(ctx context.Context, refreshes []string, options *RunOptions) error {
+	for _, statement := range refreshes {
+		if options.DryRun {
+			m.logger.Info("would refresh", "statement", statement)
+			continue
+		}
+
+		if err := m.execStatement(ctx, statement); err != nil {
+			return fmt.Errorf("failed to refresh %q: %w", statement, err)
+		}
+		m.logger.Info("refreshed", "statement", statement)
+	}
+
+	return nil
+}
+
+// beginTx begins a transaction with the factory of the run or the dialect
+func (m *Migrator) beginTx(ctx context.Context) (Tx, error) {
+	if m.sharedTx != nil {
+		return sharedTx{Tx: m.sharedTx}, nil
+	}
+	if m.txFactory != nil {
+		return m.txFactory(ctx)
+	}
+	return m.dialect.BeginTx(ctx)
+}
+
+// sharedTx is a migration transaction inside the transaction of
+// WithRollbackAfter. Its commit and rollback are left to the run.
+type sharedTx struct {
+	Tx
+}
+
+func (t sharedTx) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (t sharedTx) Rollback(ctx context.Context) error {
+	return nil
+}
+
+func (t sharedTx) ExecResult(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	execer, ok := t.Tx.(ResultExecer)
+	if !ok {
+		// the rows affected are reported as unknown
+		return driver.ResultNoRows, t.Tx.Exec(ctx, query, args...)
+	}
+	return execer.ExecResult(ctx, query, args...)
+}
+
+func (t sharedTx) QueryValue(ctx context.Context, query string, args ...interface{}) (interface{}, error) {
+	querier, ok := t.Tx.(Querier)
+	if !ok {
+		return nil, errors.New("transaction does not support queries")
+	}
+	return querier.QueryValue(ctx, query, args...)
+}
+
+// execStatement runs a single statement outside of the migrations, without a
+// transaction if the dialect supports it
+func (m *Migrator) execStatement(ctx context.Context, statement string) error {
+	if executor, ok := m.dialect.(Executor); ok && m.sharedTx == nil {
+		return executor.ExecContext(ctx, statement)
+	}
+
+	tx, err := m.beginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := tx.Exec(ctx, statement); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Down applies a specific number of "down" migrations.
+// Steps is the number of migrations to roll back: 0 rolls back nothing,
+// a negative value rolls back all applied migrations.
+func (m *Migrator) Down(ctx context.Context, steps int, opts ...Option) error {
+	opts = append(opts, func(opts *RunOptions) {
+		opts.rollbackOnly = true
+	})
+	if err := m.prepareData(ctx, steps, (*Migrator).doDown, opts...); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DownOne rolls back the last applied migration, it is equal to Down(ctx, 1).
+func (m *Migrator) DownOne(ctx context.Context, opts ...Option) error {
+	return m.Down(ctx, 1, opts...)
+}
+
+func (m *Migrator) doDown(ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error {
+	if steps < 0 || steps > len(applied) {
+		steps = len(applied)
+	}
+
+	// Determine the last N migrations to be rolled back.
+	if steps == 0 {
+		m.logger.Info("no migrations to rollback")
+		return nil
+	}
+
+	if !options.DryRun && !options.ConfirmRollback {
+		return fmt.Errorf("%w: %d migrations would be rolled back, use WithConfirmRollback", ErrRollbackNotConfirmed, steps)
+	}
+
+	toRollback := applied[len(applied)-steps:]
+
+	logMessage := "rolled back"
+	if options.DryRun {
+		logMessage = "would rollback"
+	}
+
+	// Rollback migrations in reverse order.
+	byVersion := versionIndex(migrations)
+	for i := len(toRollback) - 1; i >= 0; i-- {
+		version := toRollback[i]
+		var migration *Migration
+		var err error
+		if j, ok := byVersion[version]; ok {
+			migration = &migrations[j]
+		} else if migration, err = m.findMigration(version, nil); err != nil {
+			// not an ad hoc migration or one of a random access source
+			return err
+		}
+
+		rows := unknownRows
+		start := time.Now()
+		if !options.DryRun {
+			options.emit(Event{Type: EventMigrationStart, Version: version, Direction: DirectionDown})
+			err = injectedFailure(DirectionDown, len(toRollback)-1-i)
+			if err == nil {
+				rows, err = m.rollbackMigration(ctx, *migration, options)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to rollback migration %s%s: %w", version, m.errorClass(err), err)
+			}
+			options.emit(Event{Type: EventMigrationDone, Version: version, Direction: DirectionDown})
+		}
+
+		m.logger.Info(logMessage, migrationFields(version, rows)...)
+		options.runRolledBack = append(options.runRolledBack, version)
+		options.report.rolledBack(*migration, start, rows)
+	}
+
+	return nil
+
+}
+
+// Revert rolls back only the migration of the version, leaving the
+// migrations applied after it in place. It is meant for migrations that are
+// independent of the later ones; the history is non-linear afterwards.
+func (m *Migrator) Revert(ctx context.Context, version string, opts ...Option) error {
+	opts = append(opts, func(opts *RunOptions) {
+		opts.rollbackOnly = true
+	})
+
+	return m.prepareData(ctx, 0, func(m *Migrator, ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error {
+		index := slices.Index(applied, version)
+		if index == -1 {
+			return fmt.Errorf("migration %s is not applied", version)
+		}
+
+		migration, err := m.findMigration(version, migrations)
+		if err != nil {
+			return err
+		}
+
+		if options.DryRun {
+			m.logger.Info("would revert", "file", version)
+			return nil
+		}
+		if !options.ConfirmRollback {
+			return fmt.Errorf("%w: %s would be reverted, use WithConfirmRollback", ErrRollbackNotConfirmed, version)
+		}
+
+		rows, err := m.rollbackMigration(ctx, *migration, options)
+		if err != nil {
+			return fmt.Errorf("failed to revert migration %s: %w", version, err)
+		}
+		m.logger.Info("reverted", migrationFields(version, rows)...)
+		options.runRolledBack = append(options.runRolledBack, version)
+
+		if later := len(applied) - index - 1; later > 0 {
+			m.logger.Info("warning: migration history is now non-linear", "file", version, "later_applied", later)
+		}
+		return nil
+	}, opts...)
+}
+
+// Resolve clears the dirty state of a migration without a transaction which
+// failed partway, after the database was fixed by hand. With markApplied
+// the migration is recorded as applied, otherwise it stays pending and is
+// run again by the next Up. With WithCheckpoints the checkpoint of a
+// migration recorded as applied is cleared, a pending one keeps it to resume.
+func (m *Migrator) Resolve(ctx context.Context, version string, markApplied bool, opts ...Option) error {
+	marker, ok := m.dialect.(DirtyMarker)
+	if !ok {
+		return errors.New("dialect does not track dirty migrations")
+	}
+	opts = append(opts, func(opts *RunOptions) {
+		opts.ignoreDirty = true
+	})
+
+	return m.prepareData(ctx, 0, func(m *Migrator, ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error {
+		var dirty string
+		err := options.bookkeeping(ctx, "reading the dirty migration", func(ctx context.Context) (err error) {
+			dirty, err = marker.GetDirty(ctx)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get dirty migration: %w", err)
+		}
+		if dirty != version {
+			return fmt.Errorf("migration %s is not dirty", version)
+		}
+
+		if options.DryRun {
+			m.logger.Info("would resolve", "file", version, "applied", markApplied)
+			return nil
+		}
+
+		if markApplied && !slices.Contains(applied, version) {
+			tx, err := m.beginTx(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to begin transaction: %w", err)
+			}
+			defer tx.Rollback(ctx)
+
+			if err := m.dialect.StoreAppliedMigration(ctx, tx, AppliedRecord{Version: version}); err != nil {
+				return fmt.Errorf("failed to record migration: %w", err)
+			}
+			if err := tx.Commit(ctx); err != nil {
+				return err
+			}
+		}
+		if store, ok := m.dialect.(Checkpointer); ok && markApplied && options.Checkpoints {
+			if err := store.DeleteCheckpoint(ctx, version); err != nil {
+				return fmt.Errorf("failed to clear checkpoint of %s: %w", version, err)
+			}
+		}
+		if err := marker.ClearDirty(ctx); err != nil {
+			return fmt.Errorf("failed to clear dirty migration: %w", err)
+		}
+
+		m.logger.Info("resolved", "file", version, "applied", markApplied)
+		return nil
+	}, opts...)
+}
+
+// findMigration returns the migration of the version from the loaded
+// migrations, or reads it from the source if it supports random access
+func (m *Migrator) findMigration(version string, migrations []Migration) (*Migration, error) {
+	for _, f := range migrations {
+		if f.Version == version {
+			return &f, nil
+		}
+	}
+
+	if f, ok := m.adHoc.find(version); ok {
+		return &f, nil
+	}
+
+	if source, ok := m.source.(RandomAccessSource); ok {
+		migration, err := source.GetMigration(version)
+		if err != nil {
+			return nil, err
+		}
+		return &migration, nil
+	}
+
+	return nil, fmt.Errorf("%w for version: %s", ErrMigrationNotFound, version)
+}
+
+// Symbolic targets of To. They are reserved and can't be used as versions.
+const (
+	// TargetLatest is the newest migration of the source
+	TargetLatest = "latest"
+	// TargetZero is the state with all migrations rolled back
+	TargetZero = "zero"
+)
+
+// To migrates the database up or down to a specific version.
+// The version can also be TargetLatest to apply all pending migrations,
+// TargetZero or an empty string to roll back all applied migrations, or a
+// relative target like "+2" or "-1" to apply or roll back that number of
+// migrations from the current head, or the label a migration declares with
+// the label directive, like "v2.3". An unknown target returns
+// ErrTargetNotFound, a pending target before the newest applied migration
+// ErrOrderMismatch.
+func (m *Migrator) To(ctx context.Context, version string, opts ...Option) error {
+	if _, _, err := parseRelativeTarget(version); err != nil {
+		return err
+	}
+
+	return m.prepareData(ctx, 0, withRunSummary(func(m *Migrator, ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error {
+		return m.doTo(ctx, version, applied, migrations, options)
+	}), opts...)
+}
+
+// Migrate migrates the database to the target like To, but only when the
+// current head is the from version, so a deploy planned against a known
+// state doesn't run on a database which has moved on. The head is checked
+// under the lock before anything is applied, and ErrVersionMismatch is
+// returned when it differs. The from version can be a label, or TargetZero
+// or an empty string for a database without applied migrations.
+func (m *Migrator) Migrate(ctx context.Context, from, to string, opts ...Option) error {
+	if _, _, err := parseRelativeTarget(to); err != nil {
+		return err
+	}
+
+	return m.prepareData(ctx, 0, withRunSummary(func(m *Migrator, ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error {
+		expected := resolveLabel(from, migrations)
+		if expected == TargetZero {
+			expected = ""
+		}
+		if head := headVersion(applied, m.versionLess); head != expected {
+			return fmt.Errorf("%w: expected %q, got %q", ErrVersionMismatch, expected, head)
+		}
+		return m.doTo(ctx, to, applied, migrations, options)
+	}), opts...)
+}
+
+// doTo migrates up or down to the target of To
+func (m *Migrator) doTo(ctx context.Context, version string, applied []string, migrations []Migration, options *RunOptions) error {
+	relative, isRelative, err := parseRelativeTarget(version)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case isRelative && relative > 0:
+		return m.doUp(ctx, relative, applied, migrations, options)
+	case isRelative:
+		return m.doDown(ctx, -relative, applied, migrations, options)
+	case version == TargetLatest:
+		return m.doUp(ctx, 0, applied, migrations, options)
+	case version == TargetZero || version == "":
+		return m.doDown(ctx, -1, applied, migrations, options)
+	}
+
+	version = resolveLabel(version, migrations)
+
+	currentVersion := ""
+	apply := true
+	if len(applied) > 0 {
+		currentVersion = applied[len(applied)-1]
+		apply = false
+	}
+	if currentVersion == version {
+		return nil
+	}
+
+	appliedIndex := slices.Index(applied, version)
+	if appliedIndex != -1 {
+		// we need to rollback
+		return m.doDown(ctx, len(applied)-appliedIndex-1, applied, migrations, options)
+	} else {
+		upSteps := 0
+		found := false
+		for _, f := range migrations {
+			if f.Version == currentVersion {
+				apply = true
+			} else if apply {
+				upSteps++
+			} else {
+				if f.Version == version {
+					return fmt.Errorf("%w for version: %s", ErrOrderMismatch, version)
+				}
+			}
+
+			if f.Version == version {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("%w: %w for version: %s", ErrTargetNotFound, ErrMigrationNotFound, version)
+		}
+
+		if upSteps > 0 {
+			return m.doUp(ctx, upSteps, applied, migrations, options)
+		}
+		return nil
+	}
+}
+
+// resolveLabel returns the version of the migration with the label, or the
+// target itself when it is not a label
+func resolveLabel(target string, migrations []Migration) string {
+	for _, f := range migrations {
+		if f.Version == target {
+			return target
+		}
+	}
+	for _, f := range migrations {
+		if directives, err := parseMigrationDirectives(f.Content); err == nil && directives.Label == target {
+			return f.Version
+		}
+	}
+	return target
+}
+
+// ApplyAdHoc applies the up SQL as a tracked migration of the version that
+// is not part of the source, e.g. an emergency fix which is backfilled into
+// the source later. The version is recorded, so it is not applied again, and
+// the down SQL is used when it is rolled back by this migrator. It returns
+// ErrAlreadyApplied if the version is already applied.
+func (m *Migrator) ApplyAdHoc(ctx context.Context, version string, up, down []byte, opts ...Option) error {
+	migration := Migration{Version: version, Content: up, DownContent: down}
+
+	return m.prepareData(ctx, 0, func(m *Migrator, ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error {
+		if slices.Contains(applied, version) {
+			return fmt.Errorf("%w: %s", ErrAlreadyApplied, version)
+		}
+
+		if options.DryRun {
+			m.logger.Info("would migrate", "file", version, "adhoc", true)
+			return nil
+		}
+
+		rows, err := m.commitMigration(ctx, migration, options, false)
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %s%s: %w", version, m.errorClass(err), err)
+		}
+		m.adHoc.add(migration)
+
+		m.logger.Info("migrated", append(migrationFields(version, rows), "adhoc", true)...)
+		return nil
+	}, opts...)
+}
+
+// TestReversibility checks that every migration can be rolled back. It
+// applies all pending migrations, rolls all of them back, applies them again
+// and compares the applied migrations before and after the round trip.
+// It is meant for CI against a disposable database, which is left fully
+// migrated at the end. As it rolls back every migration, it requires
+// WithConfirmRollback.
+func (m *Migrator) TestReversibility(ctx context.Context, opts ...Option) error {
+	return m.prepareData(ctx, 0, func(m *Migrator, ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error {
+		if options.DryRun {
+			return errors.New("reversibility check can't run in dry run mode")
+		}
+		if !options.ConfirmRollback {
+			return fmt.Errorf("%w: the reversibility check rolls back all migrations, use WithConfirmRollback", ErrRollbackNotConfirmed)
+		}
+
+		if err := m.doUp(ctx, 0, applied, migrations, options); err != nil {
+			return err
+		}
+		up, err := m.dialect.GetAppliedMigrations(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get applied migrations: %w", err)
+		}
+
+		if err := m.doDown(ctx, -1, up, migrations, options); err != nil {
+			return err
+		}
+		down, err := m.dialect.GetAppliedMigrations(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get applied migrations: %w", err)
+		}
+		if len(down) != 0 {
+			return fmt.Errorf("reversibility check failed: migrations still applied after rollback: %s", strings.Join(down, ", "))
+		}
+
+		if err := m.doUp(ctx, 0, down, migrations, options); err != nil {
+			return err
+		}
+		final, err := m.dialect.GetAppliedMigrations(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get applied migrations: %w", err)
+		}
+		if !slices.Equal(up, final) {
+			return fmt.Errorf("reversibility check failed: applied migrations changed from [%s] to [%s]", strings.Join(up, ", "), strings.Join(final, ", "))
+		}
+
+		m.logger.Info("reversibility check passed", "migrations", len(final))
+		return nil
+	}, opts...)
+}
+
+// parseRelativeTarget parses a target of To relative to the current head,
+// like "+2" or "-1", into the signed number of steps
+func parseRelativeTarget(version string) (int, bool, error) {
+	if !isRelativeTarget(version) {
+		return 0, false, nil
+	}
+
+	n, err := strconv.Atoi(version[1:])
+	if err != nil || n <= 0 || strings.HasPrefix(version[1:], "+") || strings.HasPrefix(version[1:], "-") {
+		return 0, false, fmt.Errorf("invalid relative target %q: expected +N or -N with a positive number N", version)
+	}
+	if version[0] == '-' {
+		n = -n
+	}
+	return n, true, nil
+}
+
+// isRelativeTarget reports whether the target of To is relative
+func isRelativeTarget(version string) bool {
+	return strings.HasPrefix(version, "+") || strings.HasPrefix(version, "-")
+}
+
+// CheckCompatible returns ErrSchemaAhead if the database has applied
+// migrations newer than the newest migration of the source, e.g. when an old
+// application instance runs against a schema migrated by a newer release.
+// Versions are compared in the order of the source when it is an
+// OrderedSource. It only reads the applied migrations, without locking or
+// creating the migrations table.
+func (m *Migrator) CheckCompatible(ctx context.Context) error {
+	migrations, err := m.source.GetMigrations()
+	if err != nil {
+		return fmt.Errorf("failed to get migration files: %w", err)
+	}
+
+	applied, err := m.dialect.GetAppliedMigrations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+
+	newest := ""
+	for _, f := range migrations {
+		if newest == "" || m.versionLess(newest, f.Version) {
+			newest = f.Version
+		}
+	}
+
+	var ahead []string
+	for _, version := range applied {
+		if newest == "" || m.versionLess(newest, version) {
+			ahead = append(ahead, version)
+		}
+	}
+	if len(ahead) > 0 {
+		return fmt.Errorf("%w: %s", ErrSchemaAhead, strings.Join(ahead, ", "))
+	}
+
+	return nil
+}
+
+// runFunc performs a migration operation with the prepared data
+type runFunc func(m *Migrator, ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error
+
+// withRunSummary logs the number of migrations applied by the operation
+// and the resulting head version
+func withRunSummary(after runFunc) runFunc {
+	return func(m *Migrator, ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error {
+		if err := after(m, ctx, steps, applied, migrations, options); err != nil {
+			return err
+		}
+		if options.DryRun || options.NoRunSummary {
+			return nil
+		}
+
+		head := applied[:len(applied)-len(options.runRolledBack)]
+		head = append(slices.Clone(head), options.runApplied...)
+		headVersion := ""
+		if len(head) > 0 {
+			headVersion = head[len(head)-1]
+		}
+
+		m.logger.Info("migration run complete", "applied", len(options.runApplied), "head", headVersion)
+		return nil
+	}
+}
+
+func (m *Migrator) prepareData(ctx context.Context, steps int, after runFunc, opts ...Option) error {
+	options := &RunOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	if options.RunID != "" {
+		run := *m
+		run.logger = runLogger{Logger: m.logger, id: options.RunID}
+		m = &run
+	}
+	if options.TxFactory != nil {
+		run := *m
+		run.txFactory = options.TxFactory
+		m = &run
+	}
+	if options.TableSuffix != "" {
+		if !isIdentifierFragment(options.TableSuffix) {
+			return fmt.Errorf("invalid table suffix: %q", options.TableSuffix)
+		}
+		suffixer, ok := m.dialect.(TableSuffixer)
+		if !ok {
+			return errors.New("dialect does not support table suffixes")
+		}
+		run := *m
+		run.dialect = suffixer.WithTableSuffix(options.TableSuffix)
+		m = &run
+	}
+
+	options.emit(Event{Type: EventStart})
+	err := m.runWithTimeout(ctx, steps, after, options)
+	if err != nil {
+		options.emit(Event{Type: EventError, Err: err})
+	} else {
+		options.emit(Event{Type: EventDone})
+	}
+	return err
+}
+
+// runWithTimeout performs the run within the run timeout, if any
+func (m *Migrator) runWithTimeout(ctx context.Context, steps int, after runFunc, options *RunOptions) error {
+	if options.RunTimeout <= 0 {
+		return m.prepareRun(ctx, steps, after, options)
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, options.RunTimeout)
+	defer cancel()
+
+	err := m.prepareRun(runCtx, steps, after, options)
+	if err != nil && errors.Is(runCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return fmt.Errorf("%w after %s: %w", ErrRunTimeout, options.RunTimeout, err)
+	}
+	return err
+}
+
+// sourceDirection returns the direction of the content the run needs from
+// the source, or an empty string for both. Rollbacks don't need the up
+// content, and runs which only apply migrations don't need the down content
+// unless they reapply changed migrations or compare the up and down content.
+func (o *RunOptions) sourceDirection() string {
+	switch {
+	case o.rollbackOnly:
+		return DirectionDown
+	case o.applyOnly && o.ReapplyEnvironment == "" && !o.WarnIdenticalUpDown:
+		return DirectionUp
+	}
+	return ""
+}
+
+func (m *Migrator) prepareRun(ctx context.Context, steps int, after runFunc, options *RunOptions) error {
+	// Get all migration files from the source, unless the migrations to
+	// roll back can be read one by one. They are validated before the
+	// database is touched.
+	var migrations []Migration
+	if _, ok := m.source.(RandomAccessSource); !ok || !options.rollbackOnly {
+		var err error
+		direction := options.sourceDirection()
+		migrations, err = getMigrationsFor(ctx, m.source, direction)
+		if err != nil {
+			return fmt.Errorf("failed to get migration files: %w", err)
+		}
+
+		if err := validateSource(migrations, direction); err != nil {
+			return fmt.Errorf("invalid migration files: %w", err)
+		}
+
+		// Respect dependencies declared with the requires directive
+		migrations, err = orderByDependencies(migrations)
+		if err != nil {
+			return fmt.Errorf("failed to order migrations: %w", err)
+		}
+
+		if options.WarnOnGaps {
+			if gaps := versionGaps(migrations); len(gaps) > 0 {
+				missing := make([]string, len(gaps))
+				for i, gap := range gaps {
+					missing[i] = gap.missing
+				}
+				m.logger.Info("warning: gaps in migration versions", "missing", strings.Join(missing, ", "))
+			}
+		}
+
+		if options.WarnIdenticalUpDown {
+			var identical []string
+			for _, f := range migrations {
+				if identicalUpDown(f) {
+					identical = append(identical, f.Version)
+				}
+			}
+			if len(identical) > 0 && options.Strict {
+				return fmt.Errorf("%w: %s", ErrIdenticalUpDown, strings.Join(identical, ", "))
+			}
+			for _, version := range identical {
+				m.logger.Info("warning: down migration is identical to up migration", "version", version)
+			}
+		}
+	}
+
+	if options.Shadow != nil {
+		if err := m.runShadow(ctx, steps, after, options); err != nil {
+			return fmt.Errorf("shadow run failed: %w", err)
+		}
+	}
+
+	// Prerequisites of the migrations table and the migrations
+	for _, statement := range options.SetupSQL {
+		if err := m.execStatement(ctx, statement); err != nil {
+			return fmt.Errorf("failed to run setup SQL %q: %w", statement, err)
+		}
+	}
+
+	// Create migrations table if it doesn't exist
+	if !options.NoCreateTable {
+		if err := options.bookkeeping(ctx, "creating the migrations table", m.dialect.CreateMigrationsTable); err != nil {
+			return fmt.Errorf("failed to create migrations table: %w", err)
+		}
+	}
+
+	if !options.DryRun {
+		var locker Locker = m.dialect
+		if options.Locker != nil {
+			locker = options.Locker
+		}
+		waitStart := time.Now()
+		if err := locker.Lock(ctx); err != nil {
+			return fmt.Errorf("failed to lock database: %w", err)
+		}
+		acquired := time.Now()
+		if options.LockObserver != nil {
+			options.LockObserver(LockAcquired, acquired.Sub(waitStart))
+		}
+		defer func() {
+			// release the lock even if the run was cancelled or timed out
+			locker.Unlock(context.WithoutCancel(ctx))
+			if options.LockObserver != nil {
+				options.LockObserver(LockReleased, time.Since(acquired))
+			}
+		}()
+	}
+
+	// Get all applied migrations from the dialect.
+	var applied []string
+	err := options.bookkeeping(ctx, "reading the applied migrations", func(ctx context.Context) (err error) {
+		applied, err = m.dialect.GetAppliedMigrations(ctx)
+		return err
+	})
+	if err != nil {
+		if options.NoCreateTable {
+			return fmt.Errorf("failed to get applied migrations (table creation is disabled, check that the migrations table exists): %w", err)
+		}
+		return fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+
+	// A tampered migrations table can contain a version twice, which would
+	// break the step math of rollbacks
+	applied, duplicates := dedupeApplied(applied)
+	if len(duplicates) > 0 {
+		m.logger.Info("duplicate applied migrations ignored", "versions", strings.Join(duplicates, ", "))
+	}
+
+	if marker, ok := m.dialect.(DirtyMarker); ok && !options.ignoreDirty {
+		var dirty string
+		err := options.bookkeeping(ctx, "reading the dirty migration", func(ctx context.Context) (err error) {
+			dirty, err = marker.GetDirty(ctx)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get dirty migration: %w", err)
+		}
+		if dirty != "" {
+			if !options.Force {
+				return fmt.Errorf("%w: migration %s failed partway, fix the database and call Resolve", ErrDirty, dirty)
+			}
+			m.logger.Info("warning: proceeding despite dirty migration", "file", dirty)
+			options.dirty = dirty
+		}
+	}
+
+	if options.RollbackAfter && !options.DryRun {
+		return m.runRolledBack(ctx, steps, after, applied, migrations, options)
+	}
+	if !options.SchemaFingerprint || options.DryRun {
+		return after(m, ctx, steps, applied, migrations, options)
+	}
+
+	store, err := m.checkFingerprint(ctx, options)
+	if err != nil {
+		return err
+	}
+	// the migrations committed before a failure changed the schema too
+	err = after(m, ctx, steps, applied, migrations, options)
+	return errors.Join(err, storeFingerprint(context.WithoutCancel(ctx), store))
+}
+
+// runRolledBack runs the migrations in one transaction which is rolled back
+// at the end, see WithRollbackAfter
+func (m *Migrator) runRolledBack(ctx context.Context, steps int, after runFunc, applied []string, migrations []Migration, options *RunOptions) error {
+	if dialect, ok := m.dialect.(TransactionalDDL); !ok || !dialect.TransactionalDDL() {
+		return errors.New("dialect does not roll back schema changes, a run can't be rolled back")
+	}
+
+	tx, err := m.beginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	run := *m
+	run.sharedTx = tx
+
+	err = after(&run, ctx, steps, applied, migrations, options)
+	if rollbackErr := tx.Rollback(context.WithoutCancel(ctx)); rollbackErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to roll back the run: %w", rollbackErr))
+	}
+	if err != nil {
+		return err
+	}
+	m.logger.Info("run rolled back", "applied", len(options.runApplied), "rolled_back", len(options.runRolledBack))
+	return nil
+}
+
+// appliedSet returns the applied versions as a set, for membership checks
+// in loops over the migrations
+func appliedSet(applied []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(applied))
+	for _, version := range applied {
+		set[version] = struct{}{}
+	}
+	return set
+}
+
+// versionIndex returns the positions of the migrations by version, the
+// first one of a repeated version
+func versionIndex(migrations []Migration) map[string]int {
+	index := make(map[string]int, len(migrations))
+	for i, f := range migrations {
+		if _, ok := index[f.Version]; !ok {
+			index[f.Version] = i
+		}
+	}
+	return index
+}
+
+// dedupeApplied removes repeated versions from the applied migrations,
+// keeping the first occurrence, and returns the repeated versions
+func dedupeApplied(applied []string) ([]string, []string) {
+	seen := make(map[string]bool, len(applied))
+	var unique, duplicates []string
+	for _, v := range applied {
+		if seen[v] {
+			duplicates = append(duplicates, v)
+			continue
+		}
+		seen[v] = true
+		unique = append(unique, v)
+	}
+	if len(duplicates) == 0 {
+		return applied, nil
+	}
+	return unique, duplicates
+}
+
+// validateSource checks the migrations of the source before they are used,
+// and returns all problems found as a single error
+func validateSource(migrations []Migration, direction string) error {
+	return errors.Join(sourceProblems(migrations, direction)...)
+}
+
+// sourceProblems returns the problems of the source migrations, like empty
+// or duplicate versions. Migrations loaded for DirectionDown have no up
+// content to check.
+func sourceProblems(migrations []Migration, direction string) []error {
+	var errs []error
+	seen := make(map[string]bool, len(migrations))
+	for i, f := range migrations {
+		switch {
+		case f.Version == "":
+			errs = append(errs, fmt.Errorf("migration %d has an empty version", i))
+			continue
+		case f.Version == TargetLatest || f.Version == TargetZero || isRelativeTarget(f.Version):
+			errs = append(errs, fmt.Errorf("migration version %q is reserved", f.Version))
+		case seen[f.Version]:
+			errs = append(errs, fmt.Errorf("duplicate migration version %s", f.Version))
+		}
+		seen[f.Version] = true
+
+		if len(f.Content) == 0 && direction != DirectionDown {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrEmptyMigration, f.Version))
+		}
+	}
+
+	labels := make(map[string]string)
+	for _, f := range migrations {
+		directives, err := parseMigrationDirectives(f.Content)
+		if err != nil || directives.Label == "" {
+			// invalid directives are reported when the migration is applied
+			continue
+		}
+		label := directives.Label
+		switch {
+		case labels[label] != "":
+			errs = append(errs, fmt.Errorf("label %s is declared by migrations %s and %s", label, labels[label], f.Version))
+		case seen[label]:
+			errs = append(errs, fmt.Errorf("label %s of migration %s is the version of another migration", label, f.Version))
+		case label == TargetLatest || label == TargetZero || isRelativeTarget(label):
+			errs = append(errs, fmt.Errorf("label %q of migration %s is reserved", label, f.Version))
+		}
+		labels[label] = f.Version
+	}
+
+	return errs
+}
+
+// runShadow performs the operation against the shadow database. With the
+// round trip enabled, the migrations applied by the operation are then
+// rolled back and applied again.
+func (m *Migrator) runShadow(ctx context.Context, steps int, after runFunc, options *RunOptions) error {
+	shadow := &Migrator{source: m.source, dialect: options.Shadow, logger: shadowLogger{m.logger}}
+	shadowOptions := *options
+	shadowOptions.Shadow = nil
+	shadowOptions.DryRun = false
+	shadowOptions.LockObserver = nil
+	shadowOptions.report = nil
+	shadowOptions.Events = nil
+	// the lock belongs to the main database
+	shadowOptions.Locker = nil
+
+	before := 0
+	err := shadow.prepareRun(ctx, steps, func(m *Migrator, ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error {
+		before = len(applied)
+		return after(m, ctx, steps, applied, migrations, options)
+	}, &shadowOptions)
+	if err != nil || !options.ShadowRoundTrip {
+		return err
+	}
+
+	// the round trip rolls back on the shadow database only
+	roundTripOptions := shadowOptions
+	roundTripOptions.ConfirmRollback = true
+	return shadow.prepareRun(ctx, 0, func(m *Migrator, ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error {
+		n := len(applied) - before
+		if n <= 0 {
+			return nil
+		}
+		if err := m.doDown(ctx, n, applied, migrations, options); err != nil {
+			return err
+		}
+		return m.doUp(ctx, n, applied[:before], migrations, options)
+	}, &roundTripOptions)
+}
+
+// runLogger adds the run ID to log records
+type runLogger struct {
+	Logger
+	id string
+}
+
+func (l runLogger) Info(msg string, v ...interface{}) {
+	l.Logger.Info(msg, append(v, "run_id", l.id)...)
+}
+
+// shadowLogger marks log records of the shadow run
+type shadowLogger struct {
+	Logger
+}
+
+func (l shadowLogger) Info(msg string, v ...interface{}) {
+	l.Logger.Info(msg, append(v, "shadow", true)...)
+}
+
+// unknownRows is the number of affected rows when the driver doesn't report it
+const unknownRows int64 = -1
+
+// migrationFields returns the log fields of a migration, with the number of
+// affected rows when it is known
+func migrationFields(version string, rows int64) []interface{} {
+	if rows == unknownRows {
+		return []interface{}{"file", version}
+	}
+	return []interface{}{"file", version, "rows", rows}
+}
+
+// applyMigrations executes the migration content and calls after to record
+// it. It returns the number of rows affected by the content, or unknownRows.
+func (m *Migrator) applyMigrations(ctx context.Context, content []byte, name string, noTransaction bool, options *RunOptions, after func(tx Tx) error) (rows int64, err error) {
+	if options.Recover {
+		defer func() {
+			if r := recover(); r != nil {
+				// the deferred rollback of the transaction has already run
+				rows, err = unknownRows, fmt.Errorf("%w %s: %v\n%s", ErrPanic, name, r, debug.Stack())
+			}
+		}()
+	}
+
+	directives, err := parseMigrationDirectives(content)
+	if err != nil {
+		return unknownRows, fmt.Errorf("invalid directives: %w", err)
+	}
+
+	query := stripDirectives(string(content))
+	if options.StripComments {
+		query = stripComments(query)
+	}
+
+	if noTransaction {
+		// statements are committed one by one, so they can't be retried,
+		// and a failure leaves the database dirty
+		return unknownRows, m.trackDirty(ctx, name, options, m.executeStatements(ctx, query, name, directives, options, after))
+	}
+
+	// the query with the secrets is passed only to the database, timed
+	// statements resolve them one by one
+	if options.StatementMetrics == nil {
+		query, err = options.resolveSecrets(query)
+		if err != nil {
+			return unknownRows, err
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		rows, err := m.executeMigration(ctx, query, name, directives, options, after)
+		// a deadlock in the transaction of WithRollbackAfter aborts it with
+		// the migrations before, so only the whole run can be repeated
+		if err == nil || attempt > options.DeadlockRetries || m.sharedTx != nil || !m.isDeadlock(err) {
+			return rows, err
+		}
+
+		// the whole transaction was rolled back, so it can be run again
+		delay := options.DeadlockBackoff << (attempt - 1)
+		m.logger.Info("deadlock detected, retrying migration", "file", name, "attempt", attempt, "delay", delay)
+		select {
+		case <-ctx.Done():
+			return unknownRows, fmt.Errorf("%w (retry cancelled: %w)", err, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// trackDirty marks the migration as dirty when it failed, or clears the
+// dirty state when the dirty migration succeeded. Dialects which don't
+// implement DirtyMarker are not tracked.
+func (m *Migrator) trackDirty(ctx context.Context, name string, options *RunOptions, err error) error {
+	marker, ok := m.dialect.(DirtyMarker)
+	if !ok {
+		return err
+	}
+
+	// the run may be cancelled, the state must be saved anyway
+	ctx = context.WithoutCancel(ctx)
+	if err != nil {
+		if markErr := marker.MarkDirty(ctx, name); markErr != nil {
+			return errors.Join(err, fmt.Errorf("failed to mark migration as dirty: %w", markErr))
+		}
+		return err
+	}
+	if options.dirty == name {
+		if err := marker.ClearDirty(ctx); err != nil {
+			return fmt.Errorf("failed to clear dirty migration: %w", err)
+		}
+		options.dirty = ""
+	}
+	return nil
+}
+
+// isDeadlock reports whether the error is a deadlock, as detected by the dialect
+func (m *Migrator) isDeadlock(err error) bool {
+	if detector, ok := m.dialect.(DeadlockDetector); ok {
+		return detector.IsDeadlock(err)
+	}
+	classifier, ok := m.dialect.(ErrorClassifier)
+	return ok && classifier.ClassifyError(err) == ErrorDeadlock
+}
+
+// errorClass returns the class of the error for error messages, like
+// " (lock timeout)", or an empty string when the class is unknown
+func (m *Migrator) errorClass(err error) string {
+	classifier, ok := m.dialect.(ErrorClassifier)
+	if !ok {
+		return ""
+	}
+	if class := classifier.ClassifyError(err); class != ErrorUnknown {
+		return " (" + string(class) + ")"
+	}
+	return ""
+}
+
+func (m *Migrator) executeMigration(ctx context.Context, query string, name string, directives migrationDirectives, options *RunOptions, after func(tx Tx) error) (int64, error) {
+	// Begin transaction
+	tx, err := m.beginTx(ctx)
+	if err != nil {
+		return unknownRows, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Prepare the session
+	for _, statement := range directives.Session {
+		if err = tx.Exec(ctx, statement); err != nil {
+			return unknownRows, fmt.Errorf("failed to execute session statement %q: %w", statement, err)
+		}
+	}
+
+	skip, err := checkSkipCondition(ctx, tx, directives.SkipIf)
+	if err != nil {
+		return unknownRows, fmt.Errorf("failed to check skip condition of %s: %w", name, err)
+	}
+
+	rows := unknownRows
+	if skip {
+		m.logger.Info("skipped by condition", "file", name)
+	} else {
+		// Execute migration
+		if options.StatementMetrics != nil {
+			rows, err = execTimed(ctx, tx, query, name, options)
+		} else {
+			rows, err = execCountingRows(ctx, tx, query)
+		}
+		if err != nil {
+			return unknownRows, fmt.Errorf("failed to execute migration: %w", err)
+		}
+
+		// Check postconditions
+		if err = verifyMigration(ctx, tx, name, directives.Verify); err != nil {
+			return unknownRows, err
+		}
+	}
+
+	// Record changes
+	err = after(tx)
+	if err != nil {
+		return unknownRows, fmt.Errorf("failed to record migration: %w", err)
+	}
+
+	// Commit transaction
+	if err = tx.Commit(ctx); err != nil {
+		return unknownRows, err
+	}
+	return rows, nil
+}
+
+// checkSkipCondition runs the skip-if query, if any, and reports whether
+// the migration body should be skipped
+func checkSkipCondition(ctx context.Context, tx Tx, query string) (bool, error) {
+	if query == "" {
+		return false, nil
+	}
+
+	querier, ok := tx.(Querier)
+	if !ok {
+		return false, errors.New("transaction does not support queries")
+	}
+	value, err := querier.QueryValue(ctx, query)
+	if err != nil {
+		return false, err
+	}
+	return isTruthy(value), nil
+}
+
+// execCountingRows executes the query and returns the number of affected
+// rows if the transaction and the driver report it, or unknownRows. Drivers
+// report the rows of the last statement only, so with a transaction which
+// reports them, the statements are executed one by one and their rows are
+// summed.
+func execCountingRows(ctx context.Context, tx Tx, query string) (int64, error) {
+	if _, ok := tx.(ResultExecer); !ok {
+		return unknownRows, tx.Exec(ctx, query)
+	}
+
+	total := int64(0)
+	for _, statement := range splitStatements(query) {
+		rows, err := execStatementRows(ctx, tx, statement)
+		if err != nil {
+			return unknownRows, err
+		}
+		total = addRows(total, rows)
+	}
+	return total, nil
+}
+
+// addRows adds the affected rows of a statement to the total, which stays
+// unknownRows once a statement doesn't report them
+func addRows(total, rows int64) int64 {
+	if rows == unknownRows || total == unknownRows {
+		return unknownRows
+	}
+	return total + rows
+}
+
+// execStatementRows executes a single statement and returns the number of
+// affected rows if the transaction and the driver report it, or unknownRows
+func execStatementRows(ctx context.Context, tx Tx, statement string) (int64, error) {
+	execer, ok := tx.(ResultExecer)
+	if !ok {
+		return unknownRows, tx.Exec(ctx, statement)
+	}
+
+	result, err := execer.ExecResult(ctx, statement)
+	if err != nil {
+		return unknownRows, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return unknownRows, nil
+	}
+	return rows, nil
+}
+
+// executeStatements runs the statements of the migration one by one outside
+// of a transaction, then records the migration in its own transaction
+func (m *Migrator) executeStatements(ctx context.Context, query string, name string, directives migrationDirectives, options *RunOptions, after func(tx Tx) error) error {
+	executor, ok := m.dialect.(Executor)
+	if !ok {
+		return errors.New("dialect does not support migrations without a transaction")
+	}
+	if len(directives.Session) > 0 {
+		return errors.New("session directives require a transaction")
+	}
+	if directives.SkipIf != "" {
+		return errors.New("skip-if directive requires a transaction")
+	}
+
+	statements := splitStatements(query)
+	done := 0
+	var checkpoint *Checkpoint
+	if options.Checkpoints {
+		err := options.bookkeeping(ctx, "reading the checkpoint", func(ctx context.Context) (err error) {
+			if checkpoint, err = m.Checkpoint(ctx, name); err != nil {
+				return err
+			}
+			done, err = checkpoint.resumeStatements(ctx, len(statements))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if done > 0 {
+			m.logger.Info("resuming from checkpoint", "file", name, "statement", done+1)
+		}
+	}
+
+	for i := done; i < len(statements); i++ {
+		// errors quote the statement without the secrets
+		statement, err := options.resolveSecrets(statements[i])
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		err = executor.ExecContext(ctx, statement)
+		options.measure(name, i, statements[i], start, err)
+		if err != nil {
+			return fmt.Errorf("failed to execute statement %q: %w", statements[i], err)
+		}
+		if checkpoint != nil {
+			if err := checkpoint.Save(ctx, strconv.Itoa(i+1)); err != nil {
+				return err
+			}
+		}
+	}
+
+	tx, err := m.beginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err = verifyMigration(ctx, tx, name, directives.Verify); err != nil {
+		return err
+	}
+	if err = after(tx); err != nil {
+		return fmt.Errorf("failed to record migration: %w", err)
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	// the migration is recorded, so a leftover checkpoint is harmless
+	if checkpoint != nil {
+		if err := checkpoint.Clear(ctx); err != nil {
+			m.logger.Info("failed to clear checkpoint", "file", name, "error", err)
+		}
+	}
+	return nil
+}
+
+func verifyMigration(ctx context.Context, tx Tx, name string, queries []string) error {
+	if len(queries) == 0 {
+		return nil
+	}
+
+	querier, ok := tx.(Querier)
+	if !ok {
+		return fmt.Errorf("verification failed for %s: transaction does not support queries", name)
+	}
+
+	for _, query := range queries {
+		value, err := querier.QueryValue(ctx, query)
+		if err != nil {
+			return fmt.Errorf("verification failed for %s: %w", name, err)
+		}
+		if !isTruthy(value) {
+			return fmt.Errorf("verification failed for %s: %s", name, query)
+		}
+	}
+
+	return nil
+}
+
+// commitMigration applies the migration and records it. With replace, the
+// existing record of the migration is deleted first.
+func (m *Migrator) commitMigration(ctx context.Context, migration Migration, options *RunOptions, replace bool) (rows int64, err error) {
+	if len(migration.Content) == 0 {
+		return unknownRows, fmt.Errorf("%w: %s", ErrEmptyMigration, migration.Version)
+	}
+
+	noTx := noTransaction(migration, DirectionUp)
+	if noTx && m.sharedTx != nil {
+		return unknownRows, errors.New("migration runs without a transaction, its statements can't be rolled back after the run")
+	}
+	if noTx && options.AutoDownOnFailure {
+		// the cleanup runs even when the migration timed out
+		cleanupCtx := ctx
+		defer func() {
+			if err != nil {
+				err = m.cleanupFailed(cleanupCtx, migration, options, err)
+			}
+		}()
+	}
+
+	if migration.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, migration.Timeout)
+		defer cancel()
+	}
+
+	// invalid directives are reported by applyMigrations
+	directives, _ := parseMigrationDirectives(migration.Content)
+
+	start := time.Now()
+	return m.applyMigrations(ctx, migration.Content, migration.Version, noTx, options, func(tx Tx) error {
+		if directives.NoTrack {
+			// recorded by an external system, so it runs again every time
+			return nil
+		}
+		if replace {
+			if err := m.dialect.DeleteAppliedMigration(ctx, tx, migration.Version); err != nil {
+				return err
+			}
+		}
+		return m.dialect.StoreAppliedMigration(ctx, tx, AppliedRecord{
+			Version:  migration.Version,
+			Duration: time.Since(start),
+			Checksum: checksum(migration.Content),
+			Release:  options.Release,
+		})
+	})
+}
+
+// cleanupFailed runs the down statements of the failed migration without a
+// transaction one by one, see WithAutoDownOnFailure. It returns the error of
+// the migration, joined with the errors of the cleanup.
+func (m *Migrator) cleanupFailed(ctx context.Context, migration Migration, options *RunOptions, failure error) error {
+	m.logger.Info("migration failed, running down migration to clean up", "file", migration.Version, "error", failure)
+	if len(migration.DownContent) == 0 {
+		m.logger.Info("cleanup skipped, no down migration", "file", migration.Version)
+		return failure
+	}
+	executor, ok := m.dialect.(Executor)
+	if !ok {
+		m.logger.Info("cleanup skipped, dialect does not support statements without a transaction", "file", migration.Version)
+		return failure
+	}
+
+	query := stripDirectives(string(migration.DownContent))
+	if options.StripComments {
+		query = stripComments(query)
+	}
+
+	var errs []error
+	for _, statement := range splitStatements(query) {
+		resolved, err := options.resolveSecrets(statement)
+		if err == nil {
+			err = executor.ExecContext(ctx, resolved)
+		}
+		if err != nil {
+			m.logger.Info("cleanup statement failed", "file", migration.Version, "statement", statement, "error", err)
+			errs = append(errs, fmt.Errorf("statement %q: %w", statement, err))
+		}
+	}
+	if len(errs) > 0 {
+		m.logger.Info("cleanup finished with errors", "file", migration.Version, "failed", len(errs))
+		return errors.Join(failure, fmt.Errorf("cleanup of %s: %w", migration.Version, errors.Join(errs...)))
+	}
+
+	// the partial progress was undone, so the migration starts over
+	if options.Checkpoints {
+		if checkpoint, err := m.Checkpoint(ctx, migration.Version); err == nil {
+			if err := checkpoint.Clear(ctx); err != nil {
+				m.logger.Info("failed to clear checkpoint", "file", migration.Version, "error", err)
+			}
+		}
+	}
+	m.logger.Info("cleanup finished", "file", migration.Version)
+	return failure
+}
+
+func (m *Migrator) rollbackMigration(ctx context.Context, migration Migration, options *RunOptions) (int64, error) {
+	if len(migration.DownContent) == 0 {
+		return unknownRows, fmt.Errorf("%w: %s", ErrNoDownMigration, migration.Version)
+	}
+
+	if migration.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, migration.Timeout)
+		defer cancel()
+	}
+
+	// the down migration keeps the transaction boundary of the up migration
+	noTx := noTransaction(migration, DirectionDown)
+	if noTx && m.sharedTx != nil {
+		return unknownRows, errors.New("migration runs without a transaction, its statements can't be rolled back after the run")
+	}
+	return m.applyMigrations(ctx, migration.DownContent, migration.Version, noTx, options, func(tx Tx) error {
 		return m.dialect.DeleteAppliedMigration(ctx, tx, migration.Version)
 	})
 }
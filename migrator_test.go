@@ -2,9 +2,16 @@ package migrate
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // Mock implementations for testing
@@ -49,6 +56,7 @@ func (s *MockSource) GetMigrations() ([]Migration, error) {
 }
 
 type MockTx struct {
+	dialect        *MockDialect
 	execCalled     bool
 	commitCalled   bool
 	rollbackCalled bool
@@ -59,12 +67,36 @@ type MockTx struct {
 
 func (tx *MockTx) Exec(ctx context.Context, query string, args ...interface{}) error {
 	tx.execCalled = true
+	if tx.dialect != nil {
+		tx.dialect.executedQueries = append(tx.dialect.executedQueries, query)
+		if tx.dialect.execDelay > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(tx.dialect.execDelay):
+			}
+		}
+	}
 	if tx.execErr != nil {
 		return tx.execErr
 	}
+	if tx.dialect != nil && tx.dialect.execErrors[query] != nil {
+		return tx.dialect.execErrors[query]
+	}
 	return nil
 }
 
+func (tx *MockTx) QueryValue(ctx context.Context, query string, args ...interface{}) (interface{}, error) {
+	if tx.dialect == nil {
+		return nil, errors.New("no results")
+	}
+	value, ok := tx.dialect.queryResults[query]
+	if !ok {
+		return nil, errors.New("no results")
+	}
+	return value, nil
+}
+
 func (tx *MockTx) Commit(ctx context.Context) error {
 	tx.commitCalled = true
 	return tx.commitErr
@@ -94,10 +126,20 @@ type MockDialect struct {
 	unlockErr          error
 	beginTxErr         error
 	execContextErr     error
+	// Queries executed outside of a transaction
+	execContextQueries []string
 
 	// For tracking what was stored/deleted
 	storedMigrations  []string
+	storedRecords     []AppliedRecord
 	deletedMigrations []string
+	executedQueries   []string
+	execDelay         time.Duration
+	execErrors        map[string]error
+	unlockCtxErr      error
+
+	// Results of QueryValue calls by query
+	queryResults map[string]interface{}
 }
 
 func (d *MockDialect) CreateMigrationsTable(ctx context.Context) error {
@@ -113,9 +155,10 @@ func (d *MockDialect) GetAppliedMigrations(ctx context.Context) ([]string, error
 	return d.appliedMigrations, nil
 }
 
-func (d *MockDialect) StoreAppliedMigration(ctx context.Context, tx Tx, version string) error {
+func (d *MockDialect) StoreAppliedMigration(ctx context.Context, tx Tx, record AppliedRecord) error {
 	d.storeMigrationCalled = true
-	d.storedMigrations = append(d.storedMigrations, version)
+	d.storedMigrations = append(d.storedMigrations, record.Version)
+	d.storedRecords = append(d.storedRecords, record)
 	if d.storeMigrationErr != nil {
 		return d.storeMigrationErr
 	}
@@ -136,7 +179,7 @@ func (d *MockDialect) BeginTx(ctx context.Context) (Tx, error) {
 	if d.beginTxErr != nil {
 		return nil, d.beginTxErr
 	}
-	return &MockTx{}, nil
+	return &MockTx{dialect: d}, nil
 }
 
 func (d *MockDialect) Lock(ctx context.Context) error {
@@ -146,11 +189,13 @@ func (d *MockDialect) Lock(ctx context.Context) error {
 
 func (d *MockDialect) Unlock(ctx context.Context) error {
 	d.unlockCalled = true
+	d.unlockCtxErr = ctx.Err()
 	return d.unlockErr
 }
 
 func (d *MockDialect) ExecContext(ctx context.Context, query string, args ...interface{}) error {
 	d.execContextCalled = true
+	d.execContextQueries = append(d.execContextQueries, query)
 	return d.execContextErr
 }
 
@@ -195,7 +240,7 @@ func TestMigratorUp(t *testing.T) {
 			name:           "apply all pending migrations",
 			migrations:     createTestMigrations(),
 			applied:        []string{},
-			expectedLogs:   []string{"migrated file=001_create_users", "migrated file=002_add_email", "migrated file=003_add_index", "migrated file=004_add_timestamp"},
+			expectedLogs:   []string{"migrated file=001_create_users", "migrated file=002_add_email", "migrated file=003_add_index", "migrated file=004_add_timestamp", "migration run complete applied=4 head=004_add_timestamp"},
 			expectedStored: []string{"001_create_users", "002_add_email", "003_add_index", "004_add_timestamp"},
 			expectError:    false,
 		},
@@ -203,7 +248,7 @@ func TestMigratorUp(t *testing.T) {
 			name:           "apply only pending migrations",
 			migrations:     createTestMigrations(),
 			applied:        []string{"001_create_users", "002_add_email"},
-			expectedLogs:   []string{"migrated file=003_add_index", "migrated file=004_add_timestamp"},
+			expectedLogs:   []string{"migrated file=003_add_index", "migrated file=004_add_timestamp", "migration run complete applied=2 head=004_add_timestamp"},
 			expectedStored: []string{"003_add_index", "004_add_timestamp"},
 			expectError:    false,
 		},
@@ -211,7 +256,7 @@ func TestMigratorUp(t *testing.T) {
 			name:           "no pending migrations",
 			migrations:     createTestMigrations(),
 			applied:        []string{"001_create_users", "002_add_email", "003_add_index", "004_add_timestamp"},
-			expectedLogs:   []string{},
+			expectedLogs:   []string{"migration run complete applied=0 head=004_add_timestamp"},
 			expectedStored: []string{},
 			expectError:    false,
 		},
@@ -359,7 +404,7 @@ func TestMigratorDown(t *testing.T) {
 			if tt.dryRun {
 				err = migrator.Down(context.Background(), tt.steps, WithDryRun())
 			} else {
-				err = migrator.Down(context.Background(), tt.steps)
+				err = migrator.Down(context.Background(), tt.steps, WithConfirmRollback())
 			}
 
 			// Assertions
@@ -413,7 +458,7 @@ func TestMigratorTo(t *testing.T) {
 			migrations:      createTestMigrations(),
 			applied:         []string{"001_create_users"},
 			targetVersion:   "003_add_index",
-			expectedLogs:    []string{"migrated file=002_add_email", "migrated file=003_add_index"},
+			expectedLogs:    []string{"migrated file=002_add_email", "migrated file=003_add_index", "migration run complete applied=2 head=003_add_index"},
 			expectedStored:  []string{"002_add_email", "003_add_index"},
 			expectedDeleted: []string{},
 			expectError:     false,
@@ -423,7 +468,7 @@ func TestMigratorTo(t *testing.T) {
 			migrations:      createTestMigrations(),
 			applied:         []string{"001_create_users", "002_add_email", "003_add_index", "004_add_timestamp"},
 			targetVersion:   "002_add_email",
-			expectedLogs:    []string{"rolled back file=004_add_timestamp", "rolled back file=003_add_index"},
+			expectedLogs:    []string{"rolled back file=004_add_timestamp", "rolled back file=003_add_index", "migration run complete applied=0 head=002_add_email"},
 			expectedStored:  []string{},
 			expectedDeleted: []string{"004_add_timestamp", "003_add_index"},
 			expectError:     false,
@@ -433,7 +478,7 @@ func TestMigratorTo(t *testing.T) {
 			migrations:      createTestMigrations(),
 			applied:         []string{"001_create_users", "002_add_email"},
 			targetVersion:   "002_add_email",
-			expectedLogs:    []string{},
+			expectedLogs:    []string{"migration run complete applied=0 head=002_add_email"},
 			expectedStored:  []string{},
 			expectedDeleted: []string{},
 			expectError:     false,
@@ -443,7 +488,7 @@ func TestMigratorTo(t *testing.T) {
 			migrations:      createTestMigrations(),
 			applied:         []string{},
 			targetVersion:   "001_create_users",
-			expectedLogs:    []string{"migrated file=001_create_users"},
+			expectedLogs:    []string{"migrated file=001_create_users", "migration run complete applied=1 head=001_create_users"},
 			expectedStored:  []string{"001_create_users"},
 			expectedDeleted: []string{},
 			expectError:     false,
@@ -453,7 +498,7 @@ func TestMigratorTo(t *testing.T) {
 			migrations:      createTestMigrations(),
 			applied:         []string{"001_create_users"},
 			targetVersion:   "004_add_timestamp",
-			expectedLogs:    []string{"migrated file=002_add_email", "migrated file=003_add_index", "migrated file=004_add_timestamp"},
+			expectedLogs:    []string{"migrated file=002_add_email", "migrated file=003_add_index", "migrated file=004_add_timestamp", "migration run complete applied=3 head=004_add_timestamp"},
 			expectedStored:  []string{"002_add_email", "003_add_index", "004_add_timestamp"},
 			expectedDeleted: []string{},
 			expectError:     false,
@@ -468,6 +513,66 @@ func TestMigratorTo(t *testing.T) {
 			expectedDeleted: []string{},
 			expectError:     true,
 		},
+		{
+			name:            "migrate to latest",
+			migrations:      createTestMigrations(),
+			applied:         []string{"001_create_users", "002_add_email"},
+			targetVersion:   TargetLatest,
+			expectedLogs:    []string{"migrated file=003_add_index", "migrated file=004_add_timestamp", "migration run complete applied=2 head=004_add_timestamp"},
+			expectedStored:  []string{"003_add_index", "004_add_timestamp"},
+			expectedDeleted: []string{},
+			expectError:     false,
+		},
+		{
+			name:            "migrate to zero",
+			migrations:      createTestMigrations(),
+			applied:         []string{"001_create_users", "002_add_email"},
+			targetVersion:   TargetZero,
+			expectedLogs:    []string{"rolled back file=002_add_email", "rolled back file=001_create_users", "migration run complete applied=0 head="},
+			expectedStored:  []string{},
+			expectedDeleted: []string{"002_add_email", "001_create_users"},
+			expectError:     false,
+		},
+		{
+			name:            "migrate to empty target",
+			migrations:      createTestMigrations(),
+			applied:         []string{"001_create_users"},
+			targetVersion:   "",
+			expectedLogs:    []string{"rolled back file=001_create_users", "migration run complete applied=0 head="},
+			expectedStored:  []string{},
+			expectedDeleted: []string{"001_create_users"},
+			expectError:     false,
+		},
+		{
+			name:            "migrate relative up",
+			migrations:      createTestMigrations(),
+			applied:         []string{"001_create_users"},
+			targetVersion:   "+2",
+			expectedLogs:    []string{"migrated file=002_add_email", "migrated file=003_add_index", "migration run complete applied=2 head=003_add_index"},
+			expectedStored:  []string{"002_add_email", "003_add_index"},
+			expectedDeleted: []string{},
+			expectError:     false,
+		},
+		{
+			name:            "migrate relative down",
+			migrations:      createTestMigrations(),
+			applied:         []string{"001_create_users", "002_add_email", "003_add_index"},
+			targetVersion:   "-1",
+			expectedLogs:    []string{"rolled back file=003_add_index", "migration run complete applied=0 head=002_add_email"},
+			expectedStored:  []string{},
+			expectedDeleted: []string{"003_add_index"},
+			expectError:     false,
+		},
+		{
+			name:            "reserved version in source",
+			migrations:      append(createTestMigrations(), Migration{Version: "latest", Content: []byte("SELECT 1")}),
+			applied:         []string{},
+			targetVersion:   TargetLatest,
+			expectedLogs:    []string{},
+			expectedStored:  []string{},
+			expectedDeleted: []string{},
+			expectError:     true,
+		},
 		{
 			name:            "dry run migrate up",
 			migrations:      createTestMigrations(),
@@ -506,7 +611,7 @@ func TestMigratorTo(t *testing.T) {
 			if tt.dryRun {
 				err = migrator.To(context.Background(), tt.targetVersion, WithDryRun())
 			} else {
-				err = migrator.To(context.Background(), tt.targetVersion)
+				err = migrator.To(context.Background(), tt.targetVersion, WithConfirmRollback())
 			}
 
 			// Assertions
@@ -607,7 +712,7 @@ func TestMigratorErrors(t *testing.T) {
 				source.migrations = createTestMigrations()
 			},
 			operation: func(m *Migrator) error {
-				return m.Down(context.Background(), 1)
+				return m.Down(context.Background(), 1, WithConfirmRollback())
 			},
 			expectError: true,
 		},
@@ -685,7 +790,7 @@ func TestMigratorOperationOrder(t *testing.T) {
 
 		migrator := New(source, dialect, logger)
 
-		err := migrator.Down(context.Background(), 2)
+		err := migrator.Down(context.Background(), 2, WithConfirmRollback())
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -716,3 +821,2332 @@ func TestMigratorOperationOrder(t *testing.T) {
 		}
 	})
 }
+
+// Test that table creation can be disabled
+func TestMigratorNoCreateTable(t *testing.T) {
+	t.Run("skips table creation", func(t *testing.T) {
+		logger := &MockLogger{}
+		source := &MockSource{migrations: createTestMigrations()}
+		dialect := &MockDialect{appliedMigrations: []string{}}
+
+		migrator := New(source, dialect, logger)
+
+		err := migrator.Up(context.Background(), WithNoCreateTable())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if dialect.createTableCalled {
+			t.Error("CreateMigrationsTable should not be called")
+		}
+		if len(dialect.storedMigrations) != 4 {
+			t.Errorf("expected 4 stored migrations, got %d", len(dialect.storedMigrations))
+		}
+	})
+
+	t.Run("missing table surfaces an error", func(t *testing.T) {
+		logger := &MockLogger{}
+		source := &MockSource{migrations: createTestMigrations()}
+		dialect := &MockDialect{getAppliedErr: errors.New("no such table")}
+
+		migrator := New(source, dialect, logger)
+
+		err := migrator.Up(context.Background(), WithNoCreateTable())
+		if err == nil {
+			t.Fatal("expected error but got none")
+		}
+		if !errors.Is(err, dialect.getAppliedErr) {
+			t.Errorf("expected wrapped dialect error, got %v", err)
+		}
+	})
+}
+
+// Test that the lock observer is notified on acquire and release
+func TestMigratorLockObserver(t *testing.T) {
+	logger := &MockLogger{}
+	source := &MockSource{migrations: createTestMigrations()}
+	dialect := &MockDialect{appliedMigrations: []string{}}
+
+	migrator := New(source, dialect, logger)
+
+	var events []string
+	err := migrator.Up(context.Background(), WithLockObserver(func(event string, d time.Duration) {
+		if d < 0 {
+			t.Errorf("negative duration for %s", event)
+		}
+		events = append(events, event)
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{LockAcquired, LockReleased}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d: %v", len(expected), len(events), events)
+	}
+	for i, e := range expected {
+		if events[i] != e {
+			t.Errorf("event %d: expected %q, got %q", i, e, events[i])
+		}
+	}
+
+	// dry run does not lock
+	events = nil
+	if err := migrator.Up(context.Background(), WithDryRun(), WithLockObserver(func(event string, d time.Duration) {
+		events = append(events, event)
+	})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("expected no events in dry run, got %v", events)
+	}
+}
+
+// Test that comments are stripped before execution
+func TestMigratorStripComments(t *testing.T) {
+	logger := &MockLogger{}
+	source := &MockSource{migrations: []Migration{
+		{Version: "001_init", Content: []byte("-- create users\nCREATE TABLE users (name TEXT DEFAULT '--'); -- done")},
+	}}
+	dialect := &MockDialect{appliedMigrations: []string{}}
+
+	migrator := New(source, dialect, logger)
+
+	if err := migrator.Up(context.Background(), WithStripComments()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "\nCREATE TABLE users (name TEXT DEFAULT '--'); "
+	if len(dialect.executedQueries) != 1 || dialect.executedQueries[0] != expected {
+		t.Errorf("expected query %q, got %q", expected, dialect.executedQueries)
+	}
+}
+
+// Test that DownOne and Down(ctx, 1) roll back exactly one migration
+func TestMigratorDownOne(t *testing.T) {
+	operations := map[string]func(*Migrator) error{
+		"DownOne": func(m *Migrator) error {
+			return m.DownOne(context.Background(), WithConfirmRollback())
+		},
+		"Down with one step": func(m *Migrator) error {
+			return m.Down(context.Background(), 1, WithConfirmRollback())
+		},
+	}
+
+	for name, operation := range operations {
+		t.Run(name, func(t *testing.T) {
+			logger := &MockLogger{}
+			source := &MockSource{migrations: createTestMigrations()}
+			dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email", "003_add_index"}}
+
+			migrator := New(source, dialect, logger)
+
+			if err := operation(migrator); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(dialect.deletedMigrations) != 1 || dialect.deletedMigrations[0] != "003_add_index" {
+				t.Errorf("expected only 003_add_index to be rolled back, got %v", dialect.deletedMigrations)
+			}
+		})
+	}
+}
+
+// Test sentinel errors for migrations without content
+func TestMigratorEmptyContentErrors(t *testing.T) {
+	t.Run("empty up migration", func(t *testing.T) {
+		source := &MockSource{migrations: []Migration{{Version: "001_empty"}}}
+		dialect := &MockDialect{appliedMigrations: []string{}}
+
+		err := New(source, dialect, &MockLogger{}).Up(context.Background())
+		if !errors.Is(err, ErrEmptyMigration) {
+			t.Errorf("expected ErrEmptyMigration, got %v", err)
+		}
+	})
+
+	t.Run("missing down migration", func(t *testing.T) {
+		source := &MockSource{migrations: []Migration{{Version: "001_up_only", Content: []byte("CREATE TABLE a (id INT)")}}}
+		dialect := &MockDialect{appliedMigrations: []string{"001_up_only"}}
+
+		err := New(source, dialect, &MockLogger{}).Down(context.Background(), 1, WithConfirmRollback())
+		if !errors.Is(err, ErrNoDownMigration) {
+			t.Errorf("expected ErrNoDownMigration, got %v", err)
+		}
+		if errors.Is(err, ErrEmptyMigration) {
+			t.Error("ErrNoDownMigration should be distinguishable from ErrEmptyMigration")
+		}
+	})
+}
+
+// Test sentinel errors for unknown versions
+func TestMigratorNotFoundErrors(t *testing.T) {
+	t.Run("unknown target", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+		err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).To(context.Background(), "999_unknown", WithConfirmRollback())
+		if !errors.Is(err, ErrTargetNotFound) {
+			t.Errorf("expected ErrTargetNotFound, got %v", err)
+		}
+		if !errors.Is(err, ErrMigrationNotFound) {
+			t.Errorf("expected ErrMigrationNotFound, got %v", err)
+		}
+	})
+
+	t.Run("target out of order", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "003_add_index"}}
+		err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).To(context.Background(), "002_add_email", WithConfirmRollback())
+		if !errors.Is(err, ErrOrderMismatch) || errors.Is(err, ErrTargetNotFound) {
+			t.Errorf("expected ErrOrderMismatch, got %v", err)
+		}
+	})
+
+	t.Run("rollback of unknown migration", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "005_missing"}}
+		err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Down(context.Background(), 1, WithConfirmRollback())
+		if !errors.Is(err, ErrMigrationNotFound) {
+			t.Errorf("expected ErrMigrationNotFound, got %v", err)
+		}
+	})
+
+	t.Run("rollback to target of unknown migration", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "005_missing"}}
+		err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).To(context.Background(), "001_create_users", WithConfirmRollback())
+		if !errors.Is(err, ErrMigrationNotFound) {
+			t.Errorf("expected ErrMigrationNotFound, got %v", err)
+		}
+	})
+}
+
+// Test that duplicate rows of the migrations table are ignored
+func TestMigratorDuplicateApplied(t *testing.T) {
+	dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email", "002_add_email", "003_add_index"}}
+	logger := &MockLogger{}
+
+	if err := New(&MockSource{migrations: createTestMigrations()}, dialect, logger).Down(context.Background(), 2, WithConfirmRollback()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"003_add_index", "002_add_email"}
+	if fmt.Sprint(dialect.deletedMigrations) != fmt.Sprint(expected) {
+		t.Errorf("expected %v to be rolled back, got %v", expected, dialect.deletedMigrations)
+	}
+	if logs := logger.GetLogs(); len(logs) == 0 || logs[0] != "duplicate applied migrations ignored versions=002_add_email" {
+		t.Errorf("expected a duplicate warning, got %v", logs)
+	}
+}
+
+var errDeadlock = errors.New("deadlock")
+
+// deadlockDialect fails the first transactions with a deadlock
+type deadlockDialect struct {
+	*MockDialect
+	failures int
+}
+
+func (d *deadlockDialect) BeginTx(ctx context.Context) (Tx, error) {
+	if d.failures > 0 {
+		d.failures--
+		return &MockTx{dialect: d.MockDialect, execErr: errDeadlock}, nil
+	}
+	return d.MockDialect.BeginTx(ctx)
+}
+
+func (d *deadlockDialect) IsDeadlock(err error) bool {
+	return errors.Is(err, errDeadlock)
+}
+
+// Test retrying migrations which fail with a deadlock
+func TestMigratorDeadlockRetry(t *testing.T) {
+	migrations := createTestMigrations()[:1]
+
+	t.Run("retried until success", func(t *testing.T) {
+		mock := &MockDialect{appliedMigrations: []string{}}
+		logger := &MockLogger{}
+		err := New(&MockSource{migrations: migrations}, &deadlockDialect{MockDialect: mock, failures: 2}, logger).Up(context.Background(), WithDeadlockRetry(3, time.Millisecond))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fmt.Sprint(mock.storedMigrations) != "[001_create_users]" {
+			t.Errorf("expected migration to be stored once, got %v", mock.storedMigrations)
+		}
+		expected := []string{
+			"deadlock detected, retrying migration file=001_create_users attempt=1 delay=1ms",
+			"deadlock detected, retrying migration file=001_create_users attempt=2 delay=2ms",
+			"migrated file=001_create_users",
+		}
+		if fmt.Sprint(logger.GetLogs()[:3]) != fmt.Sprint(expected) {
+			t.Errorf("unexpected logs %v", logger.GetLogs())
+		}
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		mock := &MockDialect{appliedMigrations: []string{}}
+		err := New(&MockSource{migrations: migrations}, &deadlockDialect{MockDialect: mock, failures: 3}, &MockLogger{}).Up(context.Background(), WithDeadlockRetry(2, time.Millisecond))
+		if !errors.Is(err, errDeadlock) {
+			t.Errorf("expected deadlock error, got %v", err)
+		}
+	})
+
+	t.Run("not retried without the option", func(t *testing.T) {
+		mock := &MockDialect{appliedMigrations: []string{}}
+		dialect := &deadlockDialect{MockDialect: mock, failures: 1}
+		err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(context.Background())
+		if !errors.Is(err, errDeadlock) {
+			t.Errorf("expected deadlock error, got %v", err)
+		}
+	})
+
+	t.Run("other errors are not retried", func(t *testing.T) {
+		mock := &MockDialect{
+			appliedMigrations: []string{},
+			execErrors:        map[string]error{string(migrations[0].Content): errors.New("syntax error")},
+		}
+		err := New(&MockSource{migrations: migrations}, &deadlockDialect{MockDialect: mock}, &MockLogger{}).Up(context.Background(), WithDeadlockRetry(3, time.Millisecond))
+		if err == nil {
+			t.Fatal("expected error but got none")
+		}
+		if len(mock.executedQueries) != 1 {
+			t.Errorf("expected a single attempt, got %v", mock.executedQueries)
+		}
+	})
+}
+
+// Test migrations with settings from the metadata header
+func TestMigratorMigrationMetadata(t *testing.T) {
+	t.Run("no transaction", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		source := &MockSource{migrations: []Migration{{
+			Version:       "001_index",
+			Content:       []byte("CREATE INDEX CONCURRENTLY a ON t (a);\nCREATE INDEX CONCURRENTLY b ON t (b);"),
+			NoTransaction: true,
+		}}}
+
+		if err := New(source, dialect, &MockLogger{}).Up(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		expected := []string{"CREATE INDEX CONCURRENTLY a ON t (a);", "CREATE INDEX CONCURRENTLY b ON t (b);"}
+		if fmt.Sprintf("%q", dialect.execContextQueries) != fmt.Sprintf("%q", expected) {
+			t.Errorf("expected statements to run outside of a transaction, got %q", dialect.execContextQueries)
+		}
+		if len(dialect.executedQueries) != 0 {
+			t.Errorf("expected no queries in the transaction, got %q", dialect.executedQueries)
+		}
+		if fmt.Sprint(dialect.storedMigrations) != "[001_index]" {
+			t.Errorf("expected migration to be recorded, got %v", dialect.storedMigrations)
+		}
+	})
+
+	t.Run("no transaction down", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_index"}}
+		source := &MockSource{migrations: []Migration{{
+			Version:       "001_index",
+			Content:       []byte("CREATE INDEX CONCURRENTLY a ON t (a);"),
+			DownContent:   []byte("DROP INDEX CONCURRENTLY a;\nDROP INDEX CONCURRENTLY b;"),
+			NoTransaction: true,
+		}}}
+
+		if err := New(source, dialect, &MockLogger{}).Down(context.Background(), 1, WithConfirmRollback()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		expected := []string{"DROP INDEX CONCURRENTLY a;", "DROP INDEX CONCURRENTLY b;"}
+		if fmt.Sprintf("%q", dialect.execContextQueries) != fmt.Sprintf("%q", expected) {
+			t.Errorf("expected statements to run outside of a transaction, got %q", dialect.execContextQueries)
+		}
+		if len(dialect.executedQueries) != 0 {
+			t.Errorf("expected no queries in the transaction, got %q", dialect.executedQueries)
+		}
+		if fmt.Sprint(dialect.deletedMigrations) != "[001_index]" {
+			t.Errorf("expected migration record to be deleted, got %v", dialect.deletedMigrations)
+		}
+	})
+
+	t.Run("transaction down", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_users"}}
+		source := &MockSource{migrations: []Migration{{
+			Version:     "001_users",
+			Content:     []byte("CREATE TABLE users (id INT);"),
+			DownContent: []byte("DROP TABLE users;"),
+		}}}
+
+		if err := New(source, dialect, &MockLogger{}).Down(context.Background(), 1, WithConfirmRollback()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(dialect.execContextQueries) != 0 || fmt.Sprint(dialect.executedQueries) != "[DROP TABLE users;]" {
+			t.Errorf("expected the down migration in a transaction, got %q %q", dialect.execContextQueries, dialect.executedQueries)
+		}
+	})
+
+	t.Run("no transaction with session", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		source := &MockSource{migrations: []Migration{{
+			Version:       "001_index",
+			Content:       []byte("-- migrate:session SET LOCAL lock_timeout = '1s'\nCREATE INDEX CONCURRENTLY a ON t (a);"),
+			NoTransaction: true,
+		}}}
+
+		if err := New(source, dialect, &MockLogger{}).Up(context.Background()); err == nil {
+			t.Error("expected error but got none")
+		}
+		if len(dialect.execContextQueries) != 0 {
+			t.Errorf("expected nothing to run, got %q", dialect.execContextQueries)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{}, execDelay: time.Second}
+		source := &MockSource{migrations: []Migration{{
+			Version: "001_slow",
+			Content: []byte("UPDATE users SET active = 1"),
+			Timeout: 10 * time.Millisecond,
+		}}}
+
+		err := New(source, dialect, &MockLogger{}).Up(context.Background())
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected deadline error, got %v", err)
+		}
+	})
+}
+
+// Test reverting a single migration in the middle of the history
+func TestMigratorRevert(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("middle of history", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email", "003_add_index"}}
+		logger := &MockLogger{}
+
+		if err := New(&MockSource{migrations: createTestMigrations()}, dialect, logger).Revert(ctx, "002_add_email", WithConfirmRollback()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fmt.Sprint(dialect.deletedMigrations) != "[002_add_email]" {
+			t.Errorf("expected only 002_add_email to be rolled back, got %v", dialect.deletedMigrations)
+		}
+		if fmt.Sprint(dialect.executedQueries) != "[ALTER TABLE users DROP COLUMN email]" {
+			t.Errorf("unexpected queries %v", dialect.executedQueries)
+		}
+		expected := []string{"reverted file=002_add_email", "warning: migration history is now non-linear file=002_add_email later_applied=1"}
+		if fmt.Sprint(logger.GetLogs()) != fmt.Sprint(expected) {
+			t.Errorf("unexpected logs %v", logger.GetLogs())
+		}
+	})
+
+	t.Run("head", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email"}}
+		logger := &MockLogger{}
+
+		if err := New(&MockSource{migrations: createTestMigrations()}, dialect, logger).Revert(ctx, "002_add_email", WithConfirmRollback()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fmt.Sprint(logger.GetLogs()) != "[reverted file=002_add_email]" {
+			t.Errorf("unexpected logs %v", logger.GetLogs())
+		}
+	})
+
+	t.Run("not applied", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+		if err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Revert(ctx, "002_add_email", WithConfirmRollback()); err == nil {
+			t.Error("expected error but got none")
+		}
+		if len(dialect.deletedMigrations) != 0 {
+			t.Errorf("expected nothing to be rolled back, got %v", dialect.deletedMigrations)
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email"}}
+		logger := &MockLogger{}
+		if err := New(&MockSource{migrations: createTestMigrations()}, dialect, logger).Revert(ctx, "001_create_users", WithDryRun()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(dialect.deletedMigrations) != 0 || fmt.Sprint(logger.GetLogs()) != "[would revert file=001_create_users]" {
+			t.Errorf("unexpected dry run result %v %v", dialect.deletedMigrations, logger.GetLogs())
+		}
+	})
+}
+
+// Test validation of the source before the database is touched
+func TestMigratorValidateSource(t *testing.T) {
+	source := &MockSource{migrations: []Migration{
+		{Version: "001_create_users", Content: []byte("CREATE TABLE users (id INT)")},
+		{Version: "", Content: []byte("SELECT 1")},
+		{Version: "001_create_users", Content: []byte("CREATE TABLE users (id INT)")},
+		{Version: "002_empty"},
+	}}
+	dialect := &MockDialect{appliedMigrations: []string{}}
+
+	err := New(source, dialect, &MockLogger{}).Up(context.Background())
+	if err == nil {
+		t.Fatal("expected error but got none")
+	}
+	for _, expected := range []string{"migration 1 has an empty version", "duplicate migration version 001_create_users", "002_empty"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to contain %q, got %v", expected, err)
+		}
+	}
+	if !errors.Is(err, ErrEmptyMigration) {
+		t.Errorf("expected ErrEmptyMigration, got %v", err)
+	}
+	if dialect.createTableCalled || dialect.lockCalled || dialect.getAppliedCalled {
+		t.Error("the database should not be touched for an invalid source")
+	}
+}
+
+// Test refresh statements which run once after all migrations
+func TestMigratorRefreshAfter(t *testing.T) {
+	migrations := []Migration{
+		{Version: "001_sales", Content: []byte("-- migrate:refresh-after REFRESH MATERIALIZED VIEW sales_summary\nCREATE MATERIALIZED VIEW sales_summary AS SELECT 1")},
+		{Version: "002_totals", Content: []byte("-- migrate:requires 003_regions\n-- migrate:refresh-after REFRESH MATERIALIZED VIEW totals\n-- migrate:refresh-after REFRESH MATERIALIZED VIEW sales_summary\nALTER TABLE sales ADD COLUMN total INT")},
+		{Version: "003_regions", Content: []byte("-- migrate:refresh-after REFRESH MATERIALIZED VIEW regions\nCREATE TABLE regions (id INT)")},
+	}
+
+	t.Run("applied", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		logger := &MockLogger{}
+		if err := New(&MockSource{migrations: migrations}, dialect, logger).Up(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		expected := []string{
+			"REFRESH MATERIALIZED VIEW sales_summary",
+			"REFRESH MATERIALIZED VIEW regions",
+			"REFRESH MATERIALIZED VIEW totals",
+		}
+		if fmt.Sprintf("%q", dialect.execContextQueries) != fmt.Sprintf("%q", expected) {
+			t.Errorf("expected refreshes %q, got %q", expected, dialect.execContextQueries)
+		}
+		logs := logger.GetLogs()
+		if logs[2] != "migrated file=002_totals" || logs[3] != "refreshed statement=REFRESH MATERIALIZED VIEW sales_summary" {
+			t.Errorf("expected refreshes after all migrations, got %v", logs)
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_sales"}}
+		logger := &MockLogger{}
+		if err := New(&MockSource{migrations: migrations}, dialect, logger).Up(context.Background(), WithDryRun()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(dialect.execContextQueries) != 0 {
+			t.Errorf("expected no refreshes in dry run, got %q", dialect.execContextQueries)
+		}
+		expected := []string{
+			"would migrate file=003_regions",
+			"would migrate file=002_totals",
+			"would refresh statement=REFRESH MATERIALIZED VIEW regions",
+			"would refresh statement=REFRESH MATERIALIZED VIEW totals",
+			"would refresh statement=REFRESH MATERIALIZED VIEW sales_summary",
+		}
+		if fmt.Sprint(logger.GetLogs()) != fmt.Sprint(expected) {
+			t.Errorf("unexpected logs %v", logger.GetLogs())
+		}
+	})
+
+	t.Run("failed run", func(t *testing.T) {
+		dialect := &MockDialect{
+			appliedMigrations: []string{},
+			execErrors:        map[string]error{"\n\n\nALTER TABLE sales ADD COLUMN total INT": errors.New("no such table")},
+		}
+		err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(context.Background())
+		if err == nil {
+			t.Fatal("expected error but got none")
+		}
+
+		expected := []string{"REFRESH MATERIALIZED VIEW sales_summary", "REFRESH MATERIALIZED VIEW regions"}
+		if fmt.Sprintf("%q", dialect.execContextQueries) != fmt.Sprintf("%q", expected) {
+			t.Errorf("expected refreshes of committed migrations %q, got %q", expected, dialect.execContextQueries)
+		}
+	})
+}
+
+// resultTx reports the rows affected by a statement
+type resultTx struct {
+	*MockTx
+	rows int64
+}
+
+func (tx *resultTx) ExecResult(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if err := tx.Exec(ctx, query, args...); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(tx.rows), nil
+}
+
+// resultDialect begins transactions which report affected rows
+type resultDialect struct {
+	*MockDialect
+	rows int64
+}
+
+func (d *resultDialect) BeginTx(ctx context.Context) (Tx, error) {
+	return &resultTx{MockTx: &MockTx{dialect: d.MockDialect}, rows: d.rows}, nil
+}
+
+// Test logging of the rows affected by migrations
+func TestMigratorRowsAffected(t *testing.T) {
+	mock := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+	logger := &MockLogger{}
+	migrator := New(&MockSource{migrations: createTestMigrations()}, &resultDialect{MockDialect: mock, rows: 42}, logger)
+
+	if err := migrator.Up(context.Background(), WithoutRunSummary()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := migrator.DownOne(context.Background(), WithConfirmRollback()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"migrated file=002_add_email rows=42",
+		"migrated file=003_add_index rows=42",
+		"migrated file=004_add_timestamp rows=42",
+		"rolled back file=001_create_users rows=42",
+	}
+	if fmt.Sprint(logger.GetLogs()) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, logger.GetLogs())
+	}
+
+	// the rows of all statements of a migration are summed
+	mock = &MockDialect{appliedMigrations: []string{}}
+	logger = &MockLogger{}
+	source := &MockSource{migrations: []Migration{
+		{Version: "001_backfill", Content: []byte("UPDATE users SET active = true;\nUPDATE orders SET total = 0;")},
+	}}
+	if err := New(source, &resultDialect{MockDialect: mock, rows: 5}, logger).Up(context.Background(), WithoutRunSummary()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(logger.GetLogs()) != "[migrated file=001_backfill rows=10]" {
+		t.Errorf("expected the rows of both statements, got %v", logger.GetLogs())
+	}
+	if len(mock.executedQueries) != 2 {
+		t.Errorf("expected the statements to run one by one, got %q", mock.executedQueries)
+	}
+}
+
+// Test the skip-if directive
+func TestMigratorSkipIfDirective(t *testing.T) {
+	content := []byte("-- migrate:skip-if SELECT count(*) > 1000000 FROM orders\nUPDATE orders SET total = 0")
+
+	tests := []struct {
+		name          string
+		result        interface{}
+		expectedQuery []string
+		expectedLogs  []string
+	}{
+		{
+			name:         "condition holds",
+			result:       true,
+			expectedLogs: []string{"skipped by condition file=001_backfill", "migrated file=001_backfill"},
+		},
+		{
+			name:          "condition fails",
+			result:        false,
+			expectedQuery: []string{"\nUPDATE orders SET total = 0"},
+			expectedLogs:  []string{"migrated file=001_backfill"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialect := &MockDialect{
+				appliedMigrations: []string{},
+				queryResults:      map[string]interface{}{"SELECT count(*) > 1000000 FROM orders": tt.result},
+			}
+			logger := &MockLogger{}
+			source := &MockSource{migrations: []Migration{{Version: "001_backfill", Content: content}}}
+
+			if err := New(source, dialect, logger).Up(context.Background(), WithoutRunSummary()); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fmt.Sprintf("%q", dialect.executedQueries) != fmt.Sprintf("%q", tt.expectedQuery) {
+				t.Errorf("expected queries %q, got %q", tt.expectedQuery, dialect.executedQueries)
+			}
+			if fmt.Sprint(dialect.storedMigrations) != "[001_backfill]" {
+				t.Errorf("expected migration to be recorded, got %v", dialect.storedMigrations)
+			}
+			if fmt.Sprint(logger.GetLogs()) != fmt.Sprint(tt.expectedLogs) {
+				t.Errorf("expected logs %v, got %v", tt.expectedLogs, logger.GetLogs())
+			}
+		})
+	}
+
+	t.Run("query error", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		source := &MockSource{migrations: []Migration{{Version: "001_backfill", Content: content}}}
+		if err := New(source, dialect, &MockLogger{}).Up(context.Background()); err == nil {
+			t.Error("expected error but got none")
+		}
+		if len(dialect.storedMigrations) != 0 {
+			t.Errorf("expected nothing to be recorded, got %v", dialect.storedMigrations)
+		}
+	})
+}
+
+// panicTx panics when a statement is executed
+type panicTx struct {
+	*MockTx
+}
+
+func (tx *panicTx) Exec(ctx context.Context, query string, args ...interface{}) error {
+	panic("driver bug")
+}
+
+// panicDialect begins transactions which panic
+type panicDialect struct {
+	*MockDialect
+	tx *MockTx
+}
+
+func (d *panicDialect) BeginTx(ctx context.Context) (Tx, error) {
+	d.tx = &MockTx{dialect: d.MockDialect}
+	return &panicTx{MockTx: d.tx}, nil
+}
+
+// Test recovering from panics during a migration
+func TestMigratorRecover(t *testing.T) {
+	source := &MockSource{migrations: createTestMigrations()}
+
+	t.Run("recovered", func(t *testing.T) {
+		dialect := &panicDialect{MockDialect: &MockDialect{appliedMigrations: []string{}}}
+		err := New(source, dialect, &MockLogger{}).Up(context.Background(), WithRecover())
+		if !errors.Is(err, ErrPanic) {
+			t.Fatalf("expected ErrPanic, got %v", err)
+		}
+		if !strings.Contains(err.Error(), "driver bug") || !strings.Contains(err.Error(), "goroutine") {
+			t.Errorf("expected panic value and stack in error, got %v", err)
+		}
+		if !dialect.tx.rollbackCalled {
+			t.Error("expected transaction to be rolled back")
+		}
+		if !dialect.unlockCalled {
+			t.Error("expected lock to be released")
+		}
+	})
+
+	t.Run("propagated by default", func(t *testing.T) {
+		dialect := &panicDialect{MockDialect: &MockDialect{appliedMigrations: []string{}}}
+		defer func() {
+			if r := recover(); r != "driver bug" {
+				t.Errorf("expected panic to propagate, got %v", r)
+			}
+		}()
+		New(source, dialect, &MockLogger{}).Up(context.Background())
+	})
+}
+
+// Test the run ID added to log records
+func TestMigratorRunID(t *testing.T) {
+	dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email"}}
+	logger := &MockLogger{}
+	migrator := New(&MockSource{migrations: createTestMigrations()}, dialect, logger)
+
+	if err := migrator.Up(context.Background(), WithRunID("deploy-42")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{
+		"migrated file=003_add_index run_id=deploy-42",
+		"migrated file=004_add_timestamp run_id=deploy-42",
+		"migration run complete applied=2 head=004_add_timestamp run_id=deploy-42",
+	}
+	if fmt.Sprint(logger.GetLogs()) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, logger.GetLogs())
+	}
+
+	logger.Clear()
+	if err := migrator.Down(context.Background(), 1, WithConfirmRollback()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(logger.GetLogs()) != "[rolled back file=002_add_email]" {
+		t.Errorf("run ID should not outlive the run, got %v", logger.GetLogs())
+	}
+
+	logger.Clear()
+	if err := migrator.Down(context.Background(), 1, WithRunID(""), WithConfirmRollback()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !regexp.MustCompile(`run_id=[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(logger.GetLogs()[0]) {
+		t.Errorf("expected a generated UUID, got %v", logger.GetLogs())
+	}
+}
+
+// Test parsing of relative targets
+func TestMigratorToInvalidRelativeTarget(t *testing.T) {
+	for _, target := range []string{"+abc", "-", "+0", "-+1", "+-1", "+1.5"} {
+		t.Run(target, func(t *testing.T) {
+			dialect := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+			err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).To(context.Background(), target, WithConfirmRollback())
+			if err == nil || !strings.Contains(err.Error(), "invalid relative target") {
+				t.Errorf("expected parse error, got %v", err)
+			}
+			if dialect.lockCalled {
+				t.Error("database should not be touched for an invalid target")
+			}
+		})
+	}
+}
+
+// Test migrating from an expected version
+func TestMigratorMigrate(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("up from expected head", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+		if err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Migrate(ctx, "001_create_users", "003_add_index"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fmt.Sprint(dialect.storedMigrations) != "[002_add_email 003_add_index]" {
+			t.Errorf("expected migrations up to the target, got %v", dialect.storedMigrations)
+		}
+	})
+
+	t.Run("from zero", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		if err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Migrate(ctx, TargetZero, "+1"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fmt.Sprint(dialect.storedMigrations) != "[001_create_users]" {
+			t.Errorf("expected the first migration, got %v", dialect.storedMigrations)
+		}
+	})
+
+	t.Run("down from expected head", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email", "003_add_index"}}
+		if err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Migrate(ctx, "003_add_index", "001_create_users", WithConfirmRollback()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fmt.Sprint(dialect.deletedMigrations) != "[003_add_index 002_add_email]" {
+			t.Errorf("expected rollback to the target, got %v", dialect.deletedMigrations)
+		}
+	})
+
+	for name, from := range map[string]string{"behind": "001_create_users", "ahead": "003_add_index", "zero": ""} {
+		t.Run("mismatch "+name, func(t *testing.T) {
+			dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email"}}
+			err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Migrate(ctx, from, TargetLatest)
+			if !errors.Is(err, ErrVersionMismatch) {
+				t.Fatalf("expected ErrVersionMismatch, got %v", err)
+			}
+			if len(dialect.storedMigrations) != 0 || len(dialect.executedQueries) != 0 {
+				t.Errorf("nothing should run on a mismatch, got %v", dialect.storedMigrations)
+			}
+			if !dialect.unlockCalled {
+				t.Error("expected the lock to be released")
+			}
+		})
+	}
+
+	t.Run("invalid target", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Migrate(ctx, "", "+abc")
+		if err == nil || !strings.Contains(err.Error(), "invalid relative target") {
+			t.Errorf("expected parse error, got %v", err)
+		}
+		if dialect.lockCalled {
+			t.Error("database should not be touched for an invalid target")
+		}
+	})
+}
+
+// Test targeting migrations by their labels
+func TestMigratorToLabel(t *testing.T) {
+	labeled := func() []Migration {
+		migrations := createTestMigrations()
+		migrations[1].Content = append([]byte("-- migrate:label v2.3\n"), migrations[1].Content...)
+		migrations[3].Content = append([]byte("-- migrate:label v2.4\n"), migrations[3].Content...)
+		return migrations
+	}
+
+	t.Run("up to label", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		if err := New(&MockSource{migrations: labeled()}, dialect, &MockLogger{}).To(context.Background(), "v2.3"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fmt.Sprint(dialect.storedMigrations) != "[001_create_users 002_add_email]" {
+			t.Errorf("expected migrations up to the label, got %v", dialect.storedMigrations)
+		}
+	})
+
+	t.Run("down to label", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email", "003_add_index", "004_add_timestamp"}}
+		if err := New(&MockSource{migrations: labeled()}, dialect, &MockLogger{}).To(context.Background(), "v2.3", WithConfirmRollback()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fmt.Sprint(dialect.deletedMigrations) != "[004_add_timestamp 003_add_index]" {
+			t.Errorf("expected rollback to the label, got %v", dialect.deletedMigrations)
+		}
+	})
+
+	t.Run("unknown label", func(t *testing.T) {
+		err := New(&MockSource{migrations: labeled()}, &MockDialect{appliedMigrations: []string{}}, &MockLogger{}).To(context.Background(), "v9")
+		if !errors.Is(err, ErrTargetNotFound) {
+			t.Errorf("expected ErrTargetNotFound, got %v", err)
+		}
+	})
+
+	for name, label := range map[string]string{"duplicate": "v2.3", "version": "001_create_users", "reserved": "latest"} {
+		t.Run(name, func(t *testing.T) {
+			migrations := labeled()
+			migrations[2].Content = append([]byte("-- migrate:label "+label+"\n"), migrations[2].Content...)
+			dialect := &MockDialect{appliedMigrations: []string{}}
+			err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).To(context.Background(), "v2.4")
+			if err == nil || !strings.Contains(err.Error(), "label") {
+				t.Errorf("expected label error, got %v", err)
+			}
+			if dialect.lockCalled {
+				t.Error("database should not be touched for invalid labels")
+			}
+		})
+	}
+}
+
+// Test applying an ad-hoc migration outside of the source
+func TestMigratorApplyAdHoc(t *testing.T) {
+	ctx := context.Background()
+	dialect := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+	logger := &MockLogger{}
+	migrator := New(&MockSource{migrations: createTestMigrations()}, dialect, logger)
+
+	err := migrator.ApplyAdHoc(ctx, "001_hotfix", []byte("UPDATE users SET active = 1"), []byte("UPDATE users SET active = 0"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(dialect.storedMigrations) != "[001_hotfix]" {
+		t.Errorf("expected 001_hotfix to be stored, got %v", dialect.storedMigrations)
+	}
+	if fmt.Sprint(logger.GetLogs()) != "[migrated file=001_hotfix adhoc=true]" {
+		t.Errorf("unexpected logs %v", logger.GetLogs())
+	}
+	dialect.appliedMigrations = append(dialect.appliedMigrations, "001_hotfix")
+
+	err = migrator.ApplyAdHoc(ctx, "001_hotfix", []byte("UPDATE users SET active = 1"), nil)
+	if !errors.Is(err, ErrAlreadyApplied) {
+		t.Errorf("expected ErrAlreadyApplied, got %v", err)
+	}
+	if len(dialect.storedMigrations) != 1 {
+		t.Errorf("expected no new migrations to be stored, got %v", dialect.storedMigrations)
+	}
+
+	// the ad-hoc migration can be rolled back although it is not in the source
+	if err := migrator.DownOne(ctx, WithConfirmRollback()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(dialect.deletedMigrations) != "[001_hotfix]" {
+		t.Errorf("expected 001_hotfix to be rolled back, got %v", dialect.deletedMigrations)
+	}
+}
+
+// Test that concurrent runs share the ad-hoc migrations of a migrator
+func TestMigratorAdHocConcurrent(t *testing.T) {
+	set := &adHocMigrations{}
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			set.add(Migration{Version: fmt.Sprintf("%03d_hotfix", i)})
+		}()
+		go func() {
+			defer wg.Done()
+			set.find("000_hotfix")
+		}()
+	}
+	wg.Wait()
+
+	for i := range 8 {
+		if _, ok := set.find(fmt.Sprintf("%03d_hotfix", i)); !ok {
+			t.Errorf("expected %03d_hotfix to be found", i)
+		}
+	}
+	if _, ok := (*adHocMigrations)(nil).find("000_hotfix"); ok {
+		t.Error("expected no migrations in a nil set")
+	}
+
+	// a run with a run ID works on a copy of the migrator, which shares the set
+	dialect := &MockDialect{}
+	migrator := New(&MockSource{}, dialect, &MockLogger{})
+	if err := migrator.ApplyAdHoc(context.Background(), "001_hotfix", []byte("SELECT 1"), nil, WithRunID("deploy")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := migrator.adHoc.find("001_hotfix"); !ok {
+		t.Error("expected the ad-hoc migration to be recorded on the migrator")
+	}
+}
+
+// Test the verify directive
+func TestMigratorVerifyDirective(t *testing.T) {
+	tests := []struct {
+		name        string
+		result      interface{}
+		expectError bool
+	}{
+		{name: "truthy result", result: true},
+		{name: "truthy number", result: int64(1)},
+		{name: "falsy result", result: false, expectError: true},
+		{name: "null result", result: nil, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &MockSource{migrations: []Migration{{
+				Version: "001_add_column",
+				Content: []byte("-- migrate:verify SELECT has_column\nALTER TABLE users ADD COLUMN email TEXT"),
+			}}}
+			dialect := &MockDialect{
+				appliedMigrations: []string{},
+				queryResults:      map[string]interface{}{"SELECT has_column": tt.result},
+			}
+
+			err := New(source, dialect, &MockLogger{}).Up(context.Background())
+			if tt.expectError {
+				if err == nil {
+					t.Fatal("expected error but got none")
+				}
+				if len(dialect.storedMigrations) != 0 {
+					t.Errorf("expected no stored migrations, got %v", dialect.storedMigrations)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(dialect.storedMigrations) != 1 {
+				t.Errorf("expected 1 stored migration, got %v", dialect.storedMigrations)
+			}
+		})
+	}
+}
+
+// Test the whole run timeout
+func TestMigratorRunTimeout(t *testing.T) {
+	source := &MockSource{migrations: createTestMigrations()}
+	dialect := &MockDialect{appliedMigrations: []string{}, execDelay: time.Second}
+
+	err := New(source, dialect, &MockLogger{}).Up(context.Background(), WithRunTimeout(10*time.Millisecond))
+	if !errors.Is(err, ErrRunTimeout) {
+		t.Fatalf("expected ErrRunTimeout, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected wrapped deadline error, got %v", err)
+	}
+	if !dialect.unlockCalled {
+		t.Error("expected lock to be released")
+	}
+	if dialect.unlockCtxErr != nil {
+		t.Errorf("expected unlock with a live context, got %v", dialect.unlockCtxErr)
+	}
+}
+
+// hangingDialect is a MockDialect whose bookkeeping queries hang until the
+// context is done
+type hangingDialect struct {
+	*MockDialect
+	hangCreate  bool
+	hangApplied bool
+	// hangRecheck hangs the reads of the applied migrations after the first
+	hangRecheck bool
+	reads       int
+}
+
+func (d *hangingDialect) CreateMigrationsTable(ctx context.Context) error {
+	if d.hangCreate {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return d.MockDialect.CreateMigrationsTable(ctx)
+}
+
+func (d *hangingDialect) GetAppliedMigrations(ctx context.Context) ([]string, error) {
+	d.reads++
+	if d.hangApplied || d.hangRecheck && d.reads > 1 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return d.MockDialect.GetAppliedMigrations(ctx)
+}
+
+// hangingDirtyDialect is a dirtyDialect whose dirty table hangs
+type hangingDirtyDialect struct {
+	*dirtyDialect
+}
+
+func (d *hangingDirtyDialect) GetDirty(ctx context.Context) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+// Test that hanging queries on the migrations table time out
+func TestMigratorBookkeepingTimeout(t *testing.T) {
+	for name, dialect := range map[string]*hangingDialect{
+		"creating the migrations table":  {MockDialect: &MockDialect{}, hangCreate: true},
+		"reading the applied migrations": {MockDialect: &MockDialect{}, hangApplied: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Up(context.Background(), WithBookkeepingTimeout(10*time.Millisecond))
+			if !errors.Is(err, ErrBookkeepingTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("expected ErrBookkeepingTimeout, got %v", err)
+			}
+			if !strings.Contains(err.Error(), name+" took longer than 10ms") {
+				t.Errorf("expected the query in the error, got %v", err)
+			}
+			if len(dialect.storedMigrations) != 0 {
+				t.Errorf("expected no migrations to run, got %v", dialect.storedMigrations)
+			}
+		})
+	}
+
+	dirty := &hangingDirtyDialect{dirtyDialect: &dirtyDialect{MockDialect: &MockDialect{appliedMigrations: []string{}}}}
+	err := New(&MockSource{migrations: createTestMigrations()}, dirty, &MockLogger{}).Up(context.Background(), WithBookkeepingTimeout(10*time.Millisecond))
+	if !errors.Is(err, ErrBookkeepingTimeout) || !strings.Contains(err.Error(), "reading the dirty migration took longer than 10ms") {
+		t.Errorf("expected ErrBookkeepingTimeout for the dirty table, got %v", err)
+	}
+
+	// the applied migrations are read again before each migration
+	recheck := &hangingDialect{MockDialect: &MockDialect{appliedMigrations: []string{}}, hangRecheck: true}
+	recheckCtx, recheckCancel := context.WithTimeout(context.Background(), time.Second)
+	defer recheckCancel()
+	err = New(&MockSource{migrations: createTestMigrations()}, recheck, &MockLogger{}).Up(recheckCtx, WithBookkeepingTimeout(10*time.Millisecond), WithConflictStrategy(OnConflictError))
+	if !errors.Is(err, ErrBookkeepingTimeout) || recheck.reads != 2 {
+		t.Errorf("expected ErrBookkeepingTimeout for the second read, got %v after %d reads", err, recheck.reads)
+	}
+
+	// a cancelled run is not a bookkeeping timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	dialect := &hangingDialect{MockDialect: &MockDialect{}, hangApplied: true}
+	err = New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Up(ctx, WithBookkeepingTimeout(time.Minute))
+	if !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrBookkeepingTimeout) {
+		t.Errorf("expected the deadline of the run, got %v", err)
+	}
+
+	dialect = &hangingDialect{MockDialect: &MockDialect{appliedMigrations: []string{}}}
+	if err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Up(context.Background(), WithBookkeepingTimeout(time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(dialect.storedMigrations) != 4 {
+		t.Errorf("expected the migrations to run, got %v", dialect.storedMigrations)
+	}
+}
+
+// Test that re-running Up after a failure applies only the remaining migrations
+func TestMigratorResumeAfterFailure(t *testing.T) {
+	migrations := createTestMigrations()
+	source := &MockSource{migrations: migrations}
+	dialect := &MockDialect{
+		appliedMigrations: []string{},
+		execErrors:        map[string]error{string(migrations[2].Content): errors.New("disk full")},
+	}
+	migrator := New(source, dialect, &MockLogger{})
+
+	if err := migrator.Up(context.Background()); err == nil {
+		t.Fatal("expected error but got none")
+	}
+	expected := []string{"001_create_users", "002_add_email"}
+	if fmt.Sprint(dialect.storedMigrations) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v to be applied before the failure, got %v", expected, dialect.storedMigrations)
+	}
+
+	// the next run sees the recorded migrations and continues from the failed one
+	dialect.appliedMigrations = dialect.storedMigrations
+	dialect.storedMigrations = nil
+	dialect.execErrors = nil
+
+	if err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = []string{"003_add_index", "004_add_timestamp"}
+	if fmt.Sprint(dialect.storedMigrations) != fmt.Sprint(expected) {
+		t.Errorf("expected %v to be applied on resume, got %v", expected, dialect.storedMigrations)
+	}
+}
+
+// Test validation against a shadow database
+func TestMigratorShadowDatabase(t *testing.T) {
+	t.Run("shadow failure stops the real run", func(t *testing.T) {
+		migrations := createTestMigrations()
+		source := &MockSource{migrations: migrations}
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		shadow := &MockDialect{
+			appliedMigrations: []string{},
+			execErrors:        map[string]error{string(migrations[1].Content): errors.New("syntax error")},
+		}
+
+		err := New(source, dialect, &MockLogger{}).Up(context.Background(), WithShadowDatabase(shadow))
+		if err == nil {
+			t.Fatal("expected error but got none")
+		}
+		if dialect.createTableCalled || len(dialect.storedMigrations) != 0 {
+			t.Error("real database should not be touched")
+		}
+	})
+
+	t.Run("shadow success continues with the real run", func(t *testing.T) {
+		source := &MockSource{migrations: createTestMigrations()}
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+		shadow := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+		logger := &MockLogger{}
+
+		err := New(source, dialect, logger).Up(context.Background(), WithShadowDatabase(shadow))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(shadow.storedMigrations) != 3 || len(dialect.storedMigrations) != 3 {
+			t.Errorf("expected 3 migrations on both databases, got %v and %v", shadow.storedMigrations, dialect.storedMigrations)
+		}
+		if logger.GetLogs()[0] != "migrated file=002_add_email shadow=true" {
+			t.Errorf("expected shadow run to be marked in logs, got %q", logger.GetLogs()[0])
+		}
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		source := &MockSource{migrations: createTestMigrations()}
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+		// the mock doesn't update applied migrations, so emulate the state after the up
+		shadow := &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email", "003_add_index", "004_add_timestamp"}}
+
+		err := New(source, dialect, &MockLogger{}).Up(context.Background(), WithShadowDatabase(shadow), WithShadowRoundTrip())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(shadow.deletedMigrations) != 0 {
+			t.Errorf("expected nothing to roll back when no migrations were applied, got %v", shadow.deletedMigrations)
+		}
+
+		shadow = &MockDialect{appliedMigrations: []string{"001_create_users"}}
+		err = New(source, dialect, &MockLogger{}).Up(context.Background(), WithShadowDatabase(&growingDialect{MockDialect: shadow}), WithShadowRoundTrip())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expectedDeleted := []string{"004_add_timestamp", "003_add_index", "002_add_email"}
+		if fmt.Sprint(shadow.deletedMigrations) != fmt.Sprint(expectedDeleted) {
+			t.Errorf("expected %v to be rolled back, got %v", expectedDeleted, shadow.deletedMigrations)
+		}
+		if len(shadow.storedMigrations) != 6 {
+			t.Errorf("expected migrations to be applied twice, got %v", shadow.storedMigrations)
+		}
+	})
+
+	t.Run("rollback needs confirmation", func(t *testing.T) {
+		source := &MockSource{migrations: createTestMigrations()}
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+		shadow := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+
+		err := New(source, dialect, &MockLogger{}).Down(context.Background(), 1, WithShadowDatabase(shadow))
+		if !errors.Is(err, ErrRollbackNotConfirmed) {
+			t.Fatalf("expected ErrRollbackNotConfirmed, got %v", err)
+		}
+		if len(shadow.deletedMigrations) != 0 {
+			t.Errorf("expected no rollback on the shadow database, got %v", shadow.deletedMigrations)
+		}
+	})
+}
+
+// growingDialect reports stored migrations as applied
+type growingDialect struct {
+	*MockDialect
+}
+
+func (d *growingDialect) GetAppliedMigrations(ctx context.Context) ([]string, error) {
+	applied := slices.Clone(d.appliedMigrations)
+	for _, v := range d.storedMigrations {
+		if !slices.Contains(applied, v) {
+			applied = append(applied, v)
+		}
+	}
+	for _, v := range d.deletedMigrations {
+		applied = slices.DeleteFunc(applied, func(a string) bool { return a == v })
+	}
+	return applied, nil
+}
+
+// trackingDialect keeps the applied migrations up to date
+type trackingDialect struct {
+	*MockDialect
+}
+
+func (d *trackingDialect) StoreAppliedMigration(ctx context.Context, tx Tx, record AppliedRecord) error {
+	if err := d.MockDialect.StoreAppliedMigration(ctx, tx, record); err != nil {
+		return err
+	}
+	d.appliedMigrations = append(d.appliedMigrations, record.Version)
+	return nil
+}
+
+func (d *trackingDialect) DeleteAppliedMigration(ctx context.Context, tx Tx, version string) error {
+	if err := d.MockDialect.DeleteAppliedMigration(ctx, tx, version); err != nil {
+		return err
+	}
+	d.appliedMigrations = slices.DeleteFunc(d.appliedMigrations, func(a string) bool { return a == version })
+	return nil
+}
+
+// Test the reversibility check
+func TestMigratorTestReversibility(t *testing.T) {
+	t.Run("reversible migrations", func(t *testing.T) {
+		mock := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+		logger := &MockLogger{}
+
+		err := New(&MockSource{migrations: createTestMigrations()}, &trackingDialect{mock}, logger).TestReversibility(context.Background(), WithConfirmRollback())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		expected := []string{"001_create_users", "002_add_email", "003_add_index", "004_add_timestamp"}
+		if fmt.Sprint(mock.appliedMigrations) != fmt.Sprint(expected) {
+			t.Errorf("expected database to be fully migrated, got %v", mock.appliedMigrations)
+		}
+		if len(mock.deletedMigrations) != 4 {
+			t.Errorf("expected all migrations to be rolled back, got %v", mock.deletedMigrations)
+		}
+		if !mock.lockCalled || !mock.unlockCalled {
+			t.Error("expected the check to run under the lock")
+		}
+		logs := logger.GetLogs()
+		if logs[len(logs)-1] != "reversibility check passed migrations=4" {
+			t.Errorf("unexpected last log %q", logs[len(logs)-1])
+		}
+	})
+
+	t.Run("broken rollback", func(t *testing.T) {
+		mock := &MockDialect{
+			appliedMigrations: []string{},
+			execErrors:        map[string]error{"DROP INDEX idx_users_email": errors.New("index is in use")},
+		}
+
+		err := New(&MockSource{migrations: createTestMigrations()}, &trackingDialect{mock}, &MockLogger{}).TestReversibility(context.Background(), WithConfirmRollback())
+		if err == nil || !strings.Contains(err.Error(), "003_add_index") {
+			t.Errorf("expected rollback error for 003_add_index, got %v", err)
+		}
+	})
+
+	t.Run("requires confirmation", func(t *testing.T) {
+		mock := &MockDialect{appliedMigrations: []string{}}
+		err := New(&MockSource{migrations: createTestMigrations()}, &trackingDialect{mock}, &MockLogger{}).TestReversibility(context.Background())
+		if !errors.Is(err, ErrRollbackNotConfirmed) {
+			t.Fatalf("expected ErrRollbackNotConfirmed, got %v", err)
+		}
+		if len(mock.storedMigrations) != 0 {
+			t.Errorf("expected nothing to run, got %v", mock.storedMigrations)
+		}
+	})
+}
+
+// Test that session directives run before the migration body
+func TestMigratorSessionDirective(t *testing.T) {
+	source := &MockSource{migrations: []Migration{{
+		Version: "001_big_index",
+		Content: []byte("-- migrate:session SET LOCAL work_mem = '1GB'\n-- migrate:session SET LOCAL maintenance_work_mem = '2GB'\nCREATE INDEX idx ON t(a)"),
+	}}}
+	dialect := &MockDialect{appliedMigrations: []string{}}
+
+	if err := New(source, dialect, &MockLogger{}).Up(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"SET LOCAL work_mem = '1GB'", "SET LOCAL maintenance_work_mem = '2GB'", "\n\nCREATE INDEX idx ON t(a)"}
+	if fmt.Sprintf("%q", dialect.executedQueries) != fmt.Sprintf("%q", expected) {
+		t.Errorf("expected queries %q, got %q", expected, dialect.executedQueries)
+	}
+}
+
+// MockRandomAccessSource counts the loaded migrations
+type MockRandomAccessSource struct {
+	MockSource
+	getMigrationsCalled bool
+	loaded              []string
+}
+
+func (s *MockRandomAccessSource) GetMigrations() ([]Migration, error) {
+	s.getMigrationsCalled = true
+	return s.MockSource.GetMigrations()
+}
+
+func (s *MockRandomAccessSource) GetMigration(version string) (Migration, error) {
+	s.loaded = append(s.loaded, version)
+	for _, m := range s.migrations {
+		if m.Version == version {
+			return m, nil
+		}
+	}
+	return Migration{}, errors.New("not found")
+}
+
+// Test that Down reads only the rolled back migrations from a random access source
+func TestMigratorDownRandomAccess(t *testing.T) {
+	source := &MockRandomAccessSource{MockSource: MockSource{migrations: createTestMigrations()}}
+	dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email", "003_add_index"}}
+
+	if err := New(source, dialect, &MockLogger{}).Down(context.Background(), 2, WithConfirmRollback()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if source.getMigrationsCalled {
+		t.Error("GetMigrations should not be called")
+	}
+	expected := []string{"003_add_index", "002_add_email"}
+	if fmt.Sprint(source.loaded) != fmt.Sprint(expected) {
+		t.Errorf("expected %v to be loaded, got %v", expected, source.loaded)
+	}
+	if fmt.Sprint(dialect.deletedMigrations) != fmt.Sprint(expected) {
+		t.Errorf("expected %v to be rolled back, got %v", expected, dialect.deletedMigrations)
+	}
+}
+
+// MockDirectionalSource records the directions the migrations are loaded for
+type MockDirectionalSource struct {
+	MockSource
+	directions []string
+}
+
+func (s *MockDirectionalSource) GetMigrations() ([]Migration, error) {
+	s.directions = append(s.directions, "both")
+	return s.MockSource.GetMigrations()
+}
+
+func (s *MockDirectionalSource) GetMigrationsFor(ctx context.Context, direction string) ([]Migration, error) {
+	s.directions = append(s.directions, direction)
+	var migrations []Migration
+	for _, m := range s.migrations {
+		if direction == DirectionDown {
+			m.Content = nil
+		}
+		migrations = append(migrations, m)
+	}
+	return migrations, nil
+}
+
+// Test that Down loads only the down content from a directional source
+func TestMigratorDownDirectional(t *testing.T) {
+	ctx := context.Background()
+	source := &MockDirectionalSource{MockSource: MockSource{migrations: createTestMigrations()}}
+	dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email"}}
+	migrator := New(source, dialect, &MockLogger{})
+
+	if err := migrator.Down(ctx, 1, WithConfirmRollback()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(dialect.executedQueries) != "[ALTER TABLE users DROP COLUMN email]" {
+		t.Errorf("expected the down migration to run, got %v", dialect.executedQueries)
+	}
+
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(source.directions) != "[down up]" {
+		t.Errorf("expected down for the rollback and up for the apply, got %v", source.directions)
+	}
+}
+
+// Test the run summary log record
+func TestMigratorRunSummary(t *testing.T) {
+	source := &MockSource{migrations: createTestMigrations()}
+	dialect := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+	logger := &MockLogger{}
+
+	if err := New(source, dialect, logger).Up(context.Background(), WithoutRunSummary()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, log := range logger.GetLogs() {
+		if strings.HasPrefix(log, "migration run complete") {
+			t.Errorf("unexpected summary %q", log)
+		}
+	}
+}
+
+// Test detection of a schema ahead of the known migrations
+func TestMigratorCheckCompatible(t *testing.T) {
+	tests := []struct {
+		name        string
+		applied     []string
+		expectError bool
+	}{
+		{name: "behind", applied: []string{"001_create_users"}},
+		{name: "up to date", applied: []string{"001_create_users", "002_add_email", "003_add_index", "004_add_timestamp"}},
+		{name: "ahead", applied: []string{"001_create_users", "002_add_email", "003_add_index", "004_add_timestamp", "005_new_release"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &MockSource{migrations: createTestMigrations()}
+			dialect := &MockDialect{appliedMigrations: tt.applied}
+
+			err := New(source, dialect, &MockLogger{}).CheckCompatible(context.Background())
+			if tt.expectError != errors.Is(err, ErrSchemaAhead) {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if dialect.createTableCalled || dialect.lockCalled {
+				t.Error("CheckCompatible should only read")
+			}
+		})
+	}
+}
+
+// Test running setup statements before the migrations table is created
+func TestMigratorSetupSQL(t *testing.T) {
+	setup := WithSetupSQL("CREATE EXTENSION IF NOT EXISTS pgcrypto", `CREATE EXTENSION IF NOT EXISTS "uuid-ossp"`)
+
+	dialect := &MockDialect{appliedMigrations: []string{}, createTableErr: errors.New("type uuid does not exist")}
+	err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Up(context.Background(), setup)
+	if err == nil {
+		t.Fatal("expected table creation error")
+	}
+	expected := []string{"CREATE EXTENSION IF NOT EXISTS pgcrypto", `CREATE EXTENSION IF NOT EXISTS "uuid-ossp"`}
+	if fmt.Sprintf("%q", dialect.execContextQueries) != fmt.Sprintf("%q", expected) {
+		t.Errorf("expected setup before the migrations table, got %q", dialect.execContextQueries)
+	}
+
+	dialect = &MockDialect{appliedMigrations: []string{}, execContextErr: errors.New("permission denied")}
+	err = New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Up(context.Background(), setup)
+	if err == nil || !strings.Contains(err.Error(), "failed to run setup SQL") {
+		t.Fatalf("expected setup error, got %v", err)
+	}
+	if dialect.createTableCalled || dialect.lockCalled {
+		t.Error("expected no bookkeeping after a failed setup")
+	}
+}
+
+// Test beginning the migration transactions with a custom factory
+func TestMigratorTxFactory(t *testing.T) {
+	dialect := &MockDialect{appliedMigrations: []string{}}
+	var created []*MockTx
+	factory := WithTxFactory(func(ctx context.Context) (Tx, error) {
+		tx := &MockTx{dialect: dialect}
+		created = append(created, tx)
+		return tx, nil
+	})
+
+	if err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Up(context.Background(), factory); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dialect.beginTxCalled {
+		t.Error("expected transactions from the factory only")
+	}
+	if len(created) != 4 || !created[0].commitCalled || !created[3].commitCalled {
+		t.Errorf("expected a committed transaction per migration, got %d", len(created))
+	}
+	if len(dialect.storedMigrations) != 4 {
+		t.Errorf("unexpected stored migrations %v", dialect.storedMigrations)
+	}
+
+	dialect = &MockDialect{appliedMigrations: []string{}}
+	err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Up(context.Background(), WithTxFactory(func(ctx context.Context) (Tx, error) {
+		return nil, errors.New("coordinator unavailable")
+	}))
+	if err == nil || !strings.Contains(err.Error(), "coordinator unavailable") {
+		t.Errorf("expected factory error, got %v", err)
+	}
+	if dialect.beginTxCalled || len(dialect.storedMigrations) != 0 {
+		t.Error("expected no fallback to the dialect transactions")
+	}
+}
+
+// Test capping the number of migrations applied by a run
+func TestMigratorMaxMigrationsPerRun(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("capped", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		logger := &MockLogger{}
+		if err := New(&MockSource{migrations: createTestMigrations()}, dialect, logger).Up(ctx, WithMaxMigrationsPerRun(3)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fmt.Sprint(dialect.storedMigrations) != "[001_create_users 002_add_email 003_add_index]" {
+			t.Errorf("expected 3 migrations, got %v", dialect.storedMigrations)
+		}
+		if logs := logger.GetLogs(); !slices.Contains(logs, "migration cap reached, run again to apply the rest cap=3 remaining=1") {
+			t.Errorf("expected cap log, got %v", logs)
+		}
+	})
+
+	t.Run("under the cap", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email"}}
+		logger := &MockLogger{}
+		if err := New(&MockSource{migrations: createTestMigrations()}, dialect, logger).Up(ctx, WithMaxMigrationsPerRun(2), WithStrict()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(dialect.storedMigrations) != 2 {
+			t.Errorf("expected the pending migrations, got %v", dialect.storedMigrations)
+		}
+		for _, log := range logger.GetLogs() {
+			if strings.Contains(log, "cap reached") {
+				t.Errorf("expected no cap log, got %v", log)
+			}
+		}
+	})
+
+	t.Run("target within the cap", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		if err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).To(ctx, "002_add_email", WithMaxMigrationsPerRun(2), WithStrict()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(dialect.storedMigrations) != 2 {
+			t.Errorf("expected the migrations up to the target, got %v", dialect.storedMigrations)
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+		err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Up(ctx, WithMaxMigrationsPerRun(2), WithStrict())
+		if !errors.Is(err, ErrTooManyMigrations) || !strings.Contains(err.Error(), "3 pending, at most 2 per run") {
+			t.Fatalf("expected ErrTooManyMigrations, got %v", err)
+		}
+		if len(dialect.storedMigrations) != 0 {
+			t.Errorf("expected nothing to be applied, got %v", dialect.storedMigrations)
+		}
+	})
+}
+
+// transactionalDialect is a MockDialect on a database with transactional DDL
+type transactionalDialect struct {
+	*MockDialect
+}
+
+func (d transactionalDialect) TransactionalDDL() bool {
+	return true
+}
+
+func (d transactionalDialect) IsDeadlock(err error) bool {
+	return errors.Is(err, errDeadlock)
+}
+
+// Test running migrations in a transaction which is rolled back
+func TestMigratorRollbackAfter(t *testing.T) {
+	ctx := context.Background()
+	run := func(dialect Dialect, migrations []Migration, logger *MockLogger, opts ...Option) ([]*MockTx, error) {
+		var created []*MockTx
+		factory := WithTxFactory(func(ctx context.Context) (Tx, error) {
+			tx := &MockTx{}
+			if d, ok := dialect.(transactionalDialect); ok {
+				tx.dialect = d.MockDialect
+			}
+			created = append(created, tx)
+			return tx, nil
+		})
+		opts = append(opts, factory, WithRollbackAfter())
+		err := New(&MockSource{migrations: migrations}, dialect, logger).Up(ctx, opts...)
+		return created, err
+	}
+
+	t.Run("rolled back", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+		logger := &MockLogger{}
+		created, err := run(transactionalDialect{dialect}, createTestMigrations(), logger)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(created) != 1 || created[0].commitCalled || !created[0].rollbackCalled {
+			t.Fatalf("expected one rolled back transaction, got %d", len(created))
+		}
+		if len(dialect.executedQueries) != 3 {
+			t.Errorf("expected the pending migrations to run, got %v", dialect.executedQueries)
+		}
+		if logs := logger.GetLogs(); !slices.Contains(logs, "run rolled back applied=3 rolled_back=0") {
+			t.Errorf("expected rollback log, got %v", logs)
+		}
+	})
+
+	t.Run("failed migration", func(t *testing.T) {
+		dialect := &MockDialect{
+			appliedMigrations: []string{},
+			execErrors:        map[string]error{"CREATE INDEX idx_users_email ON users(email)": errors.New("syntax error")},
+		}
+		created, err := run(transactionalDialect{dialect}, createTestMigrations(), &MockLogger{})
+		if err == nil || !strings.Contains(err.Error(), "failed to apply migration 003_add_index") || !strings.Contains(err.Error(), "syntax error") {
+			t.Fatalf("expected error of the failed migration, got %v", err)
+		}
+		if len(created) != 1 || created[0].commitCalled || !created[0].rollbackCalled {
+			t.Error("expected the transaction to be rolled back")
+		}
+		if len(dialect.executedQueries) != 3 {
+			t.Errorf("expected the run to stop at the failed migration, got %v", dialect.executedQueries)
+		}
+	})
+
+	t.Run("deadlock is not retried", func(t *testing.T) {
+		dialect := &MockDialect{
+			appliedMigrations: []string{},
+			execErrors:        map[string]error{"ALTER TABLE users ADD COLUMN email VARCHAR(255)": errDeadlock},
+		}
+		logger := &MockLogger{}
+		created, err := run(transactionalDialect{dialect}, createTestMigrations(), logger, WithDeadlockRetry(3, time.Millisecond))
+		if !errors.Is(err, errDeadlock) {
+			t.Fatalf("expected deadlock error, got %v", err)
+		}
+		if len(dialect.executedQueries) != 2 {
+			t.Errorf("expected a single attempt, got %v", dialect.executedQueries)
+		}
+		for _, log := range logger.GetLogs() {
+			if strings.HasPrefix(log, "deadlock detected") {
+				t.Errorf("unexpected retry %q", log)
+			}
+		}
+		if len(created) != 1 || !created[0].rollbackCalled {
+			t.Error("expected the transaction to be rolled back")
+		}
+	})
+
+	t.Run("without transactional DDL", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		created, err := run(dialect, createTestMigrations(), &MockLogger{})
+		if err == nil || !strings.Contains(err.Error(), "can't be rolled back") {
+			t.Fatalf("expected dialect error, got %v", err)
+		}
+		if len(created) != 0 || len(dialect.storedMigrations) != 0 {
+			t.Error("expected nothing to run")
+		}
+	})
+
+	t.Run("migration without transaction", func(t *testing.T) {
+		migrations := createTestMigrations()
+		migrations[1].Content = append([]byte("-- migrate:no-transaction\n"), migrations[1].Content...)
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		created, err := run(transactionalDialect{dialect}, migrations, &MockLogger{})
+		if err == nil || !strings.Contains(err.Error(), "002_add_email") || !strings.Contains(err.Error(), "without a transaction") {
+			t.Fatalf("expected error of the migration without a transaction, got %v", err)
+		}
+		if len(dialect.execContextQueries) != 0 {
+			t.Errorf("expected no statements outside of the transaction, got %v", dialect.execContextQueries)
+		}
+		if len(created) != 1 || !created[0].rollbackCalled {
+			t.Error("expected the transaction to be rolled back")
+		}
+	})
+}
+
+// Test that rollbacks require a confirmation
+func TestMigratorConfirmRollback(t *testing.T) {
+	ctx := context.Background()
+	operations := map[string]func(m *Migrator, opts ...Option) error{
+		"down":     func(m *Migrator, opts ...Option) error { return m.Down(ctx, 1, opts...) },
+		"down one": func(m *Migrator, opts ...Option) error { return m.DownOne(ctx, opts...) },
+		"to":       func(m *Migrator, opts ...Option) error { return m.To(ctx, "001_create_users", opts...) },
+		"zero":     func(m *Migrator, opts ...Option) error { return m.To(ctx, TargetZero, opts...) },
+		"revert":   func(m *Migrator, opts ...Option) error { return m.Revert(ctx, "001_create_users", opts...) },
+	}
+
+	for name, operation := range operations {
+		t.Run(name, func(t *testing.T) {
+			dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email"}}
+			err := operation(New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}))
+			if !errors.Is(err, ErrRollbackNotConfirmed) {
+				t.Fatalf("expected ErrRollbackNotConfirmed, got %v", err)
+			}
+			if len(dialect.executedQueries) != 0 || len(dialect.deletedMigrations) != 0 {
+				t.Errorf("expected nothing to run, got %v", dialect.executedQueries)
+			}
+
+			dialect = &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email"}}
+			if err := operation(New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}), WithDryRun()); err != nil {
+				t.Errorf("expected dry run without confirmation, got %v", err)
+			}
+
+			if err := operation(New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}), WithConfirmRollback()); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if len(dialect.deletedMigrations) == 0 {
+				t.Error("expected confirmed rollback to run")
+			}
+		})
+	}
+
+	// up-only operations don't need a confirmation
+	dialect := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+	if err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).To(ctx, "003_add_index"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// dirtyDialect tracks the dirty migration in memory and fails a statement
+// executed outside of a transaction
+type dirtyDialect struct {
+	*MockDialect
+	dirty  string
+	failOn string
+}
+
+func (d *dirtyDialect) ExecContext(ctx context.Context, query string, args ...interface{}) error {
+	if query == d.failOn {
+		return errors.New("lock timeout")
+	}
+	return d.MockDialect.ExecContext(ctx, query, args...)
+}
+
+func (d *dirtyDialect) MarkDirty(ctx context.Context, version string) error {
+	d.dirty = version
+	return nil
+}
+
+func (d *dirtyDialect) GetDirty(ctx context.Context) (string, error) {
+	return d.dirty, nil
+}
+
+func (d *dirtyDialect) ClearDirty(ctx context.Context) error {
+	d.dirty = ""
+	return nil
+}
+
+// Test the dirty state of failed migrations without a transaction
+func TestMigratorDirty(t *testing.T) {
+	ctx := context.Background()
+	migrations := []Migration{
+		{Version: "001_index", Content: []byte("CREATE INDEX CONCURRENTLY a ON t (a);\nCREATE INDEX CONCURRENTLY b ON t (b);"), NoTransaction: true},
+		{Version: "002_email", Content: []byte("ALTER TABLE t ADD COLUMN email TEXT")},
+	}
+	failing := func() *dirtyDialect {
+		return &dirtyDialect{
+			MockDialect: &MockDialect{appliedMigrations: []string{}},
+			failOn:      "CREATE INDEX CONCURRENTLY b ON t (b);",
+		}
+	}
+
+	t.Run("blocks runs", func(t *testing.T) {
+		dialect := failing()
+		if err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(ctx); err == nil {
+			t.Fatal("expected error but got none")
+		}
+		if dialect.dirty != "001_index" {
+			t.Fatalf("expected migration to be dirty, got %q", dialect.dirty)
+		}
+
+		dialect.failOn = ""
+		err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(ctx)
+		if !errors.Is(err, ErrDirty) || !strings.Contains(err.Error(), "001_index") {
+			t.Fatalf("expected ErrDirty, got %v", err)
+		}
+		if len(dialect.storedMigrations) != 0 {
+			t.Errorf("expected nothing to run, got %v", dialect.storedMigrations)
+		}
+	})
+
+	t.Run("resolve as applied", func(t *testing.T) {
+		dialect := failing()
+		New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(ctx)
+
+		if err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Resolve(ctx, "002_email", true); err == nil {
+			t.Error("expected error for a migration which is not dirty")
+		}
+		logger := &MockLogger{}
+		if err := New(&MockSource{migrations: migrations}, dialect, logger).Resolve(ctx, "001_index", true); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if dialect.dirty != "" || fmt.Sprint(dialect.storedMigrations) != "[001_index]" {
+			t.Errorf("expected clean state with the migration recorded, got %q %v", dialect.dirty, dialect.storedMigrations)
+		}
+		if fmt.Sprint(logger.GetLogs()) != "[resolved file=001_index applied=true]" {
+			t.Errorf("unexpected logs %v", logger.GetLogs())
+		}
+	})
+
+	t.Run("resolve as pending", func(t *testing.T) {
+		dialect := failing()
+		New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(ctx)
+
+		if err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Resolve(ctx, "001_index", false); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if dialect.dirty != "" || len(dialect.storedMigrations) != 0 {
+			t.Errorf("expected clean state without records, got %q %v", dialect.dirty, dialect.storedMigrations)
+		}
+	})
+
+	t.Run("force", func(t *testing.T) {
+		dialect := failing()
+		New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(ctx)
+
+		dialect.failOn = ""
+		logger := &MockLogger{}
+		if err := New(&MockSource{migrations: migrations}, dialect, logger).Up(ctx, WithForce()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if dialect.dirty != "" {
+			t.Errorf("expected the dirty state to clear once the migration succeeds, got %q", dialect.dirty)
+		}
+		if logs := logger.GetLogs(); logs[0] != "warning: proceeding despite dirty migration file=001_index" {
+			t.Errorf("unexpected logs %v", logs)
+		}
+	})
+
+	t.Run("transactional failures are clean", func(t *testing.T) {
+		dialect := failing()
+		dialect.failOn = ""
+		dialect.execErrors = map[string]error{"ALTER TABLE t ADD COLUMN email TEXT": errors.New("syntax error")}
+		if err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(ctx); err == nil {
+			t.Fatal("expected error but got none")
+		}
+		if dialect.dirty != "" {
+			t.Errorf("expected clean state, got %q", dialect.dirty)
+		}
+	})
+}
+
+// checksumDialect records the checksums of applied migrations in memory
+type checksumDialect struct {
+	*MockDialect
+	checksums map[string]string
+}
+
+func (d *checksumDialect) GetChecksums(ctx context.Context) (map[string]string, error) {
+	return d.checksums, nil
+}
+
+func (d *checksumDialect) StoreAppliedMigration(ctx context.Context, tx Tx, record AppliedRecord) error {
+	if err := d.MockDialect.StoreAppliedMigration(ctx, tx, record); err != nil {
+		return err
+	}
+	d.checksums[record.Version] = record.Checksum
+	return nil
+}
+
+// Test re-applying migrations changed since they were applied
+func TestMigratorReapplyOnChange(t *testing.T) {
+	ctx := context.Background()
+	migrations := createTestMigrations()[:2]
+	dialect := &checksumDialect{MockDialect: &MockDialect{appliedMigrations: []string{}}, checksums: map[string]string{}}
+	if err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dialect.checksums["002_add_email"] != checksum(migrations[1].Content) {
+		t.Fatalf("expected checksums to be recorded, got %v", dialect.checksums)
+	}
+
+	changed := slices.Clone(migrations)
+	changed[1].Content = []byte("ALTER TABLE users ADD COLUMN email VARCHAR(320)")
+	dialect.appliedMigrations = []string{"001_create_users", "002_add_email"}
+	dialect.executedQueries = nil
+
+	err := New(&MockSource{migrations: changed}, dialect, &MockLogger{}).Up(ctx, WithReapplyOnChange("production"))
+	if !errors.Is(err, ErrReapplyNotAllowed) {
+		t.Fatalf("expected ErrReapplyNotAllowed, got %v", err)
+	}
+	if len(dialect.executedQueries) != 0 {
+		t.Errorf("expected nothing to run, got %v", dialect.executedQueries)
+	}
+
+	logger := &MockLogger{}
+	if err := New(&MockSource{migrations: changed}, dialect, logger).Up(ctx, WithReapplyOnChange("development")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{string(changed[1].DownContent), string(changed[1].Content)}
+	if fmt.Sprintf("%q", dialect.executedQueries) != fmt.Sprintf("%q", expected) {
+		t.Errorf("expected %q, got %q", expected, dialect.executedQueries)
+	}
+	if dialect.checksums["002_add_email"] != checksum(changed[1].Content) {
+		t.Error("expected checksum to be updated")
+	}
+	if logs := logger.GetLogs(); !strings.HasPrefix(logs[0], "WARNING: migration changed since it was applied") || logs[1] != "reapplied file=002_add_email" {
+		t.Errorf("unexpected logs %v", logs)
+	}
+
+	// the migrations applied after a changed one are reapplied with it
+	changed[0].Content = []byte("CREATE TABLE users (id BIGINT PRIMARY KEY)")
+	dialect.executedQueries = nil
+	logger = &MockLogger{}
+	if err := New(&MockSource{migrations: changed}, dialect, logger).Up(ctx, WithReapplyOnChange("development")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = []string{
+		string(changed[1].DownContent), string(changed[0].DownContent),
+		string(changed[0].Content), string(changed[1].Content),
+	}
+	if fmt.Sprintf("%q", dialect.executedQueries) != fmt.Sprintf("%q", expected) {
+		t.Errorf("expected %q, got %q", expected, dialect.executedQueries)
+	}
+	if logs := logger.GetLogs(); len(logs) < 3 || logs[1] != "reapplied file=001_create_users" || logs[2] != "reapplied file=002_add_email" {
+		t.Errorf("unexpected logs %v", logs)
+	}
+
+	// the later migrations must be in the source to be rolled back
+	changed[0].Content = []byte("CREATE TABLE users (id UUID PRIMARY KEY)")
+	dialect.executedQueries = nil
+	err = New(&MockSource{migrations: changed[:1]}, dialect, &MockLogger{}).Up(ctx, WithReapplyOnChange("development"))
+	if !errors.Is(err, ErrMigrationNotFound) || !strings.Contains(err.Error(), "002_add_email") {
+		t.Errorf("expected ErrMigrationNotFound of the later migration, got %v", err)
+	}
+	if len(dialect.executedQueries) != 0 {
+		t.Errorf("expected nothing to run, got %q", dialect.executedQueries)
+	}
+}
+
+// Test the record of an applied migration
+func TestMigratorAppliedRecord(t *testing.T) {
+	migrations := createTestMigrations()[:1]
+	dialect := &MockDialect{appliedMigrations: []string{}, execDelay: 10 * time.Millisecond}
+
+	if err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(context.Background(), WithRelease("build-1234")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(dialect.storedRecords) != 1 {
+		t.Fatalf("expected 1 record, got %v", dialect.storedRecords)
+	}
+	record := dialect.storedRecords[0]
+	if record.Version != "001_create_users" || record.Checksum != checksum(migrations[0].Content) || record.Release != "build-1234" {
+		t.Errorf("unexpected record %+v", record)
+	}
+	if record.Duration < 10*time.Millisecond {
+		t.Errorf("expected the duration to include the migration, got %v", record.Duration)
+	}
+}
+
+// racingDialect records a migration as applied by another instance after
+// the applied migrations are first read
+type racingDialect struct {
+	*MockDialect
+	version string
+	reads   int
+}
+
+func (d *racingDialect) GetAppliedMigrations(ctx context.Context) ([]string, error) {
+	d.reads++
+	if d.reads == 2 {
+		d.appliedMigrations = append(d.appliedMigrations, d.version)
+	}
+	return d.MockDialect.GetAppliedMigrations(ctx)
+}
+
+// Test the strategies for migrations applied during the run
+func TestMigratorConflictStrategy(t *testing.T) {
+	ctx := context.Background()
+	newDialect := func() *racingDialect {
+		return &racingDialect{MockDialect: &MockDialect{appliedMigrations: []string{"001_create_users"}}, version: "002_add_email"}
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		dialect := newDialect()
+		if err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Up(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if dialect.reads != 1 {
+			t.Errorf("expected the applied migrations to be read once, got %d", dialect.reads)
+		}
+		if len(dialect.storedMigrations) != 3 {
+			t.Errorf("expected 3 migrations to be applied, got %v", dialect.storedMigrations)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		dialect := newDialect()
+		err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).Up(ctx, WithConflictStrategy(OnConflictError))
+		if !errors.Is(err, ErrAlreadyApplied) || !strings.Contains(err.Error(), "002_add_email") {
+			t.Fatalf("expected ErrAlreadyApplied for 002_add_email, got %v", err)
+		}
+		if len(dialect.storedMigrations) != 0 {
+			t.Errorf("expected no migrations to be applied, got %v", dialect.storedMigrations)
+		}
+	})
+
+	t.Run("reapply", func(t *testing.T) {
+		dialect := newDialect()
+		logger := &MockLogger{}
+		err := New(&MockSource{migrations: createTestMigrations()}, dialect, logger).Up(ctx, WithConflictStrategy(OnConflictReapply))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fmt.Sprint(dialect.deletedMigrations) != "[002_add_email]" {
+			t.Errorf("expected the record of 002_add_email to be replaced, got %v", dialect.deletedMigrations)
+		}
+		if len(dialect.storedMigrations) != 3 {
+			t.Errorf("expected 3 migrations to be applied, got %v", dialect.storedMigrations)
+		}
+		if !slices.ContainsFunc(logger.infoLogs, func(m string) bool { return strings.Contains(m, "applied during the run") }) {
+			t.Errorf("expected a warning, got %v", logger.infoLogs)
+		}
+	})
+}
+
+// suffixDialect tracks the suffixes the dialect was copied with
+type suffixDialect struct {
+	*MockDialect
+	suffixes []string
+}
+
+func (d *suffixDialect) WithTableSuffix(suffix string) Dialect {
+	d.suffixes = append(d.suffixes, suffix)
+	return d.MockDialect
+}
+
+// Test running against a migrations table with a suffix
+func TestMigratorTableSuffix(t *testing.T) {
+	ctx := context.Background()
+
+	dialect := &suffixDialect{MockDialect: &MockDialect{appliedMigrations: []string{}}}
+	migrator := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{})
+	if err := migrator.Up(ctx, WithTableSuffix("blue")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(dialect.suffixes) != "[blue]" || len(dialect.storedMigrations) != 4 {
+		t.Errorf("expected the run on the suffixed dialect, got %v %v", dialect.suffixes, dialect.storedMigrations)
+	}
+
+	for _, suffix := range []string{"blue-green", "x; DROP TABLE users", "a.b"} {
+		if err := migrator.Up(ctx, WithTableSuffix(suffix)); err == nil || !strings.Contains(err.Error(), "invalid table suffix") {
+			t.Errorf("expected invalid suffix error for %q, got %v", suffix, err)
+		}
+	}
+
+	err := New(&MockSource{}, &MockDialect{}, &MockLogger{}).Up(ctx, WithTableSuffix("blue"))
+	if err == nil || !strings.Contains(err.Error(), "does not support table suffixes") {
+		t.Errorf("expected unsupported error, got %v", err)
+	}
+}
+
+// Test the no-track directive for migrations recorded by an external system
+func TestMigratorNoTrackDirective(t *testing.T) {
+	migrations := []Migration{
+		{Version: "001_users", Content: []byte("CREATE TABLE users (id INT)")},
+		{Version: "002_maintenance", Content: []byte("-- migrate:no-track\nCREATE INDEX IF NOT EXISTS idx ON users(id)")},
+	}
+	dialect := &trackingDialect{MockDialect: &MockDialect{appliedMigrations: []string{}}}
+	migrator := New(&MockSource{migrations: migrations}, dialect, &MockLogger{})
+
+	for run := 1; run <= 2; run++ {
+		if err := migrator.Up(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if fmt.Sprint(dialect.storedMigrations) != "[001_users]" {
+		t.Errorf("expected only the tracked migration to be recorded, got %v", dialect.storedMigrations)
+	}
+	if fmt.Sprintf("%q", dialect.executedQueries) != fmt.Sprintf("%q", []string{
+		"CREATE TABLE users (id INT)",
+		"\nCREATE INDEX IF NOT EXISTS idx ON users(id)",
+		"\nCREATE INDEX IF NOT EXISTS idx ON users(id)",
+	}) {
+		t.Errorf("expected the untracked migration to run every time, got %q", dialect.executedQueries)
+	}
+}
+
+// classifyingDialect classifies errors instead of detecting deadlocks
+type classifyingDialect struct {
+	*MockDialect
+	failures int
+}
+
+func (d *classifyingDialect) BeginTx(ctx context.Context) (Tx, error) {
+	if d.failures > 0 {
+		d.failures--
+		return &MockTx{dialect: d.MockDialect, execErr: errDeadlock}, nil
+	}
+	return d.MockDialect.BeginTx(ctx)
+}
+
+func (d *classifyingDialect) ClassifyError(err error) ErrorClass {
+	switch {
+	case errors.Is(err, errDeadlock):
+		return ErrorDeadlock
+	case strings.Contains(err.Error(), "syntax"):
+		return ErrorSyntax
+	}
+	return ErrorUnknown
+}
+
+// Test using the error classes of the dialect
+func TestMigratorClassifyError(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("deadlock retry", func(t *testing.T) {
+		dialect := &classifyingDialect{MockDialect: &MockDialect{appliedMigrations: []string{}}, failures: 1}
+		err := New(&MockSource{migrations: createTestMigrations()[:1]}, dialect, &MockLogger{}).Up(ctx, WithDeadlockRetry(1, time.Millisecond))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(dialect.storedMigrations) != 1 {
+			t.Errorf("expected the migration to be applied on retry, got %v", dialect.storedMigrations)
+		}
+	})
+
+	t.Run("error message", func(t *testing.T) {
+		dialect := &classifyingDialect{MockDialect: &MockDialect{
+			appliedMigrations: []string{},
+			execErrors:        map[string]error{"CREATE TABLE users (id INT PRIMARY KEY)": errors.New("syntax error at end of input")},
+		}}
+		err := New(&MockSource{migrations: createTestMigrations()[:1]}, dialect, &MockLogger{}).Up(ctx)
+		if err == nil || !strings.Contains(err.Error(), "failed to apply migration 001_create_users (syntax error):") {
+			t.Errorf("expected the error class in the message, got %v", err)
+		}
+	})
+}
+
+// Test cleaning up after a failed migration without a transaction
+func TestMigratorAutoDownOnFailure(t *testing.T) {
+	ctx := context.Background()
+	migrations := []Migration{{
+		Version:       "001_index",
+		Content:       []byte("CREATE INDEX CONCURRENTLY a ON t (a);\nCREATE INDEX CONCURRENTLY b ON t (b);"),
+		DownContent:   []byte("DROP INDEX CONCURRENTLY IF EXISTS b;\nDROP INDEX CONCURRENTLY IF EXISTS a;"),
+		NoTransaction: true,
+	}}
+	failing := func() *dirtyDialect {
+		return &dirtyDialect{
+			MockDialect: &MockDialect{appliedMigrations: []string{}},
+			failOn:      "CREATE INDEX CONCURRENTLY b ON t (b);",
+		}
+	}
+
+	t.Run("runs down migration", func(t *testing.T) {
+		dialect := failing()
+		logger := &MockLogger{}
+		err := New(&MockSource{migrations: migrations}, dialect, logger).Up(ctx, WithAutoDownOnFailure())
+		if err == nil || !strings.Contains(err.Error(), "lock timeout") {
+			t.Fatalf("expected the original error, got %v", err)
+		}
+		if fmt.Sprintf("%q", dialect.execContextQueries) != fmt.Sprintf("%q", []string{
+			"CREATE INDEX CONCURRENTLY a ON t (a);",
+			"DROP INDEX CONCURRENTLY IF EXISTS b;",
+			"DROP INDEX CONCURRENTLY IF EXISTS a;",
+		}) {
+			t.Errorf("expected the down statements after the failure, got %q", dialect.execContextQueries)
+		}
+		if dialect.dirty != "001_index" {
+			t.Errorf("expected migration to stay dirty, got %q", dialect.dirty)
+		}
+		logs := strings.Join(logger.GetLogs(), "\n")
+		if !strings.Contains(logs, "running down migration to clean up file=001_index error=") || !strings.Contains(logs, "cleanup finished file=001_index") {
+			t.Errorf("expected the failure and the cleanup to be logged, got %v", logger.GetLogs())
+		}
+	})
+
+	t.Run("cleanup errors", func(t *testing.T) {
+		dialect := failing()
+		dialect.execContextErr = errors.New("index is in use")
+		dialect.failOn = "CREATE INDEX CONCURRENTLY a ON t (a);"
+		logger := &MockLogger{}
+		err := New(&MockSource{migrations: migrations}, dialect, logger).Up(ctx, WithAutoDownOnFailure())
+		if err == nil || !strings.Contains(err.Error(), "lock timeout") || !strings.Contains(err.Error(), "cleanup of 001_index") || !strings.Contains(err.Error(), "index is in use") {
+			t.Fatalf("expected both the original and the cleanup errors, got %v", err)
+		}
+		if len(dialect.execContextQueries) != 2 {
+			t.Errorf("expected every down statement to be tried, got %q", dialect.execContextQueries)
+		}
+		if !strings.Contains(strings.Join(logger.GetLogs(), "\n"), "cleanup finished with errors file=001_index failed=2") {
+			t.Errorf("expected the cleanup result to be logged, got %v", logger.GetLogs())
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		dialect := failing()
+		if err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(ctx); err == nil {
+			t.Fatal("expected error but got none")
+		}
+		if len(dialect.execContextQueries) != 1 {
+			t.Errorf("expected no cleanup, got %q", dialect.execContextQueries)
+		}
+	})
+}
+
+// Test the transaction mode of each direction of a migration
+func TestMigratorDirectionalNoTransaction(t *testing.T) {
+	tests := []struct {
+		name         string
+		up, down     string
+		upTx, downTx bool
+	}{
+		{"both in a transaction", "CREATE INDEX idx ON t (a)", "DROP INDEX idx", true, true},
+		{"up without a transaction", "-- migrate:no-transaction up\nCREATE INDEX CONCURRENTLY idx ON t (a)", "DROP INDEX idx", false, true},
+		{"down without a transaction", "-- migrate:no-transaction down\nCREATE INDEX idx ON t (a)", "DROP INDEX idx", true, false},
+		{"down file without a transaction", "CREATE INDEX idx ON t (a)", "-- migrate:no-transaction\nDROP INDEX CONCURRENTLY idx", true, false},
+		{"both without a transaction", "-- migrate:no-transaction\n-- migrate:no-transaction down\nCREATE INDEX CONCURRENTLY idx ON t (a)", "DROP INDEX CONCURRENTLY idx", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			migrations := []Migration{{Version: "001_index", Content: []byte(tt.up), DownContent: []byte(tt.down)}}
+			dialect := &MockDialect{appliedMigrations: []string{}}
+			migrator := New(&MockSource{migrations: migrations}, dialect, &MockLogger{})
+
+			if err := migrator.Up(ctx); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if inTx := len(dialect.execContextQueries) == 0; inTx != tt.upTx {
+				t.Errorf("expected up in a transaction %v, got statements %q", tt.upTx, dialect.execContextQueries)
+			}
+
+			dialect.execContextQueries = nil
+			dialect.appliedMigrations = []string{"001_index"}
+			if err := migrator.Down(ctx, 1, WithConfirmRollback()); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if inTx := len(dialect.execContextQueries) == 0; inTx != tt.downTx {
+				t.Errorf("expected down in a transaction %v, got statements %q", tt.downTx, dialect.execContextQueries)
+			}
+		})
+	}
+
+	err := New(&MockSource{migrations: []Migration{{Version: "001_index", Content: []byte("-- migrate:no-transaction sideways\nSELECT 1")}}}, &MockDialect{appliedMigrations: []string{}}, &MockLogger{}).Up(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "no-transaction directive accepts") {
+		t.Errorf("expected invalid directive error, got %v", err)
+	}
+}
+
+// benchmarkMigrations returns n migrations with the first applied ones
+func benchmarkMigrations(n, applied int) ([]Migration, []string) {
+	migrations := make([]Migration, n)
+	versions := make([]string, applied)
+	for i := range migrations {
+		migrations[i] = Migration{
+			Version:     fmt.Sprintf("%05d_migration", i),
+			Content:     []byte(fmt.Sprintf("CREATE TABLE t%d (id INT)", i)),
+			DownContent: []byte(fmt.Sprintf("DROP TABLE t%d", i)),
+		}
+		if i < applied {
+			versions[i] = migrations[i].Version
+		}
+	}
+	return migrations, versions
+}
+
+// Benchmark a run which applies the last of 1000 migrations
+func BenchmarkUp(b *testing.B) {
+	migrations, applied := benchmarkMigrations(1000, 999)
+	source := &MockSource{migrations: migrations}
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dialect := &MockDialect{appliedMigrations: applied}
+		if err := New(source, dialect, &MockLogger{}).Up(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Benchmark runs to a target 10 migrations away from the 900th of 1000
+func BenchmarkTo(b *testing.B) {
+	migrations, applied := benchmarkMigrations(1000, 900)
+	source := &MockSource{migrations: migrations}
+	ctx := context.Background()
+
+	for _, target := range []struct {
+		name    string
+		version string
+	}{
+		{"up", migrations[909].Version},
+		{"down", migrations[889].Version},
+	} {
+		b.Run(target.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				dialect := &MockDialect{appliedMigrations: applied}
+				if err := New(source, dialect, &MockLogger{}).To(ctx, target.version, WithConfirmRollback()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Benchmark a run with 800 migrations which are all applied, guarding the
+// membership checks against the applied versions
+func BenchmarkUpNoPending(b *testing.B) {
+	migrations, applied := benchmarkMigrations(800, 800)
+	source := &MockSource{migrations: migrations}
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dialect := &MockDialect{appliedMigrations: applied}
+		if err := New(source, dialect, &MockLogger{}).Up(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
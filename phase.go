@@ -0,0 +1,74 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// Deploy phases of UpPhase, taken from the tags of the migrations.
+const (
+	PhasePredeploy  = "predeploy"
+	PhasePostdeploy = "postdeploy"
+)
+
+// migrationPhase returns the deploy phase of the migration, untagged
+// migrations belong to PhasePredeploy
+func migrationPhase(migration Migration) string {
+	if slices.Contains(migration.Tags, PhasePostdeploy) {
+		return PhasePostdeploy
+	}
+	return PhasePredeploy
+}
+
+// UpPhase applies the pending migrations of a deploy phase, for expand and
+// contract deploys: PhasePredeploy before the code is deployed, and
+// PhasePostdeploy after it. Migrations are assigned to a phase by the
+// predeploy or postdeploy tag of their metadata header, untagged migrations
+// are predeploy. To keep the history in version order, the run applies the
+// migrations up to the first pending migration of the other phase, which is
+// applied by a run of that phase. When pending migrations of the phase
+// follow it, nothing is applied and ErrPhaseBlocked names the blocking
+// migration.
+func (m *Migrator) UpPhase(ctx context.Context, phase string, opts ...Option) error {
+	if phase != PhasePredeploy && phase != PhasePostdeploy {
+		return fmt.Errorf("unknown deploy phase %q", phase)
+	}
+
+	return m.prepareData(ctx, 0, withRunSummary(func(m *Migrator, ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error {
+		done := appliedSet(applied)
+		blocking := ""
+		for _, file := range migrations {
+			if _, ok := done[file.Version]; ok {
+				continue
+			}
+			switch {
+			case migrationPhase(file) != phase:
+				if blocking == "" {
+					blocking = file.Version
+				}
+			case blocking != "":
+				return fmt.Errorf("%w: %s migration %s is pending before %s", ErrPhaseBlocked, otherPhase(phase), blocking, file.Version)
+			default:
+				steps++
+			}
+		}
+		if blocking != "" {
+			m.logger.Info("phase stopped at migration of another phase", "phase", phase, "file", blocking)
+		}
+
+		if steps == 0 {
+			m.logger.Info("no migrations to apply in phase", "phase", phase)
+			return nil
+		}
+		return m.doUp(ctx, steps, applied, migrations, options)
+	}), opts...)
+}
+
+// otherPhase returns the deploy phase which isn't the phase
+func otherPhase(phase string) string {
+	if phase == PhasePredeploy {
+		return PhasePostdeploy
+	}
+	return PhasePredeploy
+}
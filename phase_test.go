@@ -0,0 +1,56 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Test applying the migrations of a deploy phase
+func TestMigratorUpPhase(t *testing.T) {
+	migrations := []Migration{
+		{Version: "001_add_column", Content: []byte("ALTER TABLE users ADD COLUMN email TEXT")},
+		{Version: "002_drop_column", Content: []byte("ALTER TABLE users DROP COLUMN mail"), Tags: []string{"postdeploy"}},
+		{Version: "003_add_table", Content: []byte("CREATE TABLE orders (id INT)"), Tags: []string{"predeploy"}},
+		{Version: "004_drop_table", Content: []byte("DROP TABLE carts"), Tags: []string{"schema", "postdeploy"}},
+	}
+
+	tests := []struct {
+		name     string
+		applied  []string
+		phase    string
+		expected []string
+		blocked  string
+	}{
+		{name: "predeploy blocked by postdeploy", applied: []string{}, phase: PhasePredeploy, blocked: "postdeploy migration 002_drop_column is pending before 003_add_table"},
+		{name: "postdeploy blocked by later predeploy", applied: []string{"001_add_column"}, phase: PhasePostdeploy, blocked: "predeploy migration 003_add_table is pending before 004_drop_table"},
+		{name: "postdeploy blocked by predeploy", applied: []string{}, phase: PhasePostdeploy, blocked: "predeploy migration 001_add_column is pending before 002_drop_column"},
+		{name: "predeploy stops at last postdeploy", applied: []string{"001_add_column", "002_drop_column"}, phase: PhasePredeploy, expected: []string{"003_add_table"}},
+		{name: "last postdeploy", applied: []string{"001_add_column", "002_drop_column", "003_add_table"}, phase: PhasePostdeploy, expected: []string{"004_drop_table"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialect := &MockDialect{appliedMigrations: tt.applied}
+			err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).UpPhase(context.Background(), tt.phase)
+			if tt.blocked != "" {
+				if !errors.Is(err, ErrPhaseBlocked) || !strings.Contains(err.Error(), tt.blocked) {
+					t.Errorf("expected ErrPhaseBlocked with %q, got %v", tt.blocked, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fmt.Sprint(dialect.storedMigrations) != fmt.Sprint(tt.expected) {
+				t.Errorf("expected %v to be applied, got %v", tt.expected, dialect.storedMigrations)
+			}
+		})
+	}
+
+	t.Run("unknown phase", func(t *testing.T) {
+		if err := New(&MockSource{migrations: migrations}, &MockDialect{}, &MockLogger{}).UpPhase(context.Background(), "deploy"); err == nil {
+			t.Error("expected error but got none")
+		}
+	})
+}
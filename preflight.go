@@ -0,0 +1,87 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// preflightTable is the table created and dropped by the privilege probe
+const preflightTable = "migrate_preflight_probe"
+
+// preflightLockTimeout limits the wait for the migration lock in Preflight
+// when the dialect can't try the lock without waiting
+const preflightLockTimeout = 5 * time.Second
+
+// Preflight checks that the database user can run migrations before
+// anything is changed: it begins and rolls back a transaction, creates and
+// drops a table in a transaction which is rolled back, and acquires and
+// releases the migration lock, without waiting for it when the dialect is a
+// TryLocker. All problems are returned at once, wrapped in ErrPreflight.
+// It is opt-in and meant to be called before Up.
+func (m *Migrator) Preflight(ctx context.Context) error {
+	var problems []error
+
+	if tx, err := m.beginTx(ctx); err != nil {
+		problems = append(problems, fmt.Errorf("cannot begin a transaction, check the connection: %w", err))
+	} else if err := tx.Rollback(ctx); err != nil {
+		problems = append(problems, fmt.Errorf("cannot roll back a transaction: %w", err))
+	}
+
+	if err := m.probeCreateTable(ctx); err != nil {
+		problems = append(problems, fmt.Errorf("cannot create tables, grant the CREATE privilege on the schema: %w", err))
+	}
+
+	if err := m.probeLock(ctx); err != nil {
+		problems = append(problems, err)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %w", ErrPreflight, errors.Join(problems...))
+	}
+	return nil
+}
+
+// probeLock acquires and releases the migration lock, without waiting when
+// the dialect is a TryLocker, and for up to preflightLockTimeout otherwise
+func (m *Migrator) probeLock(ctx context.Context) error {
+	if locker, ok := m.dialect.(TryLocker); ok {
+		acquired, err := locker.TryLock(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot acquire the migration lock: %w", err)
+		}
+		if !acquired {
+			return errors.New("migration lock is held by another process")
+		}
+	} else {
+		lockCtx, cancel := context.WithTimeout(ctx, preflightLockTimeout)
+		defer cancel()
+		if err := m.dialect.Lock(lockCtx); err != nil {
+			if errors.Is(lockCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+				return fmt.Errorf("migration lock is held by another process: %w", err)
+			}
+			return fmt.Errorf("cannot acquire the migration lock: %w", err)
+		}
+	}
+
+	if err := m.dialect.Unlock(ctx); err != nil {
+		return fmt.Errorf("cannot release the migration lock: %w", err)
+	}
+	return nil
+}
+
+// probeCreateTable creates and drops a table in a transaction which is
+// rolled back, so nothing is left behind on databases with transactional DDL
+func (m *Migrator) probeCreateTable(ctx context.Context) error {
+	tx, err := m.beginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := tx.Exec(ctx, "CREATE TABLE "+preflightTable+" (id INT)"); err != nil {
+		return err
+	}
+	return tx.Exec(ctx, "DROP TABLE "+preflightTable)
+}
@@ -0,0 +1,94 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tryLockDialect is a MockDialect with a lock which can be tried
+type tryLockDialect struct {
+	*MockDialect
+	held bool
+}
+
+func (d *tryLockDialect) TryLock(ctx context.Context) (bool, error) {
+	return !d.held, nil
+}
+
+func (d *tryLockDialect) Lock(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// Test the pre-flight checks of the database
+func TestMigratorPreflight(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("ready", func(t *testing.T) {
+		dialect := &MockDialect{}
+		if err := New(&MockSource{}, dialect, &MockLogger{}).Preflight(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := []string{"CREATE TABLE migrate_preflight_probe (id INT)", "DROP TABLE migrate_preflight_probe"}
+		if fmt.Sprint(dialect.executedQueries) != fmt.Sprint(expected) {
+			t.Errorf("expected probes %v, got %v", expected, dialect.executedQueries)
+		}
+		if !dialect.lockCalled || !dialect.unlockCalled {
+			t.Error("expected the lock to be acquired and released")
+		}
+		if dialect.createTableCalled || len(dialect.storedMigrations) != 0 {
+			t.Error("expected nothing to be changed")
+		}
+	})
+
+	t.Run("missing privileges", func(t *testing.T) {
+		dialect := &MockDialect{
+			lockErr:    errors.New("permission denied for function pg_advisory_lock"),
+			execErrors: map[string]error{"CREATE TABLE migrate_preflight_probe (id INT)": errors.New("permission denied for schema public")},
+		}
+		err := New(&MockSource{}, dialect, &MockLogger{}).Preflight(ctx)
+		if !errors.Is(err, ErrPreflight) {
+			t.Fatalf("expected ErrPreflight, got %v", err)
+		}
+		for _, expected := range []string{"cannot create tables", "permission denied for schema public", "cannot acquire the migration lock"} {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("expected %q in %v", expected, err)
+			}
+		}
+		if dialect.unlockCalled {
+			t.Error("expected no unlock of a lock which wasn't acquired")
+		}
+	})
+
+	t.Run("held lock", func(t *testing.T) {
+		dialect := &tryLockDialect{MockDialect: &MockDialect{}, held: true}
+		start := time.Now()
+		err := New(&MockSource{}, dialect, &MockLogger{}).Preflight(ctx)
+		if !errors.Is(err, ErrPreflight) || !strings.Contains(err.Error(), "migration lock is held by another process") {
+			t.Fatalf("expected held lock error, got %v", err)
+		}
+		if time.Since(start) > time.Second {
+			t.Error("expected the lock to be tried without waiting")
+		}
+		if dialect.unlockCalled {
+			t.Error("expected no unlock of a lock which wasn't acquired")
+		}
+
+		dialect.held = false
+		if err := New(&MockSource{}, dialect, &MockLogger{}).Preflight(ctx); err != nil || !dialect.unlockCalled {
+			t.Errorf("expected the tried lock to be released, got %v", err)
+		}
+	})
+
+	t.Run("no connection", func(t *testing.T) {
+		dialect := &MockDialect{beginTxErr: errors.New("connection refused")}
+		err := New(&MockSource{}, dialect, &MockLogger{}).Preflight(ctx)
+		if !errors.Is(err, ErrPreflight) || !strings.Contains(err.Error(), "cannot begin a transaction") {
+			t.Errorf("expected transaction error, got %v", err)
+		}
+	})
+}
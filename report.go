@@ -0,0 +1,69 @@
+package migrate
+
+import (
+	"context"
+	"time"
+)
+
+// RunReport is a structured record of what a run did, e.g. for an audit log.
+// It can be serialized to JSON.
+type RunReport struct {
+	StartedAt  time.Time           `json:"started_at"`
+	FinishedAt time.Time           `json:"finished_at"`
+	DryRun     bool                `json:"dry_run"`
+	Applied    []ReportedMigration `json:"applied"`
+	RolledBack []ReportedMigration `json:"rolled_back"`
+	// Error is the error the run failed with, if any
+	Error string `json:"error,omitempty"`
+}
+
+// ReportedMigration is a migration applied or rolled back during a run.
+type ReportedMigration struct {
+	Version  string        `json:"version"`
+	Checksum string        `json:"checksum"`
+	Duration time.Duration `json:"duration"`
+	// Rows is the number of affected rows, -1 when the driver doesn't report it
+	Rows int64 `json:"rows"`
+}
+
+// applied records an applied migration, it is a no-op for runs without a report
+func (r *RunReport) applied(migration Migration, start time.Time, rows int64) {
+	if r != nil {
+		r.Applied = append(r.Applied, reportedMigration(migration.Version, migration.Content, start, rows))
+	}
+}
+
+// rolledBack records a rolled back migration, it is a no-op for runs without a report
+func (r *RunReport) rolledBack(migration Migration, start time.Time, rows int64) {
+	if r != nil {
+		r.RolledBack = append(r.RolledBack, reportedMigration(migration.Version, migration.DownContent, start, rows))
+	}
+}
+
+func reportedMigration(version string, content []byte, start time.Time, rows int64) ReportedMigration {
+	return ReportedMigration{
+		Version:  version,
+		Checksum: checksum(content),
+		Duration: time.Since(start),
+		Rows:     rows,
+	}
+}
+
+// UpWithReport applies all pending migrations like Up and returns a report
+// of the run. The report is returned also when the run fails, with the
+// migrations applied before the failure and the error.
+func (m *Migrator) UpWithReport(ctx context.Context, opts ...Option) (*RunReport, error) {
+	report := &RunReport{StartedAt: time.Now().UTC(), Applied: []ReportedMigration{}, RolledBack: []ReportedMigration{}}
+	opts = append(opts, func(opts *RunOptions) {
+		opts.report = report
+		report.DryRun = opts.DryRun
+	})
+
+	err := m.Up(ctx, opts...)
+	report.FinishedAt = time.Now().UTC()
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	return report, err
+}
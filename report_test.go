@@ -0,0 +1,69 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// Test the report of an Up run
+func TestMigratorUpWithReport(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+		migrations := createTestMigrations()
+
+		report, err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).UpWithReport(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(report.Applied) != 3 || report.Applied[0].Version != "002_add_email" {
+			t.Fatalf("unexpected applied migrations %+v", report.Applied)
+		}
+		if report.Applied[0].Checksum != checksum(migrations[1].Content) || report.Applied[0].Rows != -1 {
+			t.Errorf("unexpected report entry %+v", report.Applied[0])
+		}
+		if report.StartedAt.IsZero() || report.FinishedAt.Before(report.StartedAt) || report.Error != "" || report.DryRun {
+			t.Errorf("unexpected report %+v", report)
+		}
+
+		data, err := json.Marshal(report)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var decoded map[string]interface{}
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, ok := decoded["rolled_back"].([]interface{}); !ok {
+			t.Errorf("expected rolled_back to be an empty list, got %s", data)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		dialect := &MockDialect{
+			appliedMigrations: []string{},
+			execErrors:        map[string]error{"CREATE INDEX idx_users_email ON users(email)": errors.New("syntax error")},
+		}
+
+		report, err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).UpWithReport(context.Background())
+		if err == nil {
+			t.Fatal("expected error but got none")
+		}
+		if len(report.Applied) != 2 || report.Error != err.Error() {
+			t.Errorf("expected partial report with error, got %+v", report)
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		report, err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).UpWithReport(context.Background(), WithDryRun())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !report.DryRun || len(report.Applied) != 4 {
+			t.Errorf("unexpected dry run report %+v", report)
+		}
+	})
+}
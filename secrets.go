@@ -0,0 +1,51 @@
+package migrate
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// SecretResolver returns the value of a secret by its key, e.g. from a
+// vault. See WithSecretResolver.
+type SecretResolver func(key string) (string, error)
+
+var secretRe = regexp.MustCompile(`\$\{secret:([A-Za-z0-9_./-]+)\}`)
+
+// WithSecretResolver is an option that replaces `${secret:<key>}`
+// placeholders in the migrations with the values returned by resolve. The
+// placeholders are resolved right before the statements are executed, so
+// the values never reach the logs, the errors of the migrator, the
+// checksums or dry runs. The values are inserted verbatim, so they must be
+// quoted in the SQL where needed. Without a resolver the placeholders are
+// kept as is.
+func WithSecretResolver(resolve SecretResolver) Option {
+	return func(opts *RunOptions) {
+		opts.SecretResolver = resolve
+	}
+}
+
+// resolveSecrets replaces the secret placeholders of the query. The errors
+// name the key of the failed secret, never a value.
+func (o *RunOptions) resolveSecrets(query string) (string, error) {
+	if o.SecretResolver == nil {
+		return query, nil
+	}
+
+	var err error
+	query = secretRe.ReplaceAllStringFunc(query, func(placeholder string) string {
+		if err != nil {
+			return placeholder
+		}
+		key := secretRe.FindStringSubmatch(placeholder)[1]
+		value, resolveErr := o.SecretResolver(key)
+		if resolveErr != nil {
+			err = fmt.Errorf("failed to resolve secret %q: %w", key, resolveErr)
+			return placeholder
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	return query, nil
+}
@@ -0,0 +1,70 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Test resolving secret placeholders right before execution
+func TestMigratorSecretResolver(t *testing.T) {
+	ctx := context.Background()
+	resolve := func(key string) (string, error) {
+		if key == "replication_pw" {
+			return "s3cr3t", nil
+		}
+		return "", errors.New("not found")
+	}
+
+	t.Run("resolved for execution only", func(t *testing.T) {
+		migrations := []Migration{{Version: "001_replication", Content: []byte("CREATE USER replicator PASSWORD '${secret:replication_pw}'")}}
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		logger := &MockLogger{}
+		if err := New(&MockSource{migrations: migrations}, dialect, logger).Up(ctx, WithSecretResolver(resolve)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fmt.Sprint(dialect.executedQueries) != "[CREATE USER replicator PASSWORD 's3cr3t']" {
+			t.Errorf("expected the resolved secret, got %q", dialect.executedQueries)
+		}
+		if strings.Contains(fmt.Sprint(logger.GetLogs()), "s3cr3t") {
+			t.Errorf("expected the secret not to be logged, got %v", logger.GetLogs())
+		}
+	})
+
+	t.Run("unknown secret", func(t *testing.T) {
+		migrations := []Migration{{Version: "001_replication", Content: []byte("CREATE USER replicator PASSWORD '${secret:missing}'")}}
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(ctx, WithSecretResolver(resolve))
+		if err == nil || !strings.Contains(err.Error(), `failed to resolve secret "missing": not found`) {
+			t.Fatalf("expected resolve error, got %v", err)
+		}
+		if len(dialect.executedQueries) != 0 || len(dialect.storedMigrations) != 0 {
+			t.Errorf("expected nothing to run, got %q", dialect.executedQueries)
+		}
+	})
+
+	t.Run("errors without a transaction", func(t *testing.T) {
+		migrations := []Migration{{Version: "001_replication", Content: []byte("CREATE USER replicator PASSWORD '${secret:replication_pw}'"), NoTransaction: true}}
+		dialect := &MockDialect{appliedMigrations: []string{}, execContextErr: errors.New("role exists")}
+		err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(ctx, WithSecretResolver(resolve))
+		if err == nil || strings.Contains(err.Error(), "s3cr3t") || !strings.Contains(err.Error(), "${secret:replication_pw}") {
+			t.Fatalf("expected the error to quote the placeholder, got %v", err)
+		}
+		if fmt.Sprint(dialect.execContextQueries) != "[CREATE USER replicator PASSWORD 's3cr3t']" {
+			t.Errorf("expected the resolved secret, got %q", dialect.execContextQueries)
+		}
+	})
+
+	t.Run("no resolver", func(t *testing.T) {
+		migrations := []Migration{{Version: "001_template", Content: []byte("SELECT '${secret:replication_pw}'")}}
+		dialect := &MockDialect{appliedMigrations: []string{}}
+		if err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Up(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fmt.Sprint(dialect.executedQueries) != "[SELECT '${secret:replication_pw}']" {
+			t.Errorf("expected the placeholder to be kept, got %q", dialect.executedQueries)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package migrate
+
+import (
+	"regexp"
+	"strings"
+)
+
+// semverRe matches a semantic version at the start of a migration version,
+// with an optional v prefix, and followed by the end or an underscore and
+// the name of the migration, like 1.10.0 or v2.0.0-rc.1_add_users
+var semverRe = regexp.MustCompile(`^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?(?:\+[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?(?:_|$)`)
+
+// SemverLess orders versions named after semantic versions by their
+// precedence, so 1.2.0 comes before 1.10.0 and a prerelease like 2.0.0-rc.1
+// before 2.0.0. A version may have a v prefix and a name after an
+// underscore, like v1.2.0_add_users. Versions which are not semantic
+// versions come after all semantic versions and are ordered lexically, as
+// are versions of the same precedence. Use it with WithLess.
+func SemverLess(a, b string) bool {
+	ma, mb := semverRe.FindStringSubmatch(a), semverRe.FindStringSubmatch(b)
+	switch {
+	case ma == nil && mb == nil:
+		return a < b
+	case ma == nil || mb == nil:
+		return mb == nil
+	}
+
+	for i := 1; i <= 3; i++ {
+		if c := compareNumeric(ma[i], mb[i]); c != 0 {
+			return c < 0
+		}
+	}
+	if c := comparePrerelease(ma[4], mb[4]); c != 0 {
+		return c < 0
+	}
+	return a < b
+}
+
+// comparePrerelease compares prerelease tags by semver precedence, a version
+// without a tag comes after all versions with one
+func comparePrerelease(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	}
+
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, bn := isNumeric(as[i]), isNumeric(bs[i])
+		var c int
+		switch {
+		case an && bn:
+			c = compareNumeric(as[i], bs[i])
+		case an:
+			// numeric identifiers have lower precedence
+			c = -1
+		case bn:
+			c = 1
+		default:
+			c = strings.Compare(as[i], bs[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// compareNumeric compares decimal numbers of any length
+func compareNumeric(a, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+// isNumeric reports whether the identifier consists of digits only
+func isNumeric(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
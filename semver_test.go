@@ -0,0 +1,133 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// Test the order of semantic versions
+func TestSemverLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{"1.2.0", "1.10.0", true},
+		{"1.10.0", "1.2.0", false},
+		{"1.2.3", "1.2.3", false},
+		{"2.0.0", "10.0.0", true},
+		{"v1.2.0", "1.3.0", true},
+		{"1.2.0_add_users", "1.10.0_add_email", true},
+		{"2.0.0-rc.1", "2.0.0", true},
+		{"2.0.0", "2.0.0-rc.1", false},
+		{"2.0.0-alpha", "2.0.0-alpha.1", true},
+		{"2.0.0-alpha.1", "2.0.0-alpha.beta", true},
+		{"2.0.0-beta.2", "2.0.0-beta.11", true},
+		{"2.0.0-beta.11", "2.0.0-rc.1", true},
+		{"1.0.0+build.2", "1.0.0-rc.1", false},
+		{"99999999999999999999.0.0", "100000000000000000000.0.0", true},
+		{"1.2.0", "baseline", true},
+		{"baseline", "1.2.0", false},
+		{"001_init", "002_users", true},
+		{"1.2", "1.10", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			if less := SemverLess(tt.a, tt.b); less != tt.less {
+				t.Errorf("expected %v, got %v", tt.less, less)
+			}
+		})
+	}
+}
+
+// Test sorting a mixed set of versions
+func TestSemverLessSort(t *testing.T) {
+	versions := []string{"baseline", "1.10.0", "2.0.0", "1.2.0_users", "2.0.0-rc.1", "1.2.0", "v1.9.0", "2.0.0-beta.11", "2.0.0-beta.2", "1.10"}
+	sort.Slice(versions, func(i, j int) bool {
+		return SemverLess(versions[i], versions[j])
+	})
+
+	expected := "[1.2.0 1.2.0_users v1.9.0 1.10.0 2.0.0-beta.2 2.0.0-beta.11 2.0.0-rc.1 2.0.0 1.10 baseline]"
+	if fmt.Sprint(versions) != expected {
+		t.Errorf("expected %s, got %v", expected, versions)
+	}
+
+	// the order is total, so it doesn't depend on the input order
+	slices.Reverse(versions)
+	sort.Slice(versions, func(i, j int) bool {
+		return SemverLess(versions[i], versions[j])
+	})
+	if fmt.Sprint(versions) != expected {
+		t.Errorf("expected %s for reversed input, got %v", expected, versions)
+	}
+}
+
+// Test finding the newest applied version in the order of the source
+func TestMigratorSemverHead(t *testing.T) {
+	ctx := context.Background()
+	files := fstest.MapFS{
+		"migrations/1.9.0.sql":  {Data: []byte("SELECT 1;")},
+		"migrations/1.10.0.sql": {Data: []byte("SELECT 2;")},
+	}
+	source := NewFsSource(files, "migrations", WithLess(SemverLess))
+	dialect := &MockDialect{appliedMigrations: []string{"1.9.0", "1.10.0"}}
+	migrator := New(source, dialect, &MockLogger{})
+
+	if head, err := migrator.Version(ctx); err != nil || head != "1.10.0" {
+		t.Errorf("expected head 1.10.0, got %q %v", head, err)
+	}
+	if err := migrator.AssertVersion(ctx, "1.10.0"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := migrator.CheckCompatible(ctx); err != nil {
+		t.Errorf("expected the schema to be compatible, got %v", err)
+	}
+	if err := migrator.Migrate(ctx, "1.10.0", TargetLatest); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	dialect.appliedMigrations = []string{"1.9.0", "1.10.0", "1.11.0"}
+	if err := migrator.CheckCompatible(ctx); !errors.Is(err, ErrSchemaAhead) || !strings.HasSuffix(err.Error(), ": 1.11.0") {
+		t.Errorf("expected ErrSchemaAhead for 1.11.0, got %v", err)
+	}
+}
+
+// Test that decorators keep the order of the inner source
+func TestMigratorSemverHeadWrapped(t *testing.T) {
+	files := fstest.MapFS{
+		"migrations/1.2.0.sql":  {Data: []byte("SELECT 0;")},
+		"migrations/1.9.0.sql":  {Data: []byte("SELECT 1;")},
+		"migrations/1.10.0.sql": {Data: []byte("SELECT 2;")},
+	}
+	inner := NewFsSource(files, "migrations", WithLess(SemverLess))
+	down := func(version string, up []byte) ([]byte, error) { return []byte("SELECT 0;"), nil }
+	sources := map[string]Source{
+		"down":     NewDownSource(inner, down),
+		"wrapped":  NewWrappedSource(inner, []byte("SET search_path TO app;"), nil),
+		"filtered": NewFilteredSource(inner, "1.2.0"),
+		"nested":   NewWrappedSource(NewDownSource(inner, down), nil, nil),
+	}
+
+	for name, source := range sources {
+		t.Run(name, func(t *testing.T) {
+			dialect := &MockDialect{appliedMigrations: []string{"1.9.0", "1.10.0"}}
+			if head, err := New(source, dialect, &MockLogger{}).Version(context.Background()); err != nil || head != "1.10.0" {
+				t.Errorf("expected head 1.10.0, got %q %v", head, err)
+			}
+		})
+	}
+
+	migrations, err := NewFilteredSource(inner, "1.2.0").GetMigrations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(migrations) != 2 || migrations[0].Version != "1.9.0" || migrations[1].Version != "1.10.0" {
+		t.Errorf("expected the versions after 1.2.0 in semver order, got %v", migrations)
+	}
+}
@@ -1,11 +1,24 @@
 package migrate
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"io/fs"
 	"os"
+	pathpkg "path"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf16"
 )
 
 // Migration represents a single migration.
@@ -13,6 +26,16 @@ type Migration struct {
 	Version     string
 	Content     []byte
 	DownContent []byte
+
+	// Settings from the metadata header of the up migration file
+
+	// NoTransaction runs the statements of the migration one by one,
+	// outside of a transaction
+	NoTransaction bool
+	// Tags are free-form labels of the migration
+	Tags []string
+	// Timeout limits the duration of the migration, 0 means no limit
+	Timeout time.Duration
 }
 
 // Source is an interface for migration sources.
@@ -20,21 +43,213 @@ type Source interface {
 	GetMigrations() ([]Migration, error)
 }
 
+// RandomAccessSource is a source which can read a single migration without
+// loading all of them. The migrator uses it to load only the migrations
+// that are rolled back.
+type RandomAccessSource interface {
+	Source
+	GetMigration(version string) (Migration, error)
+}
+
+// DirectionalSource is a source which can load only the content needed for
+// one direction. The migrator uses it to skip reading the up content of the
+// migrations when it only rolls back.
+type DirectionalSource interface {
+	Source
+	// GetMigrationsFor returns the migrations with only the content of the
+	// direction, DirectionUp or DirectionDown. Settings from the metadata
+	// header of the up migration are kept in both directions.
+	GetMigrationsFor(ctx context.Context, direction string) ([]Migration, error)
+}
+
+// OrderedSource is a source which orders its versions other than lexically.
+// The migrator uses its order to find the newest applied version.
+type OrderedSource interface {
+	Source
+	// Less reports whether version a comes before version b
+	Less(a, b string) bool
+}
+
+// sourceLess orders versions like the source when it is an OrderedSource,
+// and lexically otherwise
+func sourceLess(source Source, a, b string) bool {
+	if ordered, ok := source.(OrderedSource); ok {
+		return ordered.Less(a, b)
+	}
+	return a < b
+}
+
+// getMigrationsFor loads the migrations for the direction when the source
+// supports it, and both contents otherwise. An empty direction loads both.
+func getMigrationsFor(ctx context.Context, source Source, direction string) ([]Migration, error) {
+	if directional, ok := source.(DirectionalSource); ok && direction != "" {
+		return directional.GetMigrationsFor(ctx, direction)
+	}
+	return source.GetMigrations()
+}
+
+// Migration directions returned by a NamingFunc.
+const (
+	DirectionUp   = "up"
+	DirectionDown = "down"
+)
+
+// NamingFunc translates a migration file name to the migration version and
+// direction, DirectionUp or DirectionDown. Files for which it returns false
+// are not migrations and are skipped.
+type NamingFunc func(filename string) (version string, direction string, ok bool)
+
+// DefaultNaming is the default naming of migration files: `<version>.down.sql`
+// for down migrations, `<version>.up.sql` or `<version>.sql` for up ones.
+func DefaultNaming(filename string) (string, string, bool) {
+	if strings.HasSuffix(filename, ".down.sql") {
+		return strings.TrimSuffix(filename, ".down.sql"), DirectionDown, true
+	} else if strings.HasSuffix(filename, ".sql") {
+		// support both .up.sql and .sql
+		return strings.TrimSuffix(strings.TrimSuffix(filename, ".sql"), ".up"), DirectionUp, true
+	}
+
+	return "", "", false
+}
+
 // FsSource is a migration source that reads from a filesystem.
 type FsSource struct {
-	fs   fs.FS
-	path string
+	fs             fs.FS
+	path           string
+	naming         NamingFunc
+	less           func(a, b string) bool
+	followSymlinks bool
+}
+
+// FsSourceOption is a function that configures a FsSource.
+type FsSourceOption func(*FsSource)
+
+// WithNaming sets the function which translates file names to versions,
+// e.g. to read migrations of Flyway or other tools. DefaultNaming is used
+// when it is not set.
+func WithNaming(naming NamingFunc) FsSourceOption {
+	return func(s *FsSource) {
+		s.naming = naming
+	}
+}
+
+// WithLess sets the order of the versions, e.g. SemverLess for migrations
+// named after semantic versions. Versions are ordered lexically when it is
+// not set.
+func WithLess(less func(a, b string) bool) FsSourceOption {
+	return func(s *FsSource) {
+		s.less = less
+	}
+}
+
+// WithFollowSymlinks makes the source descend into symlinked directories,
+// which are skipped by default. Symlink loops are reported as errors.
+func WithFollowSymlinks() FsSourceOption {
+	return func(s *FsSource) {
+		s.followSymlinks = true
+	}
 }
 
 // NewFsSource creates a new FsSource.
-func NewFsSource(fs fs.FS, path string) *FsSource {
-	return &FsSource{fs: fs, path: path}
+func NewFsSource(fs fs.FS, path string, opts ...FsSourceOption) *FsSource {
+	s := &FsSource{fs: fs, path: path, naming: DefaultNaming}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Less orders the versions with the function of WithLess, lexically when it
+// is not set.
+func (s *FsSource) Less(a, b string) bool {
+	if s.less != nil {
+		return s.less(a, b)
+	}
+	return a < b
 }
 
 func (s *FsSource) GetMigrations() ([]Migration, error) {
+	return s.loadMigrations("")
+}
+
+// GetMigrationsFor reads only the files of the direction. For
+// DirectionDown, only the metadata header at the top of the up files is
+// read, so the settings of the migrations are kept.
+func (s *FsSource) GetMigrationsFor(ctx context.Context, direction string) ([]Migration, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.loadMigrations(direction)
+}
+
+// loadMigrations reads the migrations with the content of the direction,
+// an empty direction reads both
+func (s *FsSource) loadMigrations(direction string) ([]Migration, error) {
 	migrations := make(map[string]*Migration)
 
-	err := fs.WalkDir(s.fs, s.path, func(path string, d fs.DirEntry, err error) error {
+	err := s.walk(func(path, version string, down bool) error {
+		if migrations[version] == nil {
+			migrations[version] = &Migration{Version: version}
+		}
+		switch {
+		case direction == DirectionUp && down:
+			return nil
+		case direction == DirectionDown && !down:
+			return s.readHeader(migrations[version], path)
+		}
+		return s.readFile(migrations[version], path, down)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var files []Migration
+	for _, m := range migrations {
+		files = append(files, *m)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return s.Less(files[i].Version, files[j].Version)
+	})
+
+	return files, nil
+}
+
+// GetMigration reads only the files of the given version.
+func (s *FsSource) GetMigration(version string) (Migration, error) {
+	migration := Migration{Version: version}
+	found := false
+
+	err := s.walk(func(path, fileVersion string, down bool) error {
+		if fileVersion != version {
+			return nil
+		}
+		found = true
+		return s.readFile(&migration, path, down)
+	})
+
+	if err != nil {
+		return Migration{}, err
+	}
+	if !found {
+		return Migration{}, fmt.Errorf("%w for version: %s", ErrMigrationNotFound, version)
+	}
+
+	return migration, nil
+}
+
+// walk calls fn for each migration file with its version and direction
+func (s *FsSource) walk(fn func(path, version string, down bool) error) error {
+	if s.followSymlinks {
+		root, err := fs.Stat(s.fs, s.path)
+		if err != nil {
+			return err
+		}
+		return s.walkFollowing(s.path, []fs.FileInfo{root}, fn)
+	}
+
+	return fs.WalkDir(s.fs, s.path, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -42,57 +257,526 @@ func (s *FsSource) GetMigrations() ([]Migration, error) {
 			return nil
 		}
 
-		baseName := filepath.Base(path)
-		if strings.HasSuffix(baseName, ".down.sql") {
-			version := strings.TrimSuffix(baseName, ".down.sql")
-			if migrations[version] == nil {
-				migrations[version] = &Migration{Version: version}
+		version, direction, ok := s.naming(filepath.Base(path))
+		if !ok {
+			return nil
+		}
+
+		return fn(path, version, direction == DirectionDown)
+	})
+}
+
+// maxWalkDepth limits the nesting of directories when symlinks are followed,
+// it stops loops which can't be detected by comparing the directories
+const maxWalkDepth = 64
+
+// walkFollowing walks the directory like fs.WalkDir, but also descends into
+// symlinked directories. Ancestors are the directories being walked, a
+// directory which is one of them is a symlink loop.
+func (s *FsSource) walkFollowing(dir string, ancestors []fs.FileInfo, fn func(path, version string, down bool) error) error {
+	if len(ancestors) > maxWalkDepth {
+		return fmt.Errorf("%s: too many levels of directories, possible symlink loop", dir)
+	}
+
+	entries, err := fs.ReadDir(s.fs, dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := pathpkg.Join(dir, entry.Name())
+
+		isDir := entry.IsDir()
+		if entry.Type()&fs.ModeSymlink != 0 {
+			info, err := fs.Stat(s.fs, path)
+			if err != nil {
+				return err
 			}
-			content, err := fs.ReadFile(s.fs, path)
+			isDir = info.IsDir()
+		}
+
+		if isDir {
+			info, err := fs.Stat(s.fs, path)
 			if err != nil {
 				return err
 			}
-			migrations[version].DownContent = content
-		} else if strings.HasSuffix(baseName, ".sql") {
-			// support both .up.sql and .sql
-			version := strings.TrimSuffix(strings.TrimSuffix(baseName, ".sql"), ".up")
-			if migrations[version] == nil {
-				migrations[version] = &Migration{Version: version}
+			for _, ancestor := range ancestors {
+				if os.SameFile(ancestor, info) {
+					return fmt.Errorf("%s: symlink loop detected", path)
+				}
 			}
-			content, err := fs.ReadFile(s.fs, path)
-			if err != nil {
+			if err := s.walkFollowing(path, append(ancestors, info), fn); err != nil {
 				return err
 			}
-			migrations[version].Content = content
+			continue
+		}
+
+		version, direction, ok := s.naming(entry.Name())
+		if !ok {
+			continue
 		}
+		if err := fn(path, version, direction == DirectionDown); err != nil {
+			return err
+		}
+	}
 
+	return nil
+}
+
+// readFile reads the file into the up or down content of the migration
+func (s *FsSource) readFile(migration *Migration, path string, down bool) error {
+	content, err := fs.ReadFile(s.fs, path)
+	if err != nil {
+		return err
+	}
+	if content, err = decodeContent(content); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	if down {
+		migration.DownContent = content
 		return nil
-	})
+	}
+
+	if err := parseMetadata(migration, content); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	migration.Content = content
+	return nil
+}
+
+// readHeader reads the metadata header of the up file without its content,
+// stopping at the first line which is neither blank nor a comment
+func (s *FsSource) readHeader(migration *Migration, path string) error {
+	f, err := s.fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if bom, _ := r.Peek(2); hasUTF16BOM(bom) {
+		// UTF-16 has no line by line decoding, the header is read from
+		// the decoded file
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if content, err = decodeContent(content); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		r = bufio.NewReader(bytes.NewReader(content))
+	} else if bom, _ := r.Peek(len(utf8BOM)); bytes.Equal(bom, utf8BOM) {
+		r.Discard(len(utf8BOM))
+	}
+
+	var header []byte
+	for {
+		line, isPrefix, err := r.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 && !bytes.HasPrefix(trimmed, []byte("--")) {
+			break
+		}
+
+		header = append(header, line...)
+		for isPrefix {
+			if line, isPrefix, err = r.ReadLine(); err != nil {
+				return err
+			}
+			header = append(header, line...)
+		}
+		header = append(header, '\n')
+	}
+
+	if err := parseMetadata(migration, header); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	// the up content is not loaded, so a directive of the up file which
+	// excludes the down migration from a transaction is kept as the setting
+	if directives, err := parseMigrationDirectives(header); err == nil && directives.noTransaction(DirectionUp, DirectionDown) {
+		migration.NoTransaction = true
+	}
+	return nil
+}
+
+// utf8BOM is the byte order mark some editors put at the start of UTF-8 files
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// hasUTF16BOM reports whether the content starts with a UTF-16 byte order
+// mark, little or big endian
+func hasUTF16BOM(content []byte) bool {
+	return len(content) >= 2 && (content[0] == 0xFF && content[1] == 0xFE || content[0] == 0xFE && content[1] == 0xFF)
+}
+
+// decodeContent returns the content of a migration file as UTF-8 without a
+// byte order mark, which the database would reject as part of the first
+// statement. UTF-16 files, as saved by some Windows editors, are detected by
+// their byte order mark and converted.
+func decodeContent(content []byte) ([]byte, error) {
+	if bytes.HasPrefix(content, utf8BOM) {
+		return content[len(utf8BOM):], nil
+	}
+	if !hasUTF16BOM(content) {
+		return content, nil
+	}
+
+	order := binary.ByteOrder(binary.LittleEndian)
+	if content[0] == 0xFE {
+		order = binary.BigEndian
+	}
+	content = content[2:]
+	if len(content)%2 != 0 {
+		return nil, errors.New("invalid UTF-16 content, odd number of bytes")
+	}
+
+	units := make([]uint16, len(content)/2)
+	for i := range units {
+		units[i] = order.Uint16(content[2*i:])
+	}
+	return []byte(string(utf16.Decode(units))), nil
+}
+
+// OsSource is a convenience wrapper for reading from the OS filesystem.
+type OsSource struct {
+	*FsSource
+}
+
+// NewOsSource creates a new OsSource.
+func NewOsSource(path string, opts ...FsSourceOption) *OsSource {
+	return &OsSource{
+		FsSource: NewFsSource(os.DirFS("/"), path, opts...),
+	}
+}
+
+// ReaderSource is a source of a single migration without a down migration,
+// read from a reader, e.g. an emergency fix piped to stdin. The reader is
+// read once, when the migrations are first requested.
+type ReaderSource struct {
+	version string
+	up      io.Reader
+
+	mu        sync.Mutex
+	read      bool
+	migration Migration
+	err       error
+}
+
+// NewReaderSource creates a new ReaderSource of the version.
+func NewReaderSource(version string, up io.Reader) *ReaderSource {
+	return &ReaderSource{version: version, up: up}
+}
+
+func (s *ReaderSource) GetMigrations() ([]Migration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.read {
+		s.read = true
+		s.migration, s.err = s.readMigration()
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	return []Migration{s.migration}, nil
+}
+
+// readMigration reads the migration like a file of FsSource
+func (s *ReaderSource) readMigration() (Migration, error) {
+	migration := Migration{Version: s.version}
+	content, err := io.ReadAll(s.up)
+	if err != nil {
+		return migration, fmt.Errorf("failed to read migration %s: %w", s.version, err)
+	}
+	if content, err = decodeContent(content); err != nil {
+		return migration, fmt.Errorf("migration %s: %w", s.version, err)
+	}
+	if err := parseMetadata(&migration, content); err != nil {
+		return migration, fmt.Errorf("migration %s: %w", s.version, err)
+	}
+	migration.Content = content
+	return migration, nil
+}
+
+// DownProvider derives the down content of a migration from its up content.
+type DownProvider func(version string, up []byte) ([]byte, error)
+
+// DownSource is a source decorator that generates missing down migrations.
+type DownSource struct {
+	inner Source
+	down  DownProvider
+}
+
+// NewDownSource creates a new DownSource. The provider is called for each
+// migration of the inner source which has no down content, only when the
+// down content is loaded: runs which only apply migrations don't call it,
+// and rollbacks call it only for the migrations they roll back.
+func NewDownSource(inner Source, down DownProvider) *DownSource {
+	return &DownSource{inner: inner, down: down}
+}
+
+func (s *DownSource) GetMigrations() ([]Migration, error) {
+	migrations, err := s.inner.GetMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return s.derive(migrations)
+}
+
+// GetMigrationsFor doesn't derive the down content for DirectionUp. The
+// derivation needs the up content, so DirectionDown loads both.
+func (s *DownSource) GetMigrationsFor(ctx context.Context, direction string) ([]Migration, error) {
+	if direction == DirectionUp {
+		return getMigrationsFor(ctx, s.inner, direction)
+	}
+	return s.GetMigrations()
+}
+
+// GetMigration derives the down content of a single migration, reading it
+// from the inner source one by one when it supports that
+func (s *DownSource) GetMigration(version string) (Migration, error) {
+	if source, ok := s.inner.(RandomAccessSource); ok {
+		migration, err := source.GetMigration(version)
+		if err != nil {
+			return migration, err
+		}
+		return s.deriveOne(migration)
+	}
+
+	migrations, err := s.inner.GetMigrations()
+	if err != nil {
+		return Migration{}, err
+	}
+	for _, m := range migrations {
+		if m.Version == version {
+			return s.deriveOne(m)
+		}
+	}
+	return Migration{}, fmt.Errorf("%w for version: %s", ErrMigrationNotFound, version)
+}
+
+// Less orders the versions like the inner source
+func (s *DownSource) Less(a, b string) bool {
+	return sourceLess(s.inner, a, b)
+}
+
+func (s *DownSource) derive(migrations []Migration) ([]Migration, error) {
+	// don't modify the migrations owned by the inner source
+	migrations = slices.Clone(migrations)
+	for i, m := range migrations {
+		var err error
+		if migrations[i], err = s.deriveOne(m); err != nil {
+			return nil, err
+		}
+	}
+	return migrations, nil
+}
+
+func (s *DownSource) deriveOne(m Migration) (Migration, error) {
+	if len(m.DownContent) != 0 {
+		return m, nil
+	}
+	content, err := s.down(m.Version, m.Content)
+	if err != nil {
+		return m, fmt.Errorf("failed to derive down migration %s: %w", m.Version, err)
+	}
+	m.DownContent = content
+	return m, nil
+}
+
+// WrappedSource is a source decorator that adds the same SQL before and
+// after every migration, e.g. `SET search_path` and `ANALYZE`.
+type WrappedSource struct {
+	inner  Source
+	header []byte
+	footer []byte
+}
+
+// NewWrappedSource creates a new WrappedSource. The header and the footer
+// wrap both the up and the down content, on lines of their own. The footer
+// follows the last statement of the migration, which must end with `;`.
+// Empty down content is kept empty, so irreversible migrations stay
+// irreversible.
+func NewWrappedSource(inner Source, header, footer []byte) *WrappedSource {
+	return &WrappedSource{inner: inner, header: header, footer: footer}
+}
+
+func (s *WrappedSource) GetMigrations() ([]Migration, error) {
+	migrations, err := s.inner.GetMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	// don't modify the migrations owned by the inner source
+	migrations = slices.Clone(migrations)
+	for i, m := range migrations {
+		migrations[i].Content = s.wrap(m.Content)
+		migrations[i].DownContent = s.wrap(m.DownContent)
+	}
 
+	return migrations, nil
+}
+
+// Less orders the versions like the inner source
+func (s *WrappedSource) Less(a, b string) bool {
+	return sourceLess(s.inner, a, b)
+}
+
+// wrap returns the content between the header and the footer
+func (s *WrappedSource) wrap(content []byte) []byte {
+	if len(content) == 0 {
+		return content
+	}
+
+	var b bytes.Buffer
+	for _, part := range [][]byte{s.header, content, s.footer} {
+		if len(part) == 0 {
+			continue
+		}
+		if b.Len() > 0 && !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+			b.WriteByte('\n')
+		}
+		b.Write(part)
+	}
+	return b.Bytes()
+}
+
+// FilteredSource is a source decorator that exposes only the migrations
+// newer than a watermark version, e.g. the version covered by a baseline.
+type FilteredSource struct {
+	inner      Source
+	minVersion string
+}
+
+// NewFilteredSource creates a new FilteredSource. Only the migrations of the
+// inner source with a version after minVersion are returned, in the order
+// of the inner source when it is an OrderedSource.
+func NewFilteredSource(inner Source, minVersion string) *FilteredSource {
+	return &FilteredSource{inner: inner, minVersion: minVersion}
+}
+
+func (s *FilteredSource) GetMigrations() ([]Migration, error) {
+	migrations, err := s.inner.GetMigrations()
 	if err != nil {
 		return nil, err
 	}
 
 	var files []Migration
 	for _, m := range migrations {
-		files = append(files, *m)
+		if s.Less(s.minVersion, m.Version) {
+			files = append(files, m)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no migrations after version %s", s.minVersion)
 	}
 
 	sort.Slice(files, func(i, j int) bool {
-		return files[i].Version < files[j].Version
+		return s.Less(files[i].Version, files[j].Version)
 	})
 
 	return files, nil
 }
 
-// OsSource is a convenience wrapper for reading from the OS filesystem.
-type OsSource struct {
-	*FsSource
+// Less orders the versions like the inner source
+func (s *FilteredSource) Less(a, b string) bool {
+	return sourceLess(s.inner, a, b)
 }
 
-// NewOsSource creates a new OsSource.
-func NewOsSource(path string) *OsSource {
-	return &OsSource{
-		FsSource: NewFsSource(os.DirFS("/"), path),
+// MultiSource is a source which merges the migrations of several sources.
+type MultiSource struct {
+	sources  []Source
+	parallel int
+}
+
+// MultiSourceOption is a function that configures a MultiSource.
+type MultiSourceOption func(*MultiSource)
+
+// WithParallelSources loads up to n child sources concurrently, which cuts
+// the loading time of networked sources. By default they are loaded one by one.
+func WithParallelSources(n int) MultiSourceOption {
+	return func(s *MultiSource) {
+		s.parallel = n
+	}
+}
+
+// NewMultiSource creates a new MultiSource. A version must not be provided
+// by more than one of the sources.
+func NewMultiSource(sources []Source, opts ...MultiSourceOption) *MultiSource {
+	s := &MultiSource{sources: sources, parallel: 1}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
+}
+
+func (s *MultiSource) GetMigrations() ([]Migration, error) {
+	type result struct {
+		index      int
+		migrations []Migration
+		err        error
+	}
+
+	// buffered, so loaders don't block once an error was returned
+	results := make(chan result, len(s.sources))
+	limit := make(chan struct{}, max(s.parallel, 1))
+	done := make(chan struct{})
+	defer close(done)
+	// failed is set before a failing loader frees its slot, so the slot
+	// isn't taken by the next source
+	var failed atomic.Bool
+	go func() {
+		for i, source := range s.sources {
+			select {
+			case limit <- struct{}{}:
+			case <-done:
+				return
+			}
+			if failed.Load() {
+				// fail fast, don't start the remaining sources
+				return
+			}
+			go func() {
+				defer func() { <-limit }()
+				migrations, err := source.GetMigrations()
+				if err != nil {
+					failed.Store(true)
+				}
+				results <- result{index: i, migrations: migrations, err: err}
+			}()
+		}
+	}()
+
+	loaded := make([][]Migration, len(s.sources))
+	for range s.sources {
+		r := <-results
+		if r.err != nil {
+			return nil, fmt.Errorf("failed to load source %d: %w", r.index, r.err)
+		}
+		loaded[r.index] = r.migrations
+	}
+
+	// merge in the order of the sources, so the result doesn't depend on
+	// which source was loaded first
+	var files []Migration
+	owner := make(map[string]int)
+	for i, migrations := range loaded {
+		for _, m := range migrations {
+			if j, ok := owner[m.Version]; ok {
+				return nil, fmt.Errorf("migration %s is provided by sources %d and %d", m.Version, j, i)
+			}
+			owner[m.Version] = i
+			files = append(files, m)
+		}
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Version < files[j].Version
+	})
+
+	return files, nil
 }
@@ -0,0 +1,207 @@
+// Package git provides a migration source which reads the migrations of a
+// git repository at a specific ref, without a working tree.
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"testing/fstest"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/mkozhukh/migrate"
+)
+
+// GitSource is a migration source that reads the migrations of a git
+// repository at a branch, tag or commit. The repository is cloned once, on
+// first use, and its migrations are reused by later calls, so a new source
+// is needed to see new commits of a branch.
+type GitSource struct {
+	url    string
+	ref    string
+	subdir string
+	auth   transport.AuthMethod
+	opts   []migrate.FsSourceOption
+
+	mu     sync.Mutex
+	source *migrate.FsSource
+}
+
+// Option is a function that configures a GitSource.
+type Option func(*GitSource)
+
+// WithAuth sets the authentication used to clone the repository.
+func WithAuth(auth transport.AuthMethod) Option {
+	return func(s *GitSource) {
+		s.auth = auth
+	}
+}
+
+// WithFsOptions sets the options of the FsSource which reads the files of
+// the repository, e.g. migrate.WithNaming.
+func WithFsOptions(opts ...migrate.FsSourceOption) Option {
+	return func(s *GitSource) {
+		s.opts = opts
+	}
+}
+
+// NewGitSource creates a new GitSource. The ref is a branch, tag or commit
+// hash, subdir is the directory of the migrations in the repository.
+func NewGitSource(repoURL, ref, subdir string, opts ...Option) *GitSource {
+	s := &GitSource{url: repoURL, ref: ref, subdir: strings.Trim(subdir, "/")}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// GetMigrations clones the repository into memory and reads the migrations
+// of the ref. The files are read the same way as by migrate.FsSource.
+func (s *GitSource) GetMigrations() ([]migrate.Migration, error) {
+	source, err := s.fsSource()
+	if err != nil {
+		return nil, err
+	}
+	return source.GetMigrations()
+}
+
+// GetMigration reads a single migration of the ref.
+func (s *GitSource) GetMigration(version string) (migrate.Migration, error) {
+	source, err := s.fsSource()
+	if err != nil {
+		return migrate.Migration{}, err
+	}
+	return source.GetMigration(version)
+}
+
+// Less orders the versions like the FsSource of the files, e.g. with
+// migrate.WithLess passed to WithFsOptions.
+func (s *GitSource) Less(a, b string) bool {
+	return migrate.NewFsSource(nil, ".", s.opts...).Less(a, b)
+}
+
+// fsSource returns the source of the files at the ref, cloning the
+// repository on first use. Failed clones are retried by the next call.
+func (s *GitSource) fsSource() (*migrate.FsSource, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.source != nil {
+		return s.source, nil
+	}
+	files, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	root := s.subdir
+	if root == "" {
+		root = "."
+	}
+	s.source = migrate.NewFsSource(files, root, s.opts...)
+	return s.source, nil
+}
+
+// clone fetches only the last commit of the branch or tag of the ref.
+// Commit hashes and revisions like HEAD~1 need the history, so the whole
+// repository is cloned for them.
+func (s *GitSource) clone() (*git.Repository, error) {
+	if plumbing.IsHash(s.ref) || strings.ContainsAny(s.ref, "~^@:") {
+		return git.Clone(memory.NewStorage(), nil, &git.CloneOptions{
+			URL:  s.url,
+			Auth: s.auth,
+			Tags: git.AllTags,
+		})
+	}
+
+	names := []plumbing.ReferenceName{plumbing.NewBranchReferenceName(s.ref), plumbing.NewTagReferenceName(s.ref)}
+	if s.ref == "HEAD" {
+		names = []plumbing.ReferenceName{plumbing.HEAD}
+	}
+	var err error
+	for _, name := range names {
+		var repo *git.Repository
+		repo, err = git.Clone(memory.NewStorage(), nil, &git.CloneOptions{
+			URL:           s.url,
+			Auth:          s.auth,
+			ReferenceName: name,
+			SingleBranch:  true,
+			Depth:         1,
+			Tags:          git.NoTags,
+		})
+		var missing git.NoMatchingRefSpecError
+		if !errors.As(err, &missing) {
+			return repo, err
+		}
+	}
+	return nil, err
+}
+
+// load reads the files of the migrations directory at the ref
+func (s *GitSource) load() (fs.FS, error) {
+	repo, err := s.clone()
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone %s at %s: %w", s.url, s.ref, err)
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(s.ref))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve ref %s: %w", s.ref, err)
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read commit of ref %s: %w", s.ref, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tree of ref %s: %w", s.ref, err)
+	}
+	if s.subdir != "" {
+		tree, err = tree.Tree(s.subdir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s at %s: %w", s.subdir, s.ref, err)
+		}
+	}
+
+	// the blobs are small, so the directory is held in memory and read
+	// with FsSource like any other file system
+	files := fstest.MapFS{}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if !f.Mode.IsFile() || f.Mode == filemode.Symlink {
+			return nil
+		}
+		content, err := readBlob(f)
+		if err != nil {
+			return fmt.Errorf("failed to read %s at %s: %w", f.Name, s.ref, err)
+		}
+		files[path.Join(s.subdir, f.Name)] = &fstest.MapFile{Data: content, Mode: 0o644}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files in %q at %s", s.subdir, s.ref)
+	}
+
+	return files, nil
+}
+
+func readBlob(f *object.File) ([]byte, error) {
+	reader, err := f.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,152 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// commitFiles writes the files to the work tree and commits them
+func commitFiles(t *testing.T, dir string, repo *git.Repository, files map[string]string) {
+	t.Helper()
+
+	tree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tree.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = tree.Commit("add migrations", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test reading migrations at a tag
+func TestGitSource(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commitFiles(t, dir, repo, map[string]string{
+		"db/migrations/001_create_users.up.sql":   "CREATE TABLE users (id INT)",
+		"db/migrations/001_create_users.down.sql": "DROP TABLE users",
+		"README.md": "not a migration",
+	})
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateTag("v1.0.0", head.Hash(), nil); err != nil {
+		t.Fatal(err)
+	}
+	commitFiles(t, dir, repo, map[string]string{
+		"db/migrations/002_add_email.sql": "ALTER TABLE users ADD COLUMN email TEXT",
+	})
+
+	versions := func(source *GitSource) []string {
+		t.Helper()
+		migrations, err := source.GetMigrations()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var res []string
+		for _, m := range migrations {
+			res = append(res, m.Version)
+		}
+		return res
+	}
+
+	tagged := NewGitSource(dir, "v1.0.0", "db/migrations")
+	if got := versions(tagged); fmt.Sprint(got) != "[001_create_users]" {
+		t.Errorf("expected migrations of the tag, got %v", got)
+	}
+	migrations, _ := tagged.GetMigrations()
+	if string(migrations[0].Content) != "CREATE TABLE users (id INT)" || string(migrations[0].DownContent) != "DROP TABLE users" {
+		t.Errorf("unexpected migration %+v", migrations[0])
+	}
+
+	if got := versions(NewGitSource(dir, "HEAD", "/db/migrations/")); fmt.Sprint(got) != "[001_create_users 002_add_email]" {
+		t.Errorf("expected migrations of HEAD, got %v", got)
+	}
+	if got := versions(NewGitSource(dir, head.Hash().String(), "db/migrations")); fmt.Sprint(got) != "[001_create_users]" {
+		t.Errorf("expected migrations of the commit, got %v", got)
+	}
+
+	_, err = NewGitSource(dir, "v9.9.9", "db/migrations").GetMigrations()
+	if err == nil || !strings.Contains(err.Error(), "v9.9.9") {
+		t.Errorf("expected error naming the ref, got %v", err)
+	}
+	_, err = NewGitSource(filepath.Join(dir, "missing"), "v1.0.0", "db/migrations").GetMigrations()
+	if err == nil || !strings.Contains(err.Error(), "v1.0.0") {
+		t.Errorf("expected clone error naming the ref, got %v", err)
+	}
+}
+
+// Test cloning only the last commit of a branch, once per source
+func TestGitSourceShallowCache(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFiles(t, dir, repo, map[string]string{"001_create_users.sql": "CREATE TABLE users (id INT)"})
+	commitFiles(t, dir, repo, map[string]string{"002_add_email.sql": "ALTER TABLE users ADD COLUMN email TEXT"})
+
+	source := NewGitSource(dir, "master", "")
+	clone, err := source.clone()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	commits, err := clone.Storer.IterEncodedObjects(plumbing.CommitObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	if err := commits.ForEach(func(plumbing.EncodedObject) error { count++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected only the last commit to be cloned, got %d", count)
+	}
+
+	migrations, err := source.GetMigrations()
+	if err != nil || len(migrations) != 2 {
+		t.Fatalf("unexpected migrations %v %v", migrations, err)
+	}
+	commitFiles(t, dir, repo, map[string]string{"003_add_index.sql": "CREATE INDEX idx_users_email ON users(email)"})
+
+	migrations, err = source.GetMigrations()
+	if err != nil || len(migrations) != 2 {
+		t.Errorf("expected the cached migrations, got %v %v", migrations, err)
+	}
+	migration, err := source.GetMigration("002_add_email")
+	if err != nil || string(migration.Content) != "ALTER TABLE users ADD COLUMN email TEXT" {
+		t.Errorf("unexpected migration %+v %v", migration, err)
+	}
+	if _, err := source.GetMigration("003_add_index"); err == nil {
+		t.Error("expected the migration committed after the clone to be missing")
+	}
+}
@@ -0,0 +1,570 @@
+package migrate
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"time"
+	"unicode/utf16"
+)
+
+// Test generation of down migrations
+func TestDownSource(t *testing.T) {
+	inner := &MockSource{migrations: []Migration{
+		{Version: "001_create_users", Content: []byte("CREATE TABLE users (id INT)")},
+		{Version: "002_add_email", Content: []byte("ALTER TABLE users ADD COLUMN email TEXT"), DownContent: []byte("ALTER TABLE users DROP COLUMN email")},
+	}}
+
+	var calls []string
+	source := NewDownSource(inner, func(version string, up []byte) ([]byte, error) {
+		calls = append(calls, version)
+		return []byte("-- reverse of " + string(up)), nil
+	})
+
+	migrations, err := source.GetMigrations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(calls) != 1 || calls[0] != "001_create_users" {
+		t.Errorf("expected provider to be called only for missing downs, got %v", calls)
+	}
+	if string(migrations[0].DownContent) != "-- reverse of CREATE TABLE users (id INT)" {
+		t.Errorf("unexpected derived down content %q", migrations[0].DownContent)
+	}
+	if string(migrations[1].DownContent) != "ALTER TABLE users DROP COLUMN email" {
+		t.Errorf("existing down content should be kept, got %q", migrations[1].DownContent)
+	}
+
+	calls = nil
+	if _, err := source.GetMigrationsFor(context.Background(), DirectionUp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(calls) != 0 {
+		t.Errorf("expected no provider calls for the up direction, got %v", calls)
+	}
+
+	// Up runs don't derive the down content
+	dialect := &MockDialect{}
+	if err := New(source, dialect, &MockLogger{}).Up(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(calls) != 0 {
+		t.Errorf("expected no provider calls for an up run, got %v", calls)
+	}
+
+	// Rollbacks derive only the migrations they roll back
+	dialect.appliedMigrations = []string{"001_create_users", "002_add_email"}
+	if err := New(source, dialect, &MockLogger{}).Down(context.Background(), 1, WithConfirmRollback()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(calls) != 0 {
+		t.Errorf("expected no provider calls for a rollback of a migration with down content, got %v", calls)
+	}
+	migration, err := source.GetMigration("001_create_users")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(calls) != "[001_create_users]" || len(migration.DownContent) == 0 {
+		t.Errorf("expected the down content of a single migration, got %v %q", calls, migration.DownContent)
+	}
+	if _, err := source.GetMigration("003_missing"); !errors.Is(err, ErrMigrationNotFound) {
+		t.Errorf("expected ErrMigrationNotFound, got %v", err)
+	}
+
+	failing := NewDownSource(inner, func(version string, up []byte) ([]byte, error) {
+		return nil, errors.New("differ failed")
+	})
+	if _, err := failing.GetMigrations(); err == nil {
+		t.Error("expected error but got none")
+	}
+}
+
+func testFS() fstest.MapFS {
+	return fstest.MapFS{
+		"migrations/001_create_users.up.sql":   {Data: []byte("CREATE TABLE users (id INT)")},
+		"migrations/001_create_users.down.sql": {Data: []byte("DROP TABLE users")},
+		"migrations/002_add_email.sql":         {Data: []byte("ALTER TABLE users ADD COLUMN email TEXT")},
+		"migrations/readme.md":                 {Data: []byte("not a migration")},
+	}
+}
+
+// Test reading migrations from a filesystem
+func TestFsSource(t *testing.T) {
+	source := NewFsSource(testFS(), "migrations")
+
+	migrations, err := source.GetMigrations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(migrations))
+	}
+	if migrations[0].Version != "001_create_users" || string(migrations[0].DownContent) != "DROP TABLE users" {
+		t.Errorf("unexpected first migration %+v", migrations[0])
+	}
+	if migrations[1].Version != "002_add_email" || migrations[1].DownContent != nil {
+		t.Errorf("unexpected second migration %+v", migrations[1])
+	}
+
+	t.Run("single migration", func(t *testing.T) {
+		migration, err := source.GetMigration("001_create_users")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(migration.Content) != "CREATE TABLE users (id INT)" || string(migration.DownContent) != "DROP TABLE users" {
+			t.Errorf("unexpected migration %+v", migration)
+		}
+
+		if _, err := source.GetMigration("999_missing"); !errors.Is(err, ErrMigrationNotFound) {
+			t.Errorf("expected ErrMigrationNotFound for missing version, got %v", err)
+		}
+	})
+}
+
+// Test translating file names with a custom naming
+func TestFsSourceNaming(t *testing.T) {
+	flyway := func(filename string) (string, string, bool) {
+		name, ok := strings.CutSuffix(filename, ".sql")
+		if !ok || len(name) < 2 {
+			return "", "", false
+		}
+		switch name[0] {
+		case 'V':
+			return name[1:], DirectionUp, true
+		case 'U':
+			return name[1:], DirectionDown, true
+		}
+		return "", "", false
+	}
+
+	source := NewFsSource(fstest.MapFS{
+		"db/V1__init.sql":       {Data: []byte("CREATE TABLE users (id INT)")},
+		"db/U1__init.sql":       {Data: []byte("DROP TABLE users")},
+		"db/V2__add_email.sql":  {Data: []byte("ALTER TABLE users ADD COLUMN email TEXT")},
+		"db/R__refresh_v.sql":   {Data: []byte("CREATE OR REPLACE VIEW v AS SELECT 1")},
+		"db/V3__draft.sql.bak":  {Data: []byte("not a migration")},
+		"db/sub/V4__nested.sql": {Data: []byte("CREATE TABLE nested (id INT)")},
+	}, "db", WithNaming(flyway))
+
+	migrations, err := source.GetMigrations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var versions []string
+	for _, m := range migrations {
+		versions = append(versions, m.Version)
+	}
+	if fmt.Sprint(versions) != "[1__init 2__add_email 4__nested]" {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+	if string(migrations[0].Content) != "CREATE TABLE users (id INT)" || string(migrations[0].DownContent) != "DROP TABLE users" {
+		t.Errorf("unexpected migration %+v", migrations[0])
+	}
+
+	migration, err := source.GetMigration("2__add_email")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(migration.Content) != "ALTER TABLE users ADD COLUMN email TEXT" {
+		t.Errorf("unexpected migration %+v", migration)
+	}
+}
+
+// Test filtering migrations by a watermark version
+func TestFilteredSource(t *testing.T) {
+	inner := &MockSource{migrations: []Migration{
+		{Version: "003_add_index"},
+		{Version: "001_create_users"},
+		{Version: "004_add_timestamp"},
+		{Version: "002_add_email"},
+	}}
+
+	migrations, err := NewFilteredSource(inner, "002_add_email").GetMigrations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var versions []string
+	for _, m := range migrations {
+		versions = append(versions, m.Version)
+	}
+	if fmt.Sprint(versions) != "[003_add_index 004_add_timestamp]" {
+		t.Errorf("unexpected versions %v", versions)
+	}
+	if inner.migrations[0].Version != "003_add_index" {
+		t.Error("inner migrations should not be reordered")
+	}
+
+	if _, err := NewFilteredSource(inner, "004_add_timestamp").GetMigrations(); err == nil {
+		t.Error("expected error when no migrations are left")
+	}
+}
+
+// Test a single migration read from a reader
+func TestReaderSource(t *testing.T) {
+	source := NewReaderSource("20240301_fix", strings.NewReader("UPDATE users SET active = true;\n"))
+	for range 2 {
+		migrations, err := source.GetMigrations()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(migrations) != 1 || migrations[0].Version != "20240301_fix" || string(migrations[0].Content) != "UPDATE users SET active = true;\n" || migrations[0].DownContent != nil {
+			t.Errorf("expected the migration of the reader, got %+v", migrations)
+		}
+	}
+
+	dialect := &MockDialect{appliedMigrations: []string{"20240101_users"}}
+	if err := New(NewReaderSource("20240301_fix", strings.NewReader("UPDATE users SET active = true;")), dialect, &MockLogger{}).Up(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(dialect.storedMigrations) != "[20240301_fix]" {
+		t.Errorf("expected the migration to be applied, got %v", dialect.storedMigrations)
+	}
+
+	failing := NewReaderSource("20240301_fix", iotest.ErrReader(errors.New("broken pipe")))
+	for range 2 {
+		if _, err := failing.GetMigrations(); err == nil || !strings.Contains(err.Error(), "broken pipe") {
+			t.Errorf("expected read error, got %v", err)
+		}
+	}
+}
+
+// Test adding a header and a footer to every migration
+func TestWrappedSource(t *testing.T) {
+	inner := &MockSource{migrations: []Migration{
+		{Version: "001_create_users", Content: []byte("CREATE TABLE users (id INT);\n"), DownContent: []byte("DROP TABLE users;")},
+		{Version: "002_backfill", Content: []byte("UPDATE users SET id = id;")},
+	}}
+
+	migrations, err := NewWrappedSource(inner, []byte("SET search_path TO app;"), []byte("ANALYZE;")).GetMigrations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(migrations[0].Content) != "SET search_path TO app;\nCREATE TABLE users (id INT);\nANALYZE;" {
+		t.Errorf("unexpected up content %q", migrations[0].Content)
+	}
+	if string(migrations[0].DownContent) != "SET search_path TO app;\nDROP TABLE users;\nANALYZE;" {
+		t.Errorf("unexpected down content %q", migrations[0].DownContent)
+	}
+	if len(migrations[1].DownContent) != 0 {
+		t.Errorf("expected empty down content to stay empty, got %q", migrations[1].DownContent)
+	}
+	if string(inner.migrations[0].Content) != "CREATE TABLE users (id INT);\n" {
+		t.Error("inner migrations should not be modified")
+	}
+
+	migrations, err = NewWrappedSource(inner, nil, []byte("ANALYZE;")).GetMigrations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(migrations[1].Content) != "UPDATE users SET id = id;\nANALYZE;" {
+		t.Errorf("unexpected content without a header %q", migrations[1].Content)
+	}
+}
+
+// slowSource counts concurrent loads
+type slowSource struct {
+	MockSource
+	active, peak *atomic.Int32
+	started      atomic.Bool
+	err          error
+}
+
+func (s *slowSource) GetMigrations() ([]Migration, error) {
+	s.started.Store(true)
+	n := s.active.Add(1)
+	defer s.active.Add(-1)
+	for {
+		peak := s.peak.Load()
+		if n <= peak || s.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.MockSource.GetMigrations()
+}
+
+// Test merging migrations of several sources
+func TestMultiSource(t *testing.T) {
+	var active, peak atomic.Int32
+	newSource := func(versions ...string) *slowSource {
+		s := &slowSource{active: &active, peak: &peak}
+		for _, v := range versions {
+			s.migrations = append(s.migrations, Migration{Version: v})
+		}
+		return s
+	}
+
+	t.Run("parallel", func(t *testing.T) {
+		peak.Store(0)
+		source := NewMultiSource([]Source{
+			newSource("003_c", "001_a"),
+			newSource("002_b"),
+			newSource("005_e"),
+			newSource("004_d"),
+		}, WithParallelSources(2))
+
+		migrations, err := source.GetMigrations()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var versions []string
+		for _, m := range migrations {
+			versions = append(versions, m.Version)
+		}
+		if fmt.Sprint(versions) != "[001_a 002_b 003_c 004_d 005_e]" {
+			t.Errorf("unexpected versions %v", versions)
+		}
+		if peak.Load() != 2 {
+			t.Errorf("expected 2 sources to be loaded concurrently, got %d", peak.Load())
+		}
+	})
+
+	t.Run("sequential by default", func(t *testing.T) {
+		peak.Store(0)
+		if _, err := NewMultiSource([]Source{newSource("001_a"), newSource("002_b")}).GetMigrations(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if peak.Load() != 1 {
+			t.Errorf("expected sources to be loaded one by one, got %d", peak.Load())
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		failing := newSource()
+		failing.err = errors.New("connection reset")
+		_, err := NewMultiSource([]Source{newSource("001_a"), failing}, WithParallelSources(2)).GetMigrations()
+		if !errors.Is(err, failing.err) {
+			t.Errorf("expected source error, got %v", err)
+		}
+
+		// the slot of the failed source is not taken by the next one
+		next := newSource("002_b")
+		_, err = NewMultiSource([]Source{failing, next}).GetMigrations()
+		if !errors.Is(err, failing.err) {
+			t.Errorf("expected source error, got %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if next.started.Load() {
+			t.Error("expected the remaining sources not to be started after a failure")
+		}
+
+		_, err = NewMultiSource([]Source{newSource("001_a"), newSource("001_a")}).GetMigrations()
+		if err == nil || !strings.Contains(err.Error(), "001_a") {
+			t.Errorf("expected duplicate version error, got %v", err)
+		}
+	})
+}
+
+// Test reading the metadata header of migration files
+func TestFsSourceMetadata(t *testing.T) {
+	source := NewFsSource(fstest.MapFS{
+		"migrations/001_index.up.sql":   {Data: []byte("-- migrate: {\"transaction\": false, \"tags\": [\"schema\"], \"timeout\": \"5m\"}\nCREATE INDEX CONCURRENTLY a ON t (a);")},
+		"migrations/001_index.down.sql": {Data: []byte("DROP INDEX a;")},
+		"migrations/002_plain.sql":      {Data: []byte("-- migrate:verify SELECT 1\nCREATE TABLE b (id INT);")},
+	}, "migrations")
+
+	migrations, err := source.GetMigrations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !migrations[0].NoTransaction || fmt.Sprint(migrations[0].Tags) != "[schema]" || migrations[0].Timeout != 5*time.Minute {
+		t.Errorf("unexpected metadata %+v", migrations[0])
+	}
+	if migrations[1].NoTransaction || migrations[1].Tags != nil || migrations[1].Timeout != 0 {
+		t.Errorf("expected no metadata, got %+v", migrations[1])
+	}
+
+	for name, content := range map[string]string{
+		"malformed": `-- migrate: {"transaction": false`,
+		"unknown":   `-- migrate: {"transactional": false}`,
+		"timeout":   `-- migrate: {"timeout": "soon"}`,
+		"repeated":  "-- migrate: {}\n-- migrate: {}",
+	} {
+		t.Run(name, func(t *testing.T) {
+			source := NewFsSource(fstest.MapFS{"migrations/001_bad.sql": {Data: []byte(content)}}, "migrations")
+			_, err := source.GetMigrations()
+			if err == nil || !strings.Contains(err.Error(), "migrations/001_bad.sql") {
+				t.Errorf("expected error naming the file, got %v", err)
+			}
+		})
+	}
+}
+
+// Test loading the migrations for one direction
+func TestFsSourceGetMigrationsFor(t *testing.T) {
+	source := NewFsSource(fstest.MapFS{
+		"migrations/001_index.up.sql":   {Data: []byte("-- index without locking\n-- migrate: {\"transaction\": false}\n\nCREATE INDEX CONCURRENTLY a ON t (a);")},
+		"migrations/001_index.down.sql": {Data: []byte("DROP INDEX a;")},
+		"migrations/002_plain.sql":      {Data: []byte("CREATE TABLE b (id INT);")},
+		"migrations/003_swap.up.sql":    {Data: []byte("-- migrate:no-transaction down\nCREATE INDEX c ON t (c);")},
+		"migrations/003_swap.down.sql":  {Data: []byte("DROP INDEX CONCURRENTLY c;")},
+	}, "migrations")
+	ctx := context.Background()
+
+	down, err := source.GetMigrationsFor(ctx, DirectionDown)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(down) != 3 || down[0].Content != nil || string(down[0].DownContent) != "DROP INDEX a;" || !down[0].NoTransaction {
+		t.Errorf("expected only down content with the header settings, got %+v", down)
+	}
+	if down[1].Version != "002_plain" || down[1].Content != nil {
+		t.Errorf("expected migration without down content, got %+v", down[1])
+	}
+	if !down[2].NoTransaction {
+		t.Errorf("expected the down scoped directive of the up file to be kept, got %+v", down[2])
+	}
+
+	up, err := source.GetMigrationsFor(ctx, DirectionUp)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(up) != 3 || up[0].DownContent != nil || len(up[0].Content) == 0 {
+		t.Errorf("expected only up content, got %+v", up)
+	}
+}
+
+// Test ordering the migrations of a source with a custom order
+func TestFsSourceLess(t *testing.T) {
+	files := fstest.MapFS{
+		"migrations/1.2.0.sql":        {Data: []byte("SELECT 1;")},
+		"migrations/1.10.0.sql":       {Data: []byte("SELECT 2;")},
+		"migrations/2.0.0-rc.1.sql":   {Data: []byte("SELECT 3;")},
+		"migrations/2.0.0.sql":        {Data: []byte("SELECT 4;")},
+		"migrations/2.0.0.down.sql":   {Data: []byte("SELECT 5;")},
+		"migrations/1.9.0_fix.up.sql": {Data: []byte("SELECT 6;")},
+	}
+
+	versions := func(source Source) string {
+		migrations, err := source.GetMigrations()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var res []string
+		for _, m := range migrations {
+			res = append(res, m.Version)
+		}
+		return fmt.Sprint(res)
+	}
+
+	if order := versions(NewFsSource(files, "migrations")); order != "[1.10.0 1.2.0 1.9.0_fix 2.0.0 2.0.0-rc.1]" {
+		t.Errorf("expected lexical order by default, got %s", order)
+	}
+	if order := versions(NewFsSource(files, "migrations", WithLess(SemverLess))); order != "[1.2.0 1.9.0_fix 1.10.0 2.0.0-rc.1 2.0.0]" {
+		t.Errorf("expected semver order, got %s", order)
+	}
+}
+
+// Test reading files with a byte order mark
+func TestFsSourceEncoding(t *testing.T) {
+	utf16le := func(text string) []byte {
+		data := []byte{0xFF, 0xFE}
+		for _, unit := range utf16.Encode([]rune(text)) {
+			data = binary.LittleEndian.AppendUint16(data, unit)
+		}
+		return data
+	}
+	utf16be := func(text string) []byte {
+		data := []byte{0xFE, 0xFF}
+		for _, unit := range utf16.Encode([]rune(text)) {
+			data = binary.BigEndian.AppendUint16(data, unit)
+		}
+		return data
+	}
+
+	source := NewFsSource(fstest.MapFS{
+		"migrations/001_users.up.sql":   {Data: append([]byte{0xEF, 0xBB, 0xBF}, "CREATE TABLE users (id INT);"...)},
+		"migrations/001_users.down.sql": {Data: append([]byte{0xEF, 0xBB, 0xBF}, "DROP TABLE users;"...)},
+		"migrations/002_names.up.sql":   {Data: utf16le("-- migrate:no-transaction down\nINSERT INTO users VALUES ('Zoë');")},
+		"migrations/002_names.down.sql": {Data: utf16be("DELETE FROM users;")},
+	}, "migrations")
+
+	migrations, err := source.GetMigrations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(migrations[0].Content) != "CREATE TABLE users (id INT);" || string(migrations[0].DownContent) != "DROP TABLE users;" {
+		t.Errorf("expected the UTF-8 BOM to be stripped, got %q and %q", migrations[0].Content, migrations[0].DownContent)
+	}
+	if string(migrations[1].Content) != "-- migrate:no-transaction down\nINSERT INTO users VALUES ('Zoë');" || string(migrations[1].DownContent) != "DELETE FROM users;" {
+		t.Errorf("expected UTF-16 to be converted, got %q and %q", migrations[1].Content, migrations[1].DownContent)
+	}
+
+	down, err := source.GetMigrationsFor(context.Background(), DirectionDown)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !down[1].NoTransaction {
+		t.Errorf("expected the header of the UTF-16 file to be read, got %+v", down[1])
+	}
+
+	_, err = NewFsSource(fstest.MapFS{
+		"migrations/001_odd.sql": {Data: []byte{0xFF, 0xFE, 'A'}},
+	}, "migrations").GetMigrations()
+	if err == nil || !strings.Contains(err.Error(), "001_odd.sql") {
+		t.Errorf("expected error for truncated UTF-16, got %v", err)
+	}
+}
+
+// Test following symlinked directories
+func TestFsSourceFollowSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	shared := filepath.Join(dir, "shared")
+	root := filepath.Join(dir, "migrations")
+	for _, d := range []string{shared, root} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "001_create_users.sql"), []byte("CREATE TABLE users (id INT)"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(shared, "002_add_email.sql"), []byte("ALTER TABLE users ADD COLUMN email TEXT"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(shared, filepath.Join(root, "shared")); err != nil {
+		t.Skipf("symlinks are not supported: %v", err)
+	}
+
+	versions := func(source *FsSource) ([]string, error) {
+		migrations, err := source.GetMigrations()
+		var res []string
+		for _, m := range migrations {
+			res = append(res, m.Version)
+		}
+		return res, err
+	}
+
+	got, err := versions(NewFsSource(os.DirFS(dir), "migrations"))
+	if err != nil || fmt.Sprint(got) != "[001_create_users]" {
+		t.Errorf("expected symlinked directory to be skipped by default, got %v, %v", got, err)
+	}
+
+	got, err = versions(NewFsSource(os.DirFS(dir), "migrations", WithFollowSymlinks()))
+	if err != nil || fmt.Sprint(got) != "[001_create_users 002_add_email]" {
+		t.Errorf("expected symlinked directory to be read, got %v, %v", got, err)
+	}
+
+	// a link back to the root makes a loop
+	if err := os.Symlink(root, filepath.Join(shared, "loop")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = versions(NewFsSource(os.DirFS(dir), "migrations", WithFollowSymlinks()))
+	if err == nil || !strings.Contains(err.Error(), "symlink loop") {
+		t.Errorf("expected symlink loop error, got %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package migrate
+
+import (
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenText tokenKind = iota
+	tokenString
+	tokenLineComment
+	tokenBlockComment
+	tokenDollarQuote
+)
+
+// nextToken returns the end offset and the kind of the token starting at i.
+// Plain text is returned one byte at a time, quoted strings, dollar-quoted
+// bodies and comments are returned as a whole. Unterminated tokens extend
+// to the end of the query.
+func nextToken(query string, i int) (int, tokenKind) {
+	switch c := query[i]; {
+	case c == '\'' || c == '"':
+		// a doubled quote inside a literal is read as two adjacent literals
+		end := strings.IndexByte(query[i+1:], c)
+		if end == -1 {
+			return len(query), tokenString
+		}
+		return i + end + 2, tokenString
+	case c == '-' && strings.HasPrefix(query[i:], "--"):
+		end := strings.IndexByte(query[i:], '\n')
+		if end == -1 {
+			return len(query), tokenLineComment
+		}
+		return i + end, tokenLineComment
+	case c == '/' && strings.HasPrefix(query[i:], "/*"):
+		// block comments can be nested
+		depth := 0
+		for j := i; j < len(query)-1; j++ {
+			if query[j] == '/' && query[j+1] == '*' {
+				depth++
+				j++
+			} else if query[j] == '*' && query[j+1] == '/' {
+				depth--
+				j++
+				if depth == 0 {
+					return j + 1, tokenBlockComment
+				}
+			}
+		}
+		return len(query), tokenBlockComment
+	case c == '$':
+		tag, ok := dollarTag(query[i:])
+		if !ok {
+			return i + 1, tokenText
+		}
+		end := strings.Index(query[i+len(tag):], tag)
+		if end == -1 {
+			return len(query), tokenDollarQuote
+		}
+		return i + len(tag) + end + len(tag), tokenDollarQuote
+	}
+
+	return i + 1, tokenText
+}
+
+// dollarTag returns the opening tag of a dollar-quoted string, like $$ or
+// $body$, at the start of s
+func dollarTag(s string) (string, bool) {
+	for j := 1; j < len(s); j++ {
+		c := s[j]
+		if c == '$' {
+			return s[:j+1], true
+		}
+		isLetter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && !(isDigit && j > 1) {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// stripComments removes SQL line comments from the query. String literals,
+// quoted identifiers, dollar-quoted bodies and block comments are kept as is.
+func stripComments(query string) string {
+	var b strings.Builder
+	b.Grow(len(query))
+
+	for i := 0; i < len(query); {
+		end, kind := nextToken(query, i)
+		if kind != tokenLineComment {
+			b.WriteString(query[i:end])
+		}
+		i = end
+	}
+
+	return b.String()
+}
+
+// splitStatements splits the query into separate statements on semicolons
+// that are outside of literals, dollar-quoted bodies and comments. Each
+// statement keeps its terminating semicolon and is trimmed of surrounding
+// whitespace, blank statements are dropped.
+func splitStatements(query string) []string {
+	var statements []string
+	add := func(s string) {
+		if s = strings.TrimSpace(s); s != "" {
+			statements = append(statements, s)
+		}
+	}
+
+	start := 0
+	for i := 0; i < len(query); {
+		end, kind := nextToken(query, i)
+		if kind == tokenText && query[i] == ';' {
+			add(query[start:end])
+			start = end
+		}
+		i = end
+	}
+	add(query[start:])
+
+	return statements
+}
+
+const directivePrefix = "-- migrate:"
+
+// directive is a `-- migrate:<name> <args>` comment in the migration content
+type directive struct {
+	Name string
+	Args string
+}
+
+// parseDirectives returns the directives of the migration content in the
+// order they appear. Only line comments which start a line are considered.
+func parseDirectives(content string) []directive {
+	var directives []directive
+	scanDirectives(content, func(start, end int) {
+		text := strings.TrimSpace(strings.TrimPrefix(content[start:end], directivePrefix))
+		name, args := text, ""
+		if n := strings.IndexFunc(text, unicode.IsSpace); n != -1 {
+			name, args = text[:n], strings.TrimSpace(text[n:])
+		}
+		directives = append(directives, directive{Name: name, Args: args})
+	})
+
+	return directives
+}
+
+// stripDirectives removes the directive comments from the migration content
+func stripDirectives(content string) string {
+	var b strings.Builder
+	last := 0
+	scanDirectives(content, func(start, end int) {
+		b.WriteString(content[last:start])
+		last = end
+	})
+	if last == 0 {
+		return content
+	}
+	b.WriteString(content[last:])
+
+	return b.String()
+}
+
+// scanDirectives calls fn with the offsets of each directive comment
+func scanDirectives(content string, fn func(start, end int)) {
+	lineStart := true
+	for i := 0; i < len(content); {
+		end, kind := nextToken(content, i)
+		if kind == tokenLineComment && lineStart && strings.HasPrefix(content[i:end], directivePrefix) {
+			fn(i, end)
+		}
+
+		switch c := content[i]; {
+		case c == '\n':
+			lineStart = true
+		case kind == tokenText && (c == ' ' || c == '\t' || c == '\r'):
+			// leading whitespace keeps the line start
+		default:
+			lineStart = false
+		}
+		i = end
+	}
+}
@@ -0,0 +1,197 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+)
+
+// Test removal of line comments
+func TestStripComments(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:     "trailing comment",
+			query:    "SELECT 1; -- trailing",
+			expected: "SELECT 1; ",
+		},
+		{
+			name:     "comment lines",
+			query:    "-- migrate:no-transaction\nCREATE TABLE a (id INT);\n-- done\n",
+			expected: "\nCREATE TABLE a (id INT);\n\n",
+		},
+		{
+			name:     "comment marker in string literal",
+			query:    "INSERT INTO a VALUES ('--not a comment', 'it''s -- here'); -- comment",
+			expected: "INSERT INTO a VALUES ('--not a comment', 'it''s -- here'); ",
+		},
+		{
+			name:     "comment marker in quoted identifier",
+			query:    `SELECT "a--b" FROM t`,
+			expected: `SELECT "a--b" FROM t`,
+		},
+		{
+			name:     "dollar-quoted body",
+			query:    "CREATE FUNCTION f() RETURNS int AS $$ SELECT 1 -- inner\n $$ LANGUAGE sql; -- outer",
+			expected: "CREATE FUNCTION f() RETURNS int AS $$ SELECT 1 -- inner\n $$ LANGUAGE sql; ",
+		},
+		{
+			name:     "tagged dollar-quoted body",
+			query:    "DO $body$ BEGIN -- $$ inner\n END $body$; -- outer",
+			expected: "DO $body$ BEGIN -- $$ inner\n END $body$; ",
+		},
+		{
+			name:     "positional parameter",
+			query:    "SELECT $1 -- param",
+			expected: "SELECT $1 ",
+		},
+		{
+			name:     "block comment kept",
+			query:    "/* -- ' */ SELECT 1",
+			expected: "/* -- ' */ SELECT 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripComments(tt.query); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+// Test splitting of statements
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{
+			name:     "simple statements",
+			query:    "CREATE TABLE a (id INT);\nCREATE TABLE b (id INT);\n",
+			expected: []string{"CREATE TABLE a (id INT);", "CREATE TABLE b (id INT);"},
+		},
+		{
+			name:     "last statement without semicolon",
+			query:    "SELECT 1; SELECT 2",
+			expected: []string{"SELECT 1;", "SELECT 2"},
+		},
+		{
+			name:     "semicolons in literals and comments",
+			query:    "INSERT INTO a VALUES (';', \"b;c\"); -- x; y\nSELECT /* ; */ 1;",
+			expected: []string{"INSERT INTO a VALUES (';', \"b;c\");", "-- x; y\nSELECT /* ; */ 1;"},
+		},
+		{
+			name:     "dollar-quoted function body",
+			query:    "CREATE FUNCTION f() RETURNS void AS $fn$ BEGIN PERFORM 1; END; $fn$ LANGUAGE plpgsql;\nSELECT f();",
+			expected: []string{"CREATE FUNCTION f() RETURNS void AS $fn$ BEGIN PERFORM 1; END; $fn$ LANGUAGE plpgsql;", "SELECT f();"},
+		},
+		{
+			name:     "blank statements",
+			query:    " ; ;\n",
+			expected: []string{";", ";"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitStatements(tt.query)
+			if len(got) != len(tt.expected) {
+				t.Fatalf("expected %d statements, got %d: %q", len(tt.expected), len(got), got)
+			}
+			for i, expected := range tt.expected {
+				if got[i] != expected {
+					t.Errorf("statement %d: expected %q, got %q", i, expected, got[i])
+				}
+			}
+		})
+	}
+}
+
+// Test parsing of directive comments
+func TestParseDirectives(t *testing.T) {
+	content := "-- migrate:no-transaction\n  -- migrate:verify SELECT 1\nSELECT '-- migrate:fake'; -- migrate:trailing\n/* -- migrate:hidden */"
+
+	expected := []directive{
+		{Name: "no-transaction"},
+		{Name: "verify", Args: "SELECT 1"},
+	}
+
+	got := parseDirectives(content)
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d directives, got %d: %v", len(expected), len(got), got)
+	}
+	for i, d := range expected {
+		if got[i] != d {
+			t.Errorf("directive %d: expected %+v, got %+v", i, d, got[i])
+		}
+	}
+}
+
+// Test removal of directive comments
+func TestStripDirectives(t *testing.T) {
+	content := "-- migrate:session SET LOCAL work_mem = '1GB'\n-- regular comment\nCREATE INDEX idx ON t(a); -- migrate:trailing"
+	expected := "\n-- regular comment\nCREATE INDEX idx ON t(a); -- migrate:trailing"
+
+	if got := stripDirectives(content); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+var fuzzSeeds = []string{
+	"CREATE TABLE users (id INT PRIMARY KEY);\nINSERT INTO users VALUES (1);",
+	"CREATE FUNCTION f() RETURNS trigger AS $$\nBEGIN\n  NEW.updated = now();\n  RETURN NEW;\nEND;\n$$ LANGUAGE plpgsql;",
+	"DO $body$ BEGIN RAISE NOTICE 'a;b'; END $body$;",
+	"SELECT $1, $tag$ ; $tag$, $$;$$;",
+	"/* outer /* nested ; */ still comment ; */ SELECT 1;",
+	"-- migrate:no-transaction\n-- migrate:verify SELECT count(*) > 0 FROM users\nCREATE INDEX CONCURRENTLY idx ON users(id);",
+	"DELIMITER //\nCREATE PROCEDURE p() BEGIN SELECT 1; END //\nDELIMITER ;",
+	"INSERT INTO t VALUES ('it''s', \"q\"\"d\", E'\\'');",
+	"SELECT ';' -- ;\n; ;;",
+	"'unterminated; $$ /* --",
+}
+
+func FuzzSplitStatements(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, query string) {
+		statements := splitStatements(query)
+
+		// rejoining the statements reproduces the input modulo whitespace
+		joined := strings.Join(strings.Fields(strings.Join(statements, "")), "")
+		original := strings.Join(strings.Fields(query), "")
+		if joined != original {
+			t.Errorf("split changed the query:\ninput:  %q\noutput: %q", query, statements)
+		}
+
+		for _, s := range statements {
+			if strings.TrimSpace(s) == "" {
+				t.Errorf("blank statement in %q", statements)
+			}
+		}
+	})
+}
+
+func FuzzParseDirectives(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, content string) {
+		for _, d := range parseDirectives(content) {
+			if strings.IndexFunc(d.Name, unicode.IsSpace) != -1 {
+				t.Errorf("directive name contains whitespace: %q", d.Name)
+			}
+			if strings.Contains(d.Args, "\n") {
+				t.Errorf("directive args span lines: %q", d.Args)
+			}
+		}
+	})
+}
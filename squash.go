@@ -0,0 +1,69 @@
+package migrate
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DefaultSquashSeparator is the separator of squashed migrations. The
+// `{version}` placeholder is replaced with the version of the migration
+// which follows.
+const DefaultSquashSeparator = ";\n\n-- migration: {version}\n"
+
+// SquashOptions configures Squash.
+type SquashOptions struct {
+	// Separator is inserted between the migrations, DefaultSquashSeparator
+	// is used by default
+	Separator string
+}
+
+// Squash concatenates the up content of the migrations of the source in the
+// order they are applied, e.g. to replace an old history with one baseline
+// file: the order of the source, with the migrations declared by requires
+// first. Each migration is terminated by a newline, so a trailing line
+// comment can't swallow the separator, and the separator terminates its last
+// statement, which may lack a semicolon. A trailing semicolon is trimmed
+// before the separator, so it doesn't leave an empty statement.
+func Squash(source Source, opts SquashOptions) ([]byte, error) {
+	migrations, err := source.GetMigrations()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migrations: %w", err)
+	}
+	migrations = slices.Clone(migrations)
+	slices.SortStableFunc(migrations, func(a, b Migration) int {
+		switch {
+		case sourceLess(source, a.Version, b.Version):
+			return -1
+		case sourceLess(source, b.Version, a.Version):
+			return 1
+		}
+		return 0
+	})
+	migrations, err = orderByDependencies(migrations)
+	if err != nil {
+		return nil, fmt.Errorf("failed to order migrations: %w", err)
+	}
+
+	separator := opts.Separator
+	if separator == "" {
+		separator = DefaultSquashSeparator
+	}
+
+	var b bytes.Buffer
+	for i, m := range migrations {
+		if i > 0 {
+			b.WriteString(strings.ReplaceAll(separator, "{version}", m.Version))
+		}
+		content := m.Content
+		if i < len(migrations)-1 {
+			content = bytes.TrimRight(content, "; \t\r\n")
+		}
+		b.Write(content)
+		if !bytes.HasSuffix(content, []byte("\n")) {
+			b.WriteByte('\n')
+		}
+	}
+	return b.Bytes(), nil
+}
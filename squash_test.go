@@ -0,0 +1,82 @@
+package migrate
+
+import (
+	"fmt"
+	"testing"
+	"testing/fstest"
+)
+
+// Test squashing migrations which lack trailing semicolons
+func TestSquash(t *testing.T) {
+	source := &MockSource{migrations: []Migration{
+		{Version: "002_add_email", Content: []byte("ALTER TABLE users ADD COLUMN email TEXT -- nullable")},
+		{Version: "001_create_users", Content: []byte("CREATE TABLE users (id INT)")},
+		{Version: "003_add_index", Content: []byte("CREATE INDEX idx_email ON users (email);\n")},
+	}}
+
+	squashed, err := Squash(source, SquashOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "CREATE TABLE users (id INT)\n" +
+		";\n\n-- migration: 002_add_email\n" +
+		"ALTER TABLE users ADD COLUMN email TEXT -- nullable\n" +
+		";\n\n-- migration: 003_add_index\n" +
+		"CREATE INDEX idx_email ON users (email);\n"
+	if string(squashed) != expected {
+		t.Errorf("unexpected output %q", squashed)
+	}
+	if fmt.Sprintf("%q", splitStatements(string(squashed))) != fmt.Sprintf("%q", []string{
+		"CREATE TABLE users (id INT)\n;",
+		"-- migration: 002_add_email\nALTER TABLE users ADD COLUMN email TEXT -- nullable\n;",
+		"-- migration: 003_add_index\nCREATE INDEX idx_email ON users (email);",
+	}) {
+		t.Errorf("expected one statement per migration, got %q", splitStatements(string(squashed)))
+	}
+
+	squashed, err = Squash(source, SquashOptions{Separator: ";\n"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(squashed) != "CREATE TABLE users (id INT)\n;\nALTER TABLE users ADD COLUMN email TEXT -- nullable\n;\nCREATE INDEX idx_email ON users (email);\n" {
+		t.Errorf("unexpected output with a custom separator %q", squashed)
+	}
+}
+
+// Test squashing in the order the migrations are applied
+func TestSquashOrder(t *testing.T) {
+	files := fstest.MapFS{
+		"migrations/1.2.0.sql":  {Data: []byte("CREATE TABLE users (id INT);\n")},
+		"migrations/1.10.0.sql": {Data: []byte("CREATE INDEX idx_email ON users (email);")},
+		"migrations/1.9.0.sql":  {Data: []byte("ALTER TABLE users ADD COLUMN email TEXT;  ")},
+	}
+	squashed, err := Squash(NewFsSource(files, "migrations", WithLess(SemverLess)), SquashOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "CREATE TABLE users (id INT)\n" +
+		";\n\n-- migration: 1.9.0\n" +
+		"ALTER TABLE users ADD COLUMN email TEXT\n" +
+		";\n\n-- migration: 1.10.0\n" +
+		"CREATE INDEX idx_email ON users (email);\n"
+	if string(squashed) != expected {
+		t.Errorf("unexpected output %q", squashed)
+	}
+
+	source := &MockSource{migrations: []Migration{
+		requiresMigration("001_a", "002_b"),
+		requiresMigration("002_b", ""),
+	}}
+	squashed, err = Squash(source, SquashOptions{Separator: "\n-- {version}\n"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(squashed) != "SELECT 1\n\n-- 001_a\n-- migrate:requires 002_b\nSELECT 1\n" {
+		t.Errorf("expected 002_b before 001_a, got %q", squashed)
+	}
+
+	source = &MockSource{migrations: []Migration{requiresMigration("001_a", "009_missing")}}
+	if _, err := Squash(source, SquashOptions{}); err == nil {
+		t.Error("expected an error for an unknown requirement")
+	}
+}
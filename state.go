@@ -0,0 +1,129 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// StateSnapshot is a portable snapshot of the applied migrations.
+type StateSnapshot struct {
+	ExportedAt time.Time      `json:"exported_at"`
+	Migrations []AppliedState `json:"migrations"`
+}
+
+// AppliedState is an applied migration in a StateSnapshot, as recorded in
+// the migrations table. AppliedAt is zero when the dialect doesn't record
+// it. Checksums which aren't recorded are computed from the source, and are
+// empty for migrations missing from it.
+type AppliedState struct {
+	Version   string    `json:"version"`
+	AppliedAt time.Time `json:"applied_at"`
+	Checksum  string    `json:"checksum,omitempty"`
+}
+
+// checksum returns the checksum of the migration content
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// ExportState returns the applied migrations as a JSON StateSnapshot, which
+// can be restored with ImportState, e.g. into a database restored from a
+// backup that lacks the migrations table.
+func (m *Migrator) ExportState(ctx context.Context) ([]byte, error) {
+	applied, err := m.getApplied(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+
+	// the source is read only when some checksums aren't recorded
+	var migrations []Migration
+	var byVersion map[string]int
+	snapshot := StateSnapshot{ExportedAt: time.Now().UTC(), Migrations: []AppliedState{}}
+	for _, a := range applied {
+		if a.Checksum == "" && byVersion == nil {
+			if migrations, err = m.source.GetMigrations(); err != nil {
+				return nil, fmt.Errorf("failed to get migration files: %w", err)
+			}
+			byVersion = versionIndex(migrations)
+		}
+		if i, ok := byVersion[a.Version]; ok && a.Checksum == "" {
+			a.Checksum = checksum(migrations[i].Content)
+		}
+
+		snapshot.Migrations = append(snapshot.Migrations, AppliedState{
+			Version:   a.Version,
+			AppliedAt: a.AppliedAt,
+			Checksum:  a.Checksum,
+		})
+	}
+
+	return json.MarshalIndent(snapshot, "", "  ")
+}
+
+// ImportState records the migrations of a snapshot created by ExportState
+// as applied, without running them, with the times and checksums of the
+// snapshot. Migrations which are already applied are skipped, the rest are
+// recorded in a single transaction. Checksums which don't match the source
+// are logged.
+func (m *Migrator) ImportState(ctx context.Context, data []byte, opts ...Option) error {
+	var snapshot StateSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("invalid state snapshot: %w", err)
+	}
+
+	return m.prepareData(ctx, 0, func(m *Migrator, ctx context.Context, steps int, applied []string, migrations []Migration, options *RunOptions) error {
+		var records []AppliedRecord
+		// the imported versions join the applied ones, to skip repeats
+		done := appliedSet(applied)
+		byVersion := versionIndex(migrations)
+		for _, state := range snapshot.Migrations {
+			if state.Version == "" {
+				return fmt.Errorf("invalid state snapshot: migration without version")
+			}
+			if _, ok := done[state.Version]; ok {
+				continue
+			}
+
+			i, ok := byVersion[state.Version]
+			if ok && state.Checksum != "" && checksum(migrations[i].Content) != state.Checksum {
+				m.logger.Info("checksum mismatch", "file", state.Version)
+			}
+			records = append(records, AppliedRecord{
+				Version:   state.Version,
+				Checksum:  state.Checksum,
+				AppliedAt: state.AppliedAt,
+			})
+			done[state.Version] = struct{}{}
+		}
+
+		if len(records) == 0 {
+			m.logger.Info("no migrations to import")
+			return nil
+		}
+		if options.DryRun {
+			m.logger.Info("would import", "migrations", len(records))
+			return nil
+		}
+
+		tx, err := m.beginTx(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer tx.Rollback(ctx)
+
+		if err := storeAppliedMigrations(ctx, m.dialect, tx, records); err != nil {
+			return fmt.Errorf("failed to record migrations: %w", err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+
+		m.logger.Info("imported", "migrations", len(records))
+		return nil
+	}, opts...)
+}
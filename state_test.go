@@ -0,0 +1,119 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Test exporting the applied migrations and importing them into another database
+func TestMigratorExportImportState(t *testing.T) {
+	ctx := context.Background()
+	source := &MockSource{migrations: createTestMigrations()}
+
+	appliedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	dialect := &detailedDialect{MockDialect: &MockDialect{}, applied: []AppliedMigration{
+		{Version: "001_create_users", AppliedAt: appliedAt, Checksum: "recorded"},
+		{Version: "002_add_email", AppliedAt: appliedAt},
+		{Version: "900_unknown"},
+	}}
+	data, err := New(source, dialect, &MockLogger{}).ExportState(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var snapshot StateSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatalf("invalid snapshot: %v", err)
+	}
+	if len(snapshot.Migrations) != 3 || snapshot.ExportedAt.IsZero() {
+		t.Fatalf("unexpected snapshot %+v", snapshot)
+	}
+	if snapshot.Migrations[0].Checksum != "recorded" || !snapshot.Migrations[0].AppliedAt.Equal(appliedAt) {
+		t.Errorf("expected the recorded checksum and time, got %+v", snapshot.Migrations[0])
+	}
+	if snapshot.Migrations[1].Checksum != checksum(source.migrations[1].Content) {
+		t.Errorf("expected the checksum of the source for a migration recorded without one, got %q", snapshot.Migrations[1].Checksum)
+	}
+	if snapshot.Migrations[2].Checksum != "" {
+		t.Errorf("expected no checksum for a migration missing from the source, got %q", snapshot.Migrations[2].Checksum)
+	}
+
+	restored := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+	logger := &MockLogger{}
+	if err := New(source, restored, logger).ImportState(ctx, data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if fmt.Sprint(restored.storedMigrations) != "[002_add_email 900_unknown]" {
+		t.Errorf("expected missing migrations to be recorded, got %v", restored.storedMigrations)
+	}
+	if !restored.storedRecords[0].AppliedAt.Equal(appliedAt) || !restored.storedRecords[1].AppliedAt.IsZero() {
+		t.Errorf("expected the recorded times to be restored, got %+v", restored.storedRecords)
+	}
+	if len(restored.executedQueries) != 0 {
+		t.Errorf("expected no migrations to run, got %v", restored.executedQueries)
+	}
+	if !restored.lockCalled {
+		t.Error("expected import to run under the lock")
+	}
+	if fmt.Sprint(logger.GetLogs()) != "[imported migrations=2]" {
+		t.Errorf("unexpected logs %v", logger.GetLogs())
+	}
+}
+
+// Test recording the imported migrations with multi-row inserts
+func TestMigratorImportStateBatch(t *testing.T) {
+	var tx *recordingArgsTx
+	begin := func(ctx context.Context) (Tx, error) {
+		tx = &recordingArgsTx{}
+		return tx, nil
+	}
+	query := func(ctx context.Context, query string, args ...interface{}) ([][]interface{}, error) {
+		return [][]interface{}{{"001_create_users"}}, nil
+	}
+	exec := func(ctx context.Context, query string, args ...interface{}) error {
+		return nil
+	}
+	dialect := NewCommonDialect(nil, "", WithExecFunc(exec, query, begin), WithBatchSize(2))
+
+	data := []byte(`{"migrations":[{"version":"001_create_users"},{"version":"002_add_email"},{"version":"003_add_index"},{"version":"004_add_timestamp"}]}`)
+	if err := New(&MockSource{migrations: createTestMigrations()}, dialect, &MockLogger{}).ImportState(context.Background(), data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{
+		"INSERT INTO schema_migrations (version) VALUES (?), (?)",
+		"INSERT INTO schema_migrations (version) VALUES (?)",
+	}
+	if fmt.Sprint(tx.queries) != fmt.Sprint(expected) || !tx.committed {
+		t.Fatalf("expected %v to be committed, got %v", expected, tx.queries)
+	}
+	if fmt.Sprint(tx.args) != "[[002_add_email 003_add_index] [004_add_timestamp]]" {
+		t.Errorf("expected the migrations which are not applied, got %v", tx.args)
+	}
+}
+
+// Test importing a snapshot which doesn't match the source
+func TestMigratorImportStateErrors(t *testing.T) {
+	ctx := context.Background()
+	source := &MockSource{migrations: createTestMigrations()}
+
+	if err := New(source, &MockDialect{}, &MockLogger{}).ImportState(ctx, []byte("{")); err == nil {
+		t.Error("expected error for malformed snapshot")
+	}
+
+	dialect := &MockDialect{appliedMigrations: []string{}}
+	logger := &MockLogger{}
+	data := []byte(`{"migrations": [{"version": "001_create_users", "checksum": "abc"}]}`)
+	if err := New(source, dialect, logger).ImportState(ctx, data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(logger.GetLogs()) != "[checksum mismatch file=001_create_users imported migrations=1]" {
+		t.Errorf("unexpected logs %v", logger.GetLogs())
+	}
+	if dialect.storedRecords[0].Checksum != "abc" {
+		t.Errorf("expected the checksum of the snapshot to be restored, got %+v", dialect.storedRecords[0])
+	}
+}
@@ -0,0 +1,149 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// MigrationStatus is an applied migration reported by StatusRecent.
+type MigrationStatus struct {
+	Version string
+	// AppliedAt is the time the migration was applied, zero when the
+	// dialect doesn't report it
+	AppliedAt time.Time
+}
+
+// StatusRecent returns up to n most recently applied migrations, newest
+// first. Dialects implementing RecentLister read only those rows, which
+// keeps the call cheap on long histories. For other dialects all applied
+// migrations are read and the last n are returned, without AppliedAt unless
+// the dialect implements AppliedReader.
+func (m *Migrator) StatusRecent(ctx context.Context, n int) ([]MigrationStatus, error) {
+	if n <= 0 {
+		return []MigrationStatus{}, nil
+	}
+
+	if lister, ok := m.dialect.(RecentLister); ok {
+		recent, err := lister.GetRecentMigrations(ctx, n)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get recent migrations: %w", err)
+		}
+		return recent, nil
+	}
+
+	applied, err := m.getApplied(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+
+	recent := make([]MigrationStatus, 0, min(n, len(applied)))
+	for i := len(applied) - 1; i >= 0 && len(recent) < n; i-- {
+		recent = append(recent, MigrationStatus{Version: applied[i].Version, AppliedAt: applied[i].AppliedAt})
+	}
+	return recent, nil
+}
+
+// getApplied returns the applied migrations with their details when the
+// dialect implements AppliedReader, and only their versions and recorded
+// checksums otherwise
+func (m *Migrator) getApplied(ctx context.Context) ([]AppliedMigration, error) {
+	if reader, ok := m.dialect.(AppliedReader); ok {
+		return reader.GetApplied(ctx)
+	}
+
+	versions, err := m.dialect.GetAppliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	checksums := map[string]string{}
+	if reader, ok := m.dialect.(ChecksumReader); ok {
+		if checksums, err = reader.GetChecksums(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	applied := make([]AppliedMigration, len(versions))
+	for i, version := range versions {
+		applied[i] = AppliedMigration{Version: version, Checksum: checksums[version]}
+	}
+	return applied, nil
+}
+
+// defaultWaitPoll is the poll interval of WaitForVersion when none is given
+const defaultWaitPoll = time.Second
+
+// WaitForVersion waits until the version is applied, e.g. by the migrator of
+// another service, polling the applied migrations every poll interval. It
+// only reads: errors like a missing migrations table are retried until the
+// context is done, then the context error is returned with the last error.
+func (m *Migrator) WaitForVersion(ctx context.Context, version string, poll time.Duration) error {
+	if poll <= 0 {
+		poll = defaultWaitPoll
+	}
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	for {
+		applied, err := m.dialect.GetAppliedMigrations(ctx)
+		if err == nil && slices.Contains(applied, version) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return fmt.Errorf("waiting for version %s: %w", version, errors.Join(ctx.Err(), err))
+			}
+			return fmt.Errorf("waiting for version %s: %w", version, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Version returns the newest applied version, in the order of the source
+// when it is an OrderedSource, or an empty string when no migrations are
+// applied. It only reads the applied migrations.
+func (m *Migrator) Version(ctx context.Context) (string, error) {
+	applied, err := m.dialect.GetAppliedMigrations(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+
+	return headVersion(applied, m.versionLess), nil
+}
+
+// headVersion returns the newest of the applied versions in the order of
+// less, or an empty string when none are applied
+func headVersion(applied []string, less func(a, b string) bool) string {
+	head := ""
+	for _, version := range applied {
+		if head == "" || less(head, version) {
+			head = version
+		}
+	}
+	return head
+}
+
+// versionLess orders versions like the source when it is an OrderedSource,
+// and lexically otherwise
+func (m *Migrator) versionLess(a, b string) bool {
+	return sourceLess(m.source, a, b)
+}
+
+// AssertVersion returns ErrVersionMismatch unless the newest applied version
+// is the expected one, e.g. in a smoke test after a deploy to catch runs
+// which applied fewer migrations than expected.
+func (m *Migrator) AssertVersion(ctx context.Context, expected string) error {
+	head, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if head != expected {
+		return fmt.Errorf("%w: expected %q, got %q", ErrVersionMismatch, expected, head)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recentDialect reads the recent migrations with a limited query
+type recentDialect struct {
+	*MockDialect
+	recent    []MigrationStatus
+	limit     int
+	recentErr error
+}
+
+func (d *recentDialect) GetRecentMigrations(ctx context.Context, n int) ([]MigrationStatus, error) {
+	d.limit = n
+	if d.recentErr != nil {
+		return nil, d.recentErr
+	}
+	return d.recent[:min(n, len(d.recent))], nil
+}
+
+// detailedDialect reports the details of the applied migrations
+type detailedDialect struct {
+	*MockDialect
+	applied []AppliedMigration
+}
+
+func (d *detailedDialect) GetApplied(ctx context.Context) ([]AppliedMigration, error) {
+	return d.applied, nil
+}
+
+// Test reading the most recently applied migrations
+func TestMigratorStatusRecent(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("limited query", func(t *testing.T) {
+		appliedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		dialect := &recentDialect{
+			MockDialect: &MockDialect{},
+			recent:      []MigrationStatus{{Version: "003_add_index", AppliedAt: appliedAt}, {Version: "002_add_email"}},
+		}
+		recent, err := New(&MockSource{}, dialect, &MockLogger{}).StatusRecent(ctx, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(recent) != 1 || recent[0].Version != "003_add_index" || !recent[0].AppliedAt.Equal(appliedAt) {
+			t.Errorf("unexpected recent migrations %v", recent)
+		}
+		if dialect.limit != 1 || dialect.getAppliedCalled {
+			t.Error("expected only the limited query")
+		}
+
+		dialect.recentErr = errors.New("connection refused")
+		if _, err := New(&MockSource{}, dialect, &MockLogger{}).StatusRecent(ctx, 1); !errors.Is(err, dialect.recentErr) {
+			t.Errorf("expected query error, got %v", err)
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "002_add_email", "003_add_index"}}
+		recent, err := New(&MockSource{}, dialect, &MockLogger{}).StatusRecent(ctx, 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fmt.Sprint(recent) != "[{003_add_index 0001-01-01 00:00:00 +0000 UTC} {002_add_email 0001-01-01 00:00:00 +0000 UTC}]" {
+			t.Errorf("unexpected recent migrations %v", recent)
+		}
+
+		recent, _ = New(&MockSource{}, dialect, &MockLogger{}).StatusRecent(ctx, 10)
+		if len(recent) != 3 {
+			t.Errorf("expected all applied migrations, got %v", recent)
+		}
+		recent, _ = New(&MockSource{}, dialect, &MockLogger{}).StatusRecent(ctx, 0)
+		if len(recent) != 0 {
+			t.Errorf("expected no migrations, got %v", recent)
+		}
+	})
+
+	t.Run("fallback with details", func(t *testing.T) {
+		appliedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		dialect := &detailedDialect{
+			MockDialect: &MockDialect{},
+			applied:     []AppliedMigration{{Version: "001_create_users"}, {Version: "002_add_email", AppliedAt: appliedAt}},
+		}
+		recent, err := New(&MockSource{}, dialect, &MockLogger{}).StatusRecent(ctx, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(recent) != 1 || recent[0].Version != "002_add_email" || !recent[0].AppliedAt.Equal(appliedAt) {
+			t.Errorf("expected the time of the applied migration, got %v", recent)
+		}
+	})
+}
+
+// pollingDialect applies a migration after a number of reads, failing the
+// reads before that like a missing migrations table
+type pollingDialect struct {
+	*MockDialect
+	reads     int
+	readyAt   int
+	version   string
+	failUntil int
+}
+
+func (d *pollingDialect) GetAppliedMigrations(ctx context.Context) ([]string, error) {
+	d.reads++
+	if d.reads <= d.failUntil {
+		return nil, errors.New("no such table")
+	}
+	if d.reads == d.readyAt {
+		d.appliedMigrations = append(d.appliedMigrations, d.version)
+	}
+	return d.MockDialect.GetAppliedMigrations(ctx)
+}
+
+// Test waiting until another migrator applies a version
+func TestMigratorWaitForVersion(t *testing.T) {
+	t.Run("reached", func(t *testing.T) {
+		dialect := &pollingDialect{MockDialect: &MockDialect{}, readyAt: 4, failUntil: 2, version: "002_add_email"}
+		err := New(&MockSource{}, dialect, &MockLogger{}).WaitForVersion(context.Background(), "002_add_email", time.Millisecond)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if dialect.reads != 4 {
+			t.Errorf("expected 4 reads, got %d", dialect.reads)
+		}
+		if dialect.lockCalled || dialect.createTableCalled {
+			t.Error("expected no lock and no table creation")
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		dialect := &pollingDialect{MockDialect: &MockDialect{}, failUntil: 1000}
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		err := New(&MockSource{}, dialect, &MockLogger{}).WaitForVersion(ctx, "002_add_email", time.Millisecond)
+		if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "no such table") {
+			t.Errorf("expected deadline error with the last error, got %v", err)
+		}
+	})
+}
+
+// Test asserting the version of the database
+func TestMigratorAssertVersion(t *testing.T) {
+	ctx := context.Background()
+	dialect := &MockDialect{appliedMigrations: []string{"001_create_users", "003_add_index", "002_add_email"}}
+	migrator := New(&MockSource{}, dialect, &MockLogger{})
+
+	if version, err := migrator.Version(ctx); err != nil || version != "003_add_index" {
+		t.Errorf("expected 003_add_index, got %q %v", version, err)
+	}
+	if err := migrator.AssertVersion(ctx, "003_add_index"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := migrator.AssertVersion(ctx, "004_add_timestamp"); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expected ErrVersionMismatch, got %v", err)
+	}
+	if err := New(&MockSource{}, &MockDialect{}, &MockLogger{}).AssertVersion(ctx, ""); err != nil {
+		t.Errorf("expected an empty database to match an empty version, got %v", err)
+	}
+
+	dialect.getAppliedErr = errors.New("connection refused")
+	if err := migrator.AssertVersion(ctx, "003_add_index"); err == nil || errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expected a read error, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+)
+
+// Kinds of validation findings
+const (
+	// FindingInvalid is a problem of the source, like a duplicate version
+	FindingInvalid = "invalid"
+	// FindingMissingDown is a migration without down migration
+	FindingMissingDown = "missing-down"
+	// FindingChecksumMismatch is an applied migration changed after it was
+	// applied, reported only when the dialect records checksums
+	FindingChecksumMismatch = "checksum-mismatch"
+	// FindingOrphaned is an applied migration which is not in the source,
+	// or a version recorded more than once
+	FindingOrphaned = "orphaned"
+	// FindingGap is a missing sequential version number
+	FindingGap = "gap"
+	// FindingDirty is a migration which failed in the middle, see Resolve
+	FindingDirty = "dirty"
+)
+
+// ValidationFinding is a single problem found by Validate.
+type ValidationFinding struct {
+	Kind    string
+	Version string
+	Message string
+}
+
+func (f ValidationFinding) String() string {
+	if f.Version == "" {
+		return f.Kind + ": " + f.Message
+	}
+	return f.Kind + ": " + f.Version + ": " + f.Message
+}
+
+// ValidationReport holds all problems found by Validate.
+type ValidationReport struct {
+	Findings []ValidationFinding
+}
+
+// OK reports whether no problems were found
+func (r *ValidationReport) OK() bool {
+	return len(r.Findings) == 0
+}
+
+// Kind returns the findings of the kind
+func (r *ValidationReport) Kind(kind string) []ValidationFinding {
+	var res []ValidationFinding
+	for _, f := range r.Findings {
+		if f.Kind == kind {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+func (r *ValidationReport) add(kind, version, message string) {
+	r.Findings = append(r.Findings, ValidationFinding{Kind: kind, Version: version, Message: message})
+}
+
+// Validate runs every check of the migrations against the database and
+// returns all problems found, instead of stopping at the first one. The
+// error is returned only when the source or the database can't be read,
+// the problems are in the report. It only reads the migrations table,
+// without locking or creating it.
+func (m *Migrator) Validate(ctx context.Context) (*ValidationReport, error) {
+	migrations, err := m.source.GetMigrations()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get migration files: %w", err)
+	}
+
+	applied, err := m.dialect.GetAppliedMigrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+
+	report := &ValidationReport{}
+	for _, err := range sourceProblems(migrations, "") {
+		report.add(FindingInvalid, "", err.Error())
+	}
+	for _, f := range migrations {
+		if len(f.DownContent) == 0 {
+			report.add(FindingMissingDown, f.Version, "migration has no down migration")
+		}
+	}
+	for _, gap := range versionGaps(migrations) {
+		report.add(FindingGap, gap.next, "missing versions "+gap.missing+" before this migration")
+	}
+
+	applied, duplicates := dedupeApplied(applied)
+	for _, version := range duplicates {
+		report.add(FindingOrphaned, version, "migration is recorded as applied more than once")
+	}
+	byVersion := versionIndex(migrations)
+	for _, version := range applied {
+		_, known := byVersion[version]
+		if _, adHoc := m.adHoc.find(version); !known && !adHoc {
+			report.add(FindingOrphaned, version, "applied migration is not in the source")
+		}
+	}
+
+	if store, ok := m.dialect.(ChecksumReader); ok {
+		checksums, err := store.GetChecksums(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get checksums: %w", err)
+		}
+		done := appliedSet(applied)
+		for _, f := range migrations {
+			if _, ok := done[f.Version]; ok && checksums[f.Version] != "" && checksums[f.Version] != checksum(f.Content) {
+				report.add(FindingChecksumMismatch, f.Version, "migration was changed after it was applied")
+			}
+		}
+	}
+
+	if marker, ok := m.dialect.(DirtyMarker); ok {
+		dirty, err := marker.GetDirty(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get dirty migration: %w", err)
+		}
+		if dirty != "" {
+			report.add(FindingDirty, dirty, "migration failed in the middle and needs to be resolved")
+		}
+	}
+
+	return report, nil
+}
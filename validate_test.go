@@ -0,0 +1,89 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// Test collecting all problems into the validation report
+func TestMigratorValidate(t *testing.T) {
+	migrations := []Migration{
+		{Version: "001_users", Content: []byte("CREATE TABLE users (id INT)"), DownContent: []byte("DROP TABLE users")},
+		{Version: "002_email", Content: []byte("ALTER TABLE users ADD email TEXT")},
+		{Version: "004_index", Content: []byte("CREATE INDEX idx ON users(email)"), DownContent: []byte("DROP INDEX idx")},
+		{Version: "004_index", Content: []byte("CREATE INDEX idx2 ON users(email)"), DownContent: []byte("DROP INDEX idx2")},
+	}
+	dialect := &checksumDialect{
+		MockDialect: &MockDialect{appliedMigrations: []string{"001_users", "002_email", "002_email", "000_legacy"}},
+		checksums: map[string]string{
+			"001_users": "outdated",
+			"002_email": checksum(migrations[1].Content),
+		},
+	}
+
+	report, err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Validate(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.OK() {
+		t.Fatal("expected findings")
+	}
+
+	expected := []string{
+		"invalid: duplicate migration version 004_index",
+		"missing-down: 002_email: migration has no down migration",
+		"gap: 004_index: missing versions 003 before this migration",
+		"orphaned: 002_email: migration is recorded as applied more than once",
+		"orphaned: 000_legacy: applied migration is not in the source",
+		"checksum-mismatch: 001_users: migration was changed after it was applied",
+	}
+	var got []string
+	for _, f := range report.Findings {
+		got = append(got, f.String())
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected findings\n%v\ngot\n%v", expected, got)
+	}
+	if len(report.Kind(FindingOrphaned)) != 2 {
+		t.Errorf("expected 2 orphaned findings, got %v", report.Kind(FindingOrphaned))
+	}
+}
+
+// Test a clean validation and a dirty migration
+func TestMigratorValidateDirty(t *testing.T) {
+	migrations := createTestMigrations()
+	dialect := &MockDialect{appliedMigrations: []string{"001_create_users"}}
+
+	report, err := New(&MockSource{migrations: migrations}, dialect, &MockLogger{}).Validate(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !report.OK() {
+		t.Errorf("expected no findings, got %v", report.Findings)
+	}
+
+	dirty := &dirtyDialect{MockDialect: dialect, dirty: "002_add_email"}
+	report, err = New(&MockSource{migrations: migrations}, dirty, &MockLogger{}).Validate(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if findings := report.Kind(FindingDirty); len(findings) != 1 || findings[0].Version != "002_add_email" {
+		t.Errorf("expected dirty finding, got %v", report.Findings)
+	}
+}
+
+// Benchmark validating 800 applied migrations
+func BenchmarkValidate(b *testing.B) {
+	migrations, applied := benchmarkMigrations(800, 800)
+	source := &MockSource{migrations: migrations}
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dialect := &MockDialect{appliedMigrations: applied}
+		if _, err := New(source, dialect, &MockLogger{}).Validate(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}